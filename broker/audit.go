@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditFlushInterval is how often the lines buffered by an AuditLog are
+// written to its file.
+var AuditFlushInterval = time.Second
+
+// AuditLog appends a JSON line per job disposed of to a file. Lines are
+// buffered, and written every AuditFlushInterval and once the log is closed.
+// It is safe for concurrent use, and a nil *AuditLog records nothing.
+type AuditLog struct {
+	path string
+	done chan struct{}
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	JobId      uint64    `json:"id"`
+	Tube       string    `json:"tube"`
+	WorkerId   string    `json:"worker"`
+	Outcome    string    `json:"outcome"`
+	ExitStatus int       `json:"exitStatus"`
+	Attempt    uint64    `json:"attempt,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	WorkDir    string    `json:"workDir,omitempty"`
+	Error      string    `json:"error,omitempty"`
+
+	// Body is the redacted job packet, only for tubes with -audit-body.
+	Body interface{} `json:"body,omitempty"`
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := openAuditFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{path: path, done: make(chan struct{}), f: f, w: bufio.NewWriter(f)}
+	go a.flushEvery(AuditFlushInterval)
+	return a, nil
+}
+
+func openAuditFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Reopen flushes the pending lines to the file and closes it, then opens
+// the path again, so that once the file has been moved aside by log
+// rotation, later lines go to a new file at the path. If the path cannot be
+// opened, lines carry on going to the old file.
+func (a *AuditLog) Reopen() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return nil
+	}
+	f, err := openAuditFile(a.path)
+	if err != nil {
+		return err
+	}
+	err = a.w.Flush()
+	if e := a.f.Close(); err == nil {
+		err = e
+	}
+	a.f = f
+	a.w.Reset(f)
+	return err
+}
+
+// flushEvery writes the pending lines every interval, until the log is
+// closed.
+func (a *AuditLog) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+		a.mu.Lock()
+		if a.w != nil {
+			if err := a.w.Flush(); err != nil {
+				log.Errorf("failed to flush audit log, error: %s", err)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Record appends the result of a job processed by a broker of tube.
+func (a *AuditLog) Record(tube, workerId string, r *JobResult) {
+	if a == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Time:       time.Now(),
+		JobId:      r.JobId,
+		Tube:       tube,
+		WorkerId:   workerId,
+		Outcome:    r.outcome(),
+		ExitStatus: r.ExitStatus,
+		Attempt:    r.Attempt,
+		Domain:     r.Domain,
+		WorkDir:    r.WorkDir,
+		Body:       r.auditBody,
+	}
+	if r.Error != nil {
+		rec.Error = r.Error.Error()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("failed to encode audit record of job %d, error: %s", r.JobId, err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Errorf("failed to write audit record of job %d, error: %s", r.JobId, err)
+	}
+}
+
+// Close flushes the pending lines and closes the file. Later records are
+// dropped.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		return nil
+	}
+	close(a.done)
+	err := a.w.Flush()
+	if e := a.f.Close(); err == nil {
+		err = e
+	}
+	a.w = nil
+	return err
+}
+
+// keepAuditBody keeps the packet of a job of tube on its result, redacted,
+// when the tube has its bodies audited.
+func (b *Broker) keepAuditBody(result *JobResult, tube string, packet Packet) {
+	if b.Audit == nil || result == nil || packet == nil {
+		return
+	}
+	if fields, ok := b.options.AuditBody[tube]; ok {
+		result.auditBody = packet.redacted(fields)
+	}
+}
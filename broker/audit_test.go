@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+func auditLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	return lines[:len(lines)-1]
+}
+
+func TestAuditFlushedOnClose(t *testing.T) {
+	defer func(d time.Duration) { AuditFlushInterval = d }(AuditFlushInterval)
+	AuditFlushInterval = time.Hour
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record("jobs", "w1", &JobResult{JobId: 1})
+	a.Record("jobs", "w1", &JobResult{JobId: 2, ExitStatus: 1})
+	if n := len(auditLines(t, path)); n != 0 {
+		t.Fatalf("%d lines written before the flush interval", n)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := auditLines(t, path)
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":1,`) || !strings.Contains(lines[1], `"id":2,`) {
+		t.Errorf("audit log holds %q, want both records", lines)
+	}
+
+	a.Record("jobs", "w1", &JobResult{JobId: 3})
+	if n := len(auditLines(t, path)); n != 2 {
+		t.Errorf("%d lines, want records after Close dropped", n)
+	}
+}
+
+func TestAuditFlushedPeriodically(t *testing.T) {
+	defer func(d time.Duration) { AuditFlushInterval = d }(AuditFlushInterval)
+	AuditFlushInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Record("jobs", "w1", &JobResult{JobId: 1})
+
+	deadline := time.Now().Add(time.Second)
+	for len(auditLines(t, path)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("record not written within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAuditBody(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.AuditBody = cli.TubeFields{"payments": cli.FieldList{"card"}}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := map[interface{}]interface{}{
+		"domain": "acme",
+		"card":   "4111111111111111",
+		"payer":  map[interface{}]interface{}{"name": "Ann", "card": "5500000000000004"},
+	}
+	for _, tube := range []string{"payments", "emails"} {
+		b := testBroker(o, &fakeExecutor{}, tube)
+		b.Audit = a
+		s.putPacket(tube, packet)
+		runJobs(b, 1)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := make(map[string]interface{})
+	for _, line := range auditLines(t, path) {
+		var rec struct {
+			Tube string
+			Body interface{}
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		bodies[rec.Tube] = rec.Body
+	}
+	want := map[string]interface{}{
+		"domain": "acme",
+		"card":   Redacted,
+		"payer":  map[string]interface{}{"name": "Ann", "card": Redacted},
+	}
+	if got := bodies["payments"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("payments body %v, want %v", got, want)
+	}
+	if got, ok := bodies["emails"]; !ok || got != nil {
+		t.Errorf("emails body %v, want none logged", got)
+	}
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kr/beanstalk"
+	log "github.com/sirupsen/logrus"
+)
+
+// scaledTube tracks the brokers running for a tube.
+type scaledTube struct {
+	// stops holds a channel per broker, closed to stop it.
+	stops []chan bool
+
+	// running counts the brokers which have not yet finished, including
+	// those stopped but still finishing their job.
+	running sync.WaitGroup
+
+	// next is the slot of the next broker started, so that a new broker is
+	// never named after one which is still finishing its job.
+	next uint64
+}
+
+// scaleTube starts or stops brokers for tube so that n are running.
+func (bd *BrokerDispatcher) scaleTube(tube string, n int) {
+	bd.scaleMu.Lock()
+	defer bd.scaleMu.Unlock()
+
+	st, ok := bd.scaled[tube]
+	if !ok {
+		st = &scaledTube{}
+		bd.scaled[tube] = st
+	}
+
+	if bd.draining {
+		n = 0
+	}
+
+	for len(st.stops) < n {
+		stop := make(chan bool)
+		st.running.Add(1)
+		bd.runBroker([]string{tube}, st.next, 1, stop, st.running.Done)
+		st.stops = append(st.stops, stop)
+		st.next++
+	}
+	for len(st.stops) > n {
+		last := len(st.stops) - 1
+		close(st.stops[last])
+		st.stops = st.stops[:last]
+	}
+}
+
+// drainTube stops the brokers of tube, waiting for them to finish.
+func (bd *BrokerDispatcher) drainTube(tube string) {
+	bd.scaleTube(tube, 0)
+
+	bd.scaleMu.Lock()
+	st := bd.scaled[tube]
+	bd.scaleMu.Unlock()
+	st.running.Wait()
+}
+
+// scaledTubes returns the tubes whose brokers can be scaled, with the number
+// of brokers running for each.
+func (bd *BrokerDispatcher) scaledTubes() map[string]int {
+	bd.scaleMu.Lock()
+	defer bd.scaleMu.Unlock()
+
+	tubes := make(map[string]int, len(bd.scaled))
+	for tube, st := range bd.scaled {
+		tubes[tube] = len(st.stops)
+	}
+	return tubes
+}
+
+// desiredBrokers is the number of brokers for a tube with ready jobs waiting:
+// one per -target-jobs-per-worker jobs, rounded up, within -min-per-tube and
+// -max-per-tube.
+func (bd *BrokerDispatcher) desiredBrokers(ready uint64) int {
+	n := (ready + bd.options.TargetJobsPerWorker - 1) / bd.options.TargetJobsPerWorker
+	if n < bd.options.MinPerTube {
+		n = bd.options.MinPerTube
+	}
+	if max := bd.options.MaxPerTube; max > 0 && n > max {
+		n = max
+	}
+	return int(n)
+}
+
+// RunAutoscaler polls the ready jobs of every tube with brokers of its own
+// every interval, scaling its brokers to the queue depth, until shutdown.
+func (bd *BrokerDispatcher) RunAutoscaler(interval time.Duration) (err error) {
+	nc, err := dial(bd.options)
+	if err != nil {
+		return
+	}
+	conn := beanstalk.NewConn(nc)
+
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bd.autoscale(conn)
+			case <-bd.ret:
+				return
+			}
+		}
+	}()
+
+	return
+}
+
+func (bd *BrokerDispatcher) autoscale(conn *beanstalk.Conn) {
+	for tube, running := range bd.scaledTubes() {
+		stats, err := bs.ReadTubeStats(conn, bd.options.Prefixed(tube))
+		if err != nil {
+			log.Errorf("failed to read stats of tube %s, error: %s", tube, err)
+			continue
+		}
+
+		n := bd.desiredBrokers(stats.CurrentJobsReady)
+		if n == running {
+			continue
+		}
+		log.Infof("scaling tube %s from %d to %d brokers, %d jobs ready", tube, running, n, stats.CurrentJobsReady)
+		bd.scaleTube(tube, n)
+	}
+}
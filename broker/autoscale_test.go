@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunTube(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PerTube = 2
+	bd := NewBrokerDispatcher(o)
+
+	bd.RunTube("jobs")
+	if got := bd.scaledTubes()["jobs"]; got != 2 {
+		t.Errorf("%d brokers for tube jobs, want -per-tube=2", got)
+	}
+	waitFor(t, "both brokers to watch the tube", func() bool { return s.count("watch") == 2 })
+
+	// Running a tube again starts nothing more.
+	bd.RunTube("jobs")
+	if got := bd.scaledTubes()["jobs"]; got != 2 {
+		t.Errorf("%d brokers for tube jobs once run twice, want 2", got)
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	s := newFakeServer(t)
+	var depth int64
+	s.hook("stats-tube", func(args []string) string {
+		ready := strconv.FormatInt(atomic.LoadInt64(&depth), 10)
+		return yamlDict(map[string]string{
+			"name":                  args[0],
+			"current-jobs-urgent":   "0",
+			"current-jobs-ready":    ready,
+			"current-jobs-reserved": "0",
+			"current-jobs-delayed":  "0",
+			"current-jobs-buried":   "0",
+			"total-jobs":            ready,
+			"current-watching":      "1",
+			"current-waiting":       "1",
+		})
+	})
+
+	o := s.options()
+	o.MinPerTube = 1
+	o.MaxPerTube = 4
+	o.TargetJobsPerWorker = 10
+	bd := NewBrokerDispatcher(o)
+	bd.RunTube("jobs")
+
+	nc, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := beanstalk.NewConn(nc)
+	defer conn.Close()
+
+	tests := []struct {
+		ready int64
+		want  int
+	}{
+		{25, 3},
+		{100, 4},
+		{35, 4},
+		{12, 2},
+		{0, 1},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt64(&depth, tt.ready)
+		bd.autoscale(conn)
+		if got := bd.scaledTubes()["jobs"]; got != tt.want {
+			t.Errorf("%d jobs ready: %d brokers, want %d", tt.ready, got, tt.want)
+		}
+	}
+
+	// The brokers started each dialled beanstalkd: the first, then two and
+	// one more as the depth rose.
+	waitFor(t, "the brokers to connect", func() bool { return s.dialled() == 1+4 })
+}
@@ -1,18 +1,24 @@
 package broker
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kayako/beanstalk-broker/bs"
 	"github.com/kayako/beanstalk-broker/cli"
 	"github.com/kayako/beanstalk-broker/cmd"
+	"github.com/kayako/beanstalk-broker/tracing"
 	"github.com/kr/beanstalk"
 	log "github.com/sirupsen/logrus"
-	"github.com/wulijun/go-php-serialize/phpserialize"
 )
 
 const (
@@ -29,11 +35,20 @@ const (
 	// buried. Zero means never execute.
 	ReleaseTries = 10
 
+	// SharedReserveTimeout bounds each reserve of a shared reserve loop. The
+	// executors dispose of their jobs on the same connection, and their
+	// commands are answered only after a pending reserve returns.
+	SharedReserveTimeout = 1 * time.Second
+
 	// ClusterRoot is the full path to cluster directory
 	ClusterRoot = "/opt/cluster/"
 
 	// InstanceRoot is the full path to directory where instances are stored
 	InstanceRoot = "/var/www/html/"
+
+	// DefaultTube is the tube every beanstalkd connection starts out
+	// watching, see -watch-default.
+	DefaultTube = "default"
 )
 
 type Broker struct {
@@ -44,22 +59,126 @@ type Broker struct {
 	// The shell command to execute for each job.
 	Cmd string
 
-	// Tube name this broker will service.
+	// Tube name this broker will service. For a tube group, this is the
+	// comma separated list of its tubes.
 	Tube string
 
+	// Tubes serviced by this broker, in round-robin order.
+	Tubes []string
+
+	// Tracer records a span per executed job, nil disables tracing.
+	Tracer *tracing.Tracer
+
+	// InFlight tracks the jobs being executed, nil disables tracking.
+	InFlight *InFlight
+
+	// Streams passes on the stdout of executing jobs, nil disables
+	// streaming.
+	Streams *StdoutStreams
+
+	// CheckPressure is called before reserving each job, pausing reserving
+	// while it returns an error. Nil never pauses.
+	CheckPressure PressureChecker
+
+	// Health is the external dependency of the jobs, reserving being paused
+	// while it is unhealthy. Nil never pauses.
+	Health *DependencyHealth
+
+	// Slots caps the jobs of each tube in flight, nil caps nothing.
+	Slots *TubeSlots
+
+	// Floors sheds jobs below their tube's priority floor, nil sheds none.
+	Floors *PriorityFloors
+
+	// Audit records every job processed, nil disables auditing.
+	Audit *AuditLog
+
+	// Statsd is sent the outcome of every job processed, nil sends nothing.
+	Statsd *Statsd
+
+	// Recent keeps the results of the last jobs processed, nil keeps none.
+	Recent *RecentJobs
+
+	// Validate is called with the packet of every job before it is executed,
+	// rejecting the job when it returns an error. Nil accepts every job.
+	Validate Validator
+
+	// Execute creates the worker process of each job. Defaults to forking
+	// the PHP binary.
+	Execute Executor
+
+	// ResolveWorkDir determines the directory each job is executed in.
+	// Defaults to routing on the domain key of the job packet.
+	ResolveWorkDir WorkDirResolver
+
+	// Hooks are called as each job moves through its lifecycle.
+	Hooks Hooks
+
 	options cli.Options
 
 	log     *log.Entry
-	results chan<- *JobResult
+	results chan *JobResult
+
+	// env is added to the environment of every job's child.
+	env []string
+
+	// fatal reports the error which stopped the broker.
+	fatal func(error)
+
+	// drain is closed when the broker is to stop reserving and finish, nil
+	// if it never is. shutdown is closed as well when the whole dispatcher
+	// shuts down, rather than only the broker's tube being torn down, as
+	// when scaled down.
+	drain    <-chan bool
+	shutdown <-chan bool
+
+	// serverDrain pauses reserving once beanstalkd refused a put for being
+	// in drain mode.
+	serverDrain serverDrain
+
+	// held counts the jobs held reserved on the connection of RunShared,
+	// nil for Run.
+	held *heldJobs
 
 	sync.WaitGroup
 }
 
+// WorkDirResolver returns the working directory a job should be executed in,
+// given the job and its decoded packet.
+type WorkDirResolver func(o cli.Options, job bs.Job, packet Packet) (string, error)
+
+// Validator checks the packet of a job before it is executed.
+type Validator func(packet Packet) error
+
+// spawnError is returned by executeJob when the worker process could not be
+// started. It is a transient condition, distinct from the job itself failing.
+type spawnError struct {
+	err error
+}
+
+func (e spawnError) Error() string {
+	return fmt.Sprintf("failed to spawn worker: %s", e.err)
+}
+
 type JobResult struct {
 
 	// Buried is true if the job was buried.
 	Buried bool
 
+	// ValidationFailed is true if the job was rejected without being executed.
+	ValidationFailed bool
+
+	// EmptyBody is true if the job was rejected for an empty or whitespace
+	// only body.
+	EmptyBody bool
+
+	// DeadLettered is true if the job was moved to a dead-letter tube.
+	DeadLettered bool
+
+	// Stale is true if the job exceeded the maximum age and was deleted
+	// without being executed.
+	Stale bool
+
 	// Executed is true if the job command was executed (or attempted).
 	Executed bool
 
@@ -69,141 +188,823 @@ type JobResult struct {
 	// JobId from beanstalkd.
 	JobId uint64
 
-	// Stdout of the command.
+	// WorkerId of the broker which processed the job.
+	WorkerId string
+
+	// Tube the job was reserved from, without -tube-prefix. Empty if its
+	// stats could not be read.
+	Tube string
+
+	// Attempt is the number of the execution, counting the job's releases
+	// and timeouts before it. Zero if the job was not executed.
+	Attempt uint64
+
+	// Domain the job was executed for, from the domain key of its packet,
+	// and WorkDir it was executed in. Empty if the job was not executed.
+	Domain  string
+	WorkDir string
+
+	// PermanentFailure is true if the job failed in a way retrying cannot
+	// fix, such as the controller not being found, going by its exit status
+	// or a marker on stdout.
+	PermanentFailure bool
+
+	// SuccessMarked is true if the job exited non-zero but printed the
+	// -success-marker, so is treated as having succeeded.
+	SuccessMarked bool
+
+	// FollowUps are the jobs requested through FollowUpDirective lines of
+	// stdout, put once the job has succeeded.
+	FollowUps []FollowUp
+
+	// Duration the command ran for.
+	Duration time.Duration
+
+	// Stdout of the command. Only retained when results are consumed or
+	// -retain-stdout is set, otherwise its tail is for the recent jobs.
 	Stdout []byte
 
+	// Stderr of the command, its last cmd.MaxStderrBytes. StderrCaptured is
+	// false when the executor does not keep stderr, as for persistent
+	// workers.
+	Stderr         []byte
+	StderrCaptured bool
+
 	// TimedOut indicates the worker exceeded TTR for the job.
 	// Note this is tracked by a timer, separately to beanstalkd.
 	TimedOut bool
 
+	// Interrupted indicates the worker was terminated for running past
+	// -drain-job-grace once the broker began draining.
+	Interrupted bool
+
+	// WallTimeCapped indicates the job ran under -max-job-wall-time, so a
+	// time out was the cap rather than TTR.
+	WallTimeCapped bool
+
 	// Error raised while attempting to handle the job.
 	Error error
+
+	// auditBody is the redacted packet of the job for the audit log, kept
+	// only for tubes with -audit-body.
+	auditBody interface{}
+}
+
+// ExitedOK reports whether the job's command succeeded: it exited 0, or
+// printed the -success-marker.
+func (r *JobResult) ExitedOK() bool {
+	return r.ExitStatus == 0 || r.SuccessMarked
 }
 
 // New broker instance.
-func New(o cli.Options, tube string, slot uint64, results chan<- *JobResult) (b Broker) {
+func New(o cli.Options, tube string, slot uint64, results chan *JobResult) (b Broker) {
+	return NewGroup(o, []string{tube}, slot, results)
+}
+
+// NewGroup creates a broker servicing a group of tubes in round-robin order.
+func NewGroup(o cli.Options, tubes []string, slot uint64, results chan *JobResult) (b Broker) {
 	b.Address = o.Address
-	b.Tube = tube
+	b.Tube = strings.Join(tubes, ",")
+	b.Tubes = tubes
+	b.ResolveWorkDir = getJobWD
+	b.Execute = killingExecutor(cmd.KillSequence{Signals: o.KillSignals, Grace: o.KillGrace})
+	b.CheckPressure = resourceChecker(o)
 	b.options = o
 
 	b.log = log.WithFields(log.Fields{
-		"tube": tube,
-		"slot": slot,
+		"tube":   b.Tube,
+		"slot":   slot,
+		"worker": o.WorkerId,
 	})
 
 	b.results = results
+	b.fatal = func(err error) { b.log.Error(err) }
 	return
 }
 
 // Run connects to beanstalkd and starts broking.
 // If ticks channel is present, one job is processed per tick.
+// A lost connection is re-established with backoff.
 func (b *Broker) Run(ticks chan bool, fin func()) {
 	defer fin()
-	b.log.Debugf("connecting to address: %s", b.Address)
-	conn, err := beanstalk.Dial("tcp", b.Address)
+	if !b.warmUp() {
+		return
+	}
+	conn, err := b.connectWithBackoff()
 	if err != nil {
-		log.Error(err)
+		b.fatal(err)
 		return
 	}
+	defer func() { b.disconnect(conn) }()
 
 	b.log.Printf("watching tube %s", b.Tube)
-	ts := beanstalk.NewTubeSet(conn, b.Tube)
+	tc := b.newTubeCycle(conn)
+
+	// served counts the jobs processed on conn, for -refresh-conn-after.
+	var served uint64
 
 	for {
-		if _, ok := <-ticks; !ok {
+		// Once draining, no new job is reserved, but one already reserved
+		// is still processed.
+		if _, ok := <-ticks; !ok || b.draining() {
 			b.log.Info("preparing for shutdown")
 			return
 		}
 
+		if !b.waitForResources() {
+			return
+		}
+		if !b.Slots.acquire(b.Tubes, b.drain) {
+			return
+		}
+
 		b.log.Info("reserve (waiting for job)")
-		id, body := bs.MustReserveWithoutTimeout(ts)
-		job := bs.NewJob(id, body, conn)
+		id, body, drained, err := b.reserve(tc, conn)
+		if drained {
+			b.Slots.release(b.Tubes)
+			b.log.Info("preparing for shutdown")
+			return
+		}
+
+		if err == nil && b.draining() && b.shuttingDown() {
+			b.handBack(bs.NewJob(id, body, conn))
+			b.Slots.release(b.Tubes)
+			return
+		}
+
+		var result *JobResult
+		if err == nil {
+			result, err = b.processJob(bs.NewJob(id, body, conn))
+		}
+		b.Slots.release(b.Tubes)
 
-		t, err := job.Timeouts()
+		if bs.IsConnError(err) {
+			b.log.Warnf("lost connection to %s, reconnecting, error: %s", b.Address, err)
+			if conn, err = b.reconnect(conn); err != nil {
+				b.fatal(err)
+				return
+			}
+			tc = b.newTubeCycle(conn)
+			served = 0
+			continue
+		}
 		if err != nil {
-			b.log.Error(err)
+			b.fatal(err)
 			return
 		}
-		if t >= TimeoutTries {
-			b.log.Warnf("job %d has %d timeouts, burying", job.Id, t)
-			err := job.Release(b.options.RequeueDelay)
-			if err != nil {
-				b.log.Errorf("failed to re-queue a timed out job, error: %s", err.Error())
+
+		if result != nil {
+			b.report(result)
+		}
+
+		served++
+		if max := b.options.RefreshConnAfter; max > 0 && served >= max {
+			if conn, err = b.refresh(conn); err != nil {
+				b.fatal(err)
+				return
+			}
+			tc = b.newTubeCycle(conn)
+			served = 0
+		}
+	}
+}
+
+// RunShared connects to beanstalkd once and fans the jobs reserved on that
+// connection out to a pool of workers executing them concurrently, instead of
+// each worker holding a connection of its own. One job is reserved per tick,
+// and only while a worker is free, and fewer than -max-reserved-per-conn jobs
+// are held. A lost connection is re-established once
+// the workers using it have finished.
+func (b *Broker) RunShared(ticks chan bool, fin func(), workers int) {
+	defer fin()
+	if !b.warmUp() {
+		return
+	}
+	conn, err := b.connectWithBackoff()
+	if err != nil {
+		b.fatal(err)
+		return
+	}
+	defer func() { b.disconnect(conn) }()
+
+	b.log.Printf("watching tube %s with %d shared workers", b.Tube, workers)
+	tc := b.newTubeCycle(conn)
+
+	// A slot is taken for each job reserved and given back once it is
+	// disposed of, so the slots cap the jobs held on the connection.
+	slots := workers
+	if max := b.options.MaxReservedPerConn; max > 0 && max < uint64(slots) {
+		b.log.Infof("holding at most %d reserved jobs on the connection", max)
+		slots = int(max)
+	}
+	free := make(chan bool, slots)
+	for i := 0; i < slots; i++ {
+		free <- true
+	}
+
+	var executing sync.WaitGroup
+	defer executing.Wait()
+
+	// holding counts the jobs being executed, and finished is signalled as
+	// each one finishes. The jobs held are counted by tube as well, once
+	// processJob learns each one's.
+	var holding int32
+	finished := make(chan bool, 1)
+	b.held = &heldJobs{tubes: make(map[string]int)}
+
+	// served counts the jobs reserved on conn, for -refresh-conn-after.
+	var served uint64
+
+	// giveBack returns the slots taken for a job once it is disposed of.
+	giveBack := func() {
+		b.Slots.release(b.Tubes)
+		free <- true
+	}
+
+	for {
+		if _, ok := <-ticks; !ok || b.draining() {
+			b.log.Info("preparing for shutdown")
+			return
+		}
+
+		<-free
+		if !b.waitForResources() {
+			return
+		}
+		if !b.Slots.acquire(b.Tubes, b.drain) {
+			return
+		}
+		id, body, err := tc.Reserve(SharedReserveTimeout)
+		if err == bs.ErrNoJob {
+			giveBack()
+			continue
+		}
+		if err == bs.ErrDeadlineSoon {
+			giveBack()
+			// A job held on this connection is about to exceed its TTR,
+			// refusing reserves until it is disposed of. Rather than sleep
+			// blindly, reserve again as soon as a job finishes.
+			if atomic.LoadInt32(&holding) == 0 {
+				time.Sleep(bs.DeadlineSoonDelay)
 				continue
 			}
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
+			select {
+			case <-finished:
+			case <-time.After(bs.DeadlineSoonDelay):
 			}
 			continue
 		}
-
-		releases, err := job.Releases()
 		if err != nil {
-			b.log.Error(err)
+			giveBack()
+			b.log.Warnf("lost connection to %s, reconnecting, error: %s", b.Address, err)
+			executing.Wait()
+			if conn, err = b.reconnect(conn); err != nil {
+				b.fatal(err)
+				return
+			}
+			tc = b.newTubeCycle(conn)
+			served = 0
+			continue
+		}
+
+		if b.draining() && b.shuttingDown() {
+			b.handBack(bs.NewJob(id, body, conn))
+			b.Slots.release(b.Tubes)
 			return
 		}
-		if releases >= ReleaseTries {
-			b.log.Infof("job %d has %d releases, re queueing", job.Id, releases)
-			err := job.Release(b.options.RequeueDelay)
+
+		executing.Add(1)
+		atomic.AddInt32(&holding, 1)
+		go func(job bs.Job) {
+			defer executing.Done()
+			defer giveBack()
+			defer func() {
+				atomic.AddInt32(&holding, -1)
+				select {
+				case finished <- true:
+				default:
+				}
+			}()
+
+			result, err := b.processJob(job)
 			if err != nil {
-				b.log.Errorf("failed to re-queue the job, error: %s", err.Error())
-				continue
+				b.log.Error(err)
+				return
 			}
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
+			if result != nil {
+				b.report(result)
 			}
-			continue
+		}(bs.NewJob(id, body, conn))
+
+		// The jobs reserved on conn are disposed of on it, so are finished
+		// before it is replaced.
+		served++
+		if max := b.options.RefreshConnAfter; max > 0 && served >= max {
+			executing.Wait()
+			if conn, err = b.refresh(conn); err != nil {
+				b.fatal(err)
+				return
+			}
+			tc = b.newTubeCycle(conn)
+			served = 0
 		}
+	}
+}
 
-		wd, err := getJobWD(b.options, job)
-		if err != nil {
-			log.Error(err)
-			return
+// heldJobs counts the jobs held reserved on a shared connection by tube,
+// exported as reservedJobs.
+type heldJobs struct {
+	mu    sync.Mutex
+	tubes map[string]int
+}
+
+// add changes the number of jobs of tube held by n.
+func (h *heldJobs) add(tube string, n int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tubes[tube] += n
+	reservedJobs.Set(float64(h.tubes[tube]), tube)
+}
+
+// newTubeCycle creates the TubeCycle reserving jobs for the broker's tubes.
+// The connection's watch list is set to exactly those tubes on the first
+// reserve: they are watched before default is ignored, so the ignore cannot
+// be refused with NOT_IGNORED. With -watch-default, default is kept.
+func (b *Broker) newTubeCycle(conn *beanstalk.Conn) *bs.TubeCycle {
+	tubes := make([]string, len(b.Tubes))
+	watchingDefault := false
+	for i, tube := range b.Tubes {
+		tubes[i] = b.options.Prefixed(tube)
+		watchingDefault = watchingDefault || tubes[i] == DefaultTube
+	}
+	if b.options.WatchDefault && !watchingDefault {
+		tubes = append(tubes, DefaultTube)
+	}
+	tc := bs.NewTubeCycle(conn, tubes...)
+	tc.ByPriority = b.options.CrossTubePriority
+	return tc
+}
+
+// Overflow policies of the results channel, see Options.ResultsOverflow.
+const (
+	ResultsBlock      = "block"
+	ResultsDropNewest = "drop-newest"
+	ResultsDropOldest = "drop-oldest"
+)
+
+// report passes on the result of a job processed by Run or RunShared.
+func (b *Broker) report(result *JobResult) {
+	// A job whose stats could not be read is reported under the broker's
+	// tubes, its own being unknown.
+	tube := result.Tube
+	if tube == "" {
+		tube = b.Tube
+	}
+
+	b.Audit.Record(tube, b.options.WorkerId, result)
+	b.Statsd.Record(tube, result)
+	b.Recent.Record(tube, result)
+	b.Hooks.completed(result)
+	jobsTotal.Inc(tube, result.outcome(), domainLabel(result.Domain))
+	if result.Executed {
+		jobDuration.Observe(result.Duration.Seconds(), tube)
+	}
+	if result.Executed && result.outcome() == OutcomeSucceeded {
+		sinceLastSuccess.Mark(tube)
+	}
+	if b.results == nil {
+		return
+	}
+
+	switch b.options.ResultsOverflow {
+	case ResultsDropNewest, "":
+		select {
+		case b.results <- result:
+		default:
+			b.log.Warnf("results buffer full, dropping the result of job %d", result.JobId)
+			resultsDropped.Inc(ResultsDropNewest)
+		}
+	case ResultsDropOldest:
+		for {
+			select {
+			case b.results <- result:
+				return
+			default:
+			}
+			select {
+			case old := <-b.results:
+				b.log.Warnf("results buffer full, dropping the result of job %d", old.JobId)
+				resultsDropped.Inc(ResultsDropOldest)
+			default:
+			}
 		}
+	default:
+		b.results <- result
+	}
+}
+
+// draining reports whether the broker is to stop reserving.
+func (b *Broker) draining() bool {
+	select {
+	case <-b.drain:
+		return true
+	default:
+		return false
+	}
+}
 
-		b.log.Infof("executing job %d in path %s", job.Id, wd)
+// shuttingDown reports whether the dispatcher is shutting down. A job
+// reserved just as a broker drains is only handed back then: when merely
+// its tube is being torn down, it is processed in full.
+func (b *Broker) shuttingDown() bool {
+	select {
+	case <-b.shutdown:
+		return true
+	default:
+		return false
+	}
+}
 
-		result, err := b.executeJob(job, wd)
-		if err != nil {
-			log.Error(err)
-			return
+// reserve waits for a job on tc. A reserve without a timeout only returns with
+// a job, so conn is closed to break out of it once the broker is stopped,
+// reporting drained; a job reserved meanwhile goes back to the ready queue
+// as the connection holding it is gone.
+func (b *Broker) reserve(tc *bs.TubeCycle, conn *beanstalk.Conn) (id uint64, body []byte, drained bool, err error) {
+	var mu sync.Mutex
+	reserving := true
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-b.drain:
+			mu.Lock()
+			defer mu.Unlock()
+			if reserving {
+				drained = true
+				conn.Close()
+			}
+		case <-done:
 		}
+	}()
+
+	id, body, err = tc.ReserveWithoutTimeout()
+	mu.Lock()
+	defer mu.Unlock()
+	reserving = false
+	return id, body, drained, err
+}
+
+// handBack releases a job reserved while shutting down without executing it,
+// so that another worker can take it straight away rather than after its TTR.
+func (b *Broker) handBack(job bs.Job) {
+	b.log.Infof("shutting down, releasing job %d without executing it", job.Id)
+	if err := job.Release(0); err != nil {
+		b.log.Errorf("failed to release job %d, error: %s", job.Id, err)
+	}
+}
+
+// RunOnce connects to beanstalkd, reserves a single job and processes it.
+// The returned result is nil when the job was re-queued without a result
+// to report.
+func (b *Broker) RunOnce() (*JobResult, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b.log.Printf("waiting for a single job on tube %s", b.Tube)
+	id, body, err := b.newTubeCycle(conn).ReserveWithoutTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.processJob(bs.NewJob(id, body, conn))
+}
+
+// ReprocessJob connects to beanstalkd, reserves the job with the given id
+// and processes it, regardless of which tube it belongs to.
+func (b *Broker) ReprocessJob(id uint64) (*JobResult, error) {
+	nc, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := bs.ReserveJob(nc, id)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to reserve job %d, error: %s", id, err)
+	}
+
+	conn := beanstalk.NewConn(nc)
+	defer conn.Close()
+
+	b.log.Infof("reprocessing job %d", id)
+	return b.processJob(bs.NewJob(id, body, conn))
+}
+
+func (b *Broker) connect() (*beanstalk.Conn, error) {
+	nc, err := b.dial()
+	if err != nil {
+		connectionEvents.Inc("dial_failure", b.Tube, b.options.WorkerId)
+		return nil, err
+	}
+	b.log.WithField("event", "open").Infof("connected to %s", b.Address)
+	connectionEvents.Inc("open", b.Tube, b.options.WorkerId)
+	return beanstalk.NewConn(nc), nil
+}
+
+// disconnect closes a connection made by connect.
+func (b *Broker) disconnect(conn *beanstalk.Conn) {
+	if err := conn.Close(); err != nil {
+		b.log.Debugf("failed to close connection, error: %s", err)
+	}
+	b.log.WithField("event", "close").Infof("disconnected from %s", b.Address)
+	connectionEvents.Inc("close", b.Tube, b.options.WorkerId)
+}
+
+func (b *Broker) dial() (net.Conn, error) {
+	b.log.Debugf("connecting to address: %s", b.Address)
+	return dial(b.options)
+}
 
-		err = b.handleResult(job, result)
+// giveUp disposes of a job that has exhausted its retries, or cannot succeed,
+// moving it to the dead-letter tube if there is one. Otherwise the job is
+// buried if bury is set, as for jobs which repeatedly timed out, or
+// re-queued.
+func (b *Broker) giveUp(job bs.Job, policy Policy, bury bool) *JobResult {
+	if policy.DeadletterTube != "" {
+		b.log.Infof("moving job %d to dead-letter tube %s", job.Id, policy.DeadletterTube)
+		err := job.DeadLetter(b.options.Prefixed(policy.DeadletterTube))
+		if bs.IsJobTooBig(err) {
+			// The original job is still reserved, so keep it for inspection.
+			b.log.Warnf("job %d is too big for dead-letter tube %s, burying it instead", job.Id, policy.DeadletterTube)
+			deadletterTooBig.Inc(policy.DeadletterTube)
+			if err := b.bury(job); err != nil {
+				b.log.Errorf("failed to bury the job, error: %s", err)
+				return nil
+			}
+			return &JobResult{JobId: job.Id, Buried: true, Error: err}
+		}
 		if err != nil {
-			log.Error(err)
-			return
+			b.noteDraining(err)
+			b.log.Errorf("failed to dead-letter job %d, error: %s", job.Id, err)
+			return nil
 		}
+		return &JobResult{JobId: job.Id, Buried: true, DeadLettered: true}
+	}
 
-		if result.Error != nil {
-			b.log.Warnf("result had error: %s", result.Error)
+	if bury {
+		b.log.Infof("burying job %d", job.Id)
+		if err := b.bury(job); err != nil {
+			b.log.Errorf("failed to bury the job, error: %s", err)
+			return nil
 		}
+		return &JobResult{JobId: job.Id, Buried: true}
+	}
 
-		if b.results != nil {
-			b.results <- result
-		}
+	b.log.Infof("re-queueing job %d with %v delay", job.Id, b.options.RequeueDelay)
+	if err := job.Release(b.options.RequeueDelay); err != nil {
+		b.log.Errorf("failed to re-queue the job, error: %s", err.Error())
+		return nil
 	}
+	return &JobResult{JobId: job.Id, Buried: true}
+}
 
-	b.log.Infof("broker finished")
+// reject disposes of an invalid job without executing it, according to the
+// invalid job policy.
+func (b *Broker) reject(job bs.Job, reason error) *JobResult {
+	return b.rejectWith(job, reason, b.options.InvalidJobPolicy)
 }
 
-func getJobWD(o cli.Options, job bs.Job) (string, error) {
-	dec, err := phpserialize.Decode(string(job.Body))
+// rejectWith disposes of an invalid job without executing it, deleting it if
+// policy is "delete" and burying it otherwise.
+func (b *Broker) rejectWith(job bs.Job, reason error, policy string) *JobResult {
+	result := &JobResult{JobId: job.Id, ValidationFailed: true, Error: reason}
+
+	var err error
+	if policy == "delete" {
+		b.log.Warnf("job %d is invalid, deleting, error: %s", job.Id, reason)
+		err = job.Delete()
+	} else {
+		b.log.Warnf("job %d is invalid, burying, error: %s", job.Id, reason)
+		result.Buried = true
+		err = b.bury(job)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to unserialize the job, error: %s", err)
+		b.log.Errorf("failed to dispose of invalid job %d, error: %s", job.Id, err)
+		return nil
 	}
+	return result
+}
 
-	var domain string
+// processJob executes a reserved job and disposes of it according to the
+// result. A non-nil error means the broker can no longer continue.
+func (b *Broker) processJob(job bs.Job) (result *JobResult, err error) {
+	b.Hooks.reserved(job)
+	stats, err := b.jobStats(job)
+	if perr, ok := err.(*bs.StatsParseError); ok {
+		return b.releaseUnparsed(job, perr), nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	switch dec.(type) {
-	case map[interface{}]interface{}:
-		domain, err = findDomain(dec.(map[interface{}]interface{}))
-		if err != nil {
-			return "", err
+	// Past here the tube is named without -tube-prefix.
+	tube, _ := b.options.Unprefixed(stats.Tube)
+	b.held.add(tube, 1)
+	defer b.held.add(tube, -1)
+	defer func() {
+		if result != nil {
+			result.Tube = tube
 		}
+	}()
 
-	default:
-		return "", fmt.Errorf("failed to interpret the job packet, expecting a map got %v", dec)
+	if b.options.MaxJobAge > 0 && stats.Age > b.options.MaxJobAge {
+		b.log.Warnf("job %d is %v old, deleting without executing", job.Id, stats.Age)
+		if err := job.Delete(); err != nil {
+			b.log.Errorf("failed to delete stale job %d, error: %s", job.Id, err)
+			return nil, nil
+		}
+		return &JobResult{JobId: job.Id, Stale: true}, nil
+	}
+
+	// An oversized body is neither decoded nor written to a child.
+	if max := b.options.MaxBodyBytes; max > 0 && uint64(len(job.Body)) > max {
+		err := fmt.Errorf("body of %d bytes exceeds the maximum of %d", len(job.Body), max)
+		return b.rejectWith(job, err, b.options.OversizedBodyPolicy), nil
+	}
+
+	// An empty body cannot hold a packet, so is rejected without decoding.
+	if len(bytes.TrimSpace(job.Body)) == 0 {
+		result := b.reject(job, errors.New("empty body"))
+		if result != nil {
+			result.EmptyBody = true
+		}
+		return result, nil
+	}
+
+	if b.deferForNewer(job, stats) {
+		return nil, nil
+	}
+
+	if b.shed(job, tube, stats) {
+		return nil, nil
+	}
+
+	// A body which fails to decode is rejected once the job is known to be
+	// retried no further.
+	packet, decodeErr := decodePacket(job, b.options.JobFormat)
+	if decodeErr == nil && b.handOffForShard(job, packet) {
+		return nil, nil
+	}
+
+	defer func() { b.keepAuditBody(result, tube, packet) }()
+
+	jobReleases.Observe(float64(stats.Releases), tube)
+	policy := b.policy(tube)
+
+	// The route is matched before the job's retries are checked, as its
+	// rule may change the limits. An undecoded packet only matches routes
+	// on the tube alone.
+	controller := b.options.Controller
+	route, routed := b.options.Routes.Match(tube, packet.String)
+	if routed {
+		policy.apply(route.PolicyRule)
+		if route.Controller != "" {
+			controller = route.Controller
+		}
+	}
+
+	timeLeft := job.TimeLeft
+	if wall, ok := b.options.MaxJobWallTime[tube]; ok && b.skipsPrecheck() {
+		// Rather than reading time-left, the child is timed by the wall
+		// time cap alone, on the local clock.
+		timeLeft = func() (time.Duration, error) { return wall, nil }
+	}
+	switch {
+	case policy.AtMostOnce:
+		// Never retried, so there are no retries to give up on.
+	case stats.Timeouts >= policy.MaxTimeouts:
+		b.log.Warnf("job %d has %d timeouts, giving up", job.Id, stats.Timeouts)
+		return b.giveUp(job, policy, true), nil
+	case stats.Releases >= policy.MaxReleases:
+		b.log.Infof("job %d has %d releases, giving up", job.Id, stats.Releases)
+		return b.giveUp(job, policy, false), nil
+	}
+
+	if decodeErr != nil {
+		return b.reject(job, decodeErr), nil
+	}
+
+	if missing := packet.Missing(b.options.RequiredFields); len(missing) > 0 {
+		err := fmt.Errorf("job packet is missing required fields: %s", strings.Join(missing, ", "))
+		return b.reject(job, err), nil
+	}
+
+	if b.options.TrackRetriesInBody && !policy.AtMostOnce {
+		if r, _ := packet.Int(RetriesKey); r >= 0 && uint64(r) >= policy.MaxReleases {
+			b.log.Infof("job %d has %d retries, giving up", job.Id, r)
+			return b.giveUp(job, policy, false), nil
+		}
+	}
+
+	if b.Validate != nil {
+		if err := b.Validate(packet); err != nil {
+			return b.reject(job, err), nil
+		}
+	}
+
+	var wd string
+	if routed && route.WorkDir != "" {
+		wd = route.WorkDir
+	} else if wd, err = b.ResolveWorkDir(b.options, job, packet); err != nil {
+		return b.reject(job, err), nil
+	}
+
+	if b.options.CreateWorkDir {
+		if err := b.createWorkDir(wd); err != nil {
+			b.log.Warnf("%s, releasing job %d", err, job.Id)
+			if err := job.Release(b.options.RequeueDelay); err != nil {
+				b.log.Errorf("failed to release job %d, error: %s", job.Id, err)
+			}
+			return &JobResult{JobId: job.Id, Error: err}, nil
+		}
+	}
+
+	// An at-most-once job is only deleted once it is known to be executed,
+	// so that a job rejected above is disposed of like any other.
+	if policy.AtMostOnce {
+		// The reservation goes with the job, so the time the child is
+		// allowed is read before deleting it, and runs down from then.
+		read := time.Now()
+		left, err := timeLeft()
+		if perr, ok := err.(*bs.StatsParseError); ok {
+			return b.releaseUnparsed(job, perr), nil
+		} else if err != nil {
+			return nil, err
+		}
+		timeLeft = func() (time.Duration, error) { return left - time.Since(read), nil }
+
+		b.log.Infof("deleting job %d before executing it, tube %s is at-most-once", job.Id, tube)
+		if err := job.Delete(); err != nil {
+			b.log.Errorf("failed to delete at-most-once job %d, not executing it, error: %s", job.Id, err)
+			return nil, nil
+		}
+	}
+
+	attempt := stats.Releases + stats.Timeouts + 1
+	b.log.WithField("attempt", attempt).Infof("executing job %d in path %s", job.Id, wd)
+
+	done := b.InFlight.add(job.Id, tube, wd)
+	endStream := b.Streams.begin(job.Id)
+	result, err = b.executeJob(job, tube, packet, wd, controller, policy, attempt, timeLeft)
+	endStream()
+	done()
+	result.Domain, _ = findDomain(packet)
+	result.WorkDir = wd
+	if _, ok := err.(spawnError); ok && policy.AtMostOnce {
+		spawnFailures.Inc(tube)
+		b.log.Warnf("%s, at-most-once job %d is lost", err, job.Id)
+		result.Error = err
+		return result, nil
+	} else if ok {
+		spawnFailures.Inc(tube)
+		b.log.Warnf("%s, releasing job %d", err, job.Id)
+		if err := job.Release(b.options.RequeueDelay); err != nil {
+			b.log.Errorf("failed to release job %d, error: %s", job.Id, err)
+		}
+		result.Error = err
+		return result, nil
+	}
+	if perr, ok := err.(*bs.StatsParseError); ok {
+		return b.releaseUnparsed(job, perr), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = b.handleResult(job, packet, result, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.options.PostJobHook != "" {
+		b.runPostJobHook(tube, wd, result)
+	}
+
+	if result.Error != nil {
+		b.log.Warnf("result had error: %s", result.Error)
+	}
+
+	return result, nil
+}
+
+func getJobWD(o cli.Options, job bs.Job, packet Packet) (string, error) {
+	domain, err := findDomain(packet)
+	if err != nil {
+		return "", err
 	}
 
 	if strings.ToLower(domain) == "cluster" {
@@ -213,101 +1014,516 @@ func getJobWD(o cli.Options, job bs.Job) (string, error) {
 	return o.InstanceRoot + "/" + domain + "/worker", nil
 }
 
-func findDomain(dec map[interface{}]interface{}) (string, error) {
-	for k, v := range dec {
-		switch k.(type) {
-		case string:
-			if k != "domain" {
-				continue
-			}
+// createWorkDir creates the working directory of a job if it is missing. It
+// refuses to create anything outside the instance and cluster roots.
+func (b *Broker) createWorkDir(wd string) error {
+	wd = filepath.Clean(wd)
+	within := func(root string) bool {
+		root = filepath.Clean(root)
+		return strings.HasPrefix(wd, root+string(filepath.Separator))
+	}
+	if !within(b.options.InstanceRoot) && !within(b.options.ClusterRoot) {
+		return fmt.Errorf("refusing to create working directory %s outside the instance root", wd)
+	}
 
-			if d, ok := v.(string); ok {
-				return d, nil
-			}
+	if err := os.MkdirAll(wd, 0755); err != nil {
+		return fmt.Errorf("failed to create working directory %s, error: %s", wd, err)
+	}
+	return nil
+}
+
+func findDomain(packet Packet) (string, error) {
+	if _, ok := packet["domain"]; !ok {
+		return "", errors.New("failed to find domain key in job packet")
+	}
 
-			return "", errors.New("value of domain key is not a string")
+	if d, ok := packet.String("domain"); ok {
+		// The domain names a directory under the instance root, so it must
+		// not be able to point anywhere else.
+		if d == "" || d == "." || d == ".." || strings.ContainsAny(d, "/\\\x00") {
+			return "", fmt.Errorf("invalid domain %q in job packet", d)
 		}
+		return d, nil
 	}
 
-	return "", errors.New("failed to find domain key in job packet")
+	return "", errors.New("value of domain key is not a string")
 }
 
-func (b *Broker) executeJob(job bs.Job, cwd string) (result *JobResult, err error) {
-	result = &JobResult{JobId: job.Id, Executed: true}
+func (b *Broker) executeJob(job bs.Job, tube string, packet Packet, cwd, controller string, policy Policy, attempt uint64, timeLeft func() (time.Duration, error)) (result *JobResult, err error) {
+	result = &JobResult{JobId: job.Id, WorkerId: b.options.WorkerId, Attempt: attempt, Executed: true}
+
+	if b.Tracer != nil {
+		span := b.Tracer.Start(tube+" "+controller, traceParent(packet))
+		span.SetAttribute("beanstalk.tube", tube)
+		span.SetAttribute("beanstalk.job_id", job.Id)
+		span.SetAttribute("broker.controller", controller)
+		span.SetAttribute("broker.workdir", cwd)
+		defer func() {
+			span.SetAttribute("process.exit_code", result.ExitStatus)
+			span.SetAttribute("broker.timed_out", result.TimedOut)
+			if result.TimedOut {
+				span.AddEvent("timeout")
+			}
+			if err != nil || result.TimedOut || !result.ExitedOK() {
+				span.SetFailed()
+			}
+			span.End()
+		}()
+	}
 
-	ttr, err := job.TimeLeft()
-	timer := time.NewTimer(ttr + ttrMargin)
+	// time-left is by beanstalkd's clock, and runs down from when it was
+	// asked for. The timer is armed on the local clock once the child has
+	// started, so the time taken by the read and by spawning the child is
+	// taken off the deadline.
+	read := time.Now()
+	ttr, err := timeLeft()
 	if err != nil {
 		return
 	}
 
-	cmd, out, err := cmd.NewCommand(cwd, b.options.PHPBinary, "-c", b.options.PHPINI, "index.php", b.options.Controller)
+	// By default the child is terminated just after the reservation lapses,
+	// leaving beanstalkd to release the job. Disposing of a timed out job
+	// ourselves needs the reservation, so the child is then terminated just
+	// before it lapses, and the job touched to hold it.
+	margin := b.ttrMarginOf(tube)
+	deadline := ttr + margin
+	// An at-most-once job was deleted before executing, so there is nothing
+	// to hold.
+	hold := policy.OnTimeout != OnTimeoutRelease && ttr > margin && !policy.AtMostOnce
+	if hold {
+		deadline = ttr - margin
+	}
+
+	// The body is written to stdin, so the command line is safe to log.
+	argv := []string{b.options.PHPBinary, "-c", b.options.PHPINI, "index.php", controller}
+	b.log.Debugf("job %d command line: %q", job.Id, argv)
+
+	cmd, out, err := b.Execute(cwd, argv[0], argv[1:]...)
 	if err != nil {
+		err = spawnError{err}
 		return
 	}
 
-	if err = cmd.StartWithStdin(job.Body); err != nil {
+	// Whichever way this returns, a child that was started is reaped, so
+	// that an error part way cannot leave a zombie or a stray process.
+	reaped := false
+	defer func() {
+		if reaped || !cmd.Started() {
+			return
+		}
+		b.log.Warnf("killing the child of job %d, which was not waited on", job.Id)
+		if e := cmd.Kill(); e != nil {
+			b.log.Errorf("failed to kill the child of job %d, error: %s", job.Id, e)
+		}
+		go func() {
+			for _ = range out {
+			}
+		}()
+		<-cmd.WaitChan()
+	}()
+
+	cmd.AddEnv(
+		"BEANSTALK_WORKER_ID="+b.options.WorkerId,
+		fmt.Sprintf("BEANSTALK_ATTEMPT=%d", attempt),
+	)
+	cmd.AddEnv(b.env...)
+
+	if err = cmd.StartWithStdin(frameStdin(b.options.StdinFraming, job.Body)); err != nil {
+		err = spawnError{err}
 		return
 	}
+	b.InFlight.setProcess(job.Id, cmd)
+	b.Hooks.executing(job, cwd)
+	started := time.Now()
+	defer func() { result.Duration = time.Since(started) }()
+	deadline -= time.Since(read)
+
+	// -max-job-wall-time caps the run time of a tube's jobs below their
+	// TTR. The job is then still reserved, unless at-most-once, so it is held
+	// whatever the policy, and released by handleResult if the policy is to
+	// release.
+	if wall, ok := b.options.MaxJobWallTime[tube]; ok && wall < deadline {
+		deadline = wall
+		hold = !policy.AtMostOnce
+		result.WallTimeCapped = true
+	}
+
+	// The timer is armed once and stopped once. When it fires, timeout is
+	// cleared so the child is terminated a single time, whichever phase
+	// below observes it.
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	timeout := timer.C
+
+	// With -drain-job-grace, a child still running once the broker drains
+	// on shutdown is allowed the grace to finish, then terminated for its
+	// job to be released. The grace runs from when this broker is stopped,
+	// which -drain-order may put well after shutdown begins. Otherwise
+	// draining waits for it, as does a tube being torn down.
+	var drain <-chan bool
+	if b.options.DrainJobGrace > 0 {
+		drain = b.drain
+	}
+	graceTimer := time.NewTimer(b.options.DrainJobGrace)
+	graceTimer.Stop()
+	defer graceTimer.Stop()
+	var grace <-chan time.Time
+	startGrace := func() {
+		if !b.shuttingDown() {
+			// Only the tube is torn down, so far: the grace waits for
+			// shutdown, if it follows.
+			drain = b.shutdown
+			return
+		}
+		drain = nil
+		graceTimer.Reset(b.options.DrainJobGrace)
+		grace = graceTimer.C
+	}
+	interrupt := func() {
+		timeout, grace = nil, nil
+		result.Interrupted = true
+		b.log.Warnf("job %d still running %v after draining began, terminating it", job.Id, b.options.DrainJobGrace)
+		if e := cmd.Terminate(); e != nil {
+			b.log.Errorf("failed to terminate job %d, error: %s", job.Id, e)
+		}
+	}
+
+	terminate := func() {
+		timeout, drain, grace = nil, nil, nil
+		result.TimedOut = true
+		if hold {
+			if e := job.Touch(); e != nil {
+				b.log.Errorf("failed to touch timed out job %d, error: %s", job.Id, e)
+			}
+		}
+		if e := cmd.Terminate(); e != nil {
+			b.log.Errorf("failed to terminate job %d, error: %s", job.Id, e)
+		}
+	}
+
+	// Stdout must be drained before waiting on the child, as Wait closes
+	// the pipe, even when there is no one to pass it on to. For the recent
+	// jobs alone, only the tail they keep is retained.
+	retain := b.retainStdout()
+	retainTail := !retain && b.Recent != nil
+	scanner := stdoutScanner{markers: b.options.PermanentFailureMarkers, success: b.options.SuccessMarker}
 
 stdoutReader:
 	for {
 		select {
-		case <-timer.C:
-			if err = cmd.Terminate(); err != nil {
-				return
-			}
-			result.TimedOut = true
+		case <-timeout:
+			terminate()
+		case <-drain:
+			startGrace()
+		case <-grace:
+			interrupt()
 		case data, ok := <-out:
 			if !ok {
 				break stdoutReader
 			}
 			b.log.Infof("stdout: %s", data)
-			result.Stdout = append(result.Stdout, data...)
+			b.Streams.publish(job.Id, data)
+			scanner.Write(data)
+			if retain || retainTail {
+				result.Stdout = append(result.Stdout, data...)
+			}
+			if retainTail {
+				result.Stdout = tail(result.Stdout, MaxRecentOutputBytes)
+			}
 		}
 	}
 
+	scanner.Close()
+	for _, e := range scanner.errs {
+		b.log.Warnf("ignoring invalid follow-up directive of job %d, error: %s", job.Id, e)
+	}
+	result.FollowUps = scanner.followUps
+
 	waitC := cmd.WaitChan()
 
 waitLoop:
 	for {
 		select {
 		case wr := <-waitC:
-			timer.Stop()
-			if wr.Err == nil {
+			reaped = true
+			if wr.Err != nil {
 				err = wr.Err
 			}
+			if wr.StdinErr != nil {
+				b.log.Warnf("failed to write the body of job %d to its stdin, error: %s", job.Id, wr.StdinErr)
+			}
 			result.ExitStatus = wr.Status
+			result.SuccessMarked = wr.Status != 0 && scanner.succeeded
+			result.PermanentFailure = !result.SuccessMarked && b.permanentFailure(wr.Status, scanner.marker)
 			break waitLoop
-		case <-timer.C:
-			cmd.Terminate()
-			result.TimedOut = true
+		case <-timeout:
+			terminate()
+		case <-drain:
+			startGrace()
+		case <-grace:
+			interrupt()
 		}
 	}
 
+	if c, ok := cmd.(stderrCapturer); ok {
+		result.Stderr, result.StderrCaptured = c.Stderr(), true
+	}
 	return
 }
 
-func (b *Broker) handleResult(job bs.Job, result *JobResult) (err error) {
+// jobStats reads the stats of a job, which its tube's -skip-retry-precheck
+// saves reading. The job's tube is then only known for a broker of a single
+// tube, and its stats left zero: it is never stale, deferred for newer jobs
+// or given up on before executing.
+func (b *Broker) jobStats(job bs.Job) (bs.JobStats, error) {
+	if b.skipsPrecheck() {
+		return bs.JobStats{Tube: b.options.Prefixed(b.Tubes[0])}, nil
+	}
+	return job.Stats()
+}
+
+// release releases job with delay. As with bury, the jobs of tubes skipping
+// the retry precheck are released with DefaultPriority.
+func (b *Broker) release(job bs.Job, delay time.Duration) error {
+	if b.skipsPrecheck() {
+		return job.ReleaseWithPriority(bs.DefaultPriority, delay)
+	}
+	return job.Release(delay)
+}
+
+// skipsPrecheck reports whether the broker's tube is listed in
+// -skip-retry-precheck. Tube groups never skip it, as the stats are needed to
+// learn the job's tube.
+func (b *Broker) skipsPrecheck() bool {
+	if len(b.Tubes) != 1 {
+		return false
+	}
+	for _, t := range b.options.SkipRetryPrecheck {
+		if t == b.Tubes[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseUnparsed releases a job whose stats could not be parsed. That is a
+// problem with the one job rather than the connection, so the broker carries
+// on with the next.
+func (b *Broker) releaseUnparsed(job bs.Job, err *bs.StatsParseError) *JobResult {
+	b.log.Warnf("%s, releasing job %d", err, job.Id)
+	if e := job.Release(b.options.RequeueDelay); e != nil {
+		b.log.Errorf("failed to release job %d, error: %s", job.Id, e)
+	}
+	return &JobResult{JobId: job.Id, Error: err}
+}
+
+// deferForNewer implements -prefer-newer: a job older than the threshold,
+// reserved while other jobs are ready on its tube, is released once with its
+// priority lowered by one, so that the newer jobs queued behind it at the
+// same priority are reserved first. beanstalkd has no way to reserve the
+// newest job directly; for strict LIFO order producers must set priorities.
+// Jobs already released are left alone, so no job is deferred twice.
+func (b *Broker) deferForNewer(job bs.Job, stats bs.JobStats) bool {
+	if b.options.PreferNewer == 0 || stats.Age <= b.options.PreferNewer || stats.Releases > 0 || stats.Priority == math.MaxUint32 {
+		return false
+	}
+
+	tube, err := bs.ReadTubeStats(job.Conn(), stats.Tube)
+	if err != nil || tube.CurrentJobsReady == 0 {
+		return false
+	}
+
+	b.log.Infof("job %d is %v old with %d newer jobs ready, deferring it", job.Id, stats.Age, tube.CurrentJobsReady)
+	if err := job.ReleaseWithPriority(stats.Priority+1, 0); err != nil {
+		b.log.Errorf("failed to defer job %d, processing it now, error: %s", job.Id, err)
+		return false
+	}
+	return true
+}
+
+// RetriesKey is the packet key counting a job's retries with
+// -track-retries-in-body.
+const RetriesKey = "retries"
+
+// requeueCountingRetries re-queues a failed job as a new job whose packet has
+// its retries key incremented, for producers that track retries in the body.
+// Should that fail, the job is released as it is instead, its retries
+// counted by the server alone.
+func (b *Broker) requeueCountingRetries(job bs.Job, packet Packet, policy Policy) error {
+	r, _ := packet.Int(RetriesKey)
+	if r < 0 {
+		r = 0
+	}
+	packet[RetriesKey] = r + 1
+	delay := policy.releaseDelay(uint64(r))
+
+	body, err := packet.Encode(b.options.JobFormat)
+	if err != nil {
+		b.log.Errorf("failed to encode the retries of job %d, releasing it with %v delay, error: %s", job.Id, delay, err)
+		return job.Release(delay)
+	}
+
+	id, err := job.Replace(body, delay)
+	if err != nil && id == 0 {
+		b.noteDraining(err)
+		b.log.Errorf("failed to re-queue job %d, releasing it with %v delay, error: %s", job.Id, delay, err)
+		return job.Release(delay)
+	} else if err != nil {
+		// The new job was put, so the job is left to go back to its tube
+		// on its TTR rather than released to run twice at once.
+		b.log.Errorf("failed to delete job %d once re-queued as job %d, error: %s", job.Id, id, err)
+		return nil
+	}
+	b.log.Infof("re-queued job %d as job %d with %v delay (%d retries)", job.Id, id, delay, r+1)
+	return nil
+}
+
+// deleteWithRetry deletes a job which succeeded, retrying transient errors
+// with backoff, as a job left behind would run again once its TTR expires.
+func (b *Broker) deleteWithRetry(job bs.Job) (err error) {
+	delay := b.options.DeleteRetryBackoff
+	for try := uint64(0); ; try++ {
+		err = job.Delete()
+		if err == nil || isNotFound(err) || bs.IsConnError(err) || try >= b.options.DeleteRetries {
+			return
+		}
+		b.log.Warnf("failed to delete job %d, retrying in %v, error: %s", job.Id, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// ttrMarginOf is the margin on the TTR of the jobs of tube: its
+// -ttr-margin-override, or ttrMargin.
+func (b *Broker) ttrMarginOf(tube string) time.Duration {
+	if margin, ok := b.options.TTRMarginOverride[tube]; ok {
+		return margin
+	}
+	return ttrMargin
+}
+
+// permanentFailure reports whether a job which exited with status, having
+// printed marker, failed permanently.
+func (b *Broker) permanentFailure(status int, marker string) bool {
+	if status == 0 {
+		return false
+	}
+	if marker != "" {
+		b.log.Warnf("job stdout contains permanent failure marker %q", marker)
+		return true
+	}
+	for _, code := range b.options.PermanentExitCodes {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(beanstalk.ConnError)
+	return ok && e.Err == beanstalk.ErrNotFound
+}
+
+// retainStdout reports whether job stdout is accumulated into the JobResult.
+// With no consumer of results it would only waste memory, so it is discarded
+// unless explicitly retained.
+func (b *Broker) retainStdout() bool {
+	return b.results != nil || b.options.RetainStdout
+}
+
+func (b *Broker) handleResult(job bs.Job, packet Packet, result *JobResult, policy Policy) (err error) {
+	rlog := b.resultLog(result)
+	if policy.AtMostOnce {
+		rlog.Infof("at-most-once job %d finished with exit(%d), timed out: %t", job.Id, result.ExitStatus, result.TimedOut)
+		return
+	}
+	if result.Interrupted {
+		rlog.Infof("releasing job %d, terminated on drain", job.Id)
+		err = b.release(job, 0)
+		if err != nil && isNotFound(err) {
+			b.log.Warnf("interrupted job %d is no longer reserved, leaving it to beanstalkd", job.Id)
+			err = nil
+		}
+		return
+	}
 	if result.TimedOut {
-		b.log.Warnf("job %d timed out", job.Id)
+		rlog.Warnf("job %d timed out", job.Id)
+		switch policy.OnTimeout {
+		case OnTimeoutBury:
+			rlog.Infof("burying timed out job %d", job.Id)
+			result.Buried = true
+			err = b.bury(job)
+		case OnTimeoutDelete:
+			rlog.Infof("deleting timed out job %d", job.Id)
+			err = job.Delete()
+		default:
+			if result.WallTimeCapped {
+				rlog.Infof("releasing job %d, timed out at its tube's wall time cap", job.Id)
+				err = b.release(job, policy.releaseDelay(0))
+			}
+		}
+		if err != nil && isNotFound(err) {
+			b.log.Warnf("timed out job %d is no longer reserved, leaving it to beanstalkd", job.Id)
+			result.Buried = false
+			err = nil
+		}
 		return
 	}
-	b.log.Infof("job %d finished with exit(%d)", job.Id, result.ExitStatus)
-	switch result.ExitStatus {
-	case 0:
-		b.log.Infof("deleting job %d", job.Id)
-		err = job.Delete()
+	rlog.Infof("job %d finished with exit(%d)", job.Id, result.ExitStatus)
+	if result.SuccessMarked {
+		rlog.Infof("job %d printed the success marker, treating it as succeeding", job.Id)
+	}
+	if b.options.NoRetry {
+		if result.ExitedOK() {
+			b.putFollowUps(job, result.FollowUps)
+		}
+		rlog.Infof("deleting job %d, -no-retry is set", job.Id)
+		return b.deleteWithRetry(job)
+	}
+	switch {
+	case result.ExitedOK():
+		b.putFollowUps(job, result.FollowUps)
+		if !policy.DeleteOnSuccess {
+			// Once buried, the job's result is logged as a failure's is.
+			result.Buried = true
+			b.resultLog(result).Infof("burying successful job %d", job.Id)
+			return b.bury(job)
+		}
+		rlog.Infof("deleting job %d", job.Id)
+		err = b.deleteWithRetry(job)
 	default:
-		r, err := job.Releases()
-		if err != nil {
-			r = ReleaseTries
+		if result.StderrCaptured && len(result.Stderr) == 0 {
+			// Nothing says why the job failed, so flag it for attention.
+			silentFailures.Inc(b.Tube)
+			b.log.WithField("event", "silent_failure").Warnf("job %d exited with %d without writing to stderr", job.Id, result.ExitStatus)
+		}
+		if result.PermanentFailure {
+			rlog.Warnf("job %d failed permanently, giving up", job.Id)
+			if r := b.giveUp(job, policy, true); r != nil {
+				result.Buried, result.DeadLettered = r.Buried, r.DeadLettered
+			}
+			return
+		}
+		if packet.Bool("no_retry") {
+			rlog.Infof("deleting failed job %d, it is flagged no_retry", job.Id)
+			return job.Delete()
+		}
+		if b.options.TrackRetriesInBody {
+			return b.requeueCountingRetries(job, packet, policy)
+		}
+		// Without the precheck the releases are not read, and the job is
+		// released with the first delay of its backoff.
+		var r uint64
+		if !b.skipsPrecheck() {
+			var e error
+			if r, e = job.Releases(); e != nil {
+				r = policy.MaxReleases
+			}
 		}
-		// r*r*r*r means final of 10 tries has 1h49m21s delay, 4h15m33s total.
-		// See: http://play.golang.org/p/I15lUWoabI
-		delay := time.Duration(r*r*r*r) * time.Second
-		b.log.Infof("releasing job %d with %v delay (%d retries)", job.Id, delay, r)
-		err = job.Release(delay)
+		delay := policy.releaseDelay(r)
+		rlog.Infof("releasing job %d with %v delay (%d retries)", job.Id, delay, r)
+		err = b.release(job, delay)
 	}
 	return
 }
@@ -1,10 +1,16 @@
 package broker
 
 import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/kayako/beanstalk-broker/bs"
 	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/tracing"
 	"github.com/kr/beanstalk"
 	log "github.com/sirupsen/logrus"
 )
@@ -23,34 +29,273 @@ type BrokerDispatcher struct {
 	address string
 	conn    *beanstalk.Conn
 	perTube uint64
+
+	// tubeSet holds the tubes started, by name, so that none is started
+	// twice by polling and by being run explicitly.
+	tubeMu  sync.Mutex
 	tubeSet map[string]bool
+
 	options cli.Options
 	sync.WaitGroup
 	ret chan bool
+
+	// stopping is closed as shutdown begins, before the tubes of
+	// -drain-order are stopped and ret is closed.
+	stopping chan bool
+
+	// tubesCapped is set once -max-tubes stopped new tubes being started.
+	tubesCapped bool
+
+	// invalidTubes holds the listed tubes skipped for having names
+	// beanstalkd should not have accepted, so each is warned about once.
+	invalidTubes map[string]bool
+
+	// spawns queues the tubes discovered by polling for the spawners to
+	// start their brokers.
+	spawns spawnQueue
+
+	// startTube starts the brokers of tubes, startBrokers unless replaced
+	// by tests.
+	startTube func(tubes []string)
+
+	// started is when the dispatcher was created, for the uptime.
+	started time.Time
+
+	// errs collects the errors which stopped brokers.
+	errsMu sync.Mutex
+	errs   []string
+
+	// scaled holds the brokers of each tube started on its own, which can
+	// be scaled at runtime.
+	scaleMu  sync.Mutex
+	scaled   map[string]*scaledTube
+	draining bool
+
+	// shutdown makes Shutdown close ret only once.
+	shutdown sync.Once
+
+	// running holds the names of brokers which have not yet finished.
+	runningMu sync.Mutex
+	running   map[string]bool
+
+	// Tracer is passed on to every broker started, nil disables tracing.
+	Tracer *tracing.Tracer
+
+	// InFlight tracks the jobs being executed by every broker started.
+	InFlight *InFlight
+
+	// Floors are the priority floors of tubes, set through the admin API,
+	// enforced by every broker started.
+	Floors *PriorityFloors
+
+	// Streams passes on the stdout of every broker started, when
+	// -stream-stdout is set.
+	Streams *StdoutStreams
+
+	// Audit is passed on to every broker started, nil disables auditing.
+	Audit *AuditLog
+
+	// Statsd is passed on to every broker started, nil sends nothing.
+	Statsd *Statsd
+
+	// Recent is passed on to every broker started, nil keeps nothing.
+	Recent *RecentJobs
+
+	// Hooks are passed on to every broker started.
+	Hooks Hooks
+
+	// Health gates reserving on every broker started, nil never pauses.
+	Health *DependencyHealth
+
+	// slots caps the jobs in flight of the tubes set by -max-in-flight,
+	// across every broker started.
+	slots *TubeSlots
+
+	// persistent runs the jobs of every broker with -executor=persistent.
+	persistent *PersistentExecutor
+
+	// results receives the results of every broker, when ResultsBuffer is
+	// set.
+	results chan *JobResult
 }
 
 func NewBrokerDispatcher(o cli.Options) *BrokerDispatcher {
-	return &BrokerDispatcher{
-		address: o.Address,
-		perTube: o.PerTube,
-		tubeSet: make(map[string]bool),
-		options: o,
-		ret:     make(chan bool),
+	perTube := o.PerTube
+	if o.MaxPerTube > 0 && perTube > o.MaxPerTube {
+		log.Warnf("%d workers per tube exceeds the maximum of %d, only starting %d", perTube, o.MaxPerTube, o.MaxPerTube)
+		perTube = o.MaxPerTube
+	}
+
+	var results chan *JobResult
+	if o.ResultsBuffer > 0 {
+		results = make(chan *JobResult, o.ResultsBuffer)
 	}
+
+	var streams *StdoutStreams
+	if o.StreamStdout {
+		streams = NewStdoutStreams()
+	}
+
+	var persistent *PersistentExecutor
+	if o.Executor == ExecutorPersistent {
+		persistent = NewPersistentExecutor(o.PersistentMaxJobs, o.PHPBinary, "-c", o.PHPINI, o.PersistentScript)
+	}
+
+	var slots *TubeSlots
+	if len(o.MaxInFlight) > 0 {
+		slots = NewTubeSlots(o.MaxInFlight)
+	}
+
+	bd := &BrokerDispatcher{
+		slots:        slots,
+		persistent:   persistent,
+		Streams:      streams,
+		results:      results,
+		address:      o.Address,
+		perTube:      perTube,
+		tubeSet:      make(map[string]bool),
+		invalidTubes: make(map[string]bool),
+		scaled:       make(map[string]*scaledTube),
+		options:      o,
+		ret:          make(chan bool),
+		stopping:     make(chan bool),
+		started:      time.Now(),
+		running:      make(map[string]bool),
+		InFlight:     NewInFlight(),
+		Floors:       NewPriorityFloors(),
+		spawns:       spawnQueue{ready: make(chan bool, 1)},
+	}
+	bd.startTube = bd.startBrokers
+	return bd
 }
 
-// Shutdown finishes all active jobs and shuts down the listener
+// Shutdown finishes all active jobs and shuts down the listener. The tubes
+// listed in -drain-order are stopped first, one after the other, each once
+// the previous has finished its jobs; then everything else is stopped.
+// Calls after the first do nothing.
 func (bd *BrokerDispatcher) Shutdown() {
-	close(bd.ret)
+	bd.shutdown.Do(bd.beginShutdown)
+}
+
+func (bd *BrokerDispatcher) beginShutdown() {
+	bd.scaleMu.Lock()
+	bd.draining = true
+	bd.scaleMu.Unlock()
+	close(bd.stopping)
+
+	go func() {
+		defer func() {
+			if bd.persistent != nil {
+				bd.Wait()
+				bd.persistent.Close()
+			}
+		}()
+		for _, tube := range bd.options.DrainOrder {
+			if _, ok := bd.scaledTubes()[tube]; !ok {
+				continue
+			}
+			log.Infof("draining tube %s", tube)
+			bd.drainTube(tube)
+		}
+		close(bd.ret)
+	}()
+}
+
+// WaitWithTimeout waits for all brokers to finish, as Wait does, but gives up
+// after d. The returned error names the brokers that are still running.
+func (bd *BrokerDispatcher) WaitWithTimeout(d time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		bd.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(d):
+		return fmt.Errorf("brokers still running after %v: %s", d, strings.Join(bd.runningBrokers(), ", "))
+	}
+}
+
+// Results returns the channel the results of every job processed are sent
+// to, buffering up to Options.ResultsBuffer of them, or nil if results are
+// not collected. When it is full, Options.ResultsOverflow decides whether
+// brokers wait or results are dropped.
+func (bd *BrokerDispatcher) Results() <-chan *JobResult {
+	return bd.results
+}
+
+// Err returns an error describing every broker which stopped on a fatal
+// error, such as exhausting its reconnect attempts, or nil if none did.
+func (bd *BrokerDispatcher) Err() error {
+	bd.errsMu.Lock()
+	defer bd.errsMu.Unlock()
+
+	if len(bd.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d broker(s) failed: %s", len(bd.errs), strings.Join(bd.errs, "; "))
+}
+
+func (bd *BrokerDispatcher) runningBrokers() []string {
+	bd.runningMu.Lock()
+	defer bd.runningMu.Unlock()
+
+	names := make([]string, 0, len(bd.running))
+	for name := range bd.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // RunTube runs broker(s) for the specified tube.
 // The number of brokers started is determined by the perTube argument to
 // NewBrokerDispatcher.
+// Running a tube already started, alone or by polling, does nothing.
 func (bd *BrokerDispatcher) RunTube(tube string) {
+	if !bd.claimTube(tube) {
+		return
+	}
+	bd.startTube([]string{tube})
+}
+
+// RunTubeGroup runs broker(s) that each service all of the specified tubes,
+// reserving from them in round-robin order.
+// The number of brokers started is determined by the perTube argument to
+// NewBrokerDispatcher.
+func (bd *BrokerDispatcher) RunTubeGroup(tubes []string) {
+	for _, tube := range tubes {
+		bd.claimTube(tube)
+	}
+	bd.startTube(tubes)
+}
+
+// claimTube marks tube as started, reporting false if it already was.
+func (bd *BrokerDispatcher) claimTube(tube string) bool {
+	bd.tubeMu.Lock()
+	defer bd.tubeMu.Unlock()
+	if bd.tubeSet[tube] {
+		return false
+	}
 	bd.tubeSet[tube] = true
+	return true
+}
+
+// startBrokers runs perTube brokers for tubes, or in shared reserve mode a
+// single broker with perTube workers.
+func (bd *BrokerDispatcher) startBrokers(tubes []string) {
+	if bd.options.SharedReserve {
+		bd.runBroker(tubes, 0, int(bd.perTube), nil, nil)
+		return
+	}
+	if len(tubes) == 1 {
+		bd.scaleTube(tubes[0], int(bd.perTube))
+		return
+	}
 	for i := uint64(0); i < bd.perTube; i++ {
-		bd.runBroker(tube, i)
+		bd.runBroker(tubes, i, 1, nil, nil)
 	}
 }
 
@@ -62,17 +307,23 @@ func (bd *BrokerDispatcher) RunTubes(tubes []string) {
 }
 
 // RunAllTubes polls beanstalkd, running broker as new tubes are created.
+// The brokers of new tubes are started in the background by -spawn-workers
+// spawners, so polling carries on however many tubes appear at once. The
+// poller counts towards Wait until shutdown, so that waiting does not return
+// before the first tube is discovered.
 func (bd *BrokerDispatcher) RunAllTubes() (err error) {
-	conn, err := beanstalk.Dial("tcp", bd.address)
+	nc, err := dial(bd.options)
 	if err == nil {
-		bd.conn = conn
+		bd.conn = beanstalk.NewConn(nc)
 	} else {
 		return
 	}
 
+	bd.Add(1)
 	go func() {
-		ticker := instantTicker(ListTubeDelay)
-		for _ = range ticker {
+		defer bd.Done()
+		defer bd.conn.Close()
+		for _ = range instantTicker(ListTubeDelay, bd.options.PollJitter, rand.Int63n, bd.ret) {
 			if e := bd.watchNewTubes(); e != nil {
 				log.Error(e)
 			}
@@ -82,29 +333,107 @@ func (bd *BrokerDispatcher) RunAllTubes() (err error) {
 	return
 }
 
-func (bd *BrokerDispatcher) runBroker(tube string, slot uint64) {
+// RunServerStats polls the server-wide stats of beanstalkd every interval,
+// exporting them as metrics, until shutdown.
+func (bd *BrokerDispatcher) RunServerStats(interval time.Duration) (err error) {
+	nc, err := dial(bd.options)
+	if err != nil {
+		return
+	}
+	conn := beanstalk.NewConn(nc)
+
+	go func() {
+		defer conn.Close()
+		for _ = range instantTicker(interval, bd.options.PollJitter, rand.Int63n, bd.ret) {
+			s, err := bs.ReadServerStats(conn)
+			if err != nil {
+				log.Errorf("failed to read server stats, error: %s", err)
+				continue
+			}
+			exportServerStats(s)
+		}
+	}()
+
+	return
+}
+
+// RunDependencyHealth polls check every interval until shutdown, pausing
+// reserving on every broker while it fails. It must be called before any
+// broker is started.
+func (bd *BrokerDispatcher) RunDependencyHealth(check HealthChecker, interval time.Duration) {
+	bd.Health = NewDependencyHealth(check)
+	go bd.Health.Poll(interval, bd.ret)
+}
+
+// runBroker starts a broker, which runs until shutdown or until stop, which
+// may be nil, is closed. done, if not nil, is called once it has finished.
+func (bd *BrokerDispatcher) runBroker(tubes []string, slot uint64, workers int, stop <-chan bool, done func()) {
 	ticker := make(chan bool)
+	name := fmt.Sprintf("%s/%d", strings.Join(tubes, ","), slot)
+
+	quit := make(chan bool)
+	go func() {
+		select {
+		case <-bd.ret:
+		case <-stop:
+		}
+		close(quit)
+	}()
+
+	bd.runningMu.Lock()
+	bd.running[name] = true
+	bd.runningMu.Unlock()
 	bd.Add(1)
 
 	go func() {
-		b := New(bd.options, tube, slot, nil)
-		b.Run(ticker, bd.Done)
+		b := NewGroup(bd.options, tubes, slot, bd.results)
+		b.Tracer = bd.Tracer
+		b.InFlight = bd.InFlight
+		b.Floors = bd.Floors
+		b.Streams = bd.Streams
+		b.Audit = bd.Audit
+		b.Health = bd.Health
+		b.Statsd = bd.Statsd
+		b.Recent = bd.Recent
+		b.Hooks = bd.Hooks
+		b.Slots = bd.slots
+		if bd.persistent != nil {
+			b.Execute = bd.persistent.Execute
+		}
+		b.drain = quit
+		b.shutdown = bd.stopping
+		b.fatal = func(err error) {
+			b.log.Error(err)
+			bd.errsMu.Lock()
+			bd.errs = append(bd.errs, fmt.Sprintf("%s: %s", name, err))
+			bd.errsMu.Unlock()
+		}
+		fin := func() {
+			bd.runningMu.Lock()
+			delete(bd.running, name)
+			bd.runningMu.Unlock()
+			if done != nil {
+				done()
+			}
+			bd.Done()
+		}
+		if workers > 1 {
+			b.RunShared(ticker, fin, workers)
+		} else {
+			b.Run(ticker, fin)
+		}
 	}()
 
-	end := false
 	go func() {
+		defer close(ticker)
 		for {
-			if end {
+			select {
+			case ticker <- true:
+			case <-quit:
 				return
 			}
-
-			ticker <- true
 		}
 	}()
-
-	<-bd.ret
-	end = true
-	close(ticker)
 }
 
 func (bd *BrokerDispatcher) watchNewTubes() (err error) {
@@ -113,23 +442,69 @@ func (bd *BrokerDispatcher) watchNewTubes() (err error) {
 		return
 	}
 
+	bd.tubeMu.Lock()
+	defer bd.tubeMu.Unlock()
+
+	started := 0
 	for _, tube := range tubes {
-		if !bd.tubeSet[tube] {
-			bd.RunTube(tube)
+		if err := cli.CheckTubeName(tube); err != nil {
+			if !bd.invalidTubes[tube] {
+				log.Warnf("not watching listed tube, %s", err)
+				bd.invalidTubes[tube] = true
+			}
+			continue
+		}
+		tube, ok := bd.options.Unprefixed(tube)
+		if !ok || bd.tubeSet[tube] {
+			continue
+		}
+		if max := bd.options.MaxTubes; max > 0 && len(bd.tubeSet) >= max {
+			if !bd.tubesCapped {
+				log.Warnf("watching the maximum of %d tubes, not starting any more", max)
+				bd.tubesCapped = true
+			}
+			break
 		}
+		if max := bd.options.MaxNewTubesPerCycle; max > 0 && started >= max {
+			log.Warnf("started %d new tubes this cycle, deferring the rest to the next", started)
+			break
+		}
+		bd.tubeSet[tube] = true
+		bd.spawn(tube)
+		started++
 	}
 
 	return
 }
 
-// Like time.Tick() but also fires immediately.
-func instantTicker(t time.Duration) <-chan time.Time {
+// Like time.Tick() but also fires immediately. With jitter, every fire,
+// including the first, is delayed by a random duration up to jitter, drawn
+// with randn, so that instances started together don't poll beanstalkd in
+// lockstep. The channel is closed once stop is.
+func instantTicker(t, jitter time.Duration, randn func(int64) int64, stop <-chan bool) <-chan time.Time {
 	c := make(chan time.Time)
-	ticker := time.NewTicker(t)
 	go func() {
-		c <- time.Now()
-		for t := range ticker.C {
-			c <- t
+		defer close(c)
+		wait := func(d time.Duration) bool {
+			if jitter > 0 {
+				d += time.Duration(randn(int64(jitter)))
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+
+		for d := time.Duration(0); wait(d); d = t {
+			select {
+			case c <- time.Now():
+			case <-stop:
+				return
+			}
 		}
 	}()
 	return c
@@ -0,0 +1,517 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kr/beanstalk"
+)
+
+func TestPerTubeClampedToMaxPerTube(t *testing.T) {
+	tests := []struct {
+		perTube, maxPerTube, want uint64
+	}{
+		{4, 256, 4},
+		{256, 256, 256},
+		{100000, 256, 256},
+		{100000, 0, 100000},
+	}
+	for _, tt := range tests {
+		bd := NewBrokerDispatcher(cli.Options{PerTube: tt.perTube, MaxPerTube: tt.maxPerTube})
+		if bd.perTube != tt.want {
+			t.Errorf("-per-tube=%d -max-per-tube=%d started %d workers per tube, want %d", tt.perTube, tt.maxPerTube, bd.perTube, tt.want)
+		}
+	}
+}
+
+func TestWaitWithTimeout(t *testing.T) {
+	bd := NewBrokerDispatcher(cli.Options{})
+
+	// A broker stuck on its job.
+	bd.running["jobs/0"] = true
+	bd.Add(1)
+
+	start := time.Now()
+	err := bd.WaitWithTimeout(50 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "jobs/0") {
+		t.Errorf("error %v, want it to name the stuck broker", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for a 50ms timeout", waited)
+	}
+
+	delete(bd.running, "jobs/0")
+	bd.Done()
+	if err := bd.WaitWithTimeout(time.Second); err != nil {
+		t.Errorf("error %v once every broker finished", err)
+	}
+}
+
+// watchingDispatcher creates a dispatcher of all tubes on s, connected as
+// RunAllTubes does but starting no brokers for the tubes it discovers.
+func watchingDispatcher(s *fakeServer, o cli.Options) *BrokerDispatcher {
+	s.t.Helper()
+	o.PerTube = 0
+	bd := NewBrokerDispatcher(o)
+	nc, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	bd.conn = beanstalk.NewConn(nc)
+	s.t.Cleanup(func() { bd.conn.Close() })
+	return bd
+}
+
+func TestRunAllTubesUntilShutdown(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.All = true
+	bd := NewBrokerDispatcher(o)
+	bd.startTube = func([]string) {}
+	if err := bd.RunAllTubes(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting lasts until shutdown, although no broker has started.
+	if err := bd.WaitWithTimeout(100 * time.Millisecond); err == nil {
+		t.Fatal("waiting returned before shutdown")
+	}
+	bd.Shutdown()
+	if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxNewTubesPerCycle(t *testing.T) {
+	s := newFakeServer(t)
+	for i := 0; i < 10; i++ {
+		s.put(fmt.Sprintf("tube-%d", i), 100, time.Minute, "x")
+	}
+	o := s.options()
+	o.All = true
+	o.MaxNewTubesPerCycle = 3
+	bd := watchingDispatcher(s, o)
+
+	for cycle, want := range []int{3, 6, 9, 11} {
+		if err := bd.watchNewTubes(); err != nil {
+			t.Fatal(err)
+		}
+		// The default tube is listed too.
+		if got := len(bd.tubeSet); got != want {
+			t.Errorf("cycle %d: %d tubes started, want %d", cycle, got, want)
+		}
+	}
+}
+
+func TestMaxTubes(t *testing.T) {
+	s := newFakeServer(t)
+	for i := 0; i < 10; i++ {
+		s.put(fmt.Sprintf("tube-%d", i), 100, time.Minute, "x")
+	}
+	o := s.options()
+	o.All = true
+	o.MaxTubes = 4
+	o.MaxNewTubesPerCycle = 3
+	bd := watchingDispatcher(s, o)
+
+	for cycle, want := range []int{3, 4, 4} {
+		if err := bd.watchNewTubes(); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(bd.tubeSet); got != want {
+			t.Errorf("cycle %d: %d tubes started, want %d", cycle, got, want)
+		}
+	}
+
+	// Tubes created later are not started either.
+	s.put("late", 100, time.Minute, "x")
+	if err := bd.watchNewTubes(); err != nil {
+		t.Fatal(err)
+	}
+	if bd.tubeSet["late"] || len(bd.tubeSet) != 4 {
+		t.Errorf("%d tubes started, want no more than 4", len(bd.tubeSet))
+	}
+}
+
+func TestDiscoverySpawnsInBackground(t *testing.T) {
+	s := newFakeServer(t)
+	const tubes = 50
+	for i := 0; i < tubes; i++ {
+		s.put(fmt.Sprintf("tube-%d", i), 100, time.Minute, "x")
+	}
+	o := s.options()
+	o.All = true
+	o.SpawnWorkers = 3
+	bd := watchingDispatcher(s, o)
+
+	// Starting a tube's brokers is slow, but only holds up the spawners.
+	var mu sync.Mutex
+	started, busy, most := 0, 0, 0
+	bd.startTube = func(tubes []string) {
+		mu.Lock()
+		busy++
+		if busy > most {
+			most = busy
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		busy--
+		started++
+		mu.Unlock()
+	}
+
+	begin := time.Now()
+	if err := bd.watchNewTubes(); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(begin); took > 100*time.Millisecond {
+		t.Errorf("discovering %d tubes took %v, want the poller not held up by spawning", tubes, took)
+	}
+
+	// The default tube is listed too.
+	waitFor(t, "every discovered tube started", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return started == tubes+1
+	})
+	if most > o.SpawnWorkers {
+		t.Errorf("%d tubes started at once, want at most %d", most, o.SpawnWorkers)
+	}
+	bd.Shutdown()
+	if err := bd.WaitWithTimeout(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTubesStartedOnce(t *testing.T) {
+	s := newFakeServer(t)
+	const tubes = 20
+	for i := 0; i < tubes; i++ {
+		s.put(fmt.Sprintf("tube-%d", i), 100, time.Minute, "x")
+	}
+	o := s.options()
+	o.All = true
+	bd := watchingDispatcher(s, o)
+
+	var mu sync.Mutex
+	starts := make(map[string]int)
+	bd.startTube = func(tubes []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		starts[strings.Join(tubes, ",")]++
+	}
+
+	// Tubes run explicitly while polling discovers the same ones.
+	var wg sync.WaitGroup
+	for i := 0; i < tubes; i++ {
+		wg.Add(1)
+		go func(tube string) {
+			defer wg.Done()
+			bd.RunTube(tube)
+		}(fmt.Sprintf("tube-%d", i))
+	}
+	for cycle := 0; cycle < 3; cycle++ {
+		if err := bd.watchNewTubes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	// The default tube is listed too.
+	waitFor(t, "every tube started", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(starts) == tubes+1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for tube, n := range starts {
+		if n != 1 {
+			t.Errorf("tube %s started %d times, want once", tube, n)
+		}
+	}
+	bd.Shutdown()
+}
+
+func TestConcurrentRunTube(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	// In shared reserve mode every start runs another broker, so a tube
+	// started twice would be watched twice.
+	o.SharedReserve = true
+	o.PerTube = 2
+	bd := NewBrokerDispatcher(o)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bd.RunTube("jobs")
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "the broker to watch the tube", func() bool { return s.count("watch") > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := s.count("watch"); n != 1 {
+		t.Errorf("tube watched %d times, want it started once", n)
+	}
+
+	bd.Shutdown()
+	if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTubePrefix(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.All = true
+	o.TubePrefix = "tenantA_"
+	o.Routes = cli.RoutingTable{
+		{PolicyRule: cli.PolicyRule{Tube: "email"}, Controller: "/Email/Send"},
+	}
+	s.put("tenantA_email", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	s.put("tenantB_email", 100, time.Minute, "x")
+
+	// Only the tenant's tubes are discovered, and named without the prefix.
+	bd := watchingDispatcher(s, o)
+	if err := bd.watchNewTubes(); err != nil {
+		t.Fatal(err)
+	}
+	var tubes []string
+	for tube := range bd.tubeSet {
+		tubes = append(tubes, tube)
+	}
+	if len(tubes) != 1 || tubes[0] != "email" {
+		t.Fatalf("started tubes %q, want the unprefixed email tube", tubes)
+	}
+
+	// Its broker watches the prefixed tube, and routes on the stripped name.
+	e := &fakeExecutor{}
+	runJobs(testBroker(o, e, "email"), 1)
+	if got := e.commandLines(); len(got) != 1 || !strings.HasSuffix(got[0], " /Email/Send") {
+		t.Errorf("executed %q, want the email route's controller", got)
+	}
+	if n := s.count("watch"); n != 1 {
+		t.Errorf("%d watches, want 1", n)
+	}
+	if got := s.commands(); !strings.Contains(strings.Join(got, "\n"), "watch tenantA_email") {
+		t.Errorf("the broker did not watch the prefixed tube, sent %q", got)
+	}
+}
+
+func TestInstantTickerJitter(t *testing.T) {
+	const jitter = 200 * time.Millisecond
+	want := time.Duration(rand.New(rand.NewSource(7)).Int63n(int64(jitter)))
+
+	stop := make(chan bool)
+	start := time.Now()
+	ticker := instantTicker(time.Hour, jitter, rand.New(rand.NewSource(7)).Int63n, stop)
+	<-ticker
+	if took := time.Since(start); took < want || took > jitter+50*time.Millisecond {
+		t.Errorf("first fire after %v, want %v, within %v", took, want, jitter)
+	}
+
+	// The ticker stops with the dispatcher.
+	close(stop)
+	select {
+	case _, ok := <-ticker:
+		if ok {
+			t.Error("fired after stop")
+		}
+	case <-time.After(time.Second):
+		t.Error("not closed after stop")
+	}
+}
+
+func TestInstantTickerFiresImmediately(t *testing.T) {
+	stop := make(chan bool)
+	defer close(stop)
+	randn := func(int64) int64 { t.Fatal("drew a jitter"); return 0 }
+	ticker := instantTicker(30*time.Millisecond, 0, randn, stop)
+
+	start := time.Now()
+	<-ticker
+	if took := time.Since(start); took > 20*time.Millisecond {
+		t.Errorf("first fire after %v, want it immediate", took)
+	}
+	<-ticker
+	if took := time.Since(start); took < 30*time.Millisecond {
+		t.Errorf("second fire after %v, want the interval", took)
+	}
+}
+
+func TestDrainOrder(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "worker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newFakeServer(t)
+	o := s.options()
+	o.ClusterRoot = dir
+	o.DrainOrder = cli.TubeList{"first", "second"}
+	// A stand-in for php, running the job of the second tube longest.
+	o.PHPBinary = hookScript(t, dir, `case "$(cat)" in *slow*) sleep 0.6;; *) sleep 0.3;; esac`+"\n")
+	bd := NewBrokerDispatcher(o)
+
+	packet := domainPacket("cluster")
+	first := s.put("first", 100, time.Minute, phpPacket(t, packet))
+	packet["note"] = "slow"
+	second := s.put("second", 100, time.Minute, phpPacket(t, packet))
+	for _, tube := range []string{"last", "second", "first"} {
+		bd.RunTube(tube)
+	}
+	waitFor(t, "both jobs to be reserved", func() bool {
+		return s.state(first) == "reserved" && s.state(second) == "reserved"
+	})
+	bd.Shutdown()
+
+	// A tube is stopped only once those before it in the drain order have
+	// finished, and the unlisted tubes last.
+	order := []string{"first/0", "second/0", "last/0"}
+	var seen []string
+	waitFor(t, "the brokers to stop", func() bool {
+		running := strings.Join(bd.runningBrokers(), " ")
+		for i, name := range order {
+			if strings.Contains(running, name) {
+				continue
+			}
+			for _, earlier := range order[:i] {
+				if strings.Contains(running, earlier) {
+					t.Fatalf("%s stopped before %s", name, earlier)
+				}
+			}
+		}
+		if len(seen) == 0 || seen[len(seen)-1] != running {
+			seen = append(seen, running)
+		}
+		return running == ""
+	})
+	if want := "last/0 second/0"; !strings.Contains(strings.Join(seen, ","), want) {
+		t.Errorf("running brokers went %q, want the first tube stopped alone", seen)
+	}
+	if n := s.count("delete"); n != 2 {
+		t.Errorf("%d jobs deleted, want both finished", n)
+	}
+}
+
+func TestDrainOrderJobGrace(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "worker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := newFakeServer(t)
+	o := s.options()
+	o.ClusterRoot = dir
+	o.DrainOrder = cli.TubeList{"first"}
+	o.DrainJobGrace = 700 * time.Millisecond
+	o.PHPBinary = hookScript(t, dir, `case "$(cat)" in *slow*) sleep 1;; *) sleep 0.5;; esac`+"\n")
+	bd := NewBrokerDispatcher(o)
+
+	packet := domainPacket("cluster")
+	first := s.put("first", 100, time.Minute, phpPacket(t, packet))
+	packet["note"] = "slow"
+	last := s.put("last", 100, time.Minute, phpPacket(t, packet))
+	bd.RunTube("first")
+	bd.RunTube("last")
+	waitFor(t, "both jobs to be reserved", func() bool {
+		return s.state(first) == "reserved" && s.state(last) == "reserved"
+	})
+	bd.Shutdown()
+
+	// The last tube is stopped once the first has finished its job, which
+	// is when its job's grace begins, so it outlasts the grace counted from
+	// shutdown.
+	if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{first, last} {
+		if got := s.state(id); got != "deleted" {
+			t.Errorf("job %d is %s, want it finished within the grace", id, got)
+		}
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s := newFakeServer(t)
+	bd := NewBrokerDispatcher(s.options())
+	bd.RunTube("email")
+	waitFor(t, "the broker to start", func() bool { return len(bd.runningBrokers()) == 1 })
+
+	bd.Shutdown()
+	bd.Shutdown()
+	if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	bd.Shutdown()
+}
+
+func TestMaxInFlight(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		s := newFakeServer(t)
+		o := s.options()
+		o.PerTube = 4
+		o.SharedReserve = shared
+		o.MaxInFlight = cli.TubeInts{"slow": 2}
+		o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; /bin/sleep 0.2")
+		var ids []uint64
+		for i := 0; i < 6; i++ {
+			ids = append(ids, s.putPacket("slow", domainPacket("acme")))
+		}
+		bd := NewBrokerDispatcher(o)
+		bd.RunTube("slow")
+
+		most := 0
+		waitFor(t, "the jobs to finish", func() bool {
+			if n := len(bd.InFlight.Jobs()); n > most {
+				most = n
+			}
+			for _, id := range ids {
+				if s.state(id) != "deleted" {
+					return false
+				}
+			}
+			return true
+		})
+		if most != 2 {
+			t.Errorf("shared reserve %t: at most %d jobs in flight, want 2", shared, most)
+		}
+		bd.Shutdown()
+		if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInvalidTubeNamesSkipped(t *testing.T) {
+	s := newFakeServer(t)
+	s.put("emails", 100, time.Minute, "x")
+	s.put(strings.Repeat("a", cli.MaxTubeNameLength+1), 100, time.Minute, "x")
+	s.put("sms!", 100, time.Minute, "x")
+	o := s.options()
+	o.All = true
+	bd := watchingDispatcher(s, o)
+
+	for cycle := 0; cycle < 2; cycle++ {
+		if err := bd.watchNewTubes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bd.tubeSet["emails"] || len(bd.tubeSet) != 2 {
+		t.Errorf("started tubes %v, want only default and emails", bd.tubeSet)
+	}
+	if len(bd.invalidTubes) != 2 {
+		t.Errorf("skipped %d tubes, want 2", len(bd.invalidTubes))
+	}
+}
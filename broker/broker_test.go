@@ -0,0 +1,1640 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSpawnFailureReleasesJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PHPBinary = filepath.Join(t.TempDir(), "missing")
+	b, next := s.startBroker(o, "jobs")
+
+	before := spawnFailures.Value("jobs")
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	result := next()
+
+	if _, ok := result.Error.(spawnError); !ok {
+		t.Fatalf("result error = %v, want a spawnError", result.Error)
+	}
+	if result.Buried {
+		t.Error("job was buried, want it released")
+	}
+	if got := s.state(id); got != "ready" {
+		t.Errorf("job is %s, want it released to ready", got)
+	}
+	if got := spawnFailures.Value("jobs") - before; got != 1 {
+		t.Errorf("spawn_failures_total rose by %v, want 1", got)
+	}
+
+	// The broker carries on with the job once its worker starts.
+	b.options.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exit 0")
+	result = next()
+	if result.JobId != id || result.Error != nil || result.ExitStatus != 0 {
+		t.Fatalf("retry of job %d: job %d, exit %d, error %v", id, result.JobId, result.ExitStatus, result.Error)
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it deleted", got)
+	}
+}
+
+func TestSpawnFailureOfGroupJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PHPBinary = filepath.Join(t.TempDir(), "missing")
+	_, next := s.startBroker(o, "spawning-a", "spawning-b")
+
+	// The failure is counted under the tube the job was reserved from.
+	before := spawnFailures.Value("spawning-b")
+	s.putPacket("spawning-b", domainPacket("acme"))
+	next()
+	if got := spawnFailures.Value("spawning-b") - before; got != 1 {
+		t.Errorf("spawn_failures_total of spawning-b rose by %v, want 1", got)
+	}
+	if got := spawnFailures.Value("spawning-a,spawning-b"); got != 0 {
+		t.Errorf("spawn_failures_total of the group is %v, want none", got)
+	}
+}
+
+func TestTubeGroupServesTubesEvenly(t *testing.T) {
+	s := newFakeServer(t)
+	tubes := map[uint64]string{}
+	for _, tube := range []string{"busy", "quiet"} {
+		for i := 0; i < 10; i++ {
+			tubes[s.put(tube, 100, time.Minute, phpPacket(t, domainPacket("acme")))] = tube
+		}
+	}
+
+	_, next := s.startBroker(s.options(), "busy", "quiet")
+	var order []string
+	for i := 0; i < 10; i++ {
+		order = append(order, tubes[next().JobId])
+	}
+
+	served := map[string]int{}
+	for _, tube := range order {
+		served[tube]++
+	}
+	if served["busy"] != 5 || served["quiet"] != 5 {
+		t.Errorf("served %v in order %v, want the tubes served alternately", served, order)
+	}
+}
+
+func TestDefaultTubeIgnored(t *testing.T) {
+	s := newFakeServer(t)
+	// The job of the default tube is older, so would be reserved first.
+	other := s.put(DefaultTube, 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	own := s.put("emails", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+
+	o := s.options()
+	runJobs(testBroker(o, &fakeExecutor{}, "emails"), 1)
+	if got := s.state(other); got != "ready" {
+		t.Errorf("job of the default tube is %s, want it left ready", got)
+	}
+	if got := s.state(own); got != "deleted" {
+		t.Errorf("job of the broker's tube is %s, want it processed", got)
+	}
+
+	// With -watch-default, the default tube is served as well.
+	o.WatchDefault = true
+	runJobs(testBroker(o, &fakeExecutor{}, "emails"), 1)
+	if got := s.state(other); got != "deleted" {
+		t.Errorf("job of the default tube is %s with -watch-default, want it processed", got)
+	}
+}
+
+func TestMalformedStatsReleaseJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+
+	malformed := s.put("jobs", 1, time.Minute, phpPacket(t, domainPacket("acme")))
+	next := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	s.hook("stats-job", func(args []string) string {
+		if args[0] != strconv.FormatUint(malformed, 10) {
+			return ""
+		}
+		return yamlDict(map[string]string{"id": args[0], "tube": "jobs", "state": "reserved", "pri": "urgent"})
+	})
+	_, result := s.startBroker(o, "jobs")
+
+	r := result()
+	if _, ok := r.Error.(*bs.StatsParseError); !ok || r.JobId != malformed || r.Executed {
+		t.Fatalf("job %d, executed %t, error %v, want job %d released on a StatsParseError", r.JobId, r.Executed, r.Error, malformed)
+	}
+	j, _ := s.job(malformed)
+	if j.state != "ready" || j.pri != bs.DefaultPriority {
+		t.Errorf("job is %s with priority %d, want it released with priority %d", j.state, j.pri, bs.DefaultPriority)
+	}
+
+	// The broker carries on with the next job.
+	if r := result(); r.JobId != next || !r.Executed || r.ExitStatus != 0 {
+		t.Errorf("job %d, executed %t, exit(%d), want job %d executed", r.JobId, r.Executed, r.ExitStatus, next)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("%d workers started, want 1", n)
+	}
+}
+
+func TestMaxJobAge(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.MaxJobAge = time.Hour
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+
+	stale := s.put("jobs", 1, time.Minute, phpPacket(t, domainPacket("acme")))
+	s.backdate(stale, 2*time.Hour)
+	fresh := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	_, next := s.startBroker(o, "jobs")
+
+	result := next()
+	if result.JobId != stale || !result.Stale || result.Executed {
+		t.Errorf("stale job: job %d, stale %t, executed %t, want job %d skipped", result.JobId, result.Stale, result.Executed, stale)
+	}
+	if got := s.state(stale); got != "deleted" {
+		t.Errorf("stale job is %s, want it deleted", got)
+	}
+	if n := runs(); n != 0 {
+		t.Fatalf("%d workers started for the stale job, want none", n)
+	}
+
+	result = next()
+	if result.JobId != fresh || result.Stale || !result.Executed {
+		t.Errorf("fresh job: job %d, stale %t, executed %t, want job %d executed", result.JobId, result.Stale, result.Executed, fresh)
+	}
+	if got := s.state(fresh); got != "deleted" {
+		t.Errorf("fresh job is %s, want it deleted once done", got)
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("%d workers started, want 1 for the fresh job", n)
+	}
+}
+
+func TestCustomWorkDirResolver(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	out := filepath.Join(t.TempDir(), "pwd")
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; /bin/pwd >"+out)
+	custom := t.TempDir()
+
+	var called int
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	b, next := s.startBroker(o, "jobs")
+	b.ResolveWorkDir = func(o cli.Options, job bs.Job, packet Packet) (string, error) {
+		called++
+		return custom, nil
+	}
+	if result := next(); result.JobId != id || !result.Executed {
+		t.Fatalf("job %d, executed %t, want job %d executed", result.JobId, result.Executed, id)
+	}
+
+	if called != 1 {
+		t.Errorf("resolver called %d times, want once", called)
+	}
+	if wd, err := os.ReadFile(out); err != nil || strings.TrimSpace(string(wd)) != custom {
+		t.Errorf("worker ran in %q, error %v, want %s", wd, err, custom)
+	}
+}
+
+func TestGetJobWD(t *testing.T) {
+	o := cli.Options{InstanceRoot: "/var/www/html", ClusterRoot: "/opt/cluster"}
+	tests := []struct {
+		domain interface{}
+		want   string
+		err    bool
+	}{
+		{"acme", "/var/www/html/acme/worker", false},
+		{"Cluster", "/opt/cluster/worker", false},
+		{"..", "", true},
+		{"acme/../../etc", "", true},
+		{42, "", true},
+	}
+	for _, tt := range tests {
+		wd, err := getJobWD(o, bs.Job{}, Packet{"domain": tt.domain})
+		if wd != tt.want || (err != nil) != tt.err {
+			t.Errorf("domain %v: got %q, error %v, want %q", tt.domain, wd, err, tt.want)
+		}
+	}
+	if _, err := getJobWD(o, bs.Job{}, Packet{}); err == nil {
+		t.Error("a packet without a domain was routed")
+	}
+}
+
+func TestTracerRecordsSpanPerJob(t *testing.T) {
+	s := newFakeServer(t)
+	exporter := &tracing.MemoryExporter{}
+
+	packet := domainPacket("acme")
+	packet["traceparent"] = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	first := s.put("jobs", 100, time.Minute, phpPacket(t, packet))
+	second := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	b, next := s.startBroker(s.options(), "jobs")
+	b.Tracer = tracing.NewTracerWithExporter(exporter)
+	next()
+	b.options.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exit 2")
+	next()
+	b.Tracer.Close()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want one per job", len(spans))
+	}
+	for i, id := range []uint64{first, second} {
+		if got, _ := spans[i].Attribute("beanstalk.job_id"); got != id {
+			t.Errorf("span %d is of job %v, want %d", i, got, id)
+		}
+		if spans[i].Name() != "jobs /Core/Job/Console" {
+			t.Errorf("span %d is named %q", i, spans[i].Name())
+		}
+	}
+	if spans[0].TraceID() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("span of the first job is in trace %s, want the packet's", spans[0].TraceID())
+	}
+	if status, _ := spans[1].Attribute("process.exit_code"); status != 2 || !spans[1].Failed() {
+		t.Errorf("span of the failed job has exit code %v, failed %t", status, spans[1].Failed())
+	}
+}
+
+func TestTracerSpanOfGroupJob(t *testing.T) {
+	s := newFakeServer(t)
+	exporter := &tracing.MemoryExporter{}
+	s.putPacket("mail", domainPacket("acme"))
+	b := testBroker(s.options(), &fakeExecutor{}, "reports", "mail")
+	b.Tracer = tracing.NewTracerWithExporter(exporter)
+	runJobs(b, 1)
+	b.Tracer.Close()
+
+	// The span is of the tube the job was reserved from, not the group.
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans, want one", len(spans))
+	}
+	if spans[0].Name() != "mail /Core/Job/Console" {
+		t.Errorf("span is named %q", spans[0].Name())
+	}
+	if got, _ := spans[0].Attribute("beanstalk.tube"); got != "mail" {
+		t.Errorf("span is of tube %v, want mail", got)
+	}
+}
+
+func TestExecuteJobTimer(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+
+		// With a TTR of a second, time-left is reported as 0s, so the
+		// timer fires after the one second margin. Terminations are only
+		// counted by the scripts trapping SIGTERM, -1 skips the check.
+		timedOut     bool
+		terminations int
+		status       int
+	}{
+		{"completes in time", "/bin/cat >/dev/null; exit 3", false, 0, 3},
+		{"times out", "/bin/cat >/dev/null; exec /bin/sleep 60", true, -1, -1},
+		{"completes late", "/bin/cat >/dev/null; /bin/sleep 1.5; exit 4", true, 1, 4},
+		{"output after timeout", "/bin/cat >/dev/null; /bin/sleep 1.5; echo working", true, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			terms := filepath.Join(t.TempDir(), "terms")
+			o.PHPBinary = fakePHP(t, "trap 'echo term >>"+terms+"' TERM\n"+tt.script)
+			s.put("jobs", 100, time.Second, phpPacket(t, domainPacket("acme")))
+			_, next := s.startBroker(o, "jobs")
+
+			start := time.Now()
+			result := next()
+			if result.TimedOut != tt.timedOut || result.ExitStatus != tt.status {
+				t.Errorf("timed out %t, exit %d, want %t, %d", result.TimedOut, result.ExitStatus, tt.timedOut, tt.status)
+			}
+			if tt.terminations >= 0 {
+				data, _ := os.ReadFile(terms)
+				if n := strings.Count(string(data), "term"); n != tt.terminations {
+					t.Errorf("terminated %d times, want %d", n, tt.terminations)
+				}
+			}
+			if took := time.Since(start); took > 3*time.Second {
+				t.Errorf("took %v", took)
+			}
+		})
+	}
+}
+
+func TestSharedReserveExecutesConcurrently(t *testing.T) {
+	s := newFakeServer(t)
+	for i := 0; i < 3; i++ {
+		s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	}
+	o := s.options()
+	runs := filepath.Join(t.TempDir(), "runs")
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; echo run >>"+runs+"; /bin/sleep 0.5")
+	started := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+	b := New(o, "jobs", 0, nil)
+
+	ticks := make(chan bool)
+	done := make(chan struct{})
+	go b.RunShared(ticks, func() { close(done) }, 3)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ticks <- true
+	}
+	for started() < 3 && time.Since(start) < 400*time.Millisecond {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := started(); n != 3 {
+		t.Errorf("%d workers running at once, want 3", n)
+	}
+	close(ticks)
+	<-done
+
+	if n := s.dialled(); n != 1 {
+		t.Errorf("%d connections, want one shared by the workers", n)
+	}
+	if n := s.count("delete"); n != 3 {
+		t.Errorf("%d jobs deleted, want 3", n)
+	}
+}
+
+func TestNoRetryPacketDeletedOnFailure(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exit 1")
+
+	packet := domainPacket("acme")
+	packet["no_retry"] = true
+	noRetry := s.put("jobs", 1, time.Minute, phpPacket(t, packet))
+	retried := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	_, next := s.startBroker(o, "jobs")
+
+	next()
+	if got := s.state(noRetry); got != "deleted" {
+		t.Errorf("failed no_retry job is %s, want it deleted", got)
+	}
+	next()
+	if got := s.state(retried); got == "deleted" {
+		t.Error("failed job was deleted, want it retried")
+	}
+}
+
+func TestAtMostOnceDeletesBeforeExecution(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.AtMostOnce = cli.TubeList{"jobs"}
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+
+	deletes := make(chan int, 2)
+	s.hook("delete", func(args []string) string {
+		deletes <- runs()
+		return ""
+	})
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	b, next := s.startBroker(o, "jobs")
+	if result := next(); !result.Executed {
+		t.Fatalf("job was not executed, error %v", result.Error)
+	}
+	if n := <-deletes; n != 0 {
+		t.Errorf("job deleted after %d runs, want it deleted first", n)
+	}
+
+	// By default the job is only deleted once it has run.
+	b.options.AtMostOnce = nil
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	next()
+	if n := <-deletes; n != 2 {
+		t.Errorf("job deleted after %d runs, want it deleted once run", n)
+	}
+
+	b.options.AtMostOnce = cli.TubeList{"jobs"}
+	b.options.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exit 1")
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	next()
+	if n := s.count("release"); n != 0 {
+		t.Errorf("failed job released %d times, want it gone", n)
+	}
+}
+
+func TestStdoutDrainedButNotRetained(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; i=0; while [ $i -lt 100 ]; do echo progress; i=$((i+1)); done")
+
+	// With no one consuming results, the output is read and dropped.
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	b := New(o, "jobs", 0, nil)
+	result, err := b.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TimedOut || result.ExitStatus != 0 {
+		t.Fatalf("timed out %t, exit %d, want the drained job to succeed", result.TimedOut, result.ExitStatus)
+	}
+	if len(result.Stdout) != 0 {
+		t.Errorf("retained %d bytes of stdout with no consumer", len(result.Stdout))
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it deleted", got)
+	}
+
+	o.RetainStdout = true
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	b = New(o, "jobs", 0, nil)
+	if result, err = b.RunOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 * len("progress\n"); len(result.Stdout) != want {
+		t.Errorf("retained %d bytes of stdout with -retain-stdout, want %d", len(result.Stdout), want)
+	}
+}
+
+func TestOnTimeoutPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		// Released by beanstalkd once the reservation lapses.
+		{OnTimeoutRelease, "reserved"},
+		{OnTimeoutBury, "buried"},
+		{OnTimeoutDelete, "deleted"},
+	}
+	for _, tt := range tests {
+		s := newFakeServer(t)
+		o := s.options()
+		o.OnTimeout = tt.policy
+		o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exec /bin/sleep 60")
+
+		// Without a TTR the reservation never lapses, and time-left is
+		// reported as 0s, so the timer fires after the one second margin.
+		id := s.put("jobs", 100, 0, phpPacket(t, domainPacket("acme")))
+		_, next := s.startBroker(o, "jobs")
+		if result := next(); !result.TimedOut {
+			t.Errorf("-on-timeout=%s: job did not time out", tt.policy)
+		}
+		if got := s.state(id); got != tt.want {
+			t.Errorf("-on-timeout=%s: timed out job is %s, want %s", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestTimeoutTriesBuries(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.TimeoutTries = 2
+	php, runs := countingPHP(t)
+	o.PHPBinary = fakePHP(t, php+"; exec /bin/sleep 60")
+
+	id := s.put("jobs", 100, 0, phpPacket(t, domainPacket("acme")))
+	_, next := s.startBroker(o, "jobs")
+	for i := 0; i < 2; i++ {
+		if result := next(); !result.TimedOut {
+			t.Fatalf("attempt %d did not time out", i+1)
+		}
+		s.expire(id)
+	}
+	if j, _ := s.job(id); j.timeouts != 2 || j.state != "ready" {
+		t.Fatalf("job has %d timeouts and is %s, want 2 and ready", j.timeouts, j.state)
+	}
+
+	result := next()
+	if !result.Buried || result.Executed {
+		t.Errorf("buried %t, executed %t, want the job buried without executing", result.Buried, result.Executed)
+	}
+	if got := s.state(id); got != "buried" {
+		t.Errorf("job is %s, want buried", got)
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("job executed %d times, want 2", n)
+	}
+}
+
+func TestValidatorRejectsJob(t *testing.T) {
+	tests := []struct {
+		policy     string
+		atMostOnce bool
+		want       string
+	}{
+		{"bury", false, "buried"},
+		{"delete", false, "deleted"},
+		// Rejected before being deleted for being at-most-once.
+		{"bury", true, "buried"},
+	}
+	for _, tt := range tests {
+		s := newFakeServer(t)
+		o := s.options()
+		o.InvalidJobPolicy = tt.policy
+		if tt.atMostOnce {
+			o.AtMostOnce = cli.TubeList{"jobs"}
+		}
+		php, runs := countingPHP(t)
+		o.PHPBinary = php
+
+		id := s.putPacket("jobs", domainPacket("acme"))
+		b, next := s.startBroker(o, "jobs")
+		b.Validate = func(packet Packet) error {
+			if _, ok := packet.String("user"); !ok {
+				return errors.New("job has no user")
+			}
+			return nil
+		}
+
+		result := next()
+		if result == nil {
+			t.Fatalf("-invalid-job-policy=%s, at-most-once %t: no result for the rejected job", tt.policy, tt.atMostOnce)
+		}
+		if !result.ValidationFailed || result.Executed {
+			t.Errorf("-invalid-job-policy=%s: validation failed %t, executed %t", tt.policy, result.ValidationFailed, result.Executed)
+		}
+		if got := s.state(id); got != tt.want {
+			t.Errorf("-invalid-job-policy=%s: rejected job is %s, want %s", tt.policy, got, tt.want)
+		}
+		if n := runs(); n != 0 {
+			t.Errorf("-invalid-job-policy=%s: %d workers started for a rejected job", tt.policy, n)
+		}
+
+		packet := domainPacket("acme")
+		packet["user"] = "jane"
+		s.putPacket("jobs", packet)
+		if result := next(); result.ValidationFailed || !result.Executed {
+			t.Errorf("-invalid-job-policy=%s: a valid job was rejected", tt.policy)
+		}
+	}
+}
+
+func TestRouteMaxReleases(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	two := uint64(2)
+	o.Routes = cli.RoutingTable{
+		{PolicyRule: cli.PolicyRule{Tube: "jobs", MaxReleases: &two}, Match: map[string]string{"type": "report"}},
+	}
+	e := &fakeExecutor{}
+	b := testBroker(o, e, "jobs")
+
+	// A job of the route released twice is given up on, one of the tube's
+	// other jobs is retried up to the default limit.
+	for _, tt := range []struct {
+		kind    string
+		givenUp bool
+	}{
+		{"report", true},
+		{"email", false},
+	} {
+		packet := domainPacket("acme")
+		packet["type"] = tt.kind
+		id := s.putPacket("jobs", packet)
+		s.setReleases(id, 2)
+		result, err := b.processJob(s.reserveJob(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Buried != tt.givenUp || result.Executed == tt.givenUp {
+			t.Errorf("%s job released twice: result %+v, want given up = %v", tt.kind, result, tt.givenUp)
+		}
+	}
+	if n := len(e.started()); n != 1 {
+		t.Errorf("%d jobs executed, want 1", n)
+	}
+}
+
+func TestRequiredFieldsRejectJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.RequiredFields = cli.FieldList{"job_id", "type"}
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+
+	packet := domainPacket("acme")
+	packet["job_id"] = "abc"
+	id := s.putPacket("jobs", packet)
+	b, next := s.startBroker(o, "jobs")
+	var resolved int
+	b.ResolveWorkDir = func(o cli.Options, job bs.Job, packet Packet) (string, error) {
+		resolved++
+		return getJobWD(o, job, packet)
+	}
+
+	result := next()
+	if !result.ValidationFailed || result.Executed {
+		t.Errorf("validation failed %t, executed %t, want the job rejected", result.ValidationFailed, result.Executed)
+	}
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "missing required fields: type") {
+		t.Errorf("result error = %v, want it to name the missing field type", result.Error)
+	}
+	if got := s.state(id); got != "buried" {
+		t.Errorf("rejected job is %s, want it buried", got)
+	}
+	if n := runs(); n != 0 || resolved != 0 {
+		t.Errorf("%d workers started and %d working directories resolved for a rejected job", n, resolved)
+	}
+
+	packet["type"] = "email"
+	s.putPacket("jobs", packet)
+	if result := next(); result.ValidationFailed || !result.Executed {
+		t.Errorf("a job with the required fields was rejected, error: %v", result.Error)
+	}
+}
+
+func TestDeadLetterTooBigBuries(t *testing.T) {
+	s := newFakeServer(t)
+	s.hook("put", func(args []string) string { return "JOB_TOO_BIG\r\n" })
+	o := s.options()
+	zero := uint64(0)
+	o.Policies = cli.PolicyList{{Tube: "jobs", MaxReleases: &zero, DeadletterTube: "dead"}}
+
+	before := deadletterTooBig.Value("dead")
+	id := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	result := next()
+
+	if !result.Buried || result.DeadLettered || !bs.IsJobTooBig(result.Error) {
+		t.Fatalf("result %+v, want the job buried, reporting it was too big", result)
+	}
+	if got := s.state(id); got != "buried" {
+		t.Errorf("job is %s, want it buried in place", got)
+	}
+	if got := deadletterTooBig.Value("dead") - before; got != 1 {
+		t.Errorf("deadletter_too_big_total rose by %v, want 1", got)
+	}
+}
+
+func TestChildReapedOnErrorAfterStart(t *testing.T) {
+	s := newFakeServer(t)
+	// Handing the job to the child fails once it has started, as writing to
+	// a persistent worker can.
+	e := &fakeExecutor{next: func() *fakeProcess {
+		return &fakeProcess{runFor: time.Minute, stdinErr: errors.New("broken pipe")}
+	}}
+
+	id, result := s.process(testBroker(s.options(), e, "jobs"), "jobs", time.Minute, domainPacket("acme"))
+	if _, ok := result.Error.(spawnError); !ok {
+		t.Errorf("result error = %v, want a spawnError", result.Error)
+	}
+	if !e.started()[0].reaped() {
+		t.Error("the child was left running or unreaped after executeJob returned")
+	}
+	if got := s.state(id); got != "ready" {
+		t.Errorf("job is %s, want it released", got)
+	}
+}
+
+func TestWorkerIdPropagates(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.WorkerId = "web-3"
+	env := filepath.Join(t.TempDir(), "env")
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; /usr/bin/env >"+env)
+
+	s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(o, "jobs")
+	if got := b.log.Data["worker"]; got != "web-3" {
+		t.Errorf("log field worker = %v, want web-3", got)
+	}
+
+	if result := next(); result.WorkerId != "web-3" {
+		t.Errorf("result worker id %q, want web-3", result.WorkerId)
+	}
+	data, err := os.ReadFile(env)
+	if err != nil {
+		t.Fatalf("worker did not run, error: %s", err)
+	}
+	found := false
+	for _, v := range strings.Split(string(data), "\n") {
+		found = found || v == "BEANSTALK_WORKER_ID=web-3"
+	}
+	if !found {
+		t.Errorf("child environment %q lacks BEANSTALK_WORKER_ID=web-3", data)
+	}
+}
+
+func TestShutdownReleasesReservedJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+	b := New(o, "jobs", 0, nil)
+	drain := make(chan bool)
+	b.drain, b.shutdown = drain, drain
+
+	// Shutdown begins while the broker waits on its reserve.
+	close(drain)
+	id := s.putPacket("jobs", domainPacket("acme"))
+	ticks := make(chan bool, 1)
+	ticks <- true
+	done := make(chan struct{})
+	go b.Run(ticks, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker kept running once shutting down")
+	}
+
+	// Either the reserve is broken off, or the job reserved is handed back.
+	s.waitState(id, "ready")
+	if n := runs(); n != 0 {
+		t.Errorf("%d workers started during shutdown, want none", n)
+	}
+}
+
+func TestTearDownProcessesReservedJob(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.DrainJobGrace = time.Millisecond
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: 100 * time.Millisecond} }}
+	b := testBroker(o, e, "jobs")
+	drain := make(chan bool)
+	b.drain = drain
+
+	ticks := make(chan bool, 1)
+	ticks <- true
+	done := make(chan struct{})
+	go b.RunShared(ticks, func() { close(done) }, 2)
+	waitFor(t, "the reserve", func() bool { return s.count("reserve-with-timeout") > 0 })
+
+	// The tube is torn down while the reserve waits, which then returns a
+	// job: it is executed and deleted, despite -drain-job-grace, which only
+	// applies on shutdown.
+	close(drain)
+	close(ticks)
+	id := s.putPacket("jobs", domainPacket("acme"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker kept running once its tube was torn down")
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job reserved during tear-down is %s, want it processed and deleted", got)
+	}
+	if n := len(e.started()); n != 1 {
+		t.Errorf("%d jobs executed, want 1", n)
+	}
+	if n := s.count("reserve-with-timeout"); n != 1 {
+		t.Errorf("%d reserves, want none once torn down", n)
+	}
+}
+
+func TestDrainJobGrace(t *testing.T) {
+	tests := []struct {
+		name        string
+		runFor      time.Duration
+		interrupted bool
+		state       string
+	}{
+		{"within the grace", 100 * time.Millisecond, false, "deleted"},
+		{"past the grace", time.Minute, true, "ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			o.DrainJobGrace = 300 * time.Millisecond
+			e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: tt.runFor} }}
+			b := testBroker(o, e, "jobs")
+			drain := make(chan bool)
+			b.drain, b.shutdown = drain, drain
+
+			id := s.putPacket("jobs", domainPacket("acme"))
+			results := make(chan *JobResult)
+			go func() {
+				result, err := b.processJob(s.reserveJob(id))
+				if err != nil {
+					t.Error(err)
+				}
+				results <- result
+			}()
+			waitFor(t, "the job to start", func() bool { return len(e.started()) == 1 })
+			close(drain)
+
+			start := time.Now()
+			result := <-results
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("job finished %v after draining began, want within the grace", took)
+			}
+			if result.Interrupted != tt.interrupted || result.TimedOut {
+				t.Errorf("interrupted %t, timed out %t, want interrupted %t", result.Interrupted, result.TimedOut, tt.interrupted)
+			}
+			if got := s.state(id); got != tt.state {
+				t.Errorf("job is %s, want %s", got, tt.state)
+			}
+		})
+	}
+}
+
+func TestCrossTubePriority(t *testing.T) {
+	for _, byPriority := range []bool{false, true} {
+		s := newFakeServer(t)
+		low := s.put("bulk", 1000, time.Minute, phpPacket(t, domainPacket("acme")))
+		high := s.put("urgent", 1, time.Minute, phpPacket(t, domainPacket("acme")))
+
+		o := s.options()
+		o.CrossTubePriority = byPriority
+		_, next := s.startBroker(o, "bulk", "urgent")
+		first := next().JobId
+
+		// Round-robin starts with the first tube, whatever the priorities.
+		want := low
+		if byPriority {
+			want = high
+		}
+		if first != want {
+			t.Errorf("-cross-tube-priority=%t: reserved job %d first, want %d", byPriority, first, want)
+		}
+	}
+}
+
+func TestCreateWorkDir(t *testing.T) {
+	for _, create := range []bool{false, true} {
+		s := newFakeServer(t)
+		o := s.options()
+		o.InstanceRoot = t.TempDir()
+		o.CreateWorkDir = create
+		out := filepath.Join(t.TempDir(), "pwd")
+		o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; /bin/pwd >"+out)
+
+		wd := filepath.Join(o.InstanceRoot, "acme", "worker")
+		id := s.putPacket("jobs", domainPacket("acme"))
+		_, next := s.startBroker(o, "jobs")
+		next()
+		_, statErr := os.Stat(wd)
+		if create {
+			if statErr != nil {
+				t.Errorf("-create-workdir: %s was not created, error: %s", wd, statErr)
+			}
+			if got, err := os.ReadFile(out); err != nil || strings.TrimSpace(string(got)) != wd {
+				t.Errorf("-create-workdir: worker ran in %q, error %v, want %s", got, err, wd)
+			}
+			if got := s.state(id); got != "deleted" {
+				t.Errorf("-create-workdir: job is %s, want it deleted", got)
+			}
+		} else {
+			if statErr == nil {
+				t.Errorf("%s was created without -create-workdir", wd)
+			}
+			if got := s.state(id); got != "ready" {
+				t.Errorf("job with a missing workdir is %s, want it released", got)
+			}
+		}
+	}
+}
+
+func TestCreateWorkDirOutsideRoot(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.InstanceRoot = t.TempDir()
+	o.CreateWorkDir = true
+	php, runs := countingPHP(t)
+	o.PHPBinary = php
+	outside := filepath.Join(t.TempDir(), "elsewhere")
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(o, "jobs")
+	b.ResolveWorkDir = func(o cli.Options, job bs.Job, packet Packet) (string, error) {
+		return outside, nil
+	}
+	if result := next(); result.Error == nil {
+		t.Error("no error creating a workdir outside the instance root")
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Errorf("%s was created outside the instance root", outside)
+	}
+	if got := s.state(id); got != "ready" {
+		t.Errorf("job is %s, want it released", got)
+	}
+	if n := runs(); n != 0 {
+		t.Errorf("%d workers started", n)
+	}
+}
+
+func TestControllerNotFoundIsPermanent(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PermanentFailureMarkers = cli.StringList{"Controller not found"}
+	o.PermanentExitCodes = cli.IntList{78}
+	b, next := s.startBroker(o, "jobs")
+
+	tests := []struct {
+		name      string
+		script    string
+		permanent bool
+		want      string
+	}{
+		{"marker", "echo 'Fatal error: Controller not found: /Core/Job/Missing'; exit 255", true, "buried"},
+		{"exit code", "exit 78", true, "buried"},
+		{"other failure", "echo 'database is down'; exit 255", false, "ready"},
+		{"marker on success", "echo 'Controller not found, using the default'", false, "deleted"},
+	}
+	for i, tt := range tests {
+		b.options.PHPBinary = fakePHP(t, "/bin/cat >/dev/null\n"+tt.script)
+		// Ahead of the jobs released before.
+		id := s.put("jobs", uint32(100-i), time.Minute, phpPacket(t, domainPacket("acme")))
+		result := next()
+		if result.PermanentFailure != tt.permanent {
+			t.Errorf("%s: permanent failure %t, want %t", tt.name, result.PermanentFailure, tt.permanent)
+		}
+		if got := s.state(id); got != tt.want {
+			t.Errorf("%s: job is %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSuccessMarker(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.SuccessMarker = "JOB COMPLETE"
+
+	tests := []struct {
+		name   string
+		stdout []string
+		marked bool
+		want   string
+	}{
+		{"marker", []string{"sent 3 emails\nJOB COMPLETE\n", "Fatal error: shutdown\n"}, true, "deleted"},
+		{"no marker", []string{"sent 3 emails\n"}, false, "ready"},
+	}
+	for _, tt := range tests {
+		e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{stdout: tt.stdout, status: 255} }}
+		b := testBroker(o, e, "jobs")
+		id := s.putPacket("jobs", domainPacket("acme"))
+		result, err := b.processJob(s.reserveJob(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SuccessMarked != tt.marked || result.ExitStatus != 255 {
+			t.Errorf("%s: success marked %t with exit(%d), want %t with exit(255)", tt.name, result.SuccessMarked, result.ExitStatus, tt.marked)
+		}
+		if got := s.state(id); got != tt.want {
+			t.Errorf("%s: job is %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteRetriedOnTransientError(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.DeleteRetries = 3
+	o.DeleteRetryBackoff = time.Millisecond
+
+	var failures int32
+	s.hook("delete", func([]string) string {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return "INTERNAL_ERROR\r\n"
+		}
+		return ""
+	})
+
+	atomic.StoreInt32(&failures, 2)
+	id := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	next()
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it deleted on the third try", got)
+	}
+	if n := s.count("delete"); n != 3 {
+		t.Errorf("%d deletes, want 3", n)
+	}
+
+	// Once the retries are exhausted, the broker stops with the job still
+	// reserved.
+	atomic.StoreInt32(&failures, 10)
+	id = s.putPacket("jobs", domainPacket("acme"))
+	b := New(o, "jobs", 0, nil)
+	stopped := make(chan string, 1)
+	b.fatal = func(err error) { stopped <- s.state(id) }
+	ticks := make(chan bool, 1)
+	ticks <- true
+	go b.Run(ticks, func() {})
+	select {
+	case got := <-stopped:
+		if got != "reserved" {
+			t.Errorf("job is %s, want it left reserved", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error once the delete retries were exhausted")
+	}
+	if n := s.count("delete") - 3; n != 4 {
+		t.Errorf("%d deletes, want the first try and 3 retries", n)
+	}
+}
+
+func TestStdinFramingAppliedToWorker(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.StdinFraming = StdinFramingNewline
+	stdin := filepath.Join(t.TempDir(), "stdin")
+	o.PHPBinary = fakePHP(t, "/bin/cat >"+stdin)
+
+	body := phpPacket(t, domainPacket("acme"))
+	s.put("jobs", 100, time.Minute, body)
+	_, next := s.startBroker(o, "jobs")
+	next()
+	got, err := os.ReadFile(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body+"\n" {
+		t.Errorf("worker read %q, want the newline terminated body", got)
+	}
+}
+
+func TestPreferNewerUnderBacklog(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PreferNewer = time.Minute
+	o.InstanceRoot = instanceRoot(t, "old", "new1", "new2")
+	bodies := filepath.Join(t.TempDir(), "bodies")
+	o.PHPBinary = fakePHP(t, "/bin/cat >>"+bodies+"; /bin/echo >>"+bodies)
+
+	// executed runs n jobs of tube and returns the domains of those
+	// executed, in order. Deferring a job takes a tick without a result.
+	executed := func(tube string, ticks, n int) []string {
+		os.Remove(bodies)
+		results := make(chan *JobResult)
+		tc := make(chan bool, ticks)
+		for i := 0; i < ticks; i++ {
+			tc <- true
+		}
+		done := make(chan struct{})
+		b := New(o, tube, 0, results)
+		go b.Run(tc, func() { close(done) })
+		for i := 0; i < n; i++ {
+			select {
+			case <-results:
+			case <-time.After(10 * time.Second):
+				t.Fatal("no job processed")
+			}
+		}
+		close(tc)
+		<-done
+
+		data, _ := os.ReadFile(bodies)
+		var order []string
+		for _, body := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			for _, domain := range []string{"old", "new1", "new2"} {
+				if strings.Contains(body, `"`+domain+`"`) {
+					order = append(order, domain)
+				}
+			}
+		}
+		return order
+	}
+
+	old := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("old")))
+	s.backdate(old, time.Hour)
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("new1")))
+	s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("new2")))
+	if got := strings.Join(executed("jobs", 4, 3), ","); got != "new1,new2,old" {
+		t.Errorf("executed %s, want the newer jobs first", got)
+	}
+
+	// Without a backlog the old job is executed straight away.
+	old = s.put("lone", 100, time.Minute, phpPacket(t, domainPacket("old")))
+	s.backdate(old, time.Hour)
+	if got := strings.Join(executed("lone", 1, 1), ","); got != "old" {
+		t.Errorf("executed %q, want the lone old job", got)
+	}
+}
+
+func TestExecuteJob(t *testing.T) {
+	waitErr := errors.New("wait failed")
+	tests := []struct {
+		name     string
+		proc     func() *fakeProcess
+		execErr  error
+		status   int
+		stdout   string
+		timedOut bool
+		err      func(error) bool
+	}{
+		{"clean exit", func() *fakeProcess { return &fakeProcess{stdout: []string{"done\n"}} }, nil, 0, "done\n", false, nil},
+		{"failure", func() *fakeProcess { return &fakeProcess{status: 2} }, nil, 2, "", false, nil},
+		{"timeout", func() *fakeProcess { return &fakeProcess{runFor: time.Minute} }, nil, -1, "", true, nil},
+		{"wait error", func() *fakeProcess { return &fakeProcess{status: -1, waitErr: waitErr} }, nil, -1, "", false,
+			func(err error) bool { return err == waitErr }},
+		{"start error", func() *fakeProcess { return &fakeProcess{startErr: errors.New("fork failed")} }, nil, 0, "", false,
+			func(err error) bool { _, ok := err.(spawnError); return ok }},
+		{"executor error", nil, errors.New("no such binary"), 0, "", false,
+			func(err error) bool { _, ok := err.(spawnError); return ok }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			o.RetainStdout = true
+			b := testBroker(o, &fakeExecutor{next: tt.proc, err: tt.execErr}, "jobs")
+
+			// With no TTR the timer fires after the margin alone.
+			id := s.put("jobs", 100, 0, phpPacket(t, domainPacket("acme")))
+			job := s.reserveJob(id)
+			result, err := b.executeJob(job, "jobs", Packet(domainPacket("acme")), "/", "/Core/Job/Test", b.policy("jobs"), 0, job.TimeLeft)
+			if tt.err == nil && err != nil || tt.err != nil && !tt.err(err) {
+				t.Fatalf("error %v", err)
+			}
+			if result.ExitStatus != tt.status || result.TimedOut != tt.timedOut || string(result.Stdout) != tt.stdout {
+				t.Errorf("exit %d, timed out %t, stdout %q, want %d, %t, %q",
+					result.ExitStatus, result.TimedOut, result.Stdout, tt.status, tt.timedOut, tt.stdout)
+			}
+		})
+	}
+}
+
+func TestSharedReserveDeadlineSoon(t *testing.T) {
+	tests := []struct {
+		name string
+		// refused is the reserve answered with DEADLINE_SOON.
+		refused int32
+		runFor  time.Duration
+		// The second job is reserved as soon as the first finishes when
+		// one is held, and after DeadlineSoonDelay otherwise.
+		min, max time.Duration
+	}{
+		{"holding", 2, 100 * time.Millisecond, 100 * time.Millisecond, bs.DeadlineSoonDelay / 2},
+		{"not holding", 1, 0, bs.DeadlineSoonDelay, 2 * bs.DeadlineSoonDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+			s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+			var reserves int32
+			s.hook("reserve-with-timeout", func([]string) string {
+				if atomic.AddInt32(&reserves, 1) == tt.refused {
+					return "DEADLINE_SOON\r\n"
+				}
+				return ""
+			})
+			e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: tt.runFor} }}
+			b := testBroker(s.options(), e, "jobs")
+
+			ticks := make(chan bool)
+			done := make(chan struct{})
+			go b.RunShared(ticks, func() { close(done) }, 2)
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				ticks <- true
+			}
+			for len(e.started()) < 2 && time.Since(start) < 3*bs.DeadlineSoonDelay {
+				time.Sleep(5 * time.Millisecond)
+			}
+			took := time.Since(start)
+			close(ticks)
+			<-done
+
+			if n := len(e.started()); n != 2 {
+				t.Fatalf("%d jobs executed, want 2", n)
+			}
+			if took < tt.min || took > tt.max {
+				t.Errorf("second job reserved after %v, want between %v and %v", took, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestOversizedBodyNotExecuted(t *testing.T) {
+	for _, policy := range []string{"bury", "delete"} {
+		s := newFakeServer(t)
+		o := s.options()
+		o.MaxBodyBytes = 64
+		o.OversizedBodyPolicy = policy
+		e := &fakeExecutor{}
+		b := testBroker(o, e, "jobs")
+
+		packet := domainPacket("acme")
+		packet["payload"] = strings.Repeat("x", 100)
+		id, result := s.process(b, "jobs", time.Minute, packet)
+		if n := len(e.started()); n != 0 {
+			t.Errorf("%s: %d workers started for an oversized body", policy, n)
+		}
+		if result == nil || result.Executed || !result.ValidationFailed {
+			t.Errorf("%s: result %+v, want the job rejected", policy, result)
+		}
+		want := map[string]string{"bury": "buried", "delete": "deleted"}[policy]
+		if got := s.state(id); got != want {
+			t.Errorf("%s: job is %s, want %s", policy, got, want)
+		}
+
+		// A body within the limit is executed.
+		s.process(b, "jobs", time.Minute, domainPacket("acme"))
+		if n := len(e.started()); n != 1 {
+			t.Errorf("%s: %d workers started, want 1", policy, n)
+		}
+	}
+}
+
+func TestEmptyBodyRejected(t *testing.T) {
+	for _, body := range []string{"", " \n\t"} {
+		s := newFakeServer(t)
+		e := &fakeExecutor{}
+		b := testBroker(s.options(), e, "jobs")
+
+		id := s.put("jobs", 100, time.Minute, body)
+		result, err := b.processJob(s.reserveJob(id))
+		if err != nil {
+			t.Fatalf("body %q: %s", body, err)
+		}
+		if result == nil || !result.EmptyBody || !result.ValidationFailed || result.Error == nil || result.Error.Error() != "empty body" {
+			t.Errorf("body %q: result %+v, want it rejected as empty", body, result)
+		}
+		if n := len(e.started()); n != 0 {
+			t.Errorf("body %q: %d workers started", body, n)
+		}
+		if got := s.state(id); got != "buried" {
+			t.Errorf("body %q: job is %s, want buried", body, got)
+		}
+	}
+}
+
+func TestAttemptCountsReleases(t *testing.T) {
+	s := newFakeServer(t)
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{status: 1} }}
+	b := testBroker(s.options(), e, "jobs")
+
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	var result *JobResult
+	for attempt := uint64(1); attempt <= 3; attempt++ {
+		var err error
+		if result, err = b.processJob(s.reserveJob(id)); err != nil {
+			t.Fatal(err)
+		}
+		if result.Attempt != attempt {
+			t.Errorf("attempt %d reported as %d", attempt, result.Attempt)
+		}
+	}
+	if n := s.count("release"); n != 3 {
+		t.Fatalf("%d releases, want 3", n)
+	}
+
+	found := false
+	for _, v := range e.started()[2].environ() {
+		found = found || v == "BEANSTALK_ATTEMPT=3"
+	}
+	if !found {
+		t.Errorf("child environment %v lacks BEANSTALK_ATTEMPT=3", e.started()[2].environ())
+	}
+}
+
+func TestMaxJobWallTime(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.MaxJobWallTime = cli.TubeDurations{"capped": 100 * time.Millisecond}
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: 300 * time.Millisecond} }}
+
+	start := time.Now()
+	id, result := s.process(testBroker(o, e, "capped"), "capped", time.Minute, domainPacket("acme"))
+	if took := time.Since(start); took > 250*time.Millisecond {
+		t.Errorf("capped job ran for %v", took)
+	}
+	if !result.TimedOut || !result.WallTimeCapped {
+		t.Errorf("timed out %t, wall time capped %t, want both", result.TimedOut, result.WallTimeCapped)
+	}
+	if n := e.started()[0].terminations(); n != 1 {
+		t.Errorf("terminated %d times, want once", n)
+	}
+	if got := s.state(id); got != "ready" && got != "delayed" {
+		t.Errorf("timed out job is %s, want it released", got)
+	}
+
+	// Other tubes run until their TTR.
+	_, result = s.process(testBroker(o, e, "uncapped"), "uncapped", time.Minute, domainPacket("acme"))
+	if result.TimedOut || result.ExitStatus != 0 {
+		t.Errorf("uncapped job timed out %t, exit %d", result.TimedOut, result.ExitStatus)
+	}
+}
+
+func TestSkipRetryPrecheck(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.SkipRetryPrecheck = cli.TubeList{"fast"}
+	o.MaxJobWallTime = cli.TubeDurations{"fast": 100 * time.Millisecond}
+	var status int
+	var runFor time.Duration
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{status: status, runFor: runFor} }}
+	b := testBroker(o, e, "fast")
+
+	// No stats-job is issued, whether the job succeeds, fails or is timed
+	// out by the wall time cap, which times the worker instead of its TTR.
+	for _, tt := range []struct {
+		name     string
+		status   int
+		runFor   time.Duration
+		released bool
+	}{
+		{"succeeded", 0, 0, false},
+		{"failed", 1, 0, true},
+		{"timed out", 0, time.Minute, true},
+	} {
+		status, runFor = tt.status, tt.runFor
+		id, _ := s.process(b, "fast", time.Minute, domainPacket("acme"))
+		j, ok := s.job(id)
+		switch {
+		case !tt.released && ok:
+			t.Errorf("%s job is %s, want it deleted", tt.name, j.state)
+		case tt.released && (!ok || j.state != "ready" && j.state != "delayed"):
+			t.Errorf("%s job is %s, want it released", tt.name, s.state(id))
+		case tt.released && j.pri != bs.DefaultPriority:
+			t.Errorf("%s job released with priority %d, want the default", tt.name, j.pri)
+		}
+	}
+	if n := s.count("stats-job"); n != 0 {
+		t.Errorf("%d stats-job issued, want none", n)
+	}
+}
+
+func TestTTRMarginOverride(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.TTRMarginOverride = cli.TubeMargins{"tight": 200 * time.Millisecond}
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: 600 * time.Millisecond} }}
+
+	// With no TTR the timer fires after the margin alone: the tube's
+	// override rather than the default second.
+	start := time.Now()
+	_, result := s.process(testBroker(o, e, "tight"), "tight", 0, domainPacket("acme"))
+	if took := time.Since(start); !result.TimedOut || took > 500*time.Millisecond {
+		t.Errorf("job timed out %t after %v, want it terminated at the 200ms override", result.TimedOut, took)
+	}
+
+	_, result = s.process(testBroker(o, e, "loose"), "loose", 0, domainPacket("acme"))
+	if result.TimedOut || result.ExitStatus != 0 {
+		t.Errorf("job of a tube without override timed out %t, exit %d, want it to finish within the default margin", result.TimedOut, result.ExitStatus)
+	}
+}
+
+func TestTimerAccountsForDelayBeforeExec(t *testing.T) {
+	// With a TTR of two seconds, time-left is read as 1s, so the child is
+	// terminated two seconds after the reserve, however long it took to
+	// start it. Arming the full two seconds at exec would take 3.5s.
+	const delay = 1500 * time.Millisecond
+	tests := []struct {
+		name       string
+		atMostOnce bool
+	}{
+		{"slow spawn", false},
+		{"at-most-once, slow workdir", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			if tt.atMostOnce {
+				o.AtMostOnce = cli.TubeList{"jobs"}
+			}
+			e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: time.Minute} }}
+			b := testBroker(o, e, "jobs")
+			if tt.atMostOnce {
+				// The time left is read before the job is deleted, so the
+				// delay falls after the read.
+				b.ResolveWorkDir = func(o cli.Options, job bs.Job, packet Packet) (string, error) {
+					time.Sleep(delay)
+					return "/work", nil
+				}
+			} else {
+				b.Execute = func(cwd, name string, args ...string) (Process, <-chan []byte, error) {
+					time.Sleep(delay)
+					return e.Execute(cwd, name, args...)
+				}
+			}
+
+			start := time.Now()
+			_, result := s.process(b, "jobs", 2*time.Second, domainPacket("acme"))
+			if took := time.Since(start); took < delay || took > 2700*time.Millisecond {
+				t.Errorf("job terminated after %v, want about 2s", took)
+			}
+			if !result.TimedOut {
+				t.Error("job did not time out")
+			}
+		})
+	}
+}
+
+func TestSilentFailureCounted(t *testing.T) {
+	tests := []struct {
+		name   string
+		proc   *fakeProcess
+		silent float64
+	}{
+		{"silent failure", &fakeProcess{status: 1}, 1},
+		{"failure with stderr", &fakeProcess{status: 1, stderr: "PHP Fatal error\n"}, 0},
+		{"silent success", &fakeProcess{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			e := &fakeExecutor{next: func() *fakeProcess { return tt.proc }}
+
+			before := silentFailures.Value("jobs")
+			_, result := s.process(testBroker(s.options(), e, "jobs"), "jobs", time.Minute, domainPacket("acme"))
+			if !result.StderrCaptured || string(result.Stderr) != tt.proc.stderr {
+				t.Errorf("stderr captured %t, %q, want %q", result.StderrCaptured, result.Stderr, tt.proc.stderr)
+			}
+			if got := silentFailures.Value("jobs") - before; got != tt.silent {
+				t.Errorf("silent_failures_total rose by %v, want %v", got, tt.silent)
+			}
+		})
+	}
+}
+
+func TestCommandLineLoggedAtDebug(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+
+	s := newFakeServer(t)
+	o := s.options()
+	o.Controller = "/Mail/Job/Send"
+	packet := domainPacket("acme")
+	packet["password"] = "hunter2"
+	b := testBroker(o, &fakeExecutor{}, "jobs")
+
+	log.SetLevel(log.InfoLevel)
+	s.process(b, "jobs", time.Minute, packet)
+	if strings.Contains(buf.String(), "command line") {
+		t.Errorf("command line logged above debug level:\n%s", buf.String())
+	}
+
+	log.SetLevel(log.DebugLevel)
+	id, _ := s.process(b, "jobs", time.Minute, packet)
+	logged := buf.String()
+	// The text formatter quotes the message, escaping the quoted argv.
+	want := strconv.Quote(fmt.Sprintf("job %d command line: %q", id, []string{o.PHPBinary, "-c", o.PHPINI, "index.php", "/Mail/Job/Send"}))
+	if !strings.Contains(logged, want) {
+		t.Errorf("command line %s not logged at debug level:\n%s", want, logged)
+	}
+	if strings.Contains(logged, "hunter2") {
+		t.Error("job body logged with the command line")
+	}
+}
+
+func TestLogResultsOn(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	s := newFakeServer(t)
+	o := s.options()
+	var status int
+	e := &fakeExecutor{next: func() *fakeProcess {
+		return &fakeProcess{status: status, stderr: "database is down"}
+	}}
+
+	for _, tt := range []struct {
+		on              string
+		success, failed bool
+	}{
+		{LogResultsAlways, true, true},
+		{LogResultsFailure, false, true},
+		{LogResultsNever, false, false},
+	} {
+		o.LogResultsOn = tt.on
+		b := testBroker(o, e, "jobs")
+
+		buf.Reset()
+		status = 0
+		id, _ := s.process(b, "jobs", time.Minute, domainPacket("acme"))
+		if got := strings.Contains(buf.String(), fmt.Sprintf("job %d finished", id)); got != tt.success {
+			t.Errorf("-log-results-on=%s: success logged %t, want %t:\n%s", tt.on, got, tt.success, buf.String())
+		}
+
+		buf.Reset()
+		status = 3
+		id, _ = s.process(b, "jobs", time.Minute, domainPacket("acme"))
+		logged := buf.String()
+		if got := strings.Contains(logged, fmt.Sprintf("job %d finished with exit(3)", id)); got != tt.failed {
+			t.Errorf("-log-results-on=%s: failure logged %t, want %t:\n%s", tt.on, got, tt.failed, logged)
+		}
+		if tt.on == LogResultsFailure && !strings.Contains(logged, `stderr="database is down"`) {
+			t.Errorf("-log-results-on=failure: failure logged without its stderr:\n%s", logged)
+		}
+	}
+
+	// A successful job kept for inspection is logged as it is buried.
+	no := false
+	o.Policies = cli.PolicyList{{Tube: "jobs", DeleteOnSuccess: &no}}
+	o.LogResultsOn = LogResultsFailure
+	buf.Reset()
+	status = 0
+	id, _ := s.process(testBroker(o, e, "jobs"), "jobs", time.Minute, domainPacket("acme"))
+	if logged := buf.String(); !strings.Contains(logged, fmt.Sprintf("burying successful job %d", id)) || !strings.Contains(logged, "buried=true") {
+		t.Errorf("-log-results-on=failure: buried job not logged:\n%s", logged)
+	}
+}
+
+func TestNoRetryDeletesWhateverTheOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		proc     *fakeProcess
+		status   int
+		timedOut bool
+	}{
+		{"success", &fakeProcess{}, 0, false},
+		{"failure", &fakeProcess{status: 2}, 2, false},
+		{"timeout", &fakeProcess{runFor: time.Minute}, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			o.NoRetry = true
+			// Successful jobs would otherwise be buried.
+			no := false
+			o.Policies = cli.PolicyList{{Tube: "jobs", DeleteOnSuccess: &no}}
+			e := &fakeExecutor{next: func() *fakeProcess { return tt.proc }}
+
+			// With a TTR of 3s the time out is 1s, holding the reservation.
+			id, result := s.process(testBroker(o, e, "jobs"), "jobs", 3*time.Second, domainPacket("acme"))
+			if result.ExitStatus != tt.status || result.TimedOut != tt.timedOut || result.Buried {
+				t.Errorf("exit %d, timed out %t, buried %t, want %d, %t and not buried", result.ExitStatus, result.TimedOut, result.Buried, tt.status, tt.timedOut)
+			}
+			if got := s.state(id); got != "deleted" {
+				t.Errorf("job is %s, want it deleted", got)
+			}
+		})
+	}
+}
+
+func TestMaxReservedPerConn(t *testing.T) {
+	s := newFakeServer(t)
+	for i := 0; i < 3; i++ {
+		s.put("capped", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	}
+	o := s.options()
+	o.MaxReservedPerConn = 2
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: 300 * time.Millisecond} }}
+	b := testBroker(o, e, "capped")
+
+	ticks := make(chan bool)
+	done := make(chan struct{})
+	go b.RunShared(ticks, func() { close(done) }, 3)
+	start := time.Now()
+	go func() {
+		for i := 0; i < 3; i++ {
+			ticks <- true
+		}
+	}()
+	waitFor(t, "two jobs to run", func() bool { return len(e.started()) == 2 })
+	if s.count("reserve-with-timeout") > 2 {
+		t.Error("reserved a third job while holding two")
+	}
+	lines := strings.Join(scrape(t, "capped"), "\n")
+	if !strings.Contains(lines, `reserved_jobs{tube="capped"} 2`) {
+		t.Errorf("exposition lacks the held jobs:\n%s", lines)
+	}
+
+	// The third job is reserved once one of the first two is disposed of.
+	waitFor(t, "the third job to run", func() bool { return len(e.started()) == 3 })
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("third job started after %v, before a slot was freed", took)
+	}
+	close(ticks)
+	<-done
+}
+
+func TestSharedHeldJobsByTube(t *testing.T) {
+	s := newFakeServer(t)
+	s.putPacket("held-a", domainPacket("acme"))
+	s.putPacket("held-b", domainPacket("acme"))
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{runFor: 300 * time.Millisecond} }}
+	b := testBroker(s.options(), e, "held-a", "held-b")
+
+	ticks := make(chan bool)
+	done := make(chan struct{})
+	go b.RunShared(ticks, func() { close(done) }, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			ticks <- true
+		}
+	}()
+	waitFor(t, "both jobs to run", func() bool { return len(e.started()) == 2 })
+
+	// Each job is counted under its own tube, not the group's.
+	for _, tube := range []string{"held-a", "held-b"} {
+		lines := strings.Join(scrape(t, tube), "\n")
+		if !strings.Contains(lines, fmt.Sprintf("reserved_jobs{tube=%q} 1", tube)) {
+			t.Errorf("exposition lacks the held job of %s:\n%s", tube, lines)
+		}
+	}
+	if lines := strings.Join(scrape(t, "held-a,held-b"), "\n"); strings.Contains(lines, "reserved_jobs") {
+		t.Errorf("exposition counts held jobs under the group:\n%s", lines)
+	}
+	close(ticks)
+	<-done
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+)
+
+// DrainingPause is how long reserving is paused once beanstalkd refused a
+// put as it is in drain mode. beanstalkd still hands out jobs while
+// draining, but jobs needing to put others, such as to dead-letter or
+// hand off, could not be disposed of, so the broker backs off rather than
+// churning through them until the server is taken down.
+var DrainingPause = 5 * time.Second
+
+// serverDrain records until when reserving is paused for beanstalkd being in
+// drain mode.
+type serverDrain struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// noteDraining pauses reserving for DrainingPause if err is beanstalkd
+// refusing a put as it is in drain mode.
+func (b *Broker) noteDraining(err error) {
+	if !bs.IsDraining(err) {
+		return
+	}
+
+	b.serverDrain.mu.Lock()
+	defer b.serverDrain.mu.Unlock()
+	if time.Now().After(b.serverDrain.until) {
+		b.log.Warnf("beanstalkd is in drain mode, refusing puts, pausing reserving for %v", DrainingPause)
+	}
+	b.serverDrain.until = time.Now().Add(DrainingPause)
+}
+
+// err returns an error while reserving is paused for drain mode, nil
+// otherwise.
+func (d *serverDrain) err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if left := time.Until(d.until); left > 0 {
+		return fmt.Errorf("beanstalkd is in drain mode, resuming in %v", left.Round(time.Millisecond))
+	}
+	return nil
+}
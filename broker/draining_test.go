@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainingServerPausesReserving(t *testing.T) {
+	defer func(d time.Duration) { PressureCheckInterval = d }(PressureCheckInterval)
+	PressureCheckInterval = 10 * time.Millisecond
+	defer func(d time.Duration) { DrainingPause = d }(DrainingPause)
+	DrainingPause = 300 * time.Millisecond
+
+	// beanstalkd in drain mode still hands out jobs, refusing only puts.
+	s := newFakeServer(t)
+	s.hook("put", func([]string) string { return "DRAINING\r\n" })
+	o := s.options()
+	o.ShardCount = 2
+	o.ShardIndex = shardOf("acme", 2)
+	var other string
+	for _, domain := range []string{"globex", "initech", "umbrella", "hooli"} {
+		if shardOf(domain, 2) != o.ShardIndex {
+			other = domain
+			break
+		}
+	}
+	if other == "" {
+		t.Fatal("no domain of the other shard")
+	}
+
+	// The first job cannot be handed off, the put refused, which pauses
+	// reserving the second.
+	b, next := s.startBroker(o, "jobs")
+	handOff := s.putPacket("jobs", domainPacket(other))
+	if result, err := b.processJob(s.reserveJob(handOff)); err != nil || result != nil {
+		t.Fatalf("returned %+v, error %v, want the job handed off", result, err)
+	}
+	id := s.putPacket("jobs", domainPacket("acme"))
+	start := time.Now()
+	result := next()
+	if took := time.Since(start); took < DrainingPause {
+		t.Errorf("reserved the next job after %v, want a pause of %v", took, DrainingPause)
+	}
+	if result.JobId != id || s.state(id) != "deleted" {
+		t.Errorf("processed %+v, job %d is %s, want it processed after the pause", result, id, s.state(id))
+	}
+	if got := s.state(handOff); got != "delayed" {
+		t.Errorf("job refused a hand-off is %s, want it released with a delay", got)
+	}
+	if err := b.serverDrain.err(); err != nil {
+		t.Errorf("still paused once DrainingPause passed, error: %s", err)
+	}
+}
@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"github.com/kayako/beanstalk-broker/cmd"
+)
+
+// Process is a worker process run for a job, as implemented by cmd.Cmd.
+type Process interface {
+	AddEnv(env ...string)
+	StartWithStdin(input []byte) error
+	Started() bool
+	Terminate() error
+	Kill() error
+	WaitChan() <-chan cmd.WaitResult
+}
+
+// stderrCapturer is a Process keeping what it wrote to stderr. Persistent
+// workers share the broker's stderr, so their jobs do not keep theirs.
+type stderrCapturer interface {
+	Stderr() []byte
+}
+
+// Executor creates the process running name with args in cwd, not yet
+// started, along with the channel its stdout is sent over.
+type Executor func(cwd, name string, args ...string) (Process, <-chan []byte, error)
+
+// killingExecutor is the Executor forking real processes, terminated with
+// the kill sequence k.
+func killingExecutor(k cmd.KillSequence) Executor {
+	return func(cwd, name string, args ...string) (Process, <-chan []byte, error) {
+		c, out, err := cmd.NewCommand(cwd, name, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.SetKillSequence(k)
+		return c, out, nil
+	}
+}
+
+// commandExecutor is the Executor forking real processes, terminated with
+// SIGTERM.
+func commandExecutor(cwd, name string, args ...string) (Process, <-chan []byte, error) {
+	c, out, err := cmd.NewCommand(cwd, name, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, out, nil
+}
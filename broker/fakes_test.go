@@ -0,0 +1,924 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/cmd"
+	"github.com/kr/beanstalk"
+	"github.com/wulijun/go-php-serialize/phpserialize"
+)
+
+// fakeServer is an in-memory beanstalkd speaking enough of the protocol for
+// brokers to reserve and dispose of jobs against it.
+type fakeServer struct {
+	t *testing.T
+	l net.Listener
+
+	mu      sync.Mutex
+	nextId  uint64
+	jobs    map[uint64]*fakeJob
+	tubes   map[string]bool
+	log     []string
+	hooks   map[string]func(args []string) string
+	conns   []net.Conn
+	closing bool
+}
+
+// fakeJob is a job held by a fakeServer.
+type fakeJob struct {
+	id      uint64
+	tube    string
+	body    []byte
+	pri     uint32
+	ttr     time.Duration
+	state   string
+	created time.Time
+
+	// until is when a delayed job becomes ready, or a reserved one times
+	// out.
+	until time.Time
+
+	// owner is the connection a reserved job is reserved by.
+	owner *fakeConn
+
+	reserves, timeouts, releases, buries, kicks uint64
+}
+
+// newFakeServer starts a fakeServer, stopped when the test ends.
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFake(t, l)
+}
+
+// serveFake starts a fakeServer accepting connections on l.
+func serveFake(t *testing.T, l net.Listener) *fakeServer {
+	s := &fakeServer{
+		t:      t,
+		l:      l,
+		jobs:   make(map[uint64]*fakeJob),
+		tubes:  map[string]bool{"default": true},
+		hooks:  make(map[string]func([]string) string),
+		nextId: 1,
+	}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// Addr is the address to connect to the server on, as -address takes it.
+func (s *fakeServer) Addr() string {
+	if s.l.Addr().Network() == "unix" {
+		return cli.UnixScheme + s.l.Addr().String()
+	}
+	return s.l.Addr().String()
+}
+
+// options are cli.Options connecting to the server, with the defaults the
+// flags would otherwise give. Jobs run in a directory of their domain under
+// a temporary instance root, with a fake PHP binary exiting 0.
+func (s *fakeServer) options() cli.Options {
+	return cli.Options{
+		Address:      s.Addr(),
+		PerTube:      1,
+		PHPBinary:    fakePHP(s.t, "/bin/cat >/dev/null; exit 0"),
+		PHPINI:       "php.ini",
+		InstanceRoot: instanceRoot(s.t, "acme"),
+		ClusterRoot:  "/cluster",
+		Controller:   "/Core/Job/Console",
+		JobFormat:    JobFormatPHP,
+	}
+}
+
+// hook replaces the server's reply to a command, whenever fn returns a
+// non-empty reply.
+func (s *fakeServer) hook(command string, fn func(args []string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[command] = fn
+}
+
+// put adds a ready job to tube, returning its id.
+func (s *fakeServer) put(tube string, pri uint32, ttr time.Duration, body string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putLocked(tube, pri, 0, ttr, []byte(body))
+}
+
+// putPacket adds a ready job to tube, holding packet serialized as PHP does.
+func (s *fakeServer) putPacket(tube string, packet map[interface{}]interface{}) uint64 {
+	return s.put(tube, 100, time.Minute, phpPacket(s.t, packet))
+}
+
+func (s *fakeServer) putLocked(tube string, pri uint32, delay, ttr time.Duration, body []byte) uint64 {
+	id := s.nextId
+	s.nextId++
+	j := &fakeJob{id: id, tube: tube, body: body, pri: pri, ttr: ttr, state: "ready", created: time.Now()}
+	if delay > 0 {
+		j.state, j.until = "delayed", time.Now().Add(delay)
+	}
+	s.jobs[id] = j
+	s.tubes[tube] = true
+	return id
+}
+
+// backdate makes job id older by d.
+func (s *fakeServer) backdate(id uint64, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id].created = s.jobs[id].created.Add(-d)
+}
+
+// setReleases sets how many times job id has been released.
+func (s *fakeServer) setReleases(id, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id].releases = n
+}
+
+// expire makes the reservation of job id lapse, as if its TTR had passed.
+func (s *fakeServer) expire(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.jobs[id]
+	j.state, j.timeouts = "ready", j.timeouts+1
+}
+
+// job returns a copy of job id, false if it was deleted.
+func (s *fakeServer) job(id uint64) (fakeJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	j, ok := s.jobs[id]
+	if !ok {
+		return fakeJob{}, false
+	}
+	return *j, true
+}
+
+// state returns the state of job id, "deleted" once it is gone.
+func (s *fakeServer) state(id uint64) string {
+	j, ok := s.job(id)
+	if !ok {
+		return "deleted"
+	}
+	return j.state
+}
+
+// waitState waits for job id to reach state, failing the test if it does not
+// within a few seconds.
+func (s *fakeServer) waitState(id uint64, state string) {
+	s.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.state(id) != state {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("job %d is %s, want %s", id, s.state(id), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// commands returns the commands received so far, in order.
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// count returns how many commands of the given name were received.
+func (s *fakeServer) count(command string) int {
+	n := 0
+	for _, c := range s.commands() {
+		if strings.Fields(c)[0] == command {
+			n++
+		}
+	}
+	return n
+}
+
+// dialled returns how many connections were made to the server.
+func (s *fakeServer) dialled() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// close stops the server, dropping every connection to it.
+func (s *fakeServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	s.l.Close()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// fakeConn is the state of a connection to a fakeServer.
+type fakeConn struct {
+	use   string
+	watch map[string]bool
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fc := &fakeConn{use: "default", watch: map[string]bool{"default": true}}
+	defer s.hangUp(fc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		var body []byte
+		if args[0] == "put" && len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			body = make([]byte, n+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			body = body[:n]
+		}
+
+		reply := s.reply(fc, args, body)
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+// hangUp puts the jobs reserved by fc back in the ready queue, as beanstalkd
+// does when a connection closes.
+func (s *fakeServer) hangUp(fc *fakeConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.state == "reserved" && j.owner == fc {
+			j.state = "ready"
+		}
+	}
+}
+
+func (s *fakeServer) reply(fc *fakeConn, args []string, body []byte) string {
+	s.mu.Lock()
+	s.log = append(s.log, strings.Join(args, " "))
+	hook := s.hooks[args[0]]
+	s.mu.Unlock()
+	if hook != nil {
+		if reply := hook(args[1:]); reply != "" {
+			return reply
+		}
+	}
+
+	if args[0] == "reserve" || args[0] == "reserve-with-timeout" {
+		timeout := time.Hour
+		if len(args) == 2 {
+			secs, _ := strconv.Atoi(args[1])
+			timeout = time.Duration(secs) * time.Second
+		}
+		return s.reserve(fc, timeout)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+
+	id := uint64(0)
+	if len(args) > 1 {
+		id, _ = strconv.ParseUint(args[1], 10, 64)
+	}
+	j := s.jobs[id]
+
+	switch args[0] {
+	case "use":
+		fc.use = args[1]
+		return "USING " + args[1] + "\r\n"
+	case "watch":
+		fc.watch[args[1]] = true
+		return fmt.Sprintf("WATCHING %d\r\n", len(fc.watch))
+	case "ignore":
+		if len(fc.watch) == 1 && fc.watch[args[1]] {
+			return "NOT_IGNORED\r\n"
+		}
+		delete(fc.watch, args[1])
+		return fmt.Sprintf("WATCHING %d\r\n", len(fc.watch))
+	case "put":
+		pri, _ := strconv.ParseUint(args[1], 10, 32)
+		delay, _ := strconv.Atoi(args[2])
+		ttr, _ := strconv.Atoi(args[3])
+		id := s.putLocked(fc.use, uint32(pri), time.Duration(delay)*time.Second, time.Duration(ttr)*time.Second, body)
+		return fmt.Sprintf("INSERTED %d\r\n", id)
+	case "delete":
+		if j == nil {
+			return "NOT_FOUND\r\n"
+		}
+		delete(s.jobs, id)
+		return "DELETED\r\n"
+	case "release":
+		if j == nil || j.state != "reserved" {
+			return "NOT_FOUND\r\n"
+		}
+		pri, _ := strconv.ParseUint(args[2], 10, 32)
+		delay, _ := strconv.Atoi(args[3])
+		j.pri, j.releases = uint32(pri), j.releases+1
+		j.state = "ready"
+		if delay > 0 {
+			j.state, j.until = "delayed", time.Now().Add(time.Duration(delay)*time.Second)
+		}
+		return "RELEASED\r\n"
+	case "bury":
+		if j == nil || j.state != "reserved" {
+			return "NOT_FOUND\r\n"
+		}
+		pri, _ := strconv.ParseUint(args[2], 10, 32)
+		j.pri, j.state, j.buries = uint32(pri), "buried", j.buries+1
+		return "BURIED\r\n"
+	case "touch":
+		if j == nil || j.state != "reserved" {
+			return "NOT_FOUND\r\n"
+		}
+		j.until = time.Now().Add(j.ttr)
+		return "TOUCHED\r\n"
+	case "kick":
+		// As beanstalkd, the delayed jobs are kicked when none are buried.
+		bound, _ := strconv.Atoi(args[1])
+		n := 0
+		jobs := s.sorted(fc.use, "buried")
+		if len(jobs) == 0 {
+			jobs = s.sorted(fc.use, "delayed")
+		}
+		for _, j := range jobs {
+			if n == bound {
+				break
+			}
+			j.state, j.kicks = "ready", j.kicks+1
+			n++
+		}
+		return fmt.Sprintf("KICKED %d\r\n", n)
+	case "kick-job":
+		if j == nil || j.state != "buried" {
+			return "NOT_FOUND\r\n"
+		}
+		j.state, j.kicks = "ready", j.kicks+1
+		return "KICKED\r\n"
+	case "peek":
+		if j == nil {
+			return "NOT_FOUND\r\n"
+		}
+		return found(j)
+	case "peek-ready", "peek-buried", "peek-delayed":
+		jobs := s.sorted(fc.use, strings.TrimPrefix(args[0], "peek-"))
+		if len(jobs) == 0 {
+			return "NOT_FOUND\r\n"
+		}
+		return found(jobs[0])
+	case "reserve-job":
+		if j == nil || j.state == "reserved" {
+			return "NOT_FOUND\r\n"
+		}
+		j.state, j.until, j.reserves, j.owner = "reserved", time.Now().Add(j.ttr), j.reserves+1, fc
+		return fmt.Sprintf("RESERVED %d %d\r\n%s\r\n", j.id, len(j.body), j.body)
+	case "stats-job":
+		if j == nil {
+			return "NOT_FOUND\r\n"
+		}
+		return yamlDict(s.jobStats(j))
+	case "stats-tube":
+		if !s.tubes[args[1]] {
+			return "NOT_FOUND\r\n"
+		}
+		return yamlDict(s.tubeStats(args[1]))
+	case "stats":
+		return yamlDict(s.serverStats())
+	case "list-tubes":
+		tubes := make([]string, 0, len(s.tubes))
+		for tube := range s.tubes {
+			tubes = append(tubes, tube)
+		}
+		sort.Strings(tubes)
+		var b strings.Builder
+		b.WriteString("---\n")
+		for _, tube := range tubes {
+			b.WriteString("- " + tube + "\n")
+		}
+		return fmt.Sprintf("OK %d\r\n%s\r\n", b.Len(), b.String())
+	}
+	return "UNKNOWN_COMMAND\r\n"
+}
+
+// reserve waits up to timeout for a ready job of the watched tubes, the most
+// urgent and then the oldest first.
+func (s *fakeServer) reserve(fc *fakeConn, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			return ""
+		}
+		s.tick()
+		var next *fakeJob
+		for tube := range fc.watch {
+			jobs := s.sorted(tube, "ready")
+			if len(jobs) > 0 && (next == nil || before(jobs[0], next)) {
+				next = jobs[0]
+			}
+		}
+		if next != nil {
+			next.state, next.until, next.reserves, next.owner = "reserved", time.Now().Add(next.ttr), next.reserves+1, fc
+			s.mu.Unlock()
+			return fmt.Sprintf("RESERVED %d %d\r\n%s\r\n", next.id, len(next.body), next.body)
+		}
+		s.mu.Unlock()
+
+		if !time.Now().Before(deadline) {
+			return "TIMED_OUT\r\n"
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+// tick moves delayed jobs whose delay has passed to ready, and reserved jobs
+// past their TTR back to ready.
+func (s *fakeServer) tick() {
+	now := time.Now()
+	for _, j := range s.jobs {
+		if j.state == "delayed" && !now.Before(j.until) {
+			j.state = "ready"
+		}
+		if j.state == "reserved" && j.ttr > 0 && !now.Before(j.until) {
+			j.state, j.timeouts = "ready", j.timeouts+1
+		}
+	}
+}
+
+// sorted returns the jobs of tube in state, the most urgent and then the
+// oldest first.
+func (s *fakeServer) sorted(tube, state string) []*fakeJob {
+	var jobs []*fakeJob
+	for _, j := range s.jobs {
+		if j.tube == tube && j.state == state {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return before(jobs[a], jobs[b]) })
+	return jobs
+}
+
+func before(a, b *fakeJob) bool {
+	if a.pri != b.pri {
+		return a.pri < b.pri
+	}
+	return a.id < b.id
+}
+
+func (s *fakeServer) jobStats(j *fakeJob) map[string]string {
+	left := time.Duration(0)
+	if j.state == "reserved" {
+		left = time.Until(j.until)
+	}
+	return map[string]string{
+		"id":        strconv.FormatUint(j.id, 10),
+		"tube":      j.tube,
+		"state":     j.state,
+		"pri":       strconv.FormatUint(uint64(j.pri), 10),
+		"age":       strconv.Itoa(int(time.Since(j.created) / time.Second)),
+		"delay":     "0",
+		"ttr":       strconv.Itoa(int(j.ttr / time.Second)),
+		"time-left": strconv.Itoa(int(left / time.Second)),
+		"file":      "0",
+		"reserves":  strconv.FormatUint(j.reserves, 10),
+		"timeouts":  strconv.FormatUint(j.timeouts, 10),
+		"releases":  strconv.FormatUint(j.releases, 10),
+		"buries":    strconv.FormatUint(j.buries, 10),
+		"kicks":     strconv.FormatUint(j.kicks, 10),
+	}
+}
+
+func (s *fakeServer) tubeStats(tube string) map[string]string {
+	counts := map[string]int{}
+	for _, j := range s.jobs {
+		if j.tube == tube {
+			counts[j.state]++
+		}
+	}
+	return map[string]string{
+		"name":                  tube,
+		"current-jobs-urgent":   "0",
+		"current-jobs-ready":    strconv.Itoa(counts["ready"]),
+		"current-jobs-reserved": strconv.Itoa(counts["reserved"]),
+		"current-jobs-delayed":  strconv.Itoa(counts["delayed"]),
+		"current-jobs-buried":   strconv.Itoa(counts["buried"]),
+		"total-jobs":            strconv.Itoa(len(s.jobs)),
+		"current-using":         "0",
+		"current-watching":      "0",
+		"current-waiting":       "0",
+	}
+}
+
+func (s *fakeServer) serverStats() map[string]string {
+	stats := map[string]string{}
+	for _, key := range []string{
+		"current-jobs-urgent", "current-jobs-ready", "current-jobs-reserved",
+		"current-jobs-delayed", "current-jobs-buried", "cmd-put", "cmd-reserve",
+		"cmd-delete", "cmd-release", "cmd-bury", "cmd-kick", "job-timeouts",
+		"total-jobs", "current-tubes", "current-connections",
+		"current-producers", "current-workers", "current-waiting", "uptime",
+	} {
+		stats[key] = "0"
+	}
+	stats["total-jobs"] = strconv.Itoa(len(s.jobs))
+	stats["current-tubes"] = strconv.Itoa(len(s.tubes))
+	return stats
+}
+
+func found(j *fakeJob) string {
+	return fmt.Sprintf("FOUND %d %d\r\n%s\r\n", j.id, len(j.body), j.body)
+}
+
+func yamlDict(d map[string]string) string {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, key := range keys {
+		b.WriteString(key + ": " + d[key] + "\n")
+	}
+	return fmt.Sprintf("OK %d\r\n%s\r\n", b.Len(), b.String())
+}
+
+// fakePHP writes a shell script standing in for the PHP binary and returns
+// its path. Workers run without a PATH, so commands need their full path.
+// Scripts should read the job from stdin before exiting, or spawning the
+// worker may fail writing it.
+func fakePHP(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "php")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// countingPHP returns a fake PHP binary which reads its job and exits 0,
+// and a function returning how many times it was run.
+func countingPHP(t *testing.T) (string, func() int) {
+	t.Helper()
+	runs := filepath.Join(t.TempDir(), "runs")
+	php := fakePHP(t, "/bin/cat >/dev/null; echo run >>"+runs)
+	return php, func() int {
+		data, err := os.ReadFile(runs)
+		if os.IsNotExist(err) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "run")
+	}
+}
+
+// instanceRoot creates an instance root holding the worker directory of
+// each domain.
+func instanceRoot(t *testing.T, domains ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, domain := range domains {
+		if err := os.MkdirAll(filepath.Join(root, domain, "worker"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// startBroker creates a broker of tubes against s, run until the test ends,
+// and returns it with a function having it process the next job. The broker
+// is only started by the first job, so that the test can set it up before.
+func (s *fakeServer) startBroker(o cli.Options, tubes ...string) (*Broker, func() *JobResult) {
+	results := make(chan *JobResult)
+	b := NewGroup(o, tubes, 0, results)
+	ticks := make(chan bool)
+	done := make(chan struct{})
+	var start sync.Once
+
+	// The broker only checks for shutdown between jobs, so it must not be
+	// left waiting for one.
+	s.t.Cleanup(func() {
+		// Never started, there is nothing to wait for.
+		start.Do(func() { close(done) })
+		close(ticks)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			s.t.Error("broker did not stop")
+		}
+	})
+
+	return &b, func() *JobResult {
+		s.t.Helper()
+		start.Do(func() { go b.Run(ticks, func() { close(done) }) })
+		ticks <- true
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(10 * time.Second):
+			s.t.Fatal("no job processed")
+			return nil
+		}
+	}
+}
+
+// fakeProcess is a worker process scripted by a test, started by a
+// fakeExecutor.
+type fakeProcess struct {
+	// stdout is written once the process is started.
+	stdout []string
+
+	// status is the exit status, and waitErr the error, it exits with.
+	status  int
+	waitErr error
+
+	// stderr is what the process wrote to stderr.
+	stderr string
+
+	// runFor is how long the process runs for once started, unless it is
+	// terminated first.
+	runFor time.Duration
+
+	// startErr fails starting the process.
+	startErr error
+
+	// stdinErr fails writing stdin, once the process has started.
+	stdinErr error
+
+	// ignoreTerm keeps the process running when it is terminated, until
+	// it is killed.
+	ignoreTerm bool
+
+	mu         sync.Mutex
+	env        []string
+	stdin      []byte
+	started    bool
+	terminated int
+	killed     bool
+	stop       chan struct{}
+	waited     chan struct{}
+	out        chan []byte
+	wait       chan cmd.WaitResult
+}
+
+func (p *fakeProcess) AddEnv(env ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.env = append(p.env, env...)
+}
+
+func (p *fakeProcess) StartWithStdin(input []byte) error {
+	if p.startErr != nil {
+		return p.startErr
+	}
+	p.mu.Lock()
+	p.started, p.stdin = true, input
+	p.mu.Unlock()
+
+	p.waited = make(chan struct{})
+	go func() {
+		defer close(p.waited)
+		for _, line := range p.stdout {
+			p.out <- []byte(line)
+		}
+		close(p.out)
+		wr := cmd.WaitResult{Status: p.status, Err: p.waitErr}
+		select {
+		case <-time.After(p.runFor):
+		case <-p.stop:
+			wr = cmd.WaitResult{Status: -1}
+		}
+		p.wait <- wr
+	}()
+	return p.stdinErr
+}
+
+func (p *fakeProcess) Started() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.started
+}
+
+func (p *fakeProcess) Terminate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.terminated++
+	if !p.ignoreTerm && p.terminated == 1 {
+		close(p.stop)
+	}
+	return nil
+}
+
+func (p *fakeProcess) Kill() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.killed && (p.ignoreTerm || p.terminated == 0) {
+		close(p.stop)
+	}
+	p.killed = true
+	return nil
+}
+
+func (p *fakeProcess) Stderr() []byte {
+	return []byte(p.stderr)
+}
+
+func (p *fakeProcess) WaitChan() <-chan cmd.WaitResult {
+	return p.wait
+}
+
+// terminations returns how many times the process was terminated.
+func (p *fakeProcess) terminations() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.terminated
+}
+
+// reaped reports whether the process was killed, and its exit waited on.
+func (p *fakeProcess) reaped() bool {
+	p.mu.Lock()
+	killed := p.killed
+	p.mu.Unlock()
+	select {
+	case <-p.waited:
+		return killed && len(p.wait) == 0
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+// environ returns the variables added to the process's environment.
+func (p *fakeProcess) environ() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.env...)
+}
+
+// fakeExecutor is an Executor handing out fakeProcesses, one per job.
+type fakeExecutor struct {
+	// next makes the process of each job, a process exiting 0 when nil.
+	next func() *fakeProcess
+
+	// err fails creating the process.
+	err error
+
+	mu    sync.Mutex
+	procs []*fakeProcess
+	cwds  []string
+	args  [][]string
+}
+
+func (e *fakeExecutor) Execute(cwd, name string, args ...string) (Process, <-chan []byte, error) {
+	if e.err != nil {
+		return nil, nil, e.err
+	}
+	p := &fakeProcess{}
+	if e.next != nil {
+		p = e.next()
+	}
+	p.stop = make(chan struct{})
+	p.out = make(chan []byte)
+	p.wait = make(chan cmd.WaitResult, 1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.procs = append(e.procs, p)
+	e.cwds = append(e.cwds, cwd)
+	e.args = append(e.args, append([]string{name}, args...))
+	return p, p.out, nil
+}
+
+// started returns the processes created so far.
+func (e *fakeExecutor) started() []*fakeProcess {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*fakeProcess(nil), e.procs...)
+}
+
+// workdirs returns the directories the processes were created in.
+func (e *fakeExecutor) workdirs() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.cwds...)
+}
+
+// commandLines returns the command lines the processes were created with.
+func (e *fakeExecutor) commandLines() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lines := make([]string, len(e.args))
+	for i, args := range e.args {
+		lines[i] = strings.Join(args, " ")
+	}
+	return lines
+}
+
+// testBroker creates a broker of tubes, executing jobs with e and routing
+// every job to /work.
+func testBroker(o cli.Options, e *fakeExecutor, tubes ...string) *Broker {
+	b := NewGroup(o, tubes, 0, nil)
+	b.Execute = e.Execute
+	b.CheckPressure = nil
+	b.ResolveWorkDir = func(o cli.Options, job bs.Job, packet Packet) (string, error) {
+		return "/work", nil
+	}
+	return &b
+}
+
+// runJobs runs b until it has reserved n jobs, returning once it has
+// stopped.
+func runJobs(b *Broker, n int) {
+	ticks := make(chan bool)
+	done := make(chan struct{})
+	go b.Run(ticks, func() { close(done) })
+	for i := 0; i < n; i++ {
+		ticks <- true
+	}
+	close(ticks)
+	<-done
+}
+
+// reserveJob reserves job id on a new connection to s, for the broker to
+// process.
+func (s *fakeServer) reserveJob(id uint64) bs.Job {
+	s.t.Helper()
+	nc, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	body, err := bs.ReserveJob(nc, id)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	conn := beanstalk.NewConn(nc)
+	s.t.Cleanup(func() { conn.Close() })
+	return bs.NewJob(id, body, conn)
+}
+
+// process puts a job with packet on tube and has b process it, returning the
+// result.
+func (s *fakeServer) process(b *Broker, tube string, ttr time.Duration, packet map[interface{}]interface{}) (uint64, *JobResult) {
+	s.t.Helper()
+	id := s.put(tube, 100, ttr, phpPacket(s.t, packet))
+	result, err := b.processJob(s.reserveJob(id))
+	if err != nil {
+		s.t.Fatalf("processJob: %s", err)
+	}
+	return id, result
+}
+
+// phpPacket serializes a job packet as PHP producers do.
+func phpPacket(t *testing.T, packet map[interface{}]interface{}) string {
+	t.Helper()
+	enc, err := phpserialize.Encode(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+// domainPacket is a minimal job packet, for domain.
+func domainPacket(domain string) map[interface{}]interface{} {
+	return map[interface{}]interface{}{"domain": domain}
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+)
+
+// ShedDelay is how long a job shed for being below its tube's priority
+// floor is delayed, so that it is not reserved again straight away.
+const ShedDelay = 10 * time.Second
+
+// PriorityFloors holds the priority floors of tubes set at runtime through
+// the admin API, to shed load under overload: a job whose priority is less
+// urgent than its tube's floor, so numerically greater, is put back with
+// ShedDelay rather than executed. It is safe for concurrent use, and a nil
+// *PriorityFloors sheds nothing.
+type PriorityFloors struct {
+	mu     sync.Mutex
+	floors map[string]uint32
+}
+
+// NewPriorityFloors creates a PriorityFloors with no floor set.
+func NewPriorityFloors() *PriorityFloors {
+	return &PriorityFloors{floors: make(map[string]uint32)}
+}
+
+// Set sets the floor of tube, the least urgent priority still executed.
+func (f *PriorityFloors) Set(tube string, pri uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.floors[tube] = pri
+}
+
+// Clear removes the floor of tube, reporting whether it had one.
+func (f *PriorityFloors) Clear(tube string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.floors[tube]
+	delete(f.floors, tube)
+	return ok
+}
+
+// floor returns the floor of tube, false if it has none.
+func (f *PriorityFloors) floor(tube string) (uint32, bool) {
+	if f == nil {
+		return 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pri, ok := f.floors[tube]
+	return pri, ok
+}
+
+// ServeHTTP serves POST /tubes/{tube}/priority-floor?priority=N, setting the
+// floor of the tube to N, and DELETE, clearing it.
+func (f *PriorityFloors) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tubes/")
+	if !strings.HasSuffix(path, "/priority-floor") {
+		http.NotFound(w, r)
+		return
+	}
+	tube := strings.TrimSuffix(path, "/priority-floor")
+	if tube == "" {
+		http.Error(w, "missing tube", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		pri, err := strconv.ParseUint(r.URL.Query().Get("priority"), 10, 32)
+		if err != nil {
+			http.Error(w, "priority must be an integer between 0 and 4294967295", http.StatusBadRequest)
+			return
+		}
+		f.Set(tube, uint32(pri))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tube": tube, "priority": pri})
+	case http.MethodDelete:
+		if !f.Clear(tube) {
+			http.Error(w, fmt.Sprintf("tube %s has no priority floor", tube), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shed puts a job of tube less urgent than the tube's priority floor back
+// as a new job, delayed by ShedDelay, reporting whether it did. As when
+// handing a job off to its shard, the job's releases are left untouched, so
+// however long the floor lasts the job is not given up on for being shed.
+func (b *Broker) shed(job bs.Job, tube string, stats bs.JobStats) bool {
+	floor, ok := b.Floors.floor(tube)
+	if !ok || stats.Priority <= floor {
+		return false
+	}
+
+	b.log.Infof("job %d has priority %d, below the floor of %d, shedding it", job.Id, stats.Priority, floor)
+	id, err := job.Replace(job.Body, ShedDelay)
+	if err != nil && id == 0 {
+		b.noteDraining(err)
+		b.log.Errorf("failed to shed job %d, processing it now, error: %s", job.Id, err)
+		return false
+	} else if err != nil {
+		// The copy was put, so the job is left to go back to its tube on
+		// its TTR rather than executed twice.
+		b.log.Errorf("failed to delete job %d once shed as job %d, error: %s", job.Id, id, err)
+	}
+	jobsShed.Inc(tube)
+	return true
+}
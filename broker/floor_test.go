@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setFloor sends a priority floor request as the admin API receives it,
+// returning the status code.
+func setFloor(f *PriorityFloors, method, url string) int {
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w.Code
+}
+
+func TestPriorityFloor(t *testing.T) {
+	s := newFakeServer(t)
+	e := &fakeExecutor{}
+	b := testBroker(s.options(), e, "jobs")
+	b.Floors = NewPriorityFloors()
+	process := func(pri uint32) (uint64, *JobResult) {
+		id := s.put("jobs", pri, time.Minute, phpPacket(t, domainPacket("acme")))
+		result, err := b.processJob(s.reserveJob(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id, result
+	}
+
+	if code := setFloor(b.Floors, "POST", "/tubes/jobs/priority-floor?priority=100"); code != 200 {
+		t.Fatalf("status %d setting the floor", code)
+	}
+	low, result := process(2000)
+	if result != nil || s.state(low) != "deleted" || s.state(low+1) != "delayed" {
+		t.Errorf("job below the floor is %s with result %v, copy %s, want it put back with a delay", s.state(low), result, s.state(low+1))
+	}
+	high, _ := process(10)
+	if got := s.state(high); got != "deleted" {
+		t.Errorf("job above the floor is %s, want it processed", got)
+	}
+
+	// Once cleared, every job is processed again.
+	if code := setFloor(b.Floors, "DELETE", "/tubes/jobs/priority-floor"); code != 204 {
+		t.Fatalf("status %d clearing the floor", code)
+	}
+	low, _ = process(2000)
+	if got := s.state(low); got != "deleted" {
+		t.Errorf("job is %s once the floor is cleared, want it processed", got)
+	}
+	if n := len(e.started()); n != 2 {
+		t.Errorf("%d jobs executed, want 2", n)
+	}
+
+	for _, tt := range []struct {
+		method, url string
+		code        int
+	}{
+		{"POST", "/tubes/jobs/priority-floor?priority=urgent", 400},
+		{"DELETE", "/tubes/jobs/priority-floor", 404},
+		{"GET", "/tubes/jobs/priority-floor", 405},
+		{"POST", "/tubes/jobs/other?priority=1", 404},
+	} {
+		if code := setFloor(b.Floors, tt.method, tt.url); code != tt.code {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.url, code, tt.code)
+		}
+	}
+}
+
+func TestShedJobKeepsItsReleases(t *testing.T) {
+	s := newFakeServer(t)
+	e := &fakeExecutor{}
+	b := testBroker(s.options(), e, "jobs")
+	b.Floors = NewPriorityFloors()
+	b.Floors.Set("jobs", 100)
+
+	// Shedding more times than the job may be released does not use up its
+	// retries: each time it is put back as a new job.
+	id := s.put("jobs", 2000, time.Minute, phpPacket(t, domainPacket("acme")))
+	for i := uint64(0); i <= ReleaseTries; i++ {
+		if result, err := b.processJob(s.reserveJob(id)); err != nil || result != nil {
+			t.Fatalf("shedding job %d: result %v, error %v", id, result, err)
+		}
+		id++
+		if got := s.state(id); got != "delayed" {
+			t.Fatalf("shed job is %s, want delayed", got)
+		}
+	}
+
+	b.Floors.Clear("jobs")
+	if _, err := b.processJob(s.reserveJob(id)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.state(id); got != "deleted" || len(e.started()) != 1 {
+		t.Errorf("job is %s after %d executions once the floor is cleared, want it executed", got, len(e.started()))
+	}
+}
@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// FollowUpDirective starts a line of job stdout asking the broker to put a
+// follow-up job once the job has succeeded. The rest of the line is a JSON
+// object, for example:
+//
+//	@beanstalk-put {"tube": "emails", "body": "...", "priority": 100, "delay": "30s", "ttr": "2m"}
+//
+// Only tube is required. Follow-ups of a job that fails are discarded.
+const FollowUpDirective = "@beanstalk-put "
+
+// Defaults for the fields a follow-up directive leaves out.
+const (
+	FollowUpPriority = 1024
+	FollowUpTTR      = 60 * time.Second
+)
+
+// FollowUp is a job to be put once the job requesting it has succeeded.
+type FollowUp struct {
+	Tube     string       `json:"tube"`
+	Body     string       `json:"body"`
+	Priority *uint32      `json:"priority"`
+	Delay    cli.Duration `json:"delay"`
+	TTR      cli.Duration `json:"ttr"`
+}
+
+// parseFollowUp parses the JSON part of a follow-up directive.
+func parseFollowUp(data []byte) (f FollowUp, err error) {
+	if err = json.Unmarshal(data, &f); err != nil {
+		return
+	}
+	if f.Tube == "" {
+		err = errors.New("follow-up directive has no tube")
+	} else if f.Delay.Duration < 0 || f.TTR.Duration < 0 {
+		err = errors.New("follow-up directive has a negative duration")
+	}
+	return
+}
+
+// putFollowUps puts the follow-up jobs requested by a successful job.
+// Failures are logged, they don't change what happens to the job.
+func (b *Broker) putFollowUps(job bs.Job, followUps []FollowUp) {
+	for _, f := range followUps {
+		pri := uint32(FollowUpPriority)
+		if f.Priority != nil {
+			pri = *f.Priority
+		}
+		ttr := FollowUpTTR
+		if f.TTR.Duration > 0 {
+			ttr = f.TTR.Duration
+		}
+
+		id, err := bs.Put(job.Conn(), b.options.Prefixed(f.Tube), []byte(f.Body), pri, f.Delay.Duration, ttr)
+		if err != nil {
+			b.noteDraining(err)
+			b.log.Errorf("failed to put follow-up of job %d on tube %s, error: %s", job.Id, f.Tube, err)
+			continue
+		}
+		b.log.Infof("put follow-up job %d of job %d on tube %s", id, job.Id, f.Tube)
+	}
+}
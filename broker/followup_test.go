@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFollowUp(t *testing.T) {
+	f, err := parseFollowUp([]byte(`{"tube": "emails", "body": "hi", "priority": 10, "delay": "30s", "ttr": "2m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Tube != "emails" || f.Body != "hi" || f.Priority == nil || *f.Priority != 10 || f.Delay.Duration != 30*time.Second || f.TTR.Duration != 2*time.Minute {
+		t.Errorf("parsed %+v", f)
+	}
+
+	f, err = parseFollowUp([]byte(`{"tube": "emails"}`))
+	if err != nil || f.Priority != nil || f.Delay.Duration != 0 || f.TTR.Duration != 0 {
+		t.Errorf("tube only: parsed %+v, error %v", f, err)
+	}
+
+	for _, invalid := range []string{
+		`{"body": "hi"}`,
+		`{"tube": "emails", "delay": "-1s"}`,
+		`{"tube": "emails", "ttr": "soon"}`,
+		`{"tube": "emails"`,
+	} {
+		if _, err := parseFollowUp([]byte(invalid)); err == nil {
+			t.Errorf("%s parsed", invalid)
+		}
+	}
+}
+
+func TestScannerCapsLine(t *testing.T) {
+	var s stdoutScanner
+	chunk := []byte(strings.Repeat("x", maxScanLineBytes/2))
+	for i := 0; i < 8; i++ {
+		s.Write(chunk)
+		if n := len(s.line); n > maxScanLineBytes {
+			t.Fatalf("holding %d bytes of a line, want at most %d", n, maxScanLineBytes)
+		}
+	}
+
+	// The line ends, and the next is scanned in full.
+	s.Write([]byte("\n" + FollowUpDirective + `{"tube": "emails"}` + "\n"))
+	s.Close()
+	if len(s.followUps) != 1 || s.followUps[0].Tube != "emails" || len(s.errs) != 0 {
+		t.Errorf("follow-ups %+v, errors %v, want the directive after the long line", s.followUps, s.errs)
+	}
+}
+
+func TestFollowUpPut(t *testing.T) {
+	s := newFakeServer(t)
+	stdout := "echo sending\n" +
+		"echo '" + FollowUpDirective + `{"tube": "emails", "body": "hi", "priority": 10, "delay": "30s", "ttr": "2m"}` + "'\n" +
+		"echo '" + FollowUpDirective + "{not json}'\n"
+	o := s.options()
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null\n"+stdout)
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(o, "jobs")
+	if result := next(); len(result.FollowUps) != 1 {
+		t.Fatalf("%d follow-ups, want the valid one", len(result.FollowUps))
+	}
+	f, ok := s.job(id + 1)
+	if !ok {
+		t.Fatal("follow-up job was not put")
+	}
+	if f.tube != "emails" || string(f.body) != "hi" || f.pri != 10 || f.ttr != 2*time.Minute || f.state != "delayed" {
+		t.Errorf("follow-up job %+v", f)
+	}
+
+	// A failed job's follow-ups are discarded.
+	b.options.PHPBinary = fakePHP(t, "/bin/cat >/dev/null\n"+stdout+"exit 1")
+	id = s.putPacket("jobs", domainPacket("acme"))
+	next()
+	if _, ok := s.job(id + 1); ok {
+		t.Error("follow-up of a failed job was put")
+	}
+}
@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// Framings of the job body written to the worker's stdin, see -stdin-framing.
+const (
+	// StdinFramingRaw writes the body as is.
+	StdinFramingRaw = "raw"
+
+	// StdinFramingNewline terminates the body with a newline.
+	StdinFramingNewline = "newline"
+
+	// StdinFramingLengthPrefixed precedes the body with its length as a
+	// 4 byte big-endian unsigned integer.
+	StdinFramingLengthPrefixed = "length-prefixed"
+
+	// StdinFramingBase64 writes the body in standard base64 encoding.
+	StdinFramingBase64 = "base64"
+)
+
+// frameStdin frames a job body for the worker's stdin.
+func frameStdin(framing string, body []byte) []byte {
+	switch framing {
+	case StdinFramingNewline:
+		return append(append(make([]byte, 0, len(body)+1), body...), '\n')
+	case StdinFramingLengthPrefixed:
+		framed := make([]byte, 4, len(body)+4)
+		binary.BigEndian.PutUint32(framed, uint32(len(body)))
+		return append(framed, body...)
+	case StdinFramingBase64:
+		framed := make([]byte, base64.StdEncoding.EncodedLen(len(body)))
+		base64.StdEncoding.Encode(framed, body)
+		return framed
+	default:
+		return body
+	}
+}
@@ -0,0 +1,25 @@
+package broker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameStdin(t *testing.T) {
+	body := []byte("a:1:{s:3:\"foo\";i:1;}")
+	tests := []struct {
+		framing string
+		want    []byte
+	}{
+		{StdinFramingRaw, body},
+		{"", body},
+		{StdinFramingNewline, append([]byte("a:1:{s:3:\"foo\";i:1;}"), '\n')},
+		{StdinFramingLengthPrefixed, append([]byte{0, 0, 0, 20}, body...)},
+		{StdinFramingBase64, []byte("YToxOntzOjM6ImZvbyI7aToxO30=")},
+	}
+	for _, tt := range tests {
+		if got := frameStdin(tt.framing, body); !bytes.Equal(got, tt.want) {
+			t.Errorf("%q: framed %q, want %q", tt.framing, got, tt.want)
+		}
+	}
+}
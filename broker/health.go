@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// dependencyHealthy exports whether the external dependency of jobs is
+// healthy, 1 or 0.
+var dependencyHealthy = metrics.NewGauge("dependency_healthy",
+	"Whether the dependency checked by -dependency-healthcheck-url is healthy.")
+
+// HealthChecker returns an error while an external dependency of the jobs is
+// unhealthy, nil when it is healthy.
+type HealthChecker func() error
+
+// URLChecker is the HealthChecker of a URL, healthy while a GET of it is
+// answered with a 2xx status within timeout.
+func URLChecker(url string, timeout time.Duration) HealthChecker {
+	client := &http.Client{Timeout: timeout}
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("dependency health check of %s failed, error: %s", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("dependency health check of %s failed with status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// DependencyHealth is the last known health of an external dependency,
+// shared by every broker. Unlike resource pressure, which each broker checks
+// for itself, it is a single gate polled in the background: while the
+// dependency is unhealthy, no broker reserves jobs, as they would only fail
+// and use up their retries.
+type DependencyHealth struct {
+	check HealthChecker
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewDependencyHealth creates the DependencyHealth of check, healthy until
+// it is first checked.
+func NewDependencyHealth(check HealthChecker) *DependencyHealth {
+	dependencyHealthy.Set(1)
+	return &DependencyHealth{check: check}
+}
+
+// Err returns the error of the last check, nil while the dependency is
+// healthy or when h is nil.
+func (h *DependencyHealth) Err() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Poll checks the dependency every interval until stop is closed.
+func (h *DependencyHealth) Poll(interval time.Duration, stop <-chan bool) {
+	for _ = range instantTicker(interval, 0, nil, stop) {
+		h.update()
+	}
+}
+
+// update checks the dependency, logging when its health changes.
+func (h *DependencyHealth) update() {
+	err := h.check()
+
+	h.mu.Lock()
+	was := h.err
+	h.err = err
+	h.mu.Unlock()
+
+	if err != nil {
+		dependencyHealthy.Set(0)
+		if was == nil {
+			log.Warnf("dependency is unhealthy, pausing reserving on every tube, error: %s", err)
+		}
+		return
+	}
+	dependencyHealthy.Set(1)
+	if was != nil {
+		log.Info("dependency is healthy again, resuming reserving")
+	}
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnhealthyDependencyPausesReserving(t *testing.T) {
+	defer func(d time.Duration) { PressureCheckInterval = d }(PressureCheckInterval)
+	PressureCheckInterval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	healthy := false
+	h := NewDependencyHealth(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !healthy {
+			return errors.New("search service is down")
+		}
+		return nil
+	})
+	h.update()
+
+	s := newFakeServer(t)
+	id := s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(s.options(), "jobs")
+	b.Health = h
+
+	results := make(chan *JobResult)
+	go func() { results <- next() }()
+	select {
+	case <-results:
+		t.Fatal("processed a job while the dependency was unhealthy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := s.count("reserve"); n != 0 {
+		t.Errorf("reserved %d times while the dependency was unhealthy", n)
+	}
+
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	h.update()
+	select {
+	case <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserving did not resume once the dependency recovered")
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it processed once the dependency recovered", got)
+	}
+}
+
+func TestURLChecker(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	check := URLChecker(srv.URL, time.Second)
+	if err := check(); err != nil {
+		t.Errorf("healthy dependency: %s", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := check(); err == nil {
+		t.Error("a 503 was taken as healthy")
+	}
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/kayako/beanstalk-broker/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// heartbeats counts the heartbeats of -heartbeat-interval, a sign of life
+// for monitors which cannot reach the admin API.
+var heartbeats = metrics.NewCounter("heartbeats_total",
+	"Number of heartbeats logged by the process.")
+
+// RunHeartbeat logs a heartbeat every interval until shutdown, with the
+// number of jobs executing, the number executed and the uptime.
+func (bd *BrokerDispatcher) RunHeartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bd.heartbeat()
+			case <-bd.ret:
+				return
+			}
+		}
+	}()
+}
+
+func (bd *BrokerDispatcher) heartbeat() {
+	executing, finished := bd.InFlight.Counts()
+	heartbeats.Inc()
+	log.WithFields(log.Fields{
+		"event":     "heartbeat",
+		"in_flight": executing,
+		"processed": finished,
+		"uptime":    time.Since(bd.started).Round(time.Second).String(),
+	}).Info("alive")
+}
@@ -0,0 +1,27 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s := newFakeServer(t)
+	bd := NewBrokerDispatcher(s.options())
+
+	before := heartbeats.Value()
+	bd.RunHeartbeat(50 * time.Millisecond)
+	time.Sleep(275 * time.Millisecond)
+	if n := heartbeats.Value() - before; n < 4 || n > 6 {
+		t.Errorf("%v heartbeats in 275ms, want one every 50ms", n)
+	}
+
+	bd.Shutdown()
+	bd.Wait()
+	time.Sleep(60 * time.Millisecond)
+	stopped := heartbeats.Value()
+	time.Sleep(150 * time.Millisecond)
+	if n := heartbeats.Value() - stopped; n != 0 {
+		t.Errorf("%v heartbeats after shutdown, want none", n)
+	}
+}
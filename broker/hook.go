@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"fmt"
+)
+
+// Outcomes of a job, as passed to the post-job hook and the audit log.
+const (
+	OutcomeSucceeded    = "succeeded"
+	OutcomeFailed       = "failed"
+	OutcomeTimedOut     = "timed_out"
+	OutcomeBuried       = "buried"
+	OutcomeStale        = "stale"
+	OutcomeRejected     = "rejected"
+	OutcomeDeadLettered = "dead_lettered"
+	OutcomeInterrupted  = "interrupted"
+)
+
+// outcome summarises how a job ended.
+func (r *JobResult) outcome() string {
+	switch {
+	case r.Stale:
+		return OutcomeStale
+	case r.ValidationFailed:
+		return OutcomeRejected
+	case r.DeadLettered:
+		return OutcomeDeadLettered
+	case r.Interrupted:
+		return OutcomeInterrupted
+	case r.TimedOut:
+		return OutcomeTimedOut
+	case r.Buried:
+		return OutcomeBuried
+	case r.Error != nil || !r.ExitedOK():
+		return OutcomeFailed
+	default:
+		return OutcomeSucceeded
+	}
+}
+
+// runPostJobHook runs the -post-job-hook command once a job has been disposed
+// of, passing the job metadata in its environment. Failures are only logged,
+// the hook has no say in what happens to the job.
+func (b *Broker) runPostJobHook(tube, wd string, r *JobResult) {
+	c, out, err := commandExecutor(wd, b.options.PostJobHook)
+	if err != nil {
+		b.log.Errorf("failed to create post-job hook for job %d, error: %s", r.JobId, err)
+		return
+	}
+	c.AddEnv(
+		fmt.Sprintf("JOB_ID=%d", r.JobId),
+		"JOB_TUBE="+tube,
+		fmt.Sprintf("JOB_EXIT_STATUS=%d", r.ExitStatus),
+		"JOB_OUTCOME="+r.outcome(),
+		fmt.Sprintf("JOB_ATTEMPT=%d", r.Attempt),
+		"JOB_DOMAIN="+r.Domain,
+		"BEANSTALK_WORKER_ID="+b.options.WorkerId,
+	)
+
+	if err := c.StartWithStdin(nil); err != nil {
+		b.log.Errorf("failed to start post-job hook for job %d, error: %s", r.JobId, err)
+		return
+	}
+
+	// The hook's stdout is not used, but must be drained for it to exit.
+	for _ = range out {
+	}
+
+	if wr := <-c.WaitChan(); wr.Err != nil {
+		b.log.Errorf("post-job hook for job %d failed, error: %s", r.JobId, wr.Err)
+	} else if wr.Status != 0 {
+		b.log.Warnf("post-job hook for job %d exited with status %d", r.JobId, wr.Status)
+	}
+}
@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hookScript writes a shell script to dir, returning its path.
+func hookScript(t *testing.T, dir, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPostJobHookEnvironment(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	dir := filepath.Join(o.InstanceRoot, "acme", "worker")
+	o.PostJobHook = hookScript(t, t.TempDir(), "/usr/bin/env > hook.env\n")
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; exit 3")
+	o.WorkerId = "test-worker"
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	next()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "hook.env"))
+	if err != nil {
+		t.Fatalf("hook did not run in the job's directory, error: %s", err)
+	}
+	env := strings.Split(string(data), "\n")
+	for _, want := range []string{
+		fmt.Sprintf("JOB_ID=%d", id),
+		"JOB_TUBE=jobs",
+		"JOB_EXIT_STATUS=3",
+		"JOB_OUTCOME=failed",
+		"JOB_ATTEMPT=1",
+		"BEANSTALK_WORKER_ID=test-worker",
+	} {
+		found := false
+		for _, v := range env {
+			found = found || v == want
+		}
+		if !found {
+			t.Errorf("hook environment lacks %s", want)
+		}
+	}
+}
+
+func TestPostJobHookFailureIgnored(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PostJobHook = hookScript(t, t.TempDir(), "exit 7\n")
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	if result := next(); result.Error != nil {
+		t.Errorf("result error %v from a failing hook", result.Error)
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it deleted whatever the hook does", got)
+	}
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InFlightJob describes a job which is being executed.
+type InFlightJob struct {
+	JobId   uint64        `json:"id"`
+	Tube    string        `json:"tube"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed"`
+	WorkDir string        `json:"workDir"`
+}
+
+// InFlight tracks the jobs being executed by a set of brokers. It is safe for
+// concurrent use, and a nil *InFlight tracks nothing.
+type InFlight struct {
+	mu        sync.Mutex
+	jobs      map[uint64]InFlightJob
+	processes map[uint64]Process
+
+	// finished counts the jobs which have finished executing.
+	finished uint64
+}
+
+// NewInFlight creates an empty InFlight.
+func NewInFlight() *InFlight {
+	return &InFlight{jobs: make(map[uint64]InFlightJob), processes: make(map[uint64]Process)}
+}
+
+// add records a job as started, returning a func which removes it again.
+func (f *InFlight) add(id uint64, tube, wd string) func() {
+	if f == nil {
+		return func() {}
+	}
+
+	f.mu.Lock()
+	f.jobs[id] = InFlightJob{JobId: id, Tube: tube, Started: time.Now(), WorkDir: wd}
+	f.mu.Unlock()
+
+	return func() {
+		f.mu.Lock()
+		delete(f.jobs, id)
+		delete(f.processes, id)
+		f.finished++
+		f.mu.Unlock()
+	}
+}
+
+// setProcess records the started process of a job, for Terminate.
+func (f *InFlight) setProcess(id uint64, p Process) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	if _, ok := f.jobs[id]; ok {
+		f.processes[id] = p
+	}
+	f.mu.Unlock()
+}
+
+// Terminate stops the processes of the jobs executing with their kill
+// sequence, returning how many it signalled.
+func (f *InFlight) Terminate() int {
+	if f == nil {
+		return 0
+	}
+
+	f.mu.Lock()
+	processes := make(map[uint64]Process, len(f.processes))
+	for id, p := range f.processes {
+		processes[id] = p
+	}
+	f.mu.Unlock()
+
+	for id, p := range processes {
+		if err := p.Terminate(); err != nil {
+			log.Errorf("failed to terminate job %d, error: %s", id, err)
+		}
+	}
+	return len(processes)
+}
+
+// Jobs returns the jobs currently executing, oldest first.
+func (f *InFlight) Jobs() []InFlightJob {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	jobs := make([]InFlightJob, 0, len(f.jobs))
+	for _, j := range f.jobs {
+		j.Elapsed = now.Sub(j.Started)
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Started.Before(jobs[k].Started) })
+	return jobs
+}
+
+// Counts returns how many jobs are executing, and how many have finished.
+func (f *InFlight) Counts() (executing int, finished uint64) {
+	if f == nil {
+		return 0, 0
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.jobs), f.finished
+}
+
+// ServeHTTP writes the jobs currently executing as a JSON array.
+func (f *InFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.Jobs())
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// inFlightJobs fetches the in-flight jobs as the admin API serves them.
+func inFlightJobs(t *testing.T, f *InFlight) []InFlightJob {
+	t.Helper()
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/in-flight", nil))
+	var jobs []InFlightJob
+	if err := json.NewDecoder(w.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestInFlightListsExecutingJobs(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; /bin/sleep 0.3")
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(o, "jobs")
+	b.InFlight = NewInFlight()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		next()
+	}()
+
+	var jobs []InFlightJob
+	for start := time.Now(); len(jobs) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(5 * time.Millisecond)
+		jobs = inFlightJobs(t, b.InFlight)
+	}
+	wd := filepath.Join(o.InstanceRoot, "acme", "worker")
+	if len(jobs) != 1 || jobs[0].JobId != id || jobs[0].Tube != "jobs" || jobs[0].WorkDir != wd {
+		t.Errorf("in-flight jobs %+v, want job %d of tube jobs in %s", jobs, id, wd)
+	}
+
+	<-done
+	if jobs := inFlightJobs(t, b.InFlight); len(jobs) != 0 {
+		t.Errorf("in-flight jobs %+v once finished, want none", jobs)
+	}
+}
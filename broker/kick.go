@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kr/beanstalk"
+	log "github.com/sirupsen/logrus"
+)
+
+// KickAll kicks up to bound buried jobs of each of the tubes the options
+// watch, every tube on the server with -all, back to the ready queue, in
+// order, returning how many were kicked per tube. It stops at the first
+// error, returning the counts so far.
+func KickAll(o cli.Options, bound int) (map[string]int, error) {
+	if bound <= 0 || bound > cli.MaxKickBound {
+		return nil, fmt.Errorf("kick bound must be between 1 and %d, got %d", cli.MaxKickBound, bound)
+	}
+
+	nc, err := dial(o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s, error: %s", o.Address, err)
+	}
+	conn := beanstalk.NewConn(nc)
+	defer conn.Close()
+
+	tubes := append(cli.TubeList{}, o.Tubes...)
+	tubes = append(tubes, o.TubeGroup...)
+	if o.All {
+		all, err := conn.ListTubes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tubes, error: %s", err)
+		}
+		tubes = tubes[:0]
+		for _, tube := range all {
+			if tube, ok := o.Unprefixed(tube); ok {
+				tubes = append(tubes, tube)
+			}
+		}
+	}
+	tubes, _ = tubes.Dedupe()
+
+	kicked := make(map[string]int, len(tubes))
+	for i, tube := range tubes {
+		n, err := kickBuried(conn, o.Prefixed(tube), bound)
+		if err != nil {
+			return kicked, fmt.Errorf("failed to kick tube %s, error: %s", tube, err)
+		}
+		kicked[tube] = n
+		log.Infof("kicked %d buried jobs of tube %s (%d/%d tubes)", n, tube, i+1, len(tubes))
+	}
+	return kicked, nil
+}
+
+// kickBuried kicks up to bound of the buried jobs of tube. The server kicks
+// delayed jobs instead when a tube has none buried, so the kick is bounded
+// by the number buried as well. A tube which does not exist has none.
+func kickBuried(conn *beanstalk.Conn, tube string, bound int) (int, error) {
+	stats, err := bs.ReadTubeStats(conn, tube)
+	if isNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if stats.CurrentJobsBuried < uint64(bound) {
+		bound = int(stats.CurrentJobsBuried)
+	}
+	if bound == 0 {
+		return 0, nil
+	}
+	return (&beanstalk.Tube{Conn: conn, Name: tube}).Kick(bound)
+}
+
+// KickAllHandler serves POST /kick-all?bound=N, kicking up to N buried jobs
+// with KickAll and writing the counts per tube as a JSON object.
+func KickAllHandler(o cli.Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		bound, err := strconv.Atoi(r.URL.Query().Get("bound"))
+		if err != nil || bound <= 0 || bound > cli.MaxKickBound {
+			http.Error(w, fmt.Sprintf("bound must be an integer between 1 and %d", cli.MaxKickBound), http.StatusBadRequest)
+			return
+		}
+
+		kicked, err := KickAll(o, bound)
+		if err != nil {
+			log.Error(err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]interface{}{"kicked": kicked, "error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"kicked": kicked})
+	})
+}
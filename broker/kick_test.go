@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// putBuried adds n buried jobs to tube.
+func (s *fakeServer) putBuried(tube string, n int) {
+	for i := 0; i < n; i++ {
+		id := s.put(tube, 100, time.Minute, "x")
+		s.mu.Lock()
+		s.jobs[id].state = "buried"
+		s.mu.Unlock()
+	}
+}
+
+func TestKickAllBoundPerTube(t *testing.T) {
+	s := newFakeServer(t)
+	s.putBuried("email", 3)
+	s.putBuried("sms", 1)
+	s.mu.Lock()
+	delayed := s.putLocked("push", 100, time.Hour, time.Minute, []byte("x"))
+	s.mu.Unlock()
+	o := s.options()
+	o.Tubes = cli.TubeList{"email", "sms", "push", "absent"}
+
+	// Each tube is kicked up to the bound.
+	kicked, err := KickAll(o, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kicked["email"] != 2 || kicked["sms"] != 1 || kicked["push"] != 0 || kicked["absent"] != 0 {
+		t.Errorf("kicked %v, want up to 2 jobs of each tube", kicked)
+	}
+	// A tube without buried jobs keeps its delayed jobs, which a kick
+	// would move instead.
+	if got := s.state(delayed); got != "delayed" {
+		t.Errorf("delayed job is %s, want it left delayed", got)
+	}
+
+	kicked, err = KickAll(o, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kicked["email"] != 1 || kicked["sms"] != 0 {
+		t.Errorf("kicked %v, want the email job left", kicked)
+	}
+
+	for _, bound := range []int{0, cli.MaxKickBound + 1} {
+		if _, err := KickAll(o, bound); err == nil {
+			t.Errorf("kicked with a bound of %d", bound)
+		}
+	}
+}
+
+func TestKickAllHandler(t *testing.T) {
+	s := newFakeServer(t)
+	s.putBuried("email", 2)
+	o := s.options()
+	o.Tubes = cli.TubeList{"email"}
+	srv := httptest.NewServer(KickAllHandler(o))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/kick-all?bound=5", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct{ Kicked map[string]int }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Kicked["email"] != 2 {
+		t.Errorf("kicked %v, want both email jobs", body.Kicked)
+	}
+
+	for _, query := range []string{"", "?bound=0", "?bound=x", "?bound=100001"} {
+		resp, err := http.Post(srv.URL+"/kick-all"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"github.com/kayako/beanstalk-broker/bs"
+)
+
+// Hooks are called by a broker as each job moves through its lifecycle, for
+// programs embedding the broker to add metrics, tracing or side effects.
+// Any of them may be nil. They are called synchronously on the goroutine
+// processing the job, which waits on them, so should return quickly and
+// hand slow work off.
+type Hooks struct {
+	// OnReserve is called with each job reserved, before it is checked or
+	// executed.
+	OnReserve func(job bs.Job)
+
+	// OnExecuteStart is called once the worker of a job has started in wd.
+	OnExecuteStart func(job bs.Job, wd string)
+
+	// OnComplete is called with the result of each job processed, once it
+	// has been disposed of.
+	OnComplete func(result JobResult)
+
+	// OnBury is called with each job buried, once beanstalkd has buried it.
+	OnBury func(job bs.Job)
+}
+
+func (h Hooks) reserved(job bs.Job) {
+	if h.OnReserve != nil {
+		h.OnReserve(job)
+	}
+}
+
+func (h Hooks) executing(job bs.Job, wd string) {
+	if h.OnExecuteStart != nil {
+		h.OnExecuteStart(job, wd)
+	}
+}
+
+func (h Hooks) completed(result *JobResult) {
+	if h.OnComplete != nil {
+		h.OnComplete(*result)
+	}
+}
+
+// bury buries job, calling the OnBury hook once it is. The jobs of tubes
+// skipping the retry precheck are buried with DefaultPriority, as reading
+// their own would take the round-trip skipped.
+func (b *Broker) bury(job bs.Job) error {
+	bury := job.Bury
+	if b.skipsPrecheck() {
+		bury = func() error { return job.BuryWithPriority(bs.DefaultPriority) }
+	}
+	if err := bury(); err != nil {
+		return err
+	}
+	if b.Hooks.OnBury != nil {
+		b.Hooks.OnBury(job)
+	}
+	return nil
+}
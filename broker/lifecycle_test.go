@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/kayako/beanstalk-broker/bs"
+)
+
+// recordingHooks returns Hooks appending each call to events.
+func recordingHooks() (Hooks, func() []string) {
+	var mu sync.Mutex
+	var events []string
+	add := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+	hooks := Hooks{
+		OnReserve:      func(job bs.Job) { add("reserve %d", job.Id) },
+		OnExecuteStart: func(job bs.Job, wd string) { add("execute %d in %s", job.Id, wd) },
+		OnComplete:     func(r JobResult) { add("complete %d exit(%d)", r.JobId, r.ExitStatus) },
+		OnBury:         func(job bs.Job) { add("bury %d", job.Id) },
+	}
+	return hooks, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	hooks, events := recordingHooks()
+	b := testBroker(o, &fakeExecutor{}, "jobs")
+	b.Hooks = hooks
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	runJobs(b, 1)
+	want := []string{
+		fmt.Sprintf("reserve %d", id),
+		fmt.Sprintf("execute %d in /work", id),
+		fmt.Sprintf("complete %d exit(0)", id),
+	}
+	if got := events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks called %q, want %q", got, want)
+	}
+
+	// A rejected job is buried without being executed.
+	hooks, events = recordingHooks()
+	b = testBroker(o, &fakeExecutor{}, "jobs")
+	b.Hooks = hooks
+	b.Validate = func(Packet) error { return errors.New("missing field") }
+	id = s.putPacket("jobs", domainPacket("acme"))
+	runJobs(b, 1)
+	want = []string{
+		fmt.Sprintf("reserve %d", id),
+		fmt.Sprintf("bury %d", id),
+		fmt.Sprintf("complete %d exit(0)", id),
+	}
+	if got := events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks called %q, want %q", got, want)
+	}
+	if got := s.state(id); got != "buried" {
+		t.Errorf("job is %s, want buried", got)
+	}
+}
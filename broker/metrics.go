@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kayako/beanstalk-broker/metrics"
+)
+
+var (
+	// jobsTotal counts the jobs processed, by outcome and domain.
+	jobsTotal = metrics.NewCounter("jobs_total",
+		"Number of jobs processed, by outcome and domain.", "tube", "outcome", "domain")
+
+	// jobDuration observes how long the workers of executed jobs ran.
+	jobDuration = metrics.NewHistogram("job_duration_seconds",
+		"Time the workers of executed jobs ran for.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}, "tube")
+
+	// spawnFailures counts jobs whose worker process could not be started.
+	spawnFailures = metrics.NewCounter("spawn_failures_total",
+		"Number of jobs whose worker process failed to start.", "tube")
+
+	// silentFailures counts jobs which exited non-zero without writing to
+	// stderr, leaving no clue as to why they failed.
+	silentFailures = metrics.NewCounter("silent_failures_total",
+		"Number of jobs which failed without writing to stderr.", "tube")
+
+	// connectionEvents counts brokers' connections to beanstalkd opening,
+	// closing, failing to open, being re-established and being refreshed.
+	connectionEvents = metrics.NewCounter("connection_events_total",
+		"Number of connection lifecycle events, by event.", "event", "tube", "worker")
+
+	// resultsDropped counts job results dropped as the results channel was
+	// full.
+	resultsDropped = metrics.NewCounter("results_dropped_total",
+		"Number of job results dropped because the results buffer was full.", "policy")
+
+	// deadletterTooBig counts jobs buried because beanstalkd refused their
+	// dead-letter copy as too big.
+	deadletterTooBig = metrics.NewCounter("deadletter_too_big_total",
+		"Number of jobs buried because they were too big for their dead-letter tube.", "tube")
+
+	// jobsShed counts jobs released for being below their tube's priority
+	// floor.
+	jobsShed = metrics.NewCounter("jobs_shed_total",
+		"Number of jobs released for being below their tube's priority floor.", "tube")
+
+	// jobReleases observes how many times each job processed had already
+	// been released, showing retry pressure before jobs are given up on.
+	jobReleases = metrics.NewHistogram("job_releases",
+		"Number of times jobs had been released when processed.",
+		[]float64{0, 1, 2, 3, 5, 8, 10, 20}, "tube")
+
+	// reservedJobs exports how many jobs of each tube are held reserved on
+	// shared connections.
+	reservedJobs = metrics.NewGauge("reserved_jobs",
+		"Number of jobs of the tube held reserved on a shared connection.", "tube")
+
+	// sinceLastSuccess exports how long ago each tube last had a job
+	// succeed, for alerting on brokers which are stuck or failing.
+	sinceLastSuccess = metrics.NewSinceGauge("seconds_since_last_success",
+		"Seconds since a job of the tube last succeeded.", "tube")
+
+	// serverJobs exports the server's current job counts by state.
+	serverJobs = metrics.NewGauge("beanstalkd_current_jobs",
+		"Number of jobs on the beanstalkd server, by state.", "state")
+
+	// serverConnections exports the server's current connection counts.
+	serverConnections = metrics.NewGauge("beanstalkd_current_connections",
+		"Number of connections to the beanstalkd server, by kind.", "kind")
+
+	// serverTotalJobs exports the number of jobs created since startup.
+	serverTotalJobs = metrics.NewGauge("beanstalkd_total_jobs",
+		"Number of jobs created by the beanstalkd server since it started.")
+
+	// serverCommands exports the server's command counts.
+	serverCommands = metrics.NewGauge("beanstalkd_commands",
+		"Number of commands handled by the beanstalkd server since it started.", "command")
+)
+
+// MaxDomainLabels caps the distinct domains labelling job metrics. Domains
+// seen once the cap is reached are labelled OtherDomain, so that the metrics
+// of a broker serving many tenants cannot grow without bound.
+var MaxDomainLabels = 100
+
+// OtherDomain labels the jobs of the domains past MaxDomainLabels.
+const OtherDomain = "other"
+
+// domainLabels holds the domains labelling job metrics.
+var domainLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// domainLabel returns the label of domain in job metrics.
+func domainLabel(domain string) string {
+	if domain == "" {
+		return ""
+	}
+	domainLabels.Lock()
+	defer domainLabels.Unlock()
+	if !domainLabels.seen[domain] {
+		if len(domainLabels.seen) >= MaxDomainLabels {
+			return OtherDomain
+		}
+		domainLabels.seen[domain] = true
+	}
+	return domain
+}
+
+// exportServerStats copies the selected server stats into their gauges.
+func exportServerStats(s bs.ServerStats) {
+	serverJobs.Set(float64(s.CurrentJobsUrgent), "urgent")
+	serverJobs.Set(float64(s.CurrentJobsReady), "ready")
+	serverJobs.Set(float64(s.CurrentJobsReserved), "reserved")
+	serverJobs.Set(float64(s.CurrentJobsDelayed), "delayed")
+	serverJobs.Set(float64(s.CurrentJobsBuried), "buried")
+
+	serverConnections.Set(float64(s.CurrentConnections), "all")
+	serverConnections.Set(float64(s.CurrentProducers), "producers")
+	serverConnections.Set(float64(s.CurrentWorkers), "workers")
+	serverConnections.Set(float64(s.CurrentWaiting), "waiting")
+
+	serverTotalJobs.Set(float64(s.TotalJobs))
+
+	serverCommands.Set(float64(s.CmdPut), "put")
+	serverCommands.Set(float64(s.CmdReserve), "reserve")
+	serverCommands.Set(float64(s.CmdDelete), "delete")
+	serverCommands.Set(float64(s.CmdRelease), "release")
+	serverCommands.Set(float64(s.CmdBury), "bury")
+	serverCommands.Set(float64(s.CmdKick), "kick")
+}
@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/metrics"
+)
+
+// scrape returns the lines of the metrics exposition mentioning tube.
+func scrape(t *testing.T, tube string) []string {
+	return scrapeLabel(t, "tube", tube)
+}
+
+// scrapeLabel returns the lines of the metrics exposition with the label set
+// to value.
+func scrapeLabel(t *testing.T, label, value string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var lines []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.Contains(line, fmt.Sprintf("%s=%q", label, value)) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestJobReleasesHistogram(t *testing.T) {
+	s := newFakeServer(t)
+	for _, releases := range []uint64{0, 1, 4, 15} {
+		id := s.putPacket("retrying", domainPacket("acme"))
+		s.setReleases(id, releases)
+	}
+	_, next := s.startBroker(s.options(), "retrying")
+	for i := 0; i < 4; i++ {
+		next()
+	}
+
+	lines := strings.Join(scrape(t, "retrying"), "\n")
+	for _, want := range []string{
+		`job_releases_bucket{tube="retrying",le="0"} 1`,
+		`job_releases_bucket{tube="retrying",le="1"} 2`,
+		`job_releases_bucket{tube="retrying",le="3"} 2`,
+		`job_releases_bucket{tube="retrying",le="5"} 3`,
+		`job_releases_bucket{tube="retrying",le="10"} 3`,
+		`job_releases_bucket{tube="retrying",le="20"} 4`,
+		`job_releases_bucket{tube="retrying",le="+Inf"} 4`,
+		`job_releases_sum{tube="retrying"} 20`,
+		`job_releases_count{tube="retrying"} 4`,
+	} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("exposition lacks %s:\n%s", want, lines)
+		}
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	o.WorkerId = "w1"
+	b := New(o, "dialling", 0, nil)
+	conn, err := b.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.disconnect(conn)
+
+	b.Address = closedAddress(t)
+	b.options.Address = b.Address
+	if _, err := b.connect(); err == nil {
+		t.Fatal("connected to a closed address")
+	}
+
+	lines := strings.Join(scrape(t, "dialling"), "\n")
+	for _, want := range []string{
+		`connection_events_total{event="open",tube="dialling",worker="w1"} 1`,
+		`connection_events_total{event="close",tube="dialling",worker="w1"} 1`,
+		`connection_events_total{event="dial_failure",tube="dialling",worker="w1"} 1`,
+	} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("exposition lacks %s:\n%s", want, lines)
+		}
+	}
+}
+
+func TestResultsOverflow(t *testing.T) {
+	// dropped returns the results dropped so far under policy.
+	dropped := func(policy string) (n int) {
+		for _, line := range scrapeLabel(t, "policy", policy) {
+			if strings.HasPrefix(line, "results_dropped_total") {
+				fmt.Sscan(line[strings.LastIndex(line, " ")+1:], &n)
+			}
+		}
+		return
+	}
+
+	tests := []struct {
+		policy  string
+		kept    []uint64
+		dropped int
+	}{
+		{ResultsDropNewest, []uint64{1, 2}, 1},
+		{ResultsDropOldest, []uint64{2, 3}, 1},
+	}
+	for _, tt := range tests {
+		o := cli.Options{ResultsOverflow: tt.policy}
+		b := NewGroup(o, []string{"jobs"}, 0, make(chan *JobResult, 2))
+		before := dropped(tt.policy)
+		for id := uint64(1); id <= 3; id++ {
+			b.report(&JobResult{JobId: id})
+		}
+		close(b.results)
+		var kept []uint64
+		for r := range b.results {
+			kept = append(kept, r.JobId)
+		}
+		if fmt.Sprint(kept) != fmt.Sprint(tt.kept) {
+			t.Errorf("%s: kept results %v, want %v", tt.policy, kept, tt.kept)
+		}
+		if n := dropped(tt.policy) - before; n != tt.dropped {
+			t.Errorf("%s: drop counter went up by %d, want %d", tt.policy, n, tt.dropped)
+		}
+	}
+
+	// Blocking waits for the consumer rather than dropping.
+	results := make(chan *JobResult, 1)
+	b := NewGroup(cli.Options{ResultsOverflow: ResultsBlock}, []string{"jobs"}, 0, results)
+	b.report(&JobResult{JobId: 1})
+	reported := make(chan struct{})
+	go func() {
+		b.report(&JobResult{JobId: 2})
+		close(reported)
+	}()
+	select {
+	case <-reported:
+		t.Fatal("reported a result into a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if r := <-results; r.JobId != 1 {
+		t.Errorf("read result of job %d, want 1", r.JobId)
+	}
+	<-reported
+	if r := <-results; r.JobId != 2 {
+		t.Errorf("read result of job %d, want 2", r.JobId)
+	}
+}
+
+func TestSecondsSinceLastSuccess(t *testing.T) {
+	b := NewGroup(cli.Options{}, []string{"succeeding"}, 0, nil)
+
+	b.report(&JobResult{JobId: 1, Executed: true, ExitStatus: 1})
+	b.report(&JobResult{JobId: 2, ValidationFailed: true})
+	if v := sinceLastSuccess.Value("succeeding"); v != 0 {
+		t.Errorf("gauge at %v before any job succeeded", v)
+	}
+
+	b.report(&JobResult{JobId: 3, Executed: true})
+	time.Sleep(20 * time.Millisecond)
+	if v := sinceLastSuccess.Value("succeeding"); v < 0.02 || v > 1 {
+		t.Errorf("gauge at %v, want the time since the success", v)
+	}
+	lines := strings.Join(scrape(t, "succeeding"), "\n")
+	if !strings.Contains(lines, `seconds_since_last_success{tube="succeeding"} 0.0`) {
+		t.Errorf("exposition lacks the gauge:\n%s", lines)
+	}
+}
+
+func TestJobDomain(t *testing.T) {
+	s := newFakeServer(t)
+	b := testBroker(s.options(), &fakeExecutor{}, "tenants")
+
+	_, result := s.process(b, "tenants", time.Minute, domainPacket("acme"))
+	if result.Domain != "acme" || result.WorkDir != "/work" {
+		t.Errorf("result of domain %q in %q, want acme in /work", result.Domain, result.WorkDir)
+	}
+
+	before := jobsTotal.Value("tenants", OutcomeSucceeded, "acme")
+	b.report(result)
+	if got := jobsTotal.Value("tenants", OutcomeSucceeded, "acme") - before; got != 1 {
+		t.Errorf("jobs_total of domain acme rose by %v, want 1", got)
+	}
+}
+
+func TestGroupReportsJobTube(t *testing.T) {
+	s := newFakeServer(t)
+	first := s.putPacket("grouped-a", domainPacket("acme"))
+	second := s.putPacket("grouped-b", domainPacket("acme"))
+	b := testBroker(s.options(), &fakeExecutor{}, "grouped-a", "grouped-b")
+	b.Recent = NewRecentJobs(2)
+
+	runJobs(b, 2)
+	// Each job is reported under its own tube, not the group's.
+	want := map[uint64]string{first: "grouped-a", second: "grouped-b"}
+	for _, j := range recentJobs(t, b.Recent, "") {
+		if j.Tube != want[j.JobId] {
+			t.Errorf("recent job %d of tube %q, want %q", j.JobId, j.Tube, want[j.JobId])
+		}
+	}
+	for _, tube := range []string{"grouped-a", "grouped-b"} {
+		if got := jobsTotal.Value(tube, OutcomeSucceeded, "acme"); got != 1 {
+			t.Errorf("jobs_total of %s is %v, want 1", tube, got)
+		}
+	}
+	if lines := strings.Join(scrape(t, "grouped-a,grouped-b"), "\n"); strings.Contains(lines, "jobs_total") {
+		t.Errorf("exposition counts jobs under the group:\n%s", lines)
+	}
+}
+
+func TestDomainLabelCapped(t *testing.T) {
+	defer func(n int) { MaxDomainLabels = n }(MaxDomainLabels)
+	domainLabels.Lock()
+	MaxDomainLabels = len(domainLabels.seen) + 2
+	domainLabels.Unlock()
+
+	for i, want := range []string{"capped-1", "capped-2", OtherDomain, "capped-1"} {
+		domain := fmt.Sprintf("capped-%d", i%3+1)
+		if got := domainLabel(domain); got != want {
+			t.Errorf("domain %s labelled %s, want %s", domain, got, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/wulijun/go-php-serialize/phpserialize"
+)
+
+// Packet is the decoded body of a job, a PHP serialized array or, with
+// -job-format=json, a JSON object. Either way its maps are keyed by
+// interface{} and its integers are int64, as PHP arrays are decoded.
+type Packet map[interface{}]interface{}
+
+// Job body formats, see -job-format.
+const (
+	JobFormatPHP  = "php"
+	JobFormatJSON = "json"
+)
+
+// decodePacket decodes the job body in the given format. It is done once per
+// job, and the packet passed to everything that needs its content.
+func decodePacket(job bs.Job, format string) (Packet, error) {
+	if format == JobFormatJSON {
+		return decodeJSONPacket(job.Body)
+	}
+
+	dec, err := unserialize(job.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unserialize the job, error: %s", err)
+	}
+
+	packet, ok := dec.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to interpret the job packet, expecting a map got %v", dec)
+	}
+	return Packet(packet), nil
+}
+
+// decodeJSONPacket decodes a JSON object body into a Packet.
+func decodeJSONPacket(body []byte) (Packet, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var dec interface{}
+	if err := d.Decode(&dec); err != nil {
+		return nil, fmt.Errorf("failed to decode the job, error: %s", err)
+	}
+
+	packet, ok := phpLike(dec).(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to interpret the job packet, expecting an object got %v", dec)
+	}
+	return Packet(packet), nil
+}
+
+// phpLike converts decoded JSON to the types PHP arrays are decoded into:
+// objects keyed by interface{}, and whole numbers as int64.
+func phpLike(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for k, v := range v {
+			out[k] = phpLike(v)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = phpLike(v[i])
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// unserialize decodes a PHP serialized body. The decoder panics on some
+// malformed input rather than returning an error; the panic is turned into
+// an error so the job is disposed of like any other undecodable job.
+func unserialize(body []byte) (dec interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed body: %v", r)
+		}
+	}()
+	return phpserialize.Decode(string(body))
+}
+
+// String returns the value of a string key.
+func (p Packet) String(key string) (string, bool) {
+	s, ok := p[key].(string)
+	return s, ok
+}
+
+// Bool reports whether key is set to a true value, accepting PHP booleans
+// as well as the integers and strings PHP considers true.
+func (p Packet) Bool(key string) bool {
+	switch v := p[key].(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return v != "" && v != "0"
+	}
+	return false
+}
+
+// Int returns the value of an integer key.
+func (p Packet) Int(key string) (int64, bool) {
+	i, ok := p[key].(int64)
+	return i, ok
+}
+
+// Missing returns the keys which are absent from the packet, in order.
+func (p Packet) Missing(keys []string) (missing []string) {
+	for _, key := range keys {
+		if _, ok := p[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return
+}
+
+// Encode serializes the packet back into a job body in the given format.
+func (p Packet) Encode(format string) ([]byte, error) {
+	if format == JobFormatJSON {
+		enc, err := json.Marshal(jsonable(map[interface{}]interface{}(p)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the job, error: %s", err)
+		}
+		return enc, nil
+	}
+
+	enc, err := phpserialize.Encode(map[interface{}]interface{}(p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize the job, error: %s", err)
+	}
+	return []byte(enc), nil
+}
+
+// jsonable converts the maps PHP arrays are decoded into, keyed by
+// interface{}, into maps keyed by string.
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			out[fmt.Sprint(k)] = jsonable(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, v := range v {
+			out[i] = jsonable(v)
+		}
+		return out
+	}
+	return v
+}
+
+// Redacted replaces the values of redacted keys in a packet logged with
+// -audit-body.
+const Redacted = "[redacted]"
+
+// redacted returns the packet as jsonable does, with the values of the keys
+// in fields replaced by Redacted wherever they appear in it.
+func (p Packet) redacted(fields []string) interface{} {
+	redact := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		redact[f] = true
+	}
+	return redactJSON(jsonable(map[interface{}]interface{}(p)), redact)
+}
+
+func redactJSON(v interface{}, redact map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if redact[k] {
+				v[k] = Redacted
+			} else {
+				v[k] = redactJSON(e, redact)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e, redact)
+		}
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wulijun/go-php-serialize/phpserialize"
+)
+
+func TestDecodeJSONPacket(t *testing.T) {
+	s := newFakeServer(t)
+	id := s.put("jobs", 100, time.Minute, `{"domain": "acme", "retries": 2, "ratio": 0.5, "tags": ["a", 1], "data": {"n": 3}}`)
+	packet, err := decodePacket(s.reserveJob(id), JobFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Packet{
+		"domain":  "acme",
+		"retries": int64(2),
+		"ratio":   0.5,
+		"tags":    []interface{}{"a", int64(1)},
+		"data":    map[interface{}]interface{}{"n": int64(3)},
+	}
+	if !reflect.DeepEqual(packet, want) {
+		t.Errorf("decoded %#v, want %#v", packet, want)
+	}
+
+	for _, body := range []string{`["acme"]`, `{"domain":`, phpPacket(t, domainPacket("acme"))} {
+		id := s.put("jobs", 100, time.Minute, body)
+		if _, err := decodePacket(s.reserveJob(id), JobFormatJSON); err == nil {
+			t.Errorf("decoded %q", body)
+		}
+	}
+}
+
+func TestTrackRetriesInBody(t *testing.T) {
+	tests := []struct {
+		format string
+		encode func(Packet) string
+		// retries decodes the retries key of a re-queued body.
+		retries func([]byte) int64
+	}{
+		{JobFormatPHP, func(p Packet) string { return phpPacket(t, p) }, func(body []byte) int64 {
+			dec, err := phpserialize.Decode(string(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _ := dec.(map[interface{}]interface{})[RetriesKey].(int64)
+			return r
+		}},
+		{JobFormatJSON, func(p Packet) string {
+			enc, err := json.Marshal(jsonable(map[interface{}]interface{}(p)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(enc)
+		}, func(body []byte) int64 {
+			var dec struct{ Retries int64 }
+			if err := json.Unmarshal(body, &dec); err != nil {
+				t.Fatal(err)
+			}
+			return dec.Retries
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			s := newFakeServer(t)
+			o := s.options()
+			o.JobFormat = tt.format
+			o.TrackRetriesInBody = true
+			e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{status: 1} }}
+			b := testBroker(o, e, "jobs")
+
+			id := s.put("jobs", 100, time.Minute, tt.encode(Packet(domainPacket("acme"))))
+			for want := int64(1); want <= 3; want++ {
+				if _, err := b.processJob(s.reserveJob(id)); err != nil {
+					t.Fatal(err)
+				}
+				if got := s.state(id); got != "deleted" {
+					t.Errorf("re-queued job is %s, want it deleted", got)
+				}
+				id++
+				j, ok := s.job(id)
+				if !ok {
+					t.Fatalf("failed job %d not re-queued", id-1)
+				}
+				if got := tt.retries(j.body); got != want {
+					t.Errorf("re-queued job has %d retries, want %d: %s", got, want, j.body)
+				}
+			}
+			if n := s.count("release"); n != 0 {
+				t.Errorf("%d releases, want the jobs re-put instead", n)
+			}
+		})
+	}
+}
+
+func TestTrackRetriesInBodyPutFails(t *testing.T) {
+	s := newFakeServer(t)
+	s.hook("put", func(args []string) string { return "JOB_TOO_BIG\r\n" })
+	o := s.options()
+	o.TrackRetriesInBody = true
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{status: 1} }}
+	b := testBroker(o, e, "jobs")
+
+	// The job cannot be re-put with its retries counted, so is released.
+	id := s.putPacket("jobs", domainPacket("acme"))
+	if _, err := b.processJob(s.reserveJob(id)); err != nil {
+		t.Fatalf("processJob: %s", err)
+	}
+	if got := s.state(id); got != "ready" && got != "delayed" {
+		t.Errorf("job is %s, want it released", got)
+	}
+	if n := s.count("release"); n != 1 {
+		t.Errorf("%d releases, want 1", n)
+	}
+}
+
+func TestDecoderPanicRejectsJob(t *testing.T) {
+	s := newFakeServer(t)
+	// The decoder panics on a negative string length.
+	bad := s.put("jobs", 1, time.Minute, `s:-1:"";`)
+	good := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(s.options(), "jobs")
+
+	result := next()
+	if result.JobId != bad || !result.ValidationFailed || result.Error == nil {
+		t.Errorf("result %+v, want job %d rejected", result, bad)
+	}
+	if got := s.state(bad); got != "buried" {
+		t.Errorf("malformed job is %s, want it buried", got)
+	}
+
+	// The broker carries on with the next job.
+	if result := next(); result.JobId != good || result.ExitStatus != 0 {
+		t.Errorf("result %+v, want job %d executed", result, good)
+	}
+}
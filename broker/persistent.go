@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/kayako/beanstalk-broker/cmd"
+)
+
+// Executors selectable with -executor.
+const (
+	ExecutorFork       = "fork"
+	ExecutorPersistent = "persistent"
+)
+
+// PersistentExecutor runs jobs on a pool of long-lived worker processes,
+// saving the cost of starting PHP for every job. Each worker handles one job
+// at a time, speaking a framed protocol over its stdin and stdout:
+//
+// The broker writes a request of two frames, each a 4 byte big-endian length
+// followed by that many bytes: a JSON header {"cwd": ..., "args": [...],
+// "env": [...]} describing the command the job would have been forked with,
+// then the job body.
+//
+// The worker replies with its exit status as a 4 byte big-endian signed
+// integer, then a frame holding the job's stdout.
+//
+// A worker is replaced after -persistent-max-jobs jobs, and whenever a job
+// is terminated or the protocol fails, including a stdout frame larger than
+// maxFrameBytes. Workers should exit when their stdin is closed.
+type PersistentExecutor struct {
+	name    string
+	args    []string
+	maxJobs uint64
+
+	mu   sync.Mutex
+	idle []*persistentWorker
+}
+
+// NewPersistentExecutor creates a PersistentExecutor whose workers run name
+// with args, each handling up to maxJobs jobs, or any number when zero.
+func NewPersistentExecutor(maxJobs uint64, name string, args ...string) *PersistentExecutor {
+	return &PersistentExecutor{name: name, args: args, maxJobs: maxJobs}
+}
+
+// Execute is the Executor of the pool.
+func (e *PersistentExecutor) Execute(cwd, name string, args ...string) (Process, <-chan []byte, error) {
+	out := make(chan []byte, 1)
+	return &persistentJob{
+		executor: e,
+		header:   persistentHeader{Cwd: cwd, Args: append([]string{name}, args...)},
+		out:      out,
+		done:     make(chan struct{}),
+	}, out, nil
+}
+
+// Close stops the idle workers.
+func (e *PersistentExecutor) Close() {
+	e.mu.Lock()
+	idle := e.idle
+	e.idle = nil
+	e.mu.Unlock()
+
+	for _, w := range idle {
+		w.stop()
+	}
+}
+
+// acquire takes an idle worker, or starts one.
+func (e *PersistentExecutor) acquire() (*persistentWorker, error) {
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		w := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		return w, nil
+	}
+	e.mu.Unlock()
+
+	c := exec.Command(e.name, e.args...)
+	c.Stderr = os.Stderr
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return &persistentWorker{cmd: c, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// release returns a worker to the pool after a job, or stops it if it is
+// broken or has handled its share of jobs.
+func (e *PersistentExecutor) release(w *persistentWorker, healthy bool) {
+	w.jobs++
+	if !healthy || (e.maxJobs > 0 && w.jobs >= e.maxJobs) {
+		w.stop()
+		return
+	}
+
+	e.mu.Lock()
+	e.idle = append(e.idle, w)
+	e.mu.Unlock()
+}
+
+type persistentWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	jobs   uint64
+}
+
+// stop closes the worker's stdin, asking it to exit, and reaps it.
+func (w *persistentWorker) stop() {
+	w.stdin.Close()
+	go w.cmd.Wait()
+}
+
+type persistentHeader struct {
+	Cwd  string   `json:"cwd"`
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+}
+
+// persistentJob is the Process of a job run on a persistent worker.
+type persistentJob struct {
+	executor *PersistentExecutor
+	header   persistentHeader
+	out      chan []byte
+
+	mu     sync.Mutex
+	worker *persistentWorker
+	// signalled is set once the worker was sent a signal, after which it
+	// is not reused; returned once the worker was handed back, after which
+	// it may be running another job and must not be signalled.
+	signalled, returned bool
+
+	// done is closed once the response was read, or the exchange failed.
+	done   chan struct{}
+	result cmd.WaitResult
+}
+
+func (j *persistentJob) AddEnv(env ...string) {
+	j.header.Env = append(j.header.Env, env...)
+}
+
+// StartWithStdin hands the job to a worker, then reads the response in the
+// background.
+func (j *persistentJob) StartWithStdin(input []byte) error {
+	w, err := j.executor.acquire()
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.worker = w
+	j.mu.Unlock()
+
+	header, err := json.Marshal(j.header)
+	if err == nil {
+		err = writeFrame(w.stdin, header)
+	}
+	if err == nil {
+		err = writeFrame(w.stdin, input)
+	}
+	if err != nil {
+		j.returnWorker(false)
+		j.finish(cmd.WaitResult{Status: -1, Err: err}, nil)
+		return err
+	}
+
+	go func() {
+		var status int32
+		if err := binary.Read(w.stdout, binary.BigEndian, &status); err != nil {
+			j.returnWorker(false)
+			j.finish(cmd.WaitResult{Status: -1, Err: fmt.Errorf("failed to read worker response, error: %s", err)}, nil)
+			return
+		}
+		stdout, err := readFrame(w.stdout, maxFrameBytes)
+		j.returnWorker(err == nil)
+		if err != nil {
+			j.finish(cmd.WaitResult{Status: -1, Err: fmt.Errorf("failed to read worker stdout, error: %s", err)}, nil)
+			return
+		}
+		j.finish(cmd.WaitResult{Status: int(status)}, stdout)
+	}()
+	return nil
+}
+
+// returnWorker hands the worker back to the pool once the job is done with
+// it, stopping it instead if it is broken or was signalled. It holds j.mu
+// throughout, so that a signal either reaches the worker before it is
+// reused, or not at all.
+func (j *persistentJob) returnWorker(healthy bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.returned = true
+	j.executor.release(j.worker, healthy && !j.signalled)
+}
+
+func (j *persistentJob) finish(result cmd.WaitResult, stdout []byte) {
+	if len(stdout) > 0 {
+		j.out <- stdout
+	}
+	close(j.out)
+	j.result = result
+	close(j.done)
+}
+
+func (j *persistentJob) Started() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.worker != nil
+}
+
+// Terminate and Kill signal the worker, which cannot abandon the job and so
+// is not reused. Once the job has finished they do nothing.
+func (j *persistentJob) Terminate() error {
+	return j.signal(syscall.SIGTERM)
+}
+
+func (j *persistentJob) Kill() error {
+	return j.signal(syscall.SIGKILL)
+}
+
+func (j *persistentJob) signal(sig os.Signal) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.worker == nil {
+		return errors.New("job not started")
+	}
+	if j.returned {
+		return nil
+	}
+	j.signalled = true
+	return j.worker.cmd.Process.Signal(sig)
+}
+
+func (j *persistentJob) WaitChan() <-chan cmd.WaitResult {
+	ch := make(chan cmd.WaitResult, 1)
+	go func() {
+		<-j.done
+		ch <- j.result
+	}()
+	return ch
+}
+
+// writeFrame writes data preceded by its length.
+func writeFrame(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// maxFrameBytes caps the frames read from a worker, so that a corrupt
+// length cannot make the broker allocate gigabytes.
+const maxFrameBytes = 64 << 20
+
+// readFrame reads data preceded by its length, failing on a length over max.
+func readFrame(r io.Reader, max uint32) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", n, max)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
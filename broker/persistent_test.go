@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPersistentWorkerProcess is a persistent worker, when run by
+// persistentExecutor. It replies to a job body "exit N" with status N,
+// sleeps on "sleep", and sends an oversized frame on "huge"; its stdout
+// reports its pid, the working directory and the body.
+func TestPersistentWorkerProcess(t *testing.T) {
+	if os.Getenv("BROKER_TEST_PERSISTENT_WORKER") == "" {
+		t.Skip("only run by persistentExecutor")
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		header, err := readFrame(in, maxFrameBytes)
+		if err != nil {
+			os.Exit(0)
+		}
+		body, err := readFrame(in, maxFrameBytes)
+		if err != nil {
+			os.Exit(1)
+		}
+		var h persistentHeader
+		json.Unmarshal(header, &h)
+
+		var status int32
+		switch {
+		case string(body) == "sleep":
+			time.Sleep(time.Minute)
+		case string(body) == "huge":
+			binary.Write(os.Stdout, binary.BigEndian, status)
+			binary.Write(os.Stdout, binary.BigEndian, uint32(1<<31))
+			continue
+		default:
+			fmt.Sscanf(string(body), "exit %d", &status)
+		}
+		binary.Write(os.Stdout, binary.BigEndian, status)
+		writeFrame(os.Stdout, []byte(fmt.Sprintf("pid=%d cwd=%s body=%s", os.Getpid(), h.Cwd, body)))
+	}
+}
+
+// persistentExecutor is a PersistentExecutor whose workers are
+// TestPersistentWorkerProcess.
+func persistentExecutor(t *testing.T, maxJobs uint64) *PersistentExecutor {
+	t.Setenv("BROKER_TEST_PERSISTENT_WORKER", "1")
+	e := NewPersistentExecutor(maxJobs, os.Args[0], "-test.run=^TestPersistentWorkerProcess$")
+	t.Cleanup(e.Close)
+	return e
+}
+
+// runPersistent runs a job with body on e, returning its exit status and the
+// pid of the worker it ran on.
+func runPersistent(t *testing.T, e *PersistentExecutor, body string) (int, string) {
+	t.Helper()
+	p, out, err := e.Execute("/work", "php", "index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StartWithStdin([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	var stdout []byte
+	for data := range out {
+		stdout = append(stdout, data...)
+	}
+	wr := <-p.WaitChan()
+	if wr.Err != nil {
+		t.Fatalf("job %q failed, error: %s", body, wr.Err)
+	}
+	if want := " cwd=/work body=" + body; !strings.HasSuffix(string(stdout), want) {
+		t.Errorf("stdout %q, want it to end %q", stdout, want)
+	}
+	return wr.Status, strings.Fields(string(stdout))[0]
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	for _, frame := range []string{"", "header", strings.Repeat("x", 1000)} {
+		if err := writeFrame(&buf, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.Bytes()[:4]; !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Errorf("empty frame length written as %v", got)
+	}
+	for _, want := range []string{"", "header", strings.Repeat("x", 1000)} {
+		got, err := readFrame(&buf, 1000)
+		if err != nil || string(got) != want {
+			t.Errorf("read %d bytes, error %v, want %d", len(got), err, len(want))
+		}
+	}
+
+	// A length over the limit fails before anything is allocated.
+	buf.Reset()
+	writeFrame(&buf, []byte("too long"))
+	if _, err := readFrame(&buf, 7); err == nil {
+		t.Error("read a frame over the limit")
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 5, 'a'}), 10); err == nil {
+		t.Error("read a truncated frame")
+	}
+}
+
+func TestPersistentPoolRecycling(t *testing.T) {
+	e := persistentExecutor(t, 2)
+
+	status, first := runPersistent(t, e, "exit 3")
+	if status != 3 {
+		t.Errorf("exit status %d, want 3", status)
+	}
+	if _, pid := runPersistent(t, e, "exit 0"); pid != first {
+		t.Errorf("second job ran on %s, want the warm worker %s", pid, first)
+	}
+	if _, pid := runPersistent(t, e, "exit 0"); pid == first {
+		t.Errorf("third job ran on %s, want it replaced after -persistent-max-jobs=2", pid)
+	}
+}
+
+func TestPersistentWorkerReplacedAfterTerminate(t *testing.T) {
+	e := persistentExecutor(t, 0)
+	_, first := runPersistent(t, e, "exit 0")
+
+	p, out, _ := e.Execute("/work", "php", "index.php")
+	if err := p.StartWithStdin([]byte("sleep")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	for _ = range out {
+	}
+	if wr := <-p.WaitChan(); wr.Err == nil {
+		t.Error("no error from a terminated job")
+	}
+
+	// The terminated worker is not reused, but the pool carries on.
+	_, pid := runPersistent(t, e, "exit 0")
+	if pid == first {
+		t.Errorf("job ran on the terminated worker %s", pid)
+	}
+
+	// Terminating a finished job leaves the worker, which may be running
+	// another job by now, alone.
+	p, out, _ = e.Execute("/work", "php", "index.php")
+	p.StartWithStdin([]byte("exit 0"))
+	for _ = range out {
+	}
+	<-p.WaitChan()
+	if err := p.Terminate(); err != nil {
+		t.Errorf("terminating a finished job failed, error: %s", err)
+	}
+	if _, again := runPersistent(t, e, "exit 0"); again != pid {
+		t.Errorf("job ran on %s, want the worker %s kept after a late terminate", again, pid)
+	}
+}
+
+func TestPersistentOversizedFrame(t *testing.T) {
+	e := persistentExecutor(t, 0)
+	_, first := runPersistent(t, e, "exit 0")
+
+	p, out, _ := e.Execute("/work", "php", "index.php")
+	p.StartWithStdin([]byte("huge"))
+	for _ = range out {
+	}
+	if wr := <-p.WaitChan(); wr.Err == nil || !strings.Contains(wr.Err.Error(), "limit") {
+		t.Errorf("error %v, want the frame refused", wr.Err)
+	}
+	if _, pid := runPersistent(t, e, "exit 0"); pid == first {
+		t.Error("the worker which sent an oversized frame was reused")
+	}
+}
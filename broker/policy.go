@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// Policies for jobs which exceed their TTR, see -on-timeout.
+const (
+	OnTimeoutRelease = "release"
+	OnTimeoutBury    = "bury"
+	OnTimeoutDelete  = "delete"
+)
+
+// Policy is the retry and disposal policy applied to the jobs of a tube.
+type Policy struct {
+
+	// MaxReleases is the number of releases after which a job is given up on.
+	MaxReleases uint64
+
+	// MaxTimeouts is the number of timeouts after which a job is given up on.
+	MaxTimeouts uint64
+
+	// Backoff is the base delay for releasing a failed job, doubled on every
+	// release. Zero means the default releases^4 seconds.
+	Backoff time.Duration
+
+	// DeadletterTube receives the jobs that are given up on. When empty they
+	// are re-queued after RequeueDelay instead.
+	DeadletterTube string
+
+	// DeleteOnSuccess == false means successful jobs are buried instead.
+	DeleteOnSuccess bool
+
+	// OnTimeout is how a job which exceeded its TTR is disposed of.
+	OnTimeout string
+
+	// AtMostOnce == true means jobs are deleted before being executed, so
+	// they are never run twice, at the cost of being lost if execution fails.
+	AtMostOnce bool
+}
+
+// policy returns the policy for tube, applying the matching rule of the
+// policy file over the global defaults.
+func (b *Broker) policy(tube string) Policy {
+	p := Policy{
+		MaxReleases:     ReleaseTries,
+		MaxTimeouts:     TimeoutTries,
+		DeleteOnSuccess: true,
+		OnTimeout:       OnTimeoutRelease,
+	}
+	if b.options.TimeoutTries > 0 {
+		p.MaxTimeouts = b.options.TimeoutTries
+	}
+	if b.options.OnTimeout != "" {
+		p.OnTimeout = b.options.OnTimeout
+	}
+	for _, t := range b.options.AtMostOnce {
+		if t == tube {
+			p.AtMostOnce = true
+		}
+	}
+
+	if r, ok := b.options.Policies.Match(tube); ok {
+		p.apply(r)
+	}
+	if b.options.NoRetry {
+		// Deleting a timed out job needs the reservation held.
+		p.OnTimeout = OnTimeoutDelete
+	}
+	return p
+}
+
+// apply overrides the policy with the fields set in rule.
+func (p *Policy) apply(r cli.PolicyRule) {
+	if r.MaxReleases != nil {
+		p.MaxReleases = *r.MaxReleases
+	}
+	if r.MaxTimeouts != nil {
+		p.MaxTimeouts = *r.MaxTimeouts
+	}
+	if r.Backoff != nil {
+		p.Backoff = r.Backoff.Duration
+	}
+	if r.DeleteOnSuccess != nil {
+		p.DeleteOnSuccess = *r.DeleteOnSuccess
+	}
+	if r.DeadletterTube != "" {
+		p.DeadletterTube = r.DeadletterTube
+	}
+}
+
+// releaseDelay is the delay for releasing a job which failed after having
+// been released r times, at most cli.MaxDelay.
+func (p Policy) releaseDelay(r uint64) (delay time.Duration) {
+	if r > 20 {
+		r = 20
+	}
+	if p.Backoff > cli.MaxDelay>>r {
+		// Doubling this far would overflow.
+		return cli.MaxDelay
+	} else if p.Backoff > 0 {
+		delay = p.Backoff * time.Duration(1<<r)
+	} else {
+		// r*r*r*r means final of 10 tries has 1h49m21s delay, 4h15m33s total.
+		// See: http://play.golang.org/p/I15lUWoabI
+		delay = time.Duration(r*r*r*r) * time.Second
+	}
+	if delay < 0 || delay > cli.MaxDelay {
+		delay = cli.MaxDelay
+	}
+	return
+}
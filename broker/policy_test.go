@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+func TestPolicyPrecedence(t *testing.T) {
+	three, no := uint64(3), false
+	o := cli.Options{
+		TimeoutTries: 2,
+		OnTimeout:    OnTimeoutBury,
+		Policies: cli.PolicyList{
+			{Tube: "email-*", MaxReleases: &three, Backoff: &cli.Duration{Duration: time.Second}},
+			{Tube: "email-eu", DeleteOnSuccess: &no, DeadletterTube: "dead"},
+		},
+	}
+	b := New(o, "email-eu", 0, nil)
+
+	// Defaults, overridden by the options, then by the matching rule.
+	if p := b.policy("sms"); p.MaxReleases != ReleaseTries || p.MaxTimeouts != 2 || p.OnTimeout != OnTimeoutBury || !p.DeleteOnSuccess {
+		t.Errorf("unmatched tube has policy %+v", p)
+	}
+	if p := b.policy("email-us"); p.MaxReleases != 3 || p.Backoff != time.Second || p.MaxTimeouts != 2 {
+		t.Errorf("email-us has policy %+v", p)
+	}
+	// Only the exact rule applies, not the pattern's fields too.
+	if p := b.policy("email-eu"); p.MaxReleases != ReleaseTries || p.DeleteOnSuccess || p.DeadletterTube != "dead" {
+		t.Errorf("email-eu has policy %+v", p)
+	}
+}
+
+func TestReleaseDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		r       uint64
+		want    time.Duration
+	}{
+		{0, 0, 0},
+		{0, 2, 16 * time.Second},
+		{0, 10, 10000 * time.Second},
+		{time.Second, 0, time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{2 * time.Hour, 1000, cli.MaxDelay},
+		{1000 * time.Hour, 20, cli.MaxDelay},
+		{cli.MaxDelay, 1, cli.MaxDelay},
+	}
+	for _, tt := range tests {
+		if got := (Policy{Backoff: tt.backoff}).releaseDelay(tt.r); got != tt.want {
+			t.Errorf("backoff %v after %d releases: %v, want %v", tt.backoff, tt.r, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// PressureCheckInterval is the time between checks of the host's resources
+// while reserving is paused.
+var PressureCheckInterval = 5 * time.Second
+
+// PressureChecker returns an error describing the resource pressure on the
+// host, or nil when there is room to run another job.
+type PressureChecker func() error
+
+// resourceChecker returns the PressureChecker for the thresholds in o, or nil
+// if none are set.
+func resourceChecker(o cli.Options) PressureChecker {
+	if o.MinFreeMemoryMB == 0 && o.MinFreeDiskMB == 0 {
+		return nil
+	}
+
+	return func() error {
+		if o.MinFreeMemoryMB > 0 {
+			free, err := availableMemory()
+			if err != nil {
+				return err
+			}
+			if free < o.MinFreeMemoryMB<<20 {
+				return fmt.Errorf("%dMB of memory available, below the minimum of %dMB", free>>20, o.MinFreeMemoryMB)
+			}
+		}
+		if o.MinFreeDiskMB > 0 {
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(o.DiskPath, &fs); err != nil {
+				return fmt.Errorf("failed to read free disk space of %s, error: %s", o.DiskPath, err)
+			}
+			if free := fs.Bavail * uint64(fs.Bsize); free < o.MinFreeDiskMB<<20 {
+				return fmt.Errorf("%dMB of disk free on %s, below the minimum of %dMB", free>>20, o.DiskPath, o.MinFreeDiskMB)
+			}
+		}
+		return nil
+	}
+}
+
+// availableMemory reads MemAvailable from /proc/meminfo, in bytes.
+func availableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse MemAvailable, error: %s", err)
+		}
+		return kb << 10, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// waitForResources blocks while the host is under resource pressure, so that
+// no job is reserved which would make it worse, while the dependency of the
+// jobs is unhealthy, or while beanstalkd is in drain mode. It returns false
+// if the broker started shutting down meanwhile.
+func (b *Broker) waitForResources() bool {
+	if b.CheckPressure == nil && b.Health == nil && b.serverDrain.err() == nil {
+		return true
+	}
+
+	paused := false
+	for {
+		err := b.serverDrain.err()
+		if err == nil {
+			err = b.Health.Err()
+		}
+		if err == nil && b.CheckPressure != nil {
+			err = b.CheckPressure()
+		}
+		if err == nil {
+			if paused {
+				b.log.Info("pause cleared, resuming reserving")
+			}
+			return true
+		}
+		if !paused {
+			b.log.Warnf("pausing reserving, error: %s", err)
+			paused = true
+		}
+
+		select {
+		case <-b.drain:
+			return false
+		case <-time.After(PressureCheckInterval):
+		}
+	}
+}
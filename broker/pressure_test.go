@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPressurePausesReserving(t *testing.T) {
+	defer func(d time.Duration) { PressureCheckInterval = d }(PressureCheckInterval)
+	PressureCheckInterval = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	id := s.putPacket("jobs", domainPacket("acme"))
+	b, next := s.startBroker(s.options(), "jobs")
+
+	var mu sync.Mutex
+	checks, reservesWhilePaused := 0, 0
+	b.CheckPressure = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		checks++
+		if checks <= 3 {
+			reservesWhilePaused += s.count("reserve")
+			return errors.New("10MB of memory available, below the minimum of 512MB")
+		}
+		return nil
+	}
+	next()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if checks != 4 {
+		t.Errorf("pressure checked %d times, want until it cleared", checks)
+	}
+	if reservesWhilePaused != 0 {
+		t.Error("reserved while under pressure")
+	}
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it processed once pressure cleared", got)
+	}
+}
+
+func TestPressurePauseEndsOnDrain(t *testing.T) {
+	s := newFakeServer(t)
+	b := New(s.options(), "jobs", 0, nil)
+	b.CheckPressure = func() error { return errors.New("disk full") }
+	drain := make(chan bool)
+	b.drain = drain
+
+	done := make(chan bool)
+	go func() { done <- b.waitForResources() }()
+	close(drain)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("waitForResources went on to reserve while draining")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitForResources kept waiting after the drain began")
+	}
+}
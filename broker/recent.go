@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxRecentOutputBytes is how much of the stdout and stderr of each recent
+// job is kept, their tails.
+const MaxRecentOutputBytes = 1024
+
+// RecentJob describes a job processed lately, as served at /recent-jobs.
+type RecentJob struct {
+	JobId      uint64        `json:"id"`
+	Tube       string        `json:"tube"`
+	Outcome    string        `json:"outcome"`
+	ExitStatus int           `json:"exitStatus"`
+	Finished   time.Time     `json:"finished"`
+	Duration   time.Duration `json:"duration"`
+	Stdout     string        `json:"stdout,omitempty"`
+	Stderr     string        `json:"stderr,omitempty"`
+}
+
+// RecentJobs keeps the results of the last jobs processed by a set of
+// brokers in a ring, for a glance at recent activity without a metrics
+// backend. It is safe for concurrent use, and a nil *RecentJobs keeps
+// nothing.
+type RecentJobs struct {
+	mu   sync.Mutex
+	jobs []RecentJob
+	next int
+	full bool
+}
+
+// NewRecentJobs creates a RecentJobs keeping the last size jobs.
+func NewRecentJobs(size int) *RecentJobs {
+	return &RecentJobs{jobs: make([]RecentJob, size)}
+}
+
+// Record adds the result of a job of tube, replacing the oldest once full.
+func (r *RecentJobs) Record(tube string, result *JobResult) {
+	if r == nil || len(r.jobs) == 0 {
+		return
+	}
+	job := RecentJob{
+		JobId:      result.JobId,
+		Tube:       tube,
+		Outcome:    result.outcome(),
+		ExitStatus: result.ExitStatus,
+		Finished:   time.Now(),
+		Duration:   result.Duration,
+		Stdout:     string(tail(result.Stdout, MaxRecentOutputBytes)),
+		Stderr:     string(tail(result.Stderr, MaxRecentOutputBytes)),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[r.next] = job
+	r.next = (r.next + 1) % len(r.jobs)
+	r.full = r.full || r.next == 0
+}
+
+// Jobs returns up to the last n jobs recorded, most recent first.
+func (r *RecentJobs) Jobs(n int) []RecentJob {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.next
+	if r.full {
+		kept = len(r.jobs)
+	}
+	if n > kept {
+		n = kept
+	}
+	jobs := make([]RecentJob, 0, n)
+	for i := 1; i <= n; i++ {
+		jobs = append(jobs, r.jobs[(r.next-i+len(r.jobs))%len(r.jobs)])
+	}
+	return jobs
+}
+
+// ServeHTTP writes the last n jobs, from the n query parameter, as a JSON
+// array, most recent first. n defaults to, and is capped at, every job kept.
+func (r *RecentJobs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := len(r.jobs)
+	if v := req.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			http.Error(w, "n must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Jobs(n))
+}
+
+// tail returns the last max bytes of b.
+func tail(b []byte, max int) []byte {
+	if len(b) > max {
+		return b[len(b)-max:]
+	}
+	return b
+}
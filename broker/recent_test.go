@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recentJobs fetches the recent jobs as the admin API serves them.
+func recentJobs(t *testing.T, r *RecentJobs, query string) []RecentJob {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/recent-jobs"+query, nil))
+	var jobs []RecentJob
+	if err := json.NewDecoder(w.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+// recentIds returns the ids of jobs.
+func recentIds(jobs []RecentJob) []uint64 {
+	ids := make([]uint64, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.JobId
+	}
+	return ids
+}
+
+func TestRecentJobs(t *testing.T) {
+	s := newFakeServer(t)
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		ids = append(ids, s.putPacket("jobs", domainPacket("acme")))
+	}
+	statuses := []int{0, 2, 0}
+	e := &fakeExecutor{next: func() *fakeProcess {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &fakeProcess{
+			status: status,
+			stdout: []string{strings.Repeat("o", MaxRecentOutputBytes), "done"},
+			stderr: strings.Repeat("x", 2*MaxRecentOutputBytes),
+		}
+	}}
+	o := s.options()
+	// The failed job is not retried, so each job is processed once.
+	o.NoRetry = true
+	b := testBroker(o, e, "jobs")
+	b.Recent = NewRecentJobs(2)
+
+	runJobs(b, 1)
+	jobs := recentJobs(t, b.Recent, "")
+	if len(jobs) != 1 || jobs[0].JobId != ids[0] || jobs[0].Tube != "jobs" || jobs[0].Outcome != OutcomeSucceeded {
+		t.Fatalf("recent jobs %v, want the succeeded job %d", recentIds(jobs), ids[0])
+	}
+	if n := len(jobs[0].Stderr); n != MaxRecentOutputBytes {
+		t.Errorf("kept %d bytes of stderr, want %d", n, MaxRecentOutputBytes)
+	}
+	if out := jobs[0].Stdout; len(out) != MaxRecentOutputBytes || !strings.HasSuffix(out, "done") {
+		t.Errorf("kept %d bytes of stdout ending %q, want its last %d", len(out), tail([]byte(out), 4), MaxRecentOutputBytes)
+	}
+
+	// The first job ages out of the ring, the most recent is listed first.
+	runJobs(b, 2)
+	jobs = recentJobs(t, b.Recent, "?n=50")
+	if len(jobs) != 2 || jobs[0].JobId != ids[2] || jobs[1].JobId != ids[1] {
+		t.Fatalf("recent jobs %v, want jobs %d and %d", recentIds(jobs), ids[2], ids[1])
+	}
+	if jobs[1].Outcome != OutcomeFailed || jobs[1].ExitStatus != 2 {
+		t.Errorf("recent job %d %s with exit %d, want it failed with exit 2", jobs[1].JobId, jobs[1].Outcome, jobs[1].ExitStatus)
+	}
+	if jobs := recentJobs(t, b.Recent, "?n=1"); len(jobs) != 1 || jobs[0].JobId != ids[2] {
+		t.Errorf("recent jobs %v with n=1, want job %d", recentIds(jobs), ids[2])
+	}
+
+	w := httptest.NewRecorder()
+	b.Recent.ServeHTTP(w, httptest.NewRequest("GET", "/recent-jobs?n=many", nil))
+	if w.Code != 400 {
+		t.Errorf("status %d for a bad n, want 400", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+const (
+	// defaultReconnectInitial and defaultReconnectMax are used when the
+	// options leave the reconnect backoff unset.
+	defaultReconnectInitial = 1 * time.Second
+	defaultReconnectMax     = 1 * time.Minute
+)
+
+// connectWithBackoff dials beanstalkd until it succeeds, sleeping with
+// jittered exponential backoff between attempts. It gives up after
+// -reconnect-max-attempts failed attempts, when that is not zero.
+func (b *Broker) connectWithBackoff() (*beanstalk.Conn, error) {
+	for attempt := uint64(1); ; attempt++ {
+		conn, err := b.connect()
+		if err == nil {
+			return conn, nil
+		}
+
+		if max := b.options.ReconnectMaxAttempts; max > 0 && attempt >= max {
+			return nil, fmt.Errorf("giving up connecting to %s after %d attempts, error: %s", b.Address, attempt, err)
+		}
+
+		delay := b.reconnectDelay(attempt)
+		b.log.Warnf("failed to connect to %s (attempt %d), retrying in %v, error: %s", b.Address, attempt, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// reconnect replaces a lost connection, as per connectWithBackoff.
+func (b *Broker) reconnect(conn *beanstalk.Conn) (*beanstalk.Conn, error) {
+	b.disconnect(conn)
+	conn, err := b.connectWithBackoff()
+	if err == nil {
+		b.log.WithField("event", "reconnect").Infof("reconnected to %s", b.Address)
+		connectionEvents.Inc("reconnect", b.Tube, b.options.WorkerId)
+	}
+	return conn, err
+}
+
+// refresh replaces a healthy connection once it has served
+// -refresh-conn-after jobs, as long-lived connections can accumulate state.
+func (b *Broker) refresh(conn *beanstalk.Conn) (*beanstalk.Conn, error) {
+	b.disconnect(conn)
+	conn, err := b.connectWithBackoff()
+	if err == nil {
+		b.log.WithField("event", "refresh").Infof("refreshed connection to %s after %d jobs", b.Address, b.options.RefreshConnAfter)
+		connectionEvents.Inc("refresh", b.Tube, b.options.WorkerId)
+	}
+	return conn, err
+}
+
+// reconnectDelay is the backoff after the given number of failed attempts:
+// the initial delay doubled per attempt up to the maximum, of which a random
+// half is slept, so that brokers losing their connections together don't
+// redial in lockstep.
+func (b *Broker) reconnectDelay(attempt uint64) time.Duration {
+	initial, max := b.options.ReconnectInitial, b.options.ReconnectMax
+	if initial <= 0 {
+		initial = defaultReconnectInitial
+	}
+	if max <= 0 {
+		max = defaultReconnectMax
+	}
+
+	delay := max
+	if attempt <= 32 {
+		if d := initial << (attempt - 1); d > 0 && d < max {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
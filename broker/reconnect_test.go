@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// closedAddress returns an address nothing is listening on.
+func closedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestReconnectDelay(t *testing.T) {
+	b := Broker{options: cli.Options{ReconnectInitial: time.Second, ReconnectMax: 10 * time.Second}}
+	tests := []struct {
+		attempt uint64
+		backoff time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{64, 10 * time.Second},
+		{1000, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		// A random half of the backoff is slept.
+		for i := 0; i < 100; i++ {
+			if d := b.reconnectDelay(tt.attempt); d < tt.backoff/2 || d > tt.backoff {
+				t.Fatalf("attempt %d: delay %v, want between %v and %v", tt.attempt, d, tt.backoff/2, tt.backoff)
+			}
+		}
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	o := cli.Options{
+		Address:              closedAddress(t),
+		ReconnectInitial:     time.Millisecond,
+		ReconnectMax:         5 * time.Millisecond,
+		ReconnectMaxAttempts: 3,
+	}
+	bd := NewBrokerDispatcher(o)
+	bd.runBroker([]string{"jobs"}, 0, 1, nil, nil)
+	if err := bd.WaitWithTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	err := bd.Err()
+	if err == nil || !strings.Contains(err.Error(), "jobs/0: giving up connecting") || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("dispatcher error %v, want the broker to have given up after 3 attempts", err)
+	}
+}
+
+func TestRefreshConnAfter(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		s := newFakeServer(t)
+		o := s.options()
+		o.RefreshConnAfter = 2
+		var ids []uint64
+		for i := 0; i < 5; i++ {
+			ids = append(ids, s.putPacket("jobs", domainPacket("acme")))
+		}
+		b := testBroker(o, &fakeExecutor{}, "jobs")
+
+		ticks := make(chan bool)
+		done := make(chan struct{})
+		if shared {
+			go b.RunShared(ticks, func() { close(done) }, 2)
+		} else {
+			go b.Run(ticks, func() { close(done) })
+		}
+		for range ids {
+			ticks <- true
+		}
+		waitFor(t, "the jobs to be deleted", func() bool {
+			for _, id := range ids {
+				if s.state(id) != "deleted" {
+					return false
+				}
+			}
+			return true
+		})
+		close(ticks)
+		<-done
+
+		// The first connection, and one after the second and fourth jobs.
+		if n := s.dialled(); n != 3 {
+			t.Errorf("shared reserve %t: dialled %d times, want 3", shared, n)
+		}
+	}
+}
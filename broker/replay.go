@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+	"github.com/kr/beanstalk"
+)
+
+// ReplayEnv is added to the environment of a replayed job, so that its
+// controller can tell a replay from a real run.
+const ReplayEnv = "BEANSTALK_REPLAY=1"
+
+// Replay executes a buried job again without reserving it, to see why it
+// failed: the job with the given id, or when id is zero the next buried job
+// of tube. The job is left buried whatever the outcome, so there is nothing
+// to dispose of, and its stdout and stderr are returned in the result.
+func (b *Broker) Replay(id uint64, tube string) (*JobResult, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var body []byte
+	if id != 0 {
+		body, err = conn.Peek(id)
+	} else {
+		t := &beanstalk.Tube{Conn: conn, Name: b.options.Prefixed(tube)}
+		id, body, err = t.PeekBuried()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek buried job, error: %s", err)
+	}
+	job := bs.NewJob(id, body, conn)
+
+	stats, err := job.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stats of job %d, error: %s", id, err)
+	}
+	// A job in any other state may be executing, or about to be.
+	if stats.State != "buried" {
+		return nil, fmt.Errorf("job %d is %s, only buried jobs are replayed", id, stats.State)
+	}
+	tube, _ = b.options.Unprefixed(stats.Tube)
+
+	packet, err := decodePacket(job, b.options.JobFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := b.policy(tube)
+	controller := b.options.Controller
+	route, routed := b.options.Routes.Match(tube, packet.String)
+	if routed {
+		policy.apply(route.PolicyRule)
+		if route.Controller != "" {
+			controller = route.Controller
+		}
+	}
+
+	var wd string
+	if routed && route.WorkDir != "" {
+		wd = route.WorkDir
+	} else if wd, err = b.ResolveWorkDir(b.options, job, packet); err != nil {
+		return nil, err
+	}
+
+	// The job is not reserved, so, as for an at-most-once job, there is no
+	// reservation to hold, and the child is allowed the job's TTR.
+	policy.AtMostOnce = true
+	timeLeft := func() (time.Duration, error) { return stats.TTR, nil }
+	b.options.RetainStdout = true
+	b.env = append(b.env, ReplayEnv)
+
+	attempt := stats.Releases + stats.Timeouts + 1
+	b.log.WithField("attempt", attempt).Infof("replaying buried job %d in path %s", id, wd)
+	result, err := b.executeJob(job, tube, packet, wd, controller, policy, attempt, timeLeft)
+	if _, ok := err.(spawnError); ok {
+		result.Error = err
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Domain, _ = findDomain(packet)
+	result.WorkDir = wd
+	b.log.Infof("replayed job %d finished with exit(%d), timed out: %t, left buried", id, result.ExitStatus, result.TimedOut)
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayLeavesJobBuried(t *testing.T) {
+	s := newFakeServer(t)
+	id := s.putPacket("email", domainPacket("acme"))
+	s.mu.Lock()
+	s.jobs[id].state = "buried"
+	s.mu.Unlock()
+
+	e := &fakeExecutor{next: func() *fakeProcess {
+		return &fakeProcess{status: 1, stdout: []string{"boom"}, stderr: "trace"}
+	}}
+	b := testBroker(s.options(), e, "email")
+
+	result, err := b.Replay(0, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.JobId != id || result.ExitStatus != 1 {
+		t.Errorf("got job %d exit(%d), want job %d exit(1)", result.JobId, result.ExitStatus, id)
+	}
+	if string(result.Stdout) != "boom" || string(result.Stderr) != "trace" {
+		t.Errorf("got stdout %q, stderr %q", result.Stdout, result.Stderr)
+	}
+
+	procs := e.started()
+	if len(procs) != 1 {
+		t.Fatalf("got %d processes, want 1", len(procs))
+	}
+	replayed := false
+	for _, v := range procs[0].environ() {
+		replayed = replayed || v == ReplayEnv
+	}
+	if !replayed {
+		t.Errorf("environment %q is missing %s", procs[0].environ(), ReplayEnv)
+	}
+
+	if state := s.state(id); state != "buried" {
+		t.Errorf("job is %s after replay, want buried", state)
+	}
+	for _, cmd := range []string{"reserve-job", "delete", "kick-job", "release", "bury"} {
+		if n := s.count(cmd); n != 0 {
+			t.Errorf("replay sent %s %d times", cmd, n)
+		}
+	}
+}
+
+func TestReplayRefusesJobNotBuried(t *testing.T) {
+	s := newFakeServer(t)
+	id := s.put("email", 100, time.Minute, "x")
+	e := &fakeExecutor{}
+	b := testBroker(s.options(), e, "email")
+
+	if _, err := b.Replay(id, ""); err == nil {
+		t.Error("replayed a ready job")
+	}
+	if n := len(e.started()); n != 0 {
+		t.Errorf("started %d processes, want none", n)
+	}
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Which jobs have their result logged, see -log-results-on.
+const (
+	LogResultsAlways  = "always"
+	LogResultsFailure = "failure"
+	LogResultsNever   = "never"
+)
+
+// discardLog swallows the result lines -log-results-on leaves out.
+var discardLog = log.NewEntry(&log.Logger{
+	Out:       ioutil.Discard,
+	Formatter: new(log.TextFormatter),
+	Hooks:     make(log.LevelHooks),
+	Level:     log.PanicLevel,
+})
+
+// resultLog returns the logger of the lines handleResult logs about how a
+// job finished and was disposed of. With -log-results-on=failure only jobs
+// which exited non-zero, timed out or were buried are logged, with the
+// details of the failure as fields, and with never no job is.
+func (b *Broker) resultLog(result *JobResult) *log.Entry {
+	failed := result.TimedOut || !result.ExitedOK() || result.Buried
+	switch b.options.LogResultsOn {
+	case LogResultsNever:
+		return discardLog
+	case LogResultsFailure:
+		if !failed {
+			return discardLog
+		}
+		return b.log.WithFields(log.Fields{
+			"job":       result.JobId,
+			"exit":      result.ExitStatus,
+			"timed_out": result.TimedOut,
+			"buried":    result.Buried,
+			"attempt":   result.Attempt,
+			"duration":  result.Duration,
+			"stderr":    strings.TrimSpace(string(result.Stderr)),
+		})
+	}
+	return b.log
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/cmd"
+	"github.com/kr/beanstalk"
+)
+
+// SelfTest checks that the broker can work in this environment: that
+// beanstalkd is reachable, PHP runs with the configured ini file, and the
+// instance and cluster roots exist. It writes a report to w and returns
+// whether every check passed.
+func SelfTest(o cli.Options, w io.Writer) bool {
+	checks := []struct {
+		name  string
+		check func(cli.Options) error
+	}{
+		{"beanstalkd " + o.Address, checkBeanstalkd},
+		{"php " + o.PHPBinary, checkPHP},
+		{"instance root " + o.InstanceRoot, func(o cli.Options) error { return checkDir(o.InstanceRoot) }},
+		{"cluster root " + o.ClusterRoot, func(o cli.Options) error { return checkDir(o.ClusterRoot) }},
+	}
+
+	passed := true
+	for _, c := range checks {
+		if err := c.check(o); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", c.name, err)
+			passed = false
+		} else {
+			fmt.Fprintf(w, "PASS %s\n", c.name)
+		}
+	}
+	return passed
+}
+
+func checkBeanstalkd(o cli.Options) error {
+	nc, err := dial(o)
+	if err != nil {
+		return err
+	}
+	conn := beanstalk.NewConn(nc)
+	defer conn.Close()
+
+	_, err = conn.ListTubes()
+	return err
+}
+
+func checkPHP(o cli.Options) error {
+	c, out, err := cmd.NewCommand(".", o.PHPBinary, "-c", o.PHPINI, "-v")
+	if err != nil {
+		return err
+	}
+	if err := c.StartWithStdin(nil); err != nil {
+		return err
+	}
+	for _ = range out {
+	}
+
+	wr := <-c.WaitChan()
+	if wr.Err != nil {
+		return wr.Err
+	}
+	if wr.Status != 0 {
+		return fmt.Errorf("php -v exited with status %d", wr.Status)
+	}
+	return nil
+}
+
+func checkDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	return nil
+}
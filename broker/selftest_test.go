@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	s := newFakeServer(t)
+	o := s.options()
+	o.InstanceRoot, o.ClusterRoot = dir, dir
+	// A stand-in for php, which only needs to exit 0 for -v.
+	o.PHPBinary = hookScript(t, dir, "exit 0\n")
+
+	var report bytes.Buffer
+	if !SelfTest(o, &report) {
+		t.Errorf("self-test failed:\n%s", report.String())
+	}
+
+	o.PHPBinary = filepath.Join(dir, "no-such-php")
+	report.Reset()
+	if SelfTest(o, &report) {
+		t.Error("self-test passed without a PHP binary")
+	}
+	if !strings.Contains(report.String(), "FAIL php "+o.PHPBinary) {
+		t.Errorf("report lacks the PHP failure:\n%s", report.String())
+	}
+	if n := strings.Count(report.String(), "PASS "); n != 3 {
+		t.Errorf("%d checks passed, want the other 3:\n%s", n, report.String())
+	}
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/bs"
+)
+
+// ShardReleaseDelay is how long a job belonging to another shard is delayed,
+// so the broker handing it off does not reserve it straight back.
+const ShardReleaseDelay = 1 * time.Second
+
+// shardOf returns the shard of -shard-count owning a domain.
+func shardOf(domain string, count uint64) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(domain))
+	return uint64(h.Sum32()) % count
+}
+
+// handOffForShard implements -shard-index: a job whose domain belongs to
+// another shard is put back as a new job, delayed by ShardReleaseDelay, for
+// that shard to pick up. Unlike a release this leaves the job's retries
+// untouched, unless putting the new job fails, when the job is released
+// instead. Jobs without a valid domain are kept, to be disposed of here like
+// any other such job.
+func (b *Broker) handOffForShard(job bs.Job, packet Packet) bool {
+	if b.options.ShardCount <= 1 {
+		return false
+	}
+
+	domain, err := findDomain(packet)
+	if err != nil {
+		return false
+	}
+	shard := shardOf(domain, b.options.ShardCount)
+	if shard == b.options.ShardIndex {
+		return false
+	}
+
+	b.log.Debugf("job %d of domain %s belongs to shard %d, handing it off", job.Id, domain, shard)
+	id, err := job.Replace(job.Body, ShardReleaseDelay)
+	if err != nil && id == 0 {
+		b.noteDraining(err)
+		b.log.Errorf("failed to hand off job %d to shard %d, releasing it, error: %s", job.Id, shard, err)
+		if err := job.Release(ShardReleaseDelay); err != nil {
+			b.log.Errorf("failed to release job %d, error: %s", job.Id, err)
+		}
+	} else if err != nil {
+		// The new job was put, so the job is left to go back to its tube
+		// on its TTR rather than released to be handed off twice.
+		b.log.Errorf("failed to delete job %d once handed off as job %d, error: %s", job.Id, id, err)
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShardsPartitionJobs(t *testing.T) {
+	s := newFakeServer(t)
+	// domains holds a domain of each of the two shards.
+	var domains [2]string
+	for _, domain := range []string{"acme", "globex", "initech", "umbrella", "hooli"} {
+		if shard := shardOf(domain, 2); domains[shard] == "" {
+			domains[shard] = domain
+		}
+	}
+	if domains[0] == "" || domains[1] == "" {
+		t.Fatalf("no domain of each shard in %q", domains)
+	}
+
+	var brokers [2]*Broker
+	var executors [2]*fakeExecutor
+	for i := range brokers {
+		o := s.options()
+		o.ShardIndex, o.ShardCount = uint64(i), 2
+		executors[i] = &fakeExecutor{}
+		brokers[i] = testBroker(o, executors[i], "jobs")
+	}
+
+	for shard, domain := range domains {
+		// The other shard hands the job off, untouched.
+		other := 1 - shard
+		ran := len(executors[other].started())
+		id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket(domain)))
+		result, err := brokers[other].processJob(s.reserveJob(id))
+		if err != nil || result != nil {
+			t.Fatalf("%s: shard %d returned %+v, error %v, want the job handed off", domain, other, result, err)
+		}
+		if n := len(executors[other].started()) - ran; n != 0 {
+			t.Errorf("%s: shard %d executed %d jobs of another shard", domain, other, n)
+		}
+		if got := s.state(id); got != "deleted" {
+			t.Errorf("%s: handed off job is %s, want it replaced", domain, got)
+		}
+		handedOff := id + 1
+		j, ok := s.job(handedOff)
+		if !ok || j.state != "delayed" || j.releases != 0 || string(j.body) != phpPacket(t, domainPacket(domain)) {
+			t.Fatalf("%s: replacement %+v, want the same body delayed without a release", domain, j)
+		}
+
+		// Its own shard executes it.
+		if _, err := brokers[shard].processJob(s.reserveJob(handedOff)); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(executors[shard].started()); n != 1 {
+			t.Errorf("%s: shard %d executed %d jobs, want its own", domain, shard, n)
+		}
+		if got := s.state(handedOff); got != "deleted" {
+			t.Errorf("%s: job is %s once executed by its shard", domain, got)
+		}
+	}
+	if n := s.count("release"); n != 0 {
+		t.Errorf("%d releases, want the jobs handed off without one", n)
+	}
+}
+
+func TestShardHandOffPutFails(t *testing.T) {
+	s := newFakeServer(t)
+	s.hook("put", func(args []string) string { return "JOB_TOO_BIG\r\n" })
+	o := s.options()
+	o.ShardCount = 2
+	o.ShardIndex = 1 - shardOf("acme", 2)
+	e := &fakeExecutor{}
+	b := testBroker(o, e, "jobs")
+
+	// The job cannot be put back for the other shard, so is released
+	// rather than left reserved until its TTR.
+	id := s.putPacket("jobs", domainPacket("acme"))
+	if result, err := b.processJob(s.reserveJob(id)); err != nil || result != nil {
+		t.Fatalf("returned %+v, error %v, want the job handed off", result, err)
+	}
+	if got := s.state(id); got != "delayed" {
+		t.Errorf("job is %s, want it released with a delay", got)
+	}
+	if n := len(e.started()); n != 0 {
+		t.Errorf("executed %d jobs of another shard", n)
+	}
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// TubeSlots caps how many jobs of each tube are in flight at once, across
+// every broker of the tube, as set by -max-in-flight. A broker takes a slot
+// of its tube before reserving and gives it back once the job is disposed
+// of, so that a tube's slow jobs cannot take up every worker while other
+// tubes wait.
+//
+// Only brokers of a single tube are capped: a broker of a tube group
+// reserves from whichever of its tubes has a job, so cannot know whose slot
+// to take beforehand.
+type TubeSlots struct {
+	slots map[string]chan bool
+}
+
+// NewTubeSlots creates the TubeSlots of the caps per tube.
+func NewTubeSlots(caps map[string]int) *TubeSlots {
+	s := &TubeSlots{slots: make(map[string]chan bool, len(caps))}
+	for tube, n := range caps {
+		s.slots[tube] = make(chan bool, n)
+	}
+	return s
+}
+
+// acquire takes a slot of the tube of a broker of tubes, waiting while they
+// are all taken. It reports false if drain is closed first. A nil s, or a
+// tube without a cap, never waits.
+func (s *TubeSlots) acquire(tubes []string, drain <-chan bool) bool {
+	slots := s.of(tubes)
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- true:
+		return true
+	default:
+	}
+
+	log.Debugf("tube %s has %d jobs in flight, waiting for one to finish", tubes[0], cap(slots))
+	select {
+	case slots <- true:
+		return true
+	case <-drain:
+		return false
+	}
+}
+
+// release gives back a slot taken by acquire.
+func (s *TubeSlots) release(tubes []string) {
+	if slots := s.of(tubes); slots != nil {
+		<-slots
+	}
+}
+
+func (s *TubeSlots) of(tubes []string) chan bool {
+	if s == nil || len(tubes) != 1 {
+		return nil
+	}
+	return s.slots[tubes[0]]
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"sync"
+)
+
+// spawnQueue holds the tubes discovered in -all mode whose brokers are yet
+// to be started. The poller only queues them: a pool of -spawn-workers
+// spawners starts their brokers, so that many tubes appearing at once
+// neither hold up polling nor start every broker in one burst.
+type spawnQueue struct {
+	mu    sync.Mutex
+	tubes []string
+
+	// ready is signalled when a tube is queued, waking a spawner.
+	ready chan bool
+
+	// started makes the spawners start with the first tube queued.
+	started sync.Once
+}
+
+// spawn queues tube to have its brokers started, without waiting for them.
+func (bd *BrokerDispatcher) spawn(tube string) {
+	bd.spawns.started.Do(bd.startSpawners)
+
+	bd.spawns.mu.Lock()
+	bd.spawns.tubes = append(bd.spawns.tubes, tube)
+	bd.spawns.mu.Unlock()
+	bd.spawns.wake()
+}
+
+// startSpawners starts the pool of spawners, which run until shutdown.
+func (bd *BrokerDispatcher) startSpawners() {
+	n := bd.options.SpawnWorkers
+	if n < 1 {
+		n = 1
+	}
+	bd.Add(n)
+	for i := 0; i < n; i++ {
+		go bd.spawner()
+	}
+}
+
+// spawner starts the brokers of queued tubes, one tube at a time, until
+// shutdown. Tubes still queued at shutdown are never started.
+func (bd *BrokerDispatcher) spawner() {
+	defer bd.Done()
+	for {
+		tube, ok := bd.spawns.next()
+		if !ok {
+			select {
+			case <-bd.spawns.ready:
+				continue
+			case <-bd.ret:
+				return
+			}
+		}
+		select {
+		case <-bd.ret:
+			return
+		default:
+		}
+		bd.startTube([]string{tube})
+	}
+}
+
+// next takes the first queued tube, reporting false if there is none.
+func (q *spawnQueue) next() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tubes) == 0 {
+		return "", false
+	}
+	tube := q.tubes[0]
+	q.tubes = q.tubes[1:]
+	// Pass the wakeup on, so that idle spawners share the rest.
+	if len(q.tubes) > 0 {
+		q.wake()
+	}
+	return tube, true
+}
+
+// wake signals a spawner that a tube is queued, unless one already has been.
+func (q *spawnQueue) wake() {
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsdPrefix namespaces the metrics sent to statsd.
+const StatsdPrefix = "beanstalk_broker."
+
+// Statsd sends the outcome and duration of every job processed to a statsd
+// server over UDP, tagged in the DogStatsD format. It mirrors the jobs_total
+// and job_duration_seconds metrics, for hosts which do not scrape
+// Prometheus. It is safe for concurrent use, and a nil *Statsd sends nothing.
+type Statsd struct {
+	conn net.Conn
+}
+
+// DialStatsd creates the Statsd sending to the server at address.
+func DialStatsd(address string) (*Statsd, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd at %s, error: %s", address, err)
+	}
+	return &Statsd{conn: conn}, nil
+}
+
+// Record sends the result of a job processed by a broker of tube.
+func (s *Statsd) Record(tube string, r *JobResult) {
+	if s == nil {
+		return
+	}
+
+	tags := fmt.Sprintf("#tube:%s,outcome:%s", statsdTag(tube), r.outcome())
+	if domain := domainLabel(r.Domain); domain != "" {
+		tags += ",domain:" + statsdTag(domain)
+	}
+	s.send(fmt.Sprintf("%sjobs:1|c|%s", StatsdPrefix, tags))
+	if r.Executed {
+		s.send(fmt.Sprintf("%sjob_duration:%d|ms|%s", StatsdPrefix, r.Duration.Milliseconds(), tags))
+	}
+}
+
+// send writes a metric line as a datagram. Losing it is only logged, as
+// statsd is best effort.
+func (s *Statsd) send(line string) {
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		log.Debugf("failed to send %q to statsd, error: %s", line, err)
+	}
+}
+
+// Close closes the connection. Later records are dropped.
+func (s *Statsd) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// statsdTag replaces the characters which delimit DogStatsD tags.
+func statsdTag(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", ":", "_", "#", "_").Replace(value)
+}
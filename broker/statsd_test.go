@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestStatsdJobOutcomes(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	statsd, err := DialStatsd(l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	s := newFakeServer(t)
+	e := &fakeExecutor{next: func() *fakeProcess { return &fakeProcess{status: 2} }}
+	b := testBroker(s.options(), e, "mail")
+	b.Statsd = statsd
+
+	before := jobsTotal.Value("mail", OutcomeFailed, "acme")
+	_, result := s.process(b, "mail", time.Minute, domainPacket("acme"))
+	b.report(result)
+	b.report(&JobResult{JobId: 7, ValidationFailed: true})
+
+	wants := []*regexp.Regexp{
+		regexp.MustCompile(`^beanstalk_broker\.jobs:1\|c\|#tube:mail,outcome:failed,domain:acme$`),
+		regexp.MustCompile(`^beanstalk_broker\.job_duration:\d+\|ms\|#tube:mail,outcome:failed,domain:acme$`),
+		regexp.MustCompile(`^beanstalk_broker\.jobs:1\|c\|#tube:mail,outcome:rejected$`),
+	}
+	buf := make([]byte, 512)
+	for i, want := range wants {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("metric %d not sent, error: %s", i, err)
+		}
+		if line := string(buf[:n]); !want.MatchString(line) {
+			t.Errorf("metric %d is %q, want it to match %s", i, line, want)
+		}
+	}
+
+	if got := jobsTotal.Value("mail", OutcomeFailed, "acme") - before; got != 1 {
+		t.Errorf("jobs_total of failed jobs rose by %v, want 1", got)
+	}
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"bytes"
+)
+
+// maxScanLineBytes is how much of a line of job stdout is scanned, its
+// start, comfortably more than a follow-up of a job as large as beanstalkd
+// allows by default. The excess is discarded, so that output without
+// newlines is not held in memory.
+const maxScanLineBytes = 256 * 1024
+
+// stdoutScanner reads job stdout line by line as it arrives, in chunks that
+// need not end on a line boundary, picking out follow-up directives,
+// permanent failure markers and the success marker.
+type stdoutScanner struct {
+	line      []byte
+	followUps []FollowUp
+	errs      []error
+
+	// markers are the permanent failure markers looked for, and marker the
+	// first one found.
+	markers []string
+	marker  string
+
+	// success is the success marker looked for, disabled when empty, and
+	// succeeded whether it was found.
+	success   string
+	succeeded bool
+}
+
+// Write feeds a chunk of stdout to the scanner.
+func (s *stdoutScanner) Write(data []byte) {
+	s.line = append(s.line, data...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			if len(s.line) > maxScanLineBytes {
+				s.line = s.line[:maxScanLineBytes]
+			}
+			return
+		}
+		s.scan(s.line[:i])
+		s.line = s.line[i+1:]
+	}
+}
+
+// Close scans the final line, if stdout did not end with a newline.
+func (s *stdoutScanner) Close() {
+	if len(s.line) > 0 {
+		s.scan(s.line)
+		s.line = nil
+	}
+}
+
+func (s *stdoutScanner) scan(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if s.marker == "" {
+		for _, m := range s.markers {
+			if bytes.Contains(line, []byte(m)) {
+				s.marker = m
+				break
+			}
+		}
+	}
+	if s.success != "" && !s.succeeded {
+		s.succeeded = bytes.Contains(line, []byte(s.success))
+	}
+	if !bytes.HasPrefix(line, []byte(FollowUpDirective)) {
+		return
+	}
+	f, err := parseFollowUp(line[len(FollowUpDirective):])
+	if err != nil {
+		s.errs = append(s.errs, err)
+		return
+	}
+	s.followUps = append(s.followUps, f)
+}
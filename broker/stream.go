@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// streamBuffer is how many chunks a slow subscriber may fall behind by
+// before chunks are dropped for it.
+const streamBuffer = 64
+
+// StdoutStreams passes on the stdout of executing jobs to subscribers as it
+// is read. It is safe for concurrent use, and a nil *StdoutStreams streams
+// nothing.
+type StdoutStreams struct {
+	mu   sync.Mutex
+	jobs map[uint64][]chan []byte
+}
+
+// NewStdoutStreams creates an empty StdoutStreams.
+func NewStdoutStreams() *StdoutStreams {
+	return &StdoutStreams{jobs: make(map[uint64][]chan []byte)}
+}
+
+// begin makes a job's stdout available to subscribers, returning a func
+// which ends its streams.
+func (s *StdoutStreams) begin(id uint64) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	s.jobs[id] = nil
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		subs := s.jobs[id]
+		delete(s.jobs, id)
+		s.mu.Unlock()
+
+		for _, ch := range subs {
+			close(ch)
+		}
+	}
+}
+
+// publish passes a chunk of a job's stdout on to its subscribers, dropping
+// it for those which have fallen behind rather than holding up the job.
+func (s *StdoutStreams) publish(id uint64, data []byte) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.jobs[id] {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the channel receiving a job's stdout, closed when the
+// job finishes, and a func unsubscribing from it. ok is false when the job
+// is not executing.
+func (s *StdoutStreams) Subscribe(id uint64) (chunks <-chan []byte, cancel func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs, ok := s.jobs[id]
+	if !ok {
+		return nil, nil, false
+	}
+	ch := make(chan []byte, streamBuffer)
+	s.jobs[id] = append(subs, ch)
+
+	cancel = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		subs := s.jobs[id]
+		for i, c := range subs {
+			if c == ch {
+				s.jobs[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}
+	return ch, cancel, true
+}
+
+// ServeHTTP streams the stdout of the job at /jobs/{id}/stream as
+// Server-Sent Events, one data event per chunk, and an end event once the
+// job finishes.
+func (s *StdoutStreams) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if !strings.HasSuffix(path, "/stream") {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(path, "/stream"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid job id", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	chunks, cancel, ok := s.Subscribe(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %d is not executing", id), http.StatusNotFound)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case data, ok := <-chunks:
+			if !ok {
+				fmt.Fprint(w, "event: end\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
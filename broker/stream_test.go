@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStdoutStreamServedAsEvents(t *testing.T) {
+	streams := NewStdoutStreams()
+	srv := httptest.NewServer(streams)
+	defer srv.Close()
+
+	end := streams.begin(7)
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/jobs/7/stream")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	waitFor(t, "the subscriber", func() bool {
+		streams.mu.Lock()
+		defer streams.mu.Unlock()
+		return len(streams.jobs[7]) == 1
+	})
+	streams.publish(7, []byte("hello\nworld\n"))
+	end()
+
+	select {
+	case got := <-body:
+		if want := "data: hello\ndata: world\n\nevent: end\ndata:\n\n"; got != want {
+			t.Errorf("streamed %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not ended with the job")
+	}
+
+	for path, want := range map[string]int{
+		"/jobs/7/stream":   http.StatusNotFound,
+		"/jobs/x/stream":   http.StatusBadRequest,
+		"/jobs/7/progress": http.StatusNotFound,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestStdoutStreamedWhileExecuting(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+
+	var chunks <-chan []byte
+	streams := NewStdoutStreams()
+	e := &fakeExecutor{next: func() *fakeProcess {
+		// The job is streamable by the time its worker is created.
+		var ok bool
+		if chunks, _, ok = streams.Subscribe(id); !ok {
+			t.Error("job not streamable while executing")
+		}
+		return &fakeProcess{stdout: []string{"one\n", "two\n"}}
+	}}
+	b := testBroker(o, e, "jobs")
+	b.Streams = streams
+
+	if _, err := b.processJob(s.reserveJob(id)); err != nil {
+		t.Fatal(err)
+	}
+	if chunks == nil {
+		t.FailNow()
+	}
+	var got string
+	for data := range chunks {
+		got += string(data)
+	}
+	if got != "one\ntwo\n" {
+		t.Errorf("streamed %q, want the job's stdout", got)
+	}
+	if _, _, ok := streams.Subscribe(id); ok {
+		t.Error("job still streamable once finished")
+	}
+}
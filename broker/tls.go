@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// dial connects to beanstalkd, over a Unix socket for a unix:// address, or
+// over TLS when -tls is set, giving up after -connect-timeout.
+func dial(o cli.Options) (net.Conn, error) {
+	nc, err := dialBeanstalkd(o)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil, fmt.Errorf("failed to connect to %s within %v, error: %s", o.Address, o.ConnectTimeout, err)
+	}
+	return nc, err
+}
+
+func dialBeanstalkd(o cli.Options) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.ConnectTimeout}
+	if path, ok := o.UnixSocket(); ok {
+		return dialer.Dial("unix", path)
+	}
+	if !o.TLS {
+		return dialer.Dial("tcp", o.Address)
+	}
+
+	config, err := tlsConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	// The timeout covers the handshake too.
+	return tls.DialWithDialer(dialer, "tcp", o.Address, config)
+}
+
+// tlsConfig builds the TLS configuration for a connection. The CA file is
+// read on every call and the client certificate on every handshake, so that
+// certificates rotated on disk are used from the next reconnect without a
+// restart.
+func tlsConfig(o cli.Options) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if o.TLSCA != "" {
+		pem, err := ioutil.ReadFile(o.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA file %s, error: %s", o.TLSCA, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", o.TLSCA)
+		}
+	}
+
+	if o.TLSCert != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS client certificate %s, error: %s", o.TLSCert, err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.key = ca.issue(t, "test CA", nil)
+	return ca
+}
+
+// issue creates a certificate for name, signed by the CA, or self-signed as
+// a CA when ca.cert is nil.
+func (ca *testCA) issue(t *testing.T, name string, ips []net.IP) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  ips,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := ca.cert, ca.key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, signer = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes a certificate and its key as PEM files.
+func writePEM(t *testing.T, cert *x509.Certificate, key *ecdsa.PrivateKey, certFile, keyFile string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSClientCertificateReloaded(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	o := cli.Options{
+		TLS:     true,
+		TLSCA:   filepath.Join(dir, "ca.pem"),
+		TLSCert: filepath.Join(dir, "client.pem"),
+		TLSKey:  filepath.Join(dir, "client.key"),
+	}
+	writePEM(t, ca.cert, ca.key, o.TLSCA, filepath.Join(dir, "ca.key"))
+
+	serverCert, serverKey := ca.issue(t, "beanstalkd", []net.IP{net.ParseIP("127.0.0.1")})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	o.Address = l.Addr().String()
+
+	clients := make(chan string, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := c.(*tls.Conn)
+			if err := tc.Handshake(); err == nil {
+				clients <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			c.Close()
+		}
+	}()
+
+	for _, name := range []string{"broker-2025", "broker-2026"} {
+		// Rotate the client certificate on disk between dials.
+		cert, key := ca.issue(t, name, nil)
+		writePEM(t, cert, key, o.TLSCert, o.TLSKey)
+
+		nc, err := dial(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nc.Close()
+		select {
+		case got := <-clients:
+			if got != name {
+				t.Errorf("dialled with certificate %s, want the rotated %s", got, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("server saw no handshake")
+		}
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "beanstalkd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serveFake(t, l)
+	o := s.options()
+	if o.Address != "unix://"+path {
+		t.Fatalf("address %s", o.Address)
+	}
+
+	id := s.put("jobs", 100, time.Minute, phpPacket(t, domainPacket("acme")))
+	runJobs(testBroker(o, &fakeExecutor{}, "jobs"), 1)
+	if got := s.state(id); got != "deleted" {
+		t.Errorf("job is %s, want it processed over the socket", got)
+	}
+	if n := s.dialled(); n != 1 {
+		t.Errorf("%d connections to the socket, want 1", n)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// 10.255.255.1 is not routed, so connecting to it hangs, or is refused
+	// outright or even accepted by a proxying network; in any case the dial
+	// must not outlast the bound.
+	o := cli.Options{Address: "10.255.255.1:11300", ConnectTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	if nc, err := dial(o); err == nil {
+		nc.Close()
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("dial gave up after %v, want within %v", took, o.ConnectTimeout)
+	}
+
+	// A server which accepts but never completes the TLS handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	o = cli.Options{Address: l.Addr().String(), TLS: true, ConnectTimeout: 200 * time.Millisecond}
+	start = time.Now()
+	nc, err := dial(o)
+	if err == nil {
+		nc.Close()
+		t.Fatal("completed a handshake nobody answered")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("dial gave up after %v, want within %v", took, o.ConnectTimeout)
+	}
+	if !strings.Contains(err.Error(), "within 200ms") {
+		t.Errorf("error %q, want it to name the timeout", err)
+	}
+}
@@ -0,0 +1,14 @@
+package broker
+
+// traceParent returns a W3C traceparent for the job, taken from either the
+// traceparent or the trace_id key of the job packet, so that the job's span
+// joins the producer's trace. It returns an empty string when neither is set.
+func traceParent(packet Packet) string {
+	if tp, ok := packet.String("traceparent"); ok {
+		return tp
+	}
+	if id, ok := packet.String("trace_id"); ok && len(id) == 32 {
+		return "00-" + id + "-0000000000000000-01"
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// WarmupRetryInterval is the time between attempts at a failing
+// -warmup-command.
+var WarmupRetryInterval = 5 * time.Second
+
+// warmUp runs the -warmup-command before the broker reserves its first job,
+// retrying every WarmupRetryInterval until it exits 0, so that the first job
+// neither pays for a cold start nor fails on a dependency not yet ready. It
+// reports false if the broker is drained first.
+func (b *Broker) warmUp() bool {
+	if b.options.WarmupCommand == "" {
+		return true
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := b.runWarmup()
+		if err == nil {
+			b.log.Infof("warm-up succeeded (attempt %d)", attempt)
+			return true
+		}
+		if b.draining() {
+			return false
+		}
+		b.log.Warnf("%s, retrying in %v", err, WarmupRetryInterval)
+
+		select {
+		case <-b.drain:
+			return false
+		case <-time.After(WarmupRetryInterval):
+		}
+	}
+}
+
+// runWarmup runs the -warmup-command once in the instance root, killing it
+// if the broker is drained meanwhile.
+func (b *Broker) runWarmup() error {
+	c, out, err := commandExecutor(b.options.InstanceRoot, b.options.WarmupCommand)
+	if err != nil {
+		return fmt.Errorf("failed to create warm-up command, error: %s", err)
+	}
+	c.AddEnv(
+		"BEANSTALK_TUBE="+b.Tube,
+		"BEANSTALK_WORKER_ID="+b.options.WorkerId,
+	)
+	if err := c.StartWithStdin(nil); err != nil {
+		return fmt.Errorf("failed to start warm-up command, error: %s", err)
+	}
+
+	// The command's stdout is not used, but must be drained for it to exit.
+	go func() {
+		for _ = range out {
+		}
+	}()
+
+	waitC := c.WaitChan()
+	select {
+	case wr := <-waitC:
+		if wr.Err != nil {
+			return fmt.Errorf("warm-up command failed, error: %s", wr.Err)
+		}
+		if wr.Status != 0 {
+			return fmt.Errorf("warm-up command exited with status %d", wr.Status)
+		}
+		return nil
+	case <-b.drain:
+		if err := c.Kill(); err != nil {
+			b.log.Errorf("failed to kill warm-up command, error: %s", err)
+		}
+		<-waitC
+		return fmt.Errorf("warm-up command killed on shutdown")
+	}
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmupBeforeFirstReserve(t *testing.T) {
+	s := newFakeServer(t)
+	o := s.options()
+	ran := filepath.Join(t.TempDir(), "ran")
+	o.WarmupCommand = hookScript(t, t.TempDir(), "echo warmup >>"+ran+"\n")
+	o.PHPBinary = fakePHP(t, "/bin/cat >/dev/null; echo job >>"+ran)
+
+	s.putPacket("jobs", domainPacket("acme"))
+	s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	next()
+	next()
+
+	data, err := ioutil.ReadFile(ran)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "warmup job job" {
+		t.Errorf("ran %v, want the warm-up once, before the jobs", got)
+	}
+}
+
+func TestFailingWarmupDelaysReserving(t *testing.T) {
+	defer func(d time.Duration) { WarmupRetryInterval = d }(WarmupRetryInterval)
+	WarmupRetryInterval = 20 * time.Millisecond
+
+	s := newFakeServer(t)
+	o := s.options()
+	dir := t.TempDir()
+	ready := filepath.Join(dir, "ready")
+	attempts := filepath.Join(dir, "attempts")
+	o.WarmupCommand = hookScript(t, dir, "echo x >>"+attempts+"\n[ -e "+ready+" ]\n")
+
+	id := s.putPacket("jobs", domainPacket("acme"))
+	_, next := s.startBroker(o, "jobs")
+	result := make(chan *JobResult)
+	go func() { result <- next() }()
+
+	waitFor(t, "the warm-up to be retried", func() bool {
+		data, _ := ioutil.ReadFile(attempts)
+		return strings.Count(string(data), "x") >= 3
+	})
+	if n := s.count("reserve") + s.count("reserve-with-timeout"); n != 0 {
+		t.Fatalf("reserved %d times while the warm-up was failing", n)
+	}
+	if err := ioutil.WriteFile(ready, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := <-result; r.JobId != id || !r.Executed {
+		t.Errorf("job %d, executed %t, want job %d executed once warmed up", r.JobId, r.Executed, id)
+	}
+}
@@ -5,10 +5,15 @@
 package bs
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/kr/beanstalk"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -17,23 +22,125 @@ const (
 	DeadlineSoonDelay = 1 * time.Second
 )
 
-// reserve-with-timeout until there's a job or something critical
+// ErrNoJob is returned by ReserveWithin when no job was reserved.
+var ErrNoJob = errors.New("no job reserved")
+
+// ErrDeadlineSoon is returned by ReserveWithin when beanstalkd refused the
+// reserve because a job reserved on the same connection is about to exceed
+// its TTR. A caller holding such a job should see to it, by finishing or
+// touching it, before reserving again; one holding none can just retry after
+// a short sleep.
+var ErrDeadlineSoon = errors.New("deadline soon")
+
+// reserve-with-timeout until there's a job or the connection fails.
 // Handles beanstalk.ErrTimeout by retrying immediately.
-// Handles beanstalk.ErrDeadline by sleeping DeadlineSoonDelay before retry.
-// print other errors.
-func MustReserveWithoutTimeout(ts *beanstalk.TubeSet) (uint64, []byte) {
+// Handles beanstalk.ErrDeadline by sleeping DeadlineSoonDelay before retry,
+// as the caller holds no job it could see to meanwhile.
+// print other error responses, throttled by ReserveErrorLogInterval, and
+// retry; connection failures are returned.
+func ReserveWithoutTimeout(ts *beanstalk.TubeSet) (uint64, []byte, error) {
 	for {
-		id, body, err := ts.Reserve(1 * time.Hour)
-		if err == nil {
-			return id, body
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrTimeout {
-			continue
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrDeadline {
+		id, body, err := ReserveWithin(ts, 1*time.Hour)
+		if err == ErrDeadlineSoon {
 			time.Sleep(DeadlineSoonDelay)
 			continue
-		} else {
-			log.Error(err)
-			continue
 		}
+		if err != ErrNoJob {
+			return id, body, err
+		}
+	}
+}
+
+// ReserveWithin makes a single reserve attempt, waiting at most timeout for a
+// job. It returns ErrNoJob when no job was reserved, ErrDeadlineSoon on
+// DEADLINE_SOON, or the error if the connection failed. Other error responses
+// are logged as per ReserveWithoutTimeout.
+func ReserveWithin(ts *beanstalk.TubeSet, timeout time.Duration) (uint64, []byte, error) {
+	id, body, err := ts.Reserve(timeout)
+	if err == nil {
+		return id, body, nil
+	}
+	if IsConnError(err) {
+		return 0, nil, err
+	}
+	if e, ok := err.(beanstalk.ConnError); ok && e.Err == beanstalk.ErrTimeout {
+		return 0, nil, ErrNoJob
+	} else if ok && e.Err == beanstalk.ErrDeadline {
+		return 0, nil, ErrDeadlineSoon
+	}
+	reserveErrors.log(err)
+	return 0, nil, ErrNoJob
+}
+
+// Put creates a job on tube, returning its id.
+func Put(conn *beanstalk.Conn, tube string, body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	t := beanstalk.Tube{Conn: conn, Name: tube}
+	return t.Put(body, pri, delay, ttr)
+}
+
+// IsConnError reports whether err is a failure of the connection itself,
+// after which it must be re-established, rather than an error response from
+// beanstalkd.
+func IsConnError(err error) bool {
+	if e, ok := err.(beanstalk.ConnError); ok {
+		err = e.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// IsJobTooBig reports whether err is beanstalkd refusing a put because the
+// job body exceeds its max-job-size.
+func IsJobTooBig(err error) bool {
+	if e, ok := err.(beanstalk.ConnError); ok {
+		err = e.Err
+	}
+	return err == beanstalk.ErrJobTooBig
+}
+
+// IsDraining reports whether err is beanstalkd refusing a put because it is
+// in drain mode, ahead of being taken down.
+func IsDraining(err error) bool {
+	if e, ok := err.(beanstalk.ConnError); ok {
+		err = e.Err
+	}
+	return err == beanstalk.ErrDraining
+}
+
+// ReserveJob reserves the job with the given id, whether it is ready, delayed
+// or buried, using the reserve-job command. github.com/kr/beanstalk does not
+// implement reserve-job, so the command is written directly to rw; it must be
+// called before rw is wrapped with beanstalk.NewConn, which then owns the
+// reservation.
+func ReserveJob(rw io.ReadWriter, id uint64) (body []byte, err error) {
+	if _, err = fmt.Fprintf(rw, "reserve-job %d\r\n", id); err != nil {
+		return
+	}
+
+	// beanstalkd sends nothing beyond the response, so the buffered reader
+	// cannot consume bytes meant for later commands.
+	r := bufio.NewReader(rw)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	var rid uint64
+	var size int
+	if _, e := fmt.Sscanf(line, "RESERVED %d %d", &rid, &size); e != nil {
+		if line == "NOT_FOUND" {
+			return nil, beanstalk.ConnError{Op: "reserve-job", Err: beanstalk.ErrNotFound}
+		}
+		return nil, fmt.Errorf("reserve-job: unexpected response %q", line)
+	}
+
+	body = make([]byte, size+2) // include trailing CR NL
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
 	}
+	return body[:size], nil
 }
@@ -0,0 +1,68 @@
+package bs
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kr/beanstalk"
+)
+
+// scripted is a connection replying with a canned response, recording what
+// is written to it.
+type scripted struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func newScripted(reply string) *scripted {
+	return &scripted{Reader: strings.NewReader(reply)}
+}
+
+func (s *scripted) Read(p []byte) (int, error) {
+	return s.Reader.Read(p)
+}
+
+func (s *scripted) Close() error {
+	return nil
+}
+
+// scriptedConn is a beanstalk connection replying with a canned response.
+func scriptedConn(reply string) (*beanstalk.Conn, *scripted) {
+	rw := newScripted(reply)
+	return beanstalk.NewConn(rw), rw
+}
+
+func TestReserveJob(t *testing.T) {
+	rw := newScripted("RESERVED 42 5\r\nhello\r\n")
+	body, err := ReserveJob(rw, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("body %q, want hello", body)
+	}
+	if got := rw.String(); got != "reserve-job 42\r\n" {
+		t.Errorf("sent %q, want reserve-job 42", got)
+	}
+}
+
+func TestReserveJobNotFound(t *testing.T) {
+	_, err := ReserveJob(newScripted("NOT_FOUND\r\n"), 42)
+	if e, ok := err.(beanstalk.ConnError); !ok || e.Err != beanstalk.ErrNotFound {
+		t.Errorf("error %v, want not found", err)
+	}
+}
+
+func TestReserveJobUnexpectedResponse(t *testing.T) {
+	if _, err := ReserveJob(newScripted("UNKNOWN_COMMAND\r\n"), 42); err == nil || !strings.Contains(err.Error(), "UNKNOWN_COMMAND") {
+		t.Errorf("error %v, want the unexpected response", err)
+	}
+}
+
+func TestReserveJobTruncatedBody(t *testing.T) {
+	if _, err := ReserveJob(newScripted("RESERVED 42 5\r\nhel"), 42); err == nil {
+		t.Error("a truncated body was accepted")
+	}
+}
@@ -0,0 +1,133 @@
+package bs
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// TubeCycle reserves jobs from a group of tubes in round-robin order, so that
+// a busy tube cannot monopolize the connection.
+//
+// Fairness guarantee: each reserve polls the tubes one at a time, starting
+// with the tube after the one last served. While several tubes have ready
+// jobs, no tube is served twice before every other tube with a ready job has
+// been served once. Only when every tube is empty does TubeCycle fall back to
+// a blocking reserve across the whole group.
+//
+// With ByPriority set, the round-robin order gives way to priority: before
+// each reserve the ready job of every tube is peeked, and the tube holding the
+// most urgent one is reserved from first. This costs a peek and a stats-job
+// round-trip per tube on every reserve.
+type TubeCycle struct {
+	conn  *beanstalk.Conn
+	tubes []string
+	sets  []*beanstalk.TubeSet
+	all   *beanstalk.TubeSet
+	next  int
+
+	// ByPriority == true means jobs are reserved across tubes in priority
+	// order rather than round-robin.
+	ByPriority bool
+}
+
+// NewTubeCycle creates a TubeCycle over the given tubes.
+func NewTubeCycle(conn *beanstalk.Conn, tubes ...string) *TubeCycle {
+	c := &TubeCycle{
+		conn:  conn,
+		tubes: tubes,
+		all:   beanstalk.NewTubeSet(conn, tubes...),
+	}
+	for _, tube := range tubes {
+		c.sets = append(c.sets, beanstalk.NewTubeSet(conn, tube))
+	}
+	return c
+}
+
+// ReserveWithoutTimeout reserves the next job, following the round-robin
+// order. Errors are handled as per the package's ReserveWithoutTimeout.
+func (c *TubeCycle) ReserveWithoutTimeout() (uint64, []byte, error) {
+	for {
+		id, body, err := c.poll()
+		if err == ErrDeadlineSoon {
+			time.Sleep(DeadlineSoonDelay)
+			continue
+		}
+		if err != ErrNoJob {
+			return id, body, err
+		}
+		return ReserveWithoutTimeout(c.all)
+	}
+}
+
+// Reserve is as ReserveWithoutTimeout, but gives up once timeout has passed
+// without a job, returning ErrNoJob. ErrDeadlineSoon is returned rather than
+// slept on, for callers which may hold jobs on the connection.
+func (c *TubeCycle) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	if id, body, err := c.poll(); err != ErrNoJob {
+		return id, body, err
+	}
+	return ReserveWithin(c.all, timeout)
+}
+
+// poll tries each tube in turn without waiting, starting after the tube last
+// served. It does nothing for a single tube, which needs no fairness.
+func (c *TubeCycle) poll() (uint64, []byte, error) {
+	if len(c.sets) == 1 {
+		return 0, nil, ErrNoJob
+	}
+
+	if c.ByPriority {
+		if n, ok := c.mostUrgent(); ok {
+			id, body, err := ReserveWithin(c.sets[n], 0)
+			if err == nil {
+				c.next = n + 1
+			}
+			if err != ErrNoJob {
+				return id, body, err
+			}
+			// Another worker took the job in between; fall back to polling.
+		}
+	}
+
+	for i := range c.sets {
+		n := (c.next + i) % len(c.sets)
+		id, body, err := ReserveWithin(c.sets[n], 0)
+		if err == nil {
+			c.next = n + 1
+		}
+		if err != ErrNoJob {
+			return id, body, err
+		}
+	}
+	return 0, nil, ErrNoJob
+}
+
+// mostUrgent returns the index of the tube whose next ready job has the most
+// urgent priority, or false if no tube has a ready job. Ties go to the tube
+// next in round-robin order.
+func (c *TubeCycle) mostUrgent() (int, bool) {
+	best, found := 0, false
+	var bestPri uint64
+
+	for i := range c.tubes {
+		n := (c.next + i) % len(c.tubes)
+		id, _, err := (&beanstalk.Tube{Conn: c.conn, Name: c.tubes[n]}).PeekReady()
+		if err != nil {
+			continue
+		}
+		stats, err := c.conn.StatsJob(id)
+		if err != nil {
+			continue
+		}
+		pri, err := strconv.ParseUint(stats["pri"], 10, 32)
+		if err != nil {
+			continue
+		}
+		if !found || pri < bestPri {
+			best, bestPri, found = n, pri, true
+		}
+	}
+	return best, found
+}
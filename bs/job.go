@@ -6,8 +6,27 @@ import (
 	"time"
 
 	"github.com/kr/beanstalk"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultPriority is the priority a job is released or buried with when its
+// own cannot be read from its stats.
+const DefaultPriority = 1024
+
+// StatsParseError is returned when the stats-job response for a job cannot
+// be parsed, as from a beanstalkd version or a proxy formatting it
+// unexpectedly. It is a problem with the one job, not the connection.
+type StatsParseError struct {
+	Id    uint64
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *StatsParseError) Error() string {
+	return fmt.Sprintf("failed to parse %s %q in the stats of job %d, error: %s", e.Key, e.Value, e.Id, e.Err)
+}
+
 // Job represents a beanstalkd job, and holds a reference to the connection so
 // that server actions can be taken as methods on the job.
 type Job struct {
@@ -21,6 +40,36 @@ type Job struct {
 	conn *beanstalk.Conn
 }
 
+// JobStats is the typed form of the stats-job response for a job.
+type JobStats struct {
+
+	// Tube the job belongs to.
+	Tube string
+
+	// State is one of ready, delayed, reserved or buried.
+	State string
+
+	// Priority of the job, zero is most urgent.
+	Priority uint32
+
+	// Age is the time since the job was created.
+	Age time.Duration
+
+	// TTR is the job's time-to-run.
+	TTR time.Duration
+
+	// TimeLeft until the reservation expires, with one second precision.
+	TimeLeft time.Duration
+
+	// Reserves, Timeouts, Releases, Buries and Kicks count how many times
+	// each event has happened to the job.
+	Reserves uint64
+	Timeouts uint64
+	Releases uint64
+	Buries   uint64
+	Kicks    uint64
+}
+
 // Create a Job instance.
 func NewJob(id uint64, body []byte, conn *beanstalk.Conn) Job {
 	return Job{
@@ -30,15 +79,52 @@ func NewJob(id uint64, body []byte, conn *beanstalk.Conn) Job {
 	}
 }
 
-// Bury the job, with its original priority.
+// Bury the job, with its original priority, or DefaultPriority when that
+// cannot be parsed.
 func (j Job) Bury() error {
-	pri, err := j.Priority()
+	pri, err := j.priorityOrDefault()
 	if err != nil {
 		return err
 	}
 	return j.conn.Bury(j.Id, pri)
 }
 
+// DeadLetter moves the job to the given tube, keeping its priority and TTR.
+// The copy is put before the original is deleted, so a failure part way
+// leaves the job in place rather than losing it.
+func (j Job) DeadLetter(tube string) error {
+	stats, err := j.Stats()
+	if err != nil {
+		return err
+	}
+
+	if _, err := Put(j.conn, tube, j.Body, stats.Priority, 0, stats.TTR); err != nil {
+		return err
+	}
+	return j.Delete()
+}
+
+// Replace puts a new job with body on the job's tube, keeping its priority
+// and TTR, then deletes the job. As with DeadLetter, a failure part way
+// leaves the job in place rather than losing it.
+func (j Job) Replace(body []byte, delay time.Duration) (uint64, error) {
+	stats, err := j.Stats()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := Put(j.conn, stats.Tube, body, stats.Priority, delay, stats.TTR)
+	if err != nil {
+		return 0, err
+	}
+	return id, j.Delete()
+}
+
+// Conn is the connection the job was reserved on.
+func (j Job) Conn() *beanstalk.Conn {
+	return j.conn
+}
+
 // Delete the job.
 func (j Job) Delete() error {
 	return j.conn.Delete(j.Id)
@@ -50,20 +136,102 @@ func (j Job) Priority() (uint32, error) {
 	return uint32(pri64), err
 }
 
-// Release the job, with its original priority and no delay.
+// Release the job, with its original priority, or DefaultPriority when that
+// cannot be parsed.
 func (j Job) Release(delay time.Duration) error {
-	pri, err := j.Priority()
+	pri, err := j.priorityOrDefault()
 	if err != nil {
 		return err
 	}
 	return j.conn.Release(j.Id, pri, delay)
 }
 
+func (j Job) priorityOrDefault() (uint32, error) {
+	pri, err := j.Priority()
+	if _, ok := err.(*StatsParseError); ok {
+		return DefaultPriority, nil
+	}
+	return pri, err
+}
+
+// BuryWithPriority buries the job with a new priority.
+func (j Job) BuryWithPriority(pri uint32) error {
+	return j.conn.Bury(j.Id, pri)
+}
+
+// ReleaseWithPriority releases the job back to its tube with a new priority.
+func (j Job) ReleaseWithPriority(pri uint32, delay time.Duration) error {
+	return j.conn.Release(j.Id, pri, delay)
+}
+
 // Releases counts how many times the job has been released back to the tube.
 func (j Job) Releases() (uint64, error) {
 	return j.uint64Stat("releases")
 }
 
+// RawStats fetches the full stats-job response for the job as a map, for
+// fields JobStats does not carry, such as those added by newer beanstalkd
+// versions. Values that are unsigned integers are uint64, the rest, like
+// tube and state, are strings.
+func (j Job) RawStats() (map[string]interface{}, error) {
+	stats, err := j.conn.StatsJob(j.Id)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{}, len(stats))
+	for key, v := range stats {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			raw[key] = n
+		} else {
+			raw[key] = v
+		}
+	}
+	return raw, nil
+}
+
+// Stats fetches all stats-job fields for the job in a single round-trip.
+func (j Job) Stats() (s JobStats, err error) {
+	stats, err := j.RawStats()
+	if err != nil {
+		return
+	}
+
+	s.Tube = stringStat(stats, "tube")
+	s.State = stringStat(stats, "state")
+
+	pri, err := j.parseUint(stats, "pri", 32)
+	if err != nil {
+		return
+	}
+	s.Priority = uint32(pri)
+
+	durations := map[string]*time.Duration{
+		"age":       &s.Age,
+		"ttr":       &s.TTR,
+		"time-left": &s.TimeLeft,
+	}
+	for key, d := range durations {
+		if *d, err = j.parseDuration(stats, key); err != nil {
+			return
+		}
+	}
+
+	counts := map[string]*uint64{
+		"reserves": &s.Reserves,
+		"timeouts": &s.Timeouts,
+		"releases": &s.Releases,
+		"buries":   &s.Buries,
+		"kicks":    &s.Kicks,
+	}
+	for key, c := range counts {
+		if *c, err = j.parseUint(stats, key, 64); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 func (j Job) String() string {
 	stats, err := j.conn.StatsJob(j.Id)
 	if err == nil {
@@ -73,15 +241,20 @@ func (j Job) String() string {
 	}
 }
 
+// Touch the job, restarting its TTR so the reservation is held for longer.
+func (j Job) Touch() error {
+	return j.conn.Touch(j.Id)
+}
+
 // TimeLeft as reported by beanstalkd, as a time.Duration.
 // beanstalkd reports as int(seconds), which defines the (low) precision.
 // Less than 1.0 seconds remaining will be reported as zero.
 func (j Job) TimeLeft() (time.Duration, error) {
-	stats, err := j.conn.StatsJob(j.Id)
+	stats, err := j.RawStats()
 	if err != nil {
 		return 0, err
 	}
-	return time.ParseDuration(stats["time-left"] + "s")
+	return j.parseDuration(stats, "time-left")
 }
 
 // Timeouts counts how many times the job has been reserved and reached TTR.
@@ -90,9 +263,51 @@ func (j Job) Timeouts() (uint64, error) {
 }
 
 func (j Job) uint64Stat(key string) (uint64, error) {
-	stats, err := j.conn.StatsJob(j.Id)
+	stats, err := j.RawStats()
 	if err != nil {
 		return 0, err
 	}
-	return strconv.ParseUint(stats[key], 10, 64)
+	return j.parseUint(stats, key, 64)
+}
+
+// parseUint is the unsigned integer of key in stats, which must fit in
+// bitSize bits.
+func (j Job) parseUint(stats map[string]interface{}, key string, bitSize int) (uint64, error) {
+	n, err := strconv.ParseUint(stringStat(stats, key), 10, bitSize)
+	if err != nil {
+		return 0, j.parseError(stats, key, err)
+	}
+	return n, nil
+}
+
+// parseDuration is the duration of key in stats, which beanstalkd reports in
+// whole seconds.
+func (j Job) parseDuration(stats map[string]interface{}, key string) (time.Duration, error) {
+	if n, ok := stats[key].(uint64); ok {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(stringStat(stats, key) + "s")
+	if err != nil {
+		return 0, j.parseError(stats, key, err)
+	}
+	return d, nil
+}
+
+// stringStat is the value of key in stats as beanstalkd sent it, empty when
+// it is missing.
+func stringStat(stats map[string]interface{}, key string) string {
+	switch v := stats[key].(type) {
+	case string:
+		return v
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	}
+	return ""
+}
+
+// parseError is the StatsParseError of key in the stats of the job, logging
+// the whole response to debug.
+func (j Job) parseError(stats map[string]interface{}, key string, err error) error {
+	log.Debugf("unparseable stats-job response for job %d: %v", j.Id, stats)
+	return &StatsParseError{Id: j.Id, Key: key, Value: stringStat(stats, key), Err: err}
 }
@@ -0,0 +1,81 @@
+package bs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const jobStats = `---
+id: 42
+tube: emails
+state: reserved
+pri: 1024
+age: 95
+delay: 0
+ttr: 60
+time-left: 58
+file: 3
+reserves: 2
+timeouts: 1
+releases: 0
+buries: 0
+kicks: 0
+`
+
+func TestRawStats(t *testing.T) {
+	conn, rw := scriptedConn(okYAML(jobStats))
+	raw, err := NewJob(42, nil, conn).RawStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rw.String(); got != "stats-job 42\r\n" {
+		t.Errorf("sent %q, want stats-job 42", got)
+	}
+	want := map[string]interface{}{
+		"id":        uint64(42),
+		"tube":      "emails",
+		"state":     "reserved",
+		"pri":       uint64(1024),
+		"age":       uint64(95),
+		"delay":     uint64(0),
+		"ttr":       uint64(60),
+		"time-left": uint64(58),
+		"file":      uint64(3),
+		"reserves":  uint64(2),
+		"timeouts":  uint64(1),
+		"releases":  uint64(0),
+		"buries":    uint64(0),
+		"kicks":     uint64(0),
+	}
+	if !reflect.DeepEqual(raw, want) {
+		t.Errorf("raw stats %v, want %v", raw, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	conn, _ := scriptedConn(okYAML(jobStats))
+	stats, err := NewJob(42, nil, conn).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := JobStats{
+		Tube:     "emails",
+		State:    "reserved",
+		Priority: 1024,
+		Age:      95 * time.Second,
+		TTR:      time.Minute,
+		TimeLeft: 58 * time.Second,
+		Reserves: 2,
+		Timeouts: 1,
+	}
+	if stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+
+	conn, _ = scriptedConn(okYAML("---\ntube: emails\npri: urgent\n"))
+	_, err = NewJob(42, nil, conn).Stats()
+	if e, ok := err.(*StatsParseError); !ok || e.Key != "pri" || e.Value != "urgent" {
+		t.Errorf("error %v, want a StatsParseError of pri", err)
+	}
+}
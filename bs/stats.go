@@ -0,0 +1,110 @@
+package bs
+
+import (
+	"strconv"
+
+	"github.com/kr/beanstalk"
+)
+
+// ServerStats is the typed form of the server-wide stats response.
+type ServerStats struct {
+	CurrentJobsUrgent   uint64
+	CurrentJobsReady    uint64
+	CurrentJobsReserved uint64
+	CurrentJobsDelayed  uint64
+	CurrentJobsBuried   uint64
+
+	CmdPut     uint64
+	CmdReserve uint64
+	CmdDelete  uint64
+	CmdRelease uint64
+	CmdBury    uint64
+	CmdKick    uint64
+
+	JobTimeouts uint64
+	TotalJobs   uint64
+
+	CurrentTubes       uint64
+	CurrentConnections uint64
+	CurrentProducers   uint64
+	CurrentWorkers     uint64
+	CurrentWaiting     uint64
+
+	// Uptime of the server in seconds.
+	Uptime uint64
+}
+
+// ReadServerStats fetches and parses the stats of the server conn is
+// connected to.
+func ReadServerStats(conn *beanstalk.Conn) (s ServerStats, err error) {
+	stats, err := conn.Stats()
+	if err != nil {
+		return
+	}
+
+	fields := map[string]*uint64{
+		"current-jobs-urgent":   &s.CurrentJobsUrgent,
+		"current-jobs-ready":    &s.CurrentJobsReady,
+		"current-jobs-reserved": &s.CurrentJobsReserved,
+		"current-jobs-delayed":  &s.CurrentJobsDelayed,
+		"current-jobs-buried":   &s.CurrentJobsBuried,
+		"cmd-put":               &s.CmdPut,
+		"cmd-reserve":           &s.CmdReserve,
+		"cmd-delete":            &s.CmdDelete,
+		"cmd-release":           &s.CmdRelease,
+		"cmd-bury":              &s.CmdBury,
+		"cmd-kick":              &s.CmdKick,
+		"job-timeouts":          &s.JobTimeouts,
+		"total-jobs":            &s.TotalJobs,
+		"current-tubes":         &s.CurrentTubes,
+		"current-connections":   &s.CurrentConnections,
+		"current-producers":     &s.CurrentProducers,
+		"current-workers":       &s.CurrentWorkers,
+		"current-waiting":       &s.CurrentWaiting,
+		"uptime":                &s.Uptime,
+	}
+	for key, f := range fields {
+		if *f, err = strconv.ParseUint(stats[key], 10, 64); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// TubeStats is the typed form of the stats-tube response.
+type TubeStats struct {
+	CurrentJobsUrgent   uint64
+	CurrentJobsReady    uint64
+	CurrentJobsReserved uint64
+	CurrentJobsDelayed  uint64
+	CurrentJobsBuried   uint64
+	TotalJobs           uint64
+
+	CurrentWatching uint64
+	CurrentWaiting  uint64
+}
+
+// ReadTubeStats fetches and parses the stats of tube.
+func ReadTubeStats(conn *beanstalk.Conn, tube string) (s TubeStats, err error) {
+	stats, err := (&beanstalk.Tube{Conn: conn, Name: tube}).Stats()
+	if err != nil {
+		return
+	}
+
+	fields := map[string]*uint64{
+		"current-jobs-urgent":   &s.CurrentJobsUrgent,
+		"current-jobs-ready":    &s.CurrentJobsReady,
+		"current-jobs-reserved": &s.CurrentJobsReserved,
+		"current-jobs-delayed":  &s.CurrentJobsDelayed,
+		"current-jobs-buried":   &s.CurrentJobsBuried,
+		"total-jobs":            &s.TotalJobs,
+		"current-watching":      &s.CurrentWatching,
+		"current-waiting":       &s.CurrentWaiting,
+	}
+	for key, f := range fields {
+		if *f, err = strconv.ParseUint(stats[key], 10, 64); err != nil {
+			return
+		}
+	}
+	return
+}
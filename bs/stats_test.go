@@ -0,0 +1,96 @@
+package bs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// okYAML frames a stats body as beanstalkd does.
+func okYAML(body string) string {
+	return fmt.Sprintf("OK %d\r\n%s\r\n", len(body), body)
+}
+
+const serverStats = `---
+current-jobs-urgent: 1
+current-jobs-ready: 12
+current-jobs-reserved: 3
+current-jobs-delayed: 4
+current-jobs-buried: 5
+cmd-put: 1000
+cmd-peek: 7
+cmd-reserve: 990
+cmd-reserve-with-timeout: 0
+cmd-delete: 980
+cmd-release: 20
+cmd-use: 2
+cmd-watch: 6
+cmd-bury: 5
+cmd-kick: 1
+cmd-stats: 30
+job-timeouts: 8
+total-jobs: 1000
+max-job-size: 65535
+current-tubes: 6
+current-connections: 9
+current-producers: 2
+current-workers: 4
+current-waiting: 1
+total-connections: 40
+pid: 1234
+version: "1.12"
+rusage-utime: 0.148000
+rusage-stime: 0.312000
+uptime: 86400
+binlog-enabled: false
+draining: false
+id: 1ac4d8e10b1c2b4e
+hostname: queue-1
+`
+
+func TestReadServerStats(t *testing.T) {
+	conn, rw := scriptedConn(okYAML(serverStats))
+	s, err := ReadServerStats(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ServerStats{
+		CurrentJobsUrgent:   1,
+		CurrentJobsReady:    12,
+		CurrentJobsReserved: 3,
+		CurrentJobsDelayed:  4,
+		CurrentJobsBuried:   5,
+		CmdPut:              1000,
+		CmdReserve:          990,
+		CmdDelete:           980,
+		CmdRelease:          20,
+		CmdBury:             5,
+		CmdKick:             1,
+		JobTimeouts:         8,
+		TotalJobs:           1000,
+		CurrentTubes:        6,
+		CurrentConnections:  9,
+		CurrentProducers:    2,
+		CurrentWorkers:      4,
+		CurrentWaiting:      1,
+		Uptime:              86400,
+	}
+	if s != want {
+		t.Errorf("stats %+v, want %+v", s, want)
+	}
+	if got := rw.String(); got != "stats\r\n" {
+		t.Errorf("sent %q, want stats", got)
+	}
+}
+
+func TestReadServerStatsMalformed(t *testing.T) {
+	conn, _ := scriptedConn(okYAML(strings.Replace(serverStats, "current-workers: 4", "current-workers: many", 1)))
+	if _, err := ReadServerStats(conn); err == nil {
+		t.Error("malformed stats parsed")
+	}
+
+	conn, _ = scriptedConn(okYAML(strings.Replace(serverStats, "uptime: 86400\n", "", 1)))
+	if _, err := ReadServerStats(conn); err == nil {
+		t.Error("stats missing a field parsed")
+	}
+}
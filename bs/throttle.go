@@ -0,0 +1,48 @@
+package bs
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReserveErrorLogInterval rate-limits the logging of reserve errors: an error
+// identical to the last one logged is only logged again once this interval
+// has passed. Zero logs every error.
+var ReserveErrorLogInterval time.Duration
+
+// reserveErrors throttles the errors logged by ReserveWithin.
+var reserveErrors errorThrottle
+
+// errorThrottle logs errors, suppressing repeats of the same error within
+// ReserveErrorLogInterval and reporting how many were suppressed.
+type errorThrottle struct {
+	mu         sync.Mutex
+	last       string
+	at         time.Time
+	suppressed int
+}
+
+func (t *errorThrottle) log(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msg, now := err.Error(), time.Now()
+	if msg == t.last && now.Sub(t.at) < ReserveErrorLogInterval {
+		t.suppressed++
+		return
+	}
+
+	switch {
+	case t.suppressed > 0 && msg == t.last:
+		log.Errorf("%s (%d similar errors suppressed)", msg, t.suppressed)
+	case t.suppressed > 0:
+		// The count belongs to the previous error, not this one.
+		log.Errorf("%s (%d similar errors suppressed)", t.last, t.suppressed)
+		log.Error(msg)
+	default:
+		log.Error(msg)
+	}
+	t.last, t.at, t.suppressed = msg, now, 0
+}
@@ -0,0 +1,69 @@
+package bs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// captureLog collects what is logged until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestErrorThrottle(t *testing.T) {
+	defer func(d time.Duration) { ReserveErrorLogInterval = d }(ReserveErrorLogInterval)
+	ReserveErrorLogInterval = 100 * time.Millisecond
+	buf := captureLog(t)
+
+	var throttle errorThrottle
+	refused := errors.New("connection refused")
+	for i := 0; i < 50; i++ {
+		throttle.log(refused)
+	}
+	if n := strings.Count(buf.String(), "connection refused"); n != 1 {
+		t.Fatalf("burst of 50 errors logged %d times, want once:\n%s", n, buf)
+	}
+
+	// A different error is logged straight away, after the count of the
+	// previous one.
+	throttle.log(errors.New("broken pipe"))
+	if !strings.Contains(buf.String(), "connection refused (49 similar errors suppressed)") {
+		t.Errorf("suppressed count not reported against its error:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "msg=\"broken pipe\"") {
+		t.Errorf("new error was suppressed:\n%s", buf)
+	}
+
+	// Once the interval has passed, a repeat is logged with the count of
+	// those suppressed.
+	buf.Reset()
+	throttle.log(refused)
+	throttle.log(refused)
+	time.Sleep(ReserveErrorLogInterval)
+	throttle.log(refused)
+	if n := strings.Count(buf.String(), "connection refused"); n != 2 {
+		t.Errorf("logged %d times, want 2:\n%s", n, buf)
+	}
+	if !strings.Contains(buf.String(), "connection refused (1 similar errors suppressed)") {
+		t.Errorf("suppressed count not reported:\n%s", buf)
+	}
+
+	// Zero logs every error.
+	ReserveErrorLogInterval = 0
+	buf.Reset()
+	for i := 0; i < 5; i++ {
+		throttle.log(refused)
+	}
+	if n := strings.Count(buf.String(), "connection refused"); n != 5 {
+		t.Errorf("logged %d of 5 errors with no interval", n)
+	}
+}
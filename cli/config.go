@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// redacted replaces secrets in the encoded options.
+const redacted = "REDACTED"
+
+// MarshalJSON encodes the options as they took effect, with the policy and
+// routing files read, and with secrets redacted: the passwords of URLs. The
+// TLS files are only held as paths, so are encoded as they are.
+func (o Options) MarshalJSON() ([]byte, error) {
+	// options has the fields of Options without its methods, so encoding it
+	// does not recurse.
+	type options Options
+	r := options(o)
+	r.OtelEndpoint = redactURL(r.OtelEndpoint)
+	r.DependencyHealthcheckURL = redactURL(r.DependencyHealthcheckURL)
+	return json.Marshal(r)
+}
+
+// String is the options encoded by MarshalJSON.
+func (o Options) String() string {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// redactURL replaces the password of a URL with redacted. A value which is
+// not a URL is returned as it is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
@@ -4,12 +4,20 @@
 package cli
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/kayako/beanstalk-broker/cmd"
+	log "github.com/sirupsen/logrus"
 )
 
 // Options contains runtime configuration, and is generally the result of
@@ -22,12 +30,91 @@ type Options struct {
 	// All == true means all tubes will be watched.
 	All bool
 
+	// PollJitter is the most by which polling beanstalkd for new tubes and
+	// stats is randomly delayed, staggering instances started together.
+	PollJitter time.Duration
+
+	// MaxNewTubesPerCycle limits how many newly discovered tubes are started
+	// per poll in -all mode. Zero means no limit.
+	MaxNewTubesPerCycle int
+
+	// MaxTubes caps how many tubes are watched in -all mode, in total.
+	// Zero means no limit.
+	MaxTubes int
+
+	// SpawnWorkers is how many goroutines start the brokers of tubes
+	// discovered in -all mode, so that many tubes appearing at once are
+	// started a few at a time without holding up polling.
+	SpawnWorkers int
+
+	// GoMaxProcs is how many OS threads execute Go code at once, set as
+	// GOMAXPROCS. Zero leaves the runtime's default, which follows the CPU
+	// quota of the container.
+	GoMaxProcs int
+
 	// PerTube is the number of workers servicing each tube concurrently.
 	PerTube uint64
 
+	// MaxPerTube is the sanity ceiling for PerTube, which is lowered to it
+	// with a warning.
+	MaxPerTube uint64
+
+	// SharedReserve == true means the workers of a tube share a single
+	// connection and reserve loop, rather than one each.
+	SharedReserve bool
+
+	// ShardIndex and ShardCount split jobs between brokers by domain: a
+	// broker only executes the jobs whose domain hashes to its ShardIndex,
+	// handing the others off. A ShardCount of 1 disables sharding.
+	ShardIndex uint64
+	ShardCount uint64
+
+	// MaxReservedPerConn caps the jobs held reserved at once on a shared
+	// connection, below the number of workers. Zero leaves the workers as
+	// the only cap.
+	MaxReservedPerConn uint64
+
+	// ConnectTimeout bounds dialling beanstalkd, so that an unreachable
+	// server fails the connection, and is retried, rather than hanging it.
+	// Zero means no timeout.
+	ConnectTimeout time.Duration
+
+	// TLS == true means beanstalkd is connected to over TLS, verifying it
+	// against TLSCA, or the system roots when empty. TLSCert and TLSKey are
+	// the optional client certificate. The files are re-read on reconnect.
+	TLS     bool
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
+
 	// The beanstalkd tubes to watch.
 	Tubes TubeList
 
+	// TubePrefix namespaces the tubes on a shared beanstalkd. It is added to
+	// the names of the tubes watched and put to, and stripped from the tubes
+	// of jobs reserved, so tube names elsewhere are given without it.
+	TubePrefix string
+
+	// WatchDefault == true means each broker also reserves from beanstalkd's
+	// default tube. Otherwise default, which every connection starts out
+	// watching, is ignored once the broker's own tubes are watched.
+	WatchDefault bool
+
+	// TubeGroup is a list of tubes whose workers each service every tube in
+	// the group, in round-robin order.
+	TubeGroup TubeList
+
+	// AutoscaleInterval is how often the brokers of each tube are scaled to
+	// its queue depth, between MinPerTube and MaxPerTube, aiming for
+	// TargetJobsPerWorker ready jobs per broker. Zero disables autoscaling.
+	AutoscaleInterval   time.Duration
+	MinPerTube          uint64
+	TargetJobsPerWorker uint64
+
+	// CrossTubePriority == true means a tube group reserves its most urgent
+	// ready job first, rather than serving its tubes round-robin.
+	CrossTubePriority bool
+
 	// Full path to PHP Binary that should be used
 	PHPBinary string
 
@@ -45,8 +132,292 @@ type Options struct {
 
 	// RequeueDelay is the delay to be used when a task is re-requeued
 	RequeueDelay time.Duration
+
+	// Executor is how jobs are run: fork starts PHP per job, persistent
+	// hands jobs to long-lived PHP workers running PersistentScript, each
+	// replaced after PersistentMaxJobs jobs.
+	Executor          string
+	PersistentScript  string
+	PersistentMaxJobs uint64
+
+	// KillSignals are sent in turn, KillGrace apart, to stop a timed out job
+	// while it keeps running.
+	KillSignals SignalList
+	KillGrace   time.Duration
+
+	// MaxJobWallTime caps how long a job of the given tubes may run,
+	// whatever its TTR, after which it is terminated as timed out.
+	MaxJobWallTime TubeDurations
+
+	// TTRMarginOverride replaces, for the given tubes, the margin by which
+	// a job's child outlives its reservation before being terminated, or
+	// is terminated ahead of it when the broker disposes of timed out jobs.
+	TTRMarginOverride TubeMargins
+
+	// MaxInFlight caps how many jobs of the given tubes are executed at
+	// once, across all of the tube's workers.
+	MaxInFlight TubeInts
+
+	// StdinFraming is how the job body is written to the worker's stdin:
+	// raw, newline, length-prefixed or base64.
+	StdinFraming string
+
+	// WorkerId identifies this broker in logs and to jobs, defaults to the
+	// hostname.
+	WorkerId string
+
+	// MinFreeMemoryMB and MinFreeDiskMB pause reserving while the host has
+	// less memory available, or less disk free on DiskPath. Zero disables.
+	MinFreeMemoryMB uint64
+	MinFreeDiskMB   uint64
+	DiskPath        string
+
+	// CreateWorkDir == true means a missing job working directory is created
+	// rather than failing the job.
+	CreateWorkDir bool
+
+	// SkipPathValidation == true means the PHP binary and ini file are not
+	// checked at startup. They are only checked in modes executing jobs.
+	SkipPathValidation bool
+
+	// PermanentExitCodes and PermanentFailureMarkers identify failed jobs
+	// which retrying cannot fix, such as the controller not being found, by
+	// exit status or by a string on stdout. Such jobs are buried or
+	// dead-lettered rather than released.
+	PermanentExitCodes      IntList
+	PermanentFailureMarkers StringList
+
+	// SuccessMarker is a string on stdout meaning the job succeeded even if
+	// it exited non-zero, for workers which fail on shutdown after doing
+	// their work. Disabled when empty.
+	SuccessMarker string
+
+	// AuditLog is a file a JSON line is appended to for every job processed,
+	// disabled when empty.
+	AuditLog string
+
+	// AuditBody lists the tubes whose decoded job packets are included in
+	// the audit log, with the values of the given keys redacted. Bodies of
+	// other tubes are never logged.
+	AuditBody TubeFields
+
+	// PIDFile is a file the broker's PID is written to while it runs,
+	// disabled when empty.
+	PIDFile string
+
+	// PostJobHook is a command run after every executed job, with the job
+	// metadata in its environment. Disabled when empty.
+	PostJobHook string
+
+	// WarmupCommand is a command each broker runs before reserving its
+	// first job, retried until it exits 0. Disabled when empty.
+	WarmupCommand string
+
+	// ResultsBuffer is the capacity of the channel job results are collected
+	// on, zero to not collect them. ResultsOverflow is what to do when it is
+	// full: block, drop-newest, the default when empty, or drop-oldest. They
+	// are for programs embedding the broker, so have no flags.
+	ResultsBuffer   int
+	ResultsOverflow string
+
+	// RetainStdout == true means job stdout is kept in results even when no
+	// one consumes them.
+	RetainStdout bool
+
+	// OnTimeout is how jobs exceeding their TTR are disposed of: release
+	// (by beanstalkd), bury or delete.
+	OnTimeout string
+
+	// LogResultsOn is which jobs have how they finished logged: always,
+	// failure, for those exiting non-zero, timing out or buried, or never.
+	LogResultsOn string
+
+	// TimeoutTries is the number of timeouts after which a job is buried.
+	TimeoutTries uint64
+
+	// InvalidJobPolicy is how jobs rejected before execution are disposed
+	// of: bury or delete.
+	InvalidJobPolicy string
+
+	// RequiredFields are the packet keys every job must have, rejecting
+	// those missing any before resolving their working directory.
+	RequiredFields FieldList
+
+	// MaxBodyBytes is the largest job body executed, zero for no limit.
+	// Larger jobs are disposed of according to OversizedBodyPolicy, bury or
+	// delete.
+	MaxBodyBytes        uint64
+	OversizedBodyPolicy string
+
+	// NoRetry == true means every job is deleted once executed, whatever
+	// its outcome, so that no job is ever run twice by the broker.
+	NoRetry bool
+
+	// TrackRetriesInBody == true means failed jobs are re-put with the
+	// retries key of their packet incremented, rather than released.
+	TrackRetriesInBody bool
+
+	// JobFormat is how job bodies are serialized: php or json.
+	JobFormat string
+
+	// AtMostOnce lists the tubes whose jobs are deleted before execution.
+	AtMostOnce TubeList
+
+	// SkipRetryPrecheck lists the tubes whose jobs are handled without ever
+	// reading their stats, saving the round-trips at the cost of the retry
+	// limits and of their priorities. Each needs a MaxJobWallTime to time
+	// its jobs, as their TTR is not read either.
+	SkipRetryPrecheck TubeList
+
+	// PolicyFile is the path to a JSON file of per-tube retry policies.
+	PolicyFile string
+
+	// Policies are the rules loaded from PolicyFile.
+	Policies PolicyList
+
+	// RoutingFile is the path to a YAML file of routes choosing the
+	// controller, working directory and retry policy of jobs.
+	RoutingFile string
+
+	// Routes are the routes loaded from RoutingFile.
+	Routes RoutingTable
+
+	// ReconnectInitial and ReconnectMax bound the backoff between attempts
+	// to re-establish a lost connection to beanstalkd.
+	ReconnectInitial time.Duration
+	ReconnectMax     time.Duration
+
+	// ReconnectMaxAttempts is the number of failed attempts after which a
+	// broker gives up. Zero means retrying forever.
+	ReconnectMaxAttempts uint64
+
+	// RefreshConnAfter is the number of jobs after which a broker replaces
+	// its connection with a new one, between jobs. Zero never does.
+	RefreshConnAfter uint64
+
+	// ReserveErrorLogInterval is the minimum time between logging repeats of
+	// the same reserve error.
+	ReserveErrorLogInterval time.Duration
+
+	// DeleteRetries is the number of times deleting a successful job is
+	// retried on a transient error, with DeleteRetryBackoff doubled after
+	// every try.
+	DeleteRetries      uint64
+	DeleteRetryBackoff time.Duration
+
+	// PreferNewer is the age beyond which a job reserved while others are
+	// ready is deferred once in their favour, zero to disable.
+	PreferNewer time.Duration
+
+	// DrainOrder lists tubes to stop one after the other on shutdown, before
+	// all other tubes.
+	DrainOrder TubeList
+
+	// MaxRuntime is how long the broker runs before shutting down as on
+	// SIGTERM, zero for no limit.
+	MaxRuntime time.Duration
+
+	// ShutdownTimeout is how long to wait for brokers to finish on shutdown
+	// before forcing the process to exit.
+	ShutdownTimeout time.Duration
+
+	// DrainJobGrace is how long a job still executing when its broker is
+	// stopped on shutdown, which -drain-order may delay, is allowed to
+	// finish before it is terminated and released.
+	// Zero waits for it, up to ShutdownTimeout.
+	DrainJobGrace time.Duration
+
+	// MaxJobAge is the age beyond which jobs are deleted without being
+	// executed. Zero disables the check.
+	MaxJobAge time.Duration
+
+	// Once == true means a single job is processed before exiting.
+	Once bool
+
+	// SelfTest == true means the environment is checked, then the process
+	// exits, non-zero if a check failed.
+	SelfTest bool
+
+	// PrintConfig == true means the options are printed as JSON, then the
+	// process exits.
+	PrintConfig bool
+
+	// ReprocessId is the id of a single job to reserve and process before
+	// exiting. Zero disables this mode.
+	ReprocessId uint64
+
+	// ReplayId is the id of a buried job to execute again, leaving it
+	// buried, before exiting. ReplayTube replays the next buried job of a
+	// tube instead. Zero and empty disable this mode.
+	ReplayId   uint64
+	ReplayTube string
+
+	// KickAll is how many buried jobs to kick in each of the watched tubes
+	// before exiting. Zero disables this mode.
+	KickAll int
+
+	// Exit codes used in one-shot mode for each job outcome.
+	ExitOnSuccess int
+	ExitOnFailure int
+	ExitOnTimeout int
+	ExitOnBury    int
+
+	// OtelEndpoint is the OTLP/HTTP collector job spans are exported to,
+	// disabled when empty
+	OtelEndpoint string
+
+	// MetricsAddress is the TCP address metrics are served on, disabled when empty
+	MetricsAddress string
+
+	// StatsdAddress is the UDP address of the statsd server job outcomes are
+	// sent to, disabled when empty
+	StatsdAddress string
+
+	// HeartbeatInterval is how often a heartbeat is logged and counted,
+	// zero to disable.
+	HeartbeatInterval time.Duration
+
+	// ServerStatsInterval is how often beanstalkd's server stats are exported
+	// as metrics. Zero disables polling.
+	ServerStatsInterval time.Duration
+
+	// DependencyHealthcheckURL is polled every DependencyHealthcheckInterval,
+	// reserving being paused on every tube while it does not answer with a
+	// 2xx status. Disabled when empty.
+	DependencyHealthcheckURL      string
+	DependencyHealthcheckInterval time.Duration
+
+	// AdminAddress is the TCP address the admin API is served on, disabled
+	// when empty
+	AdminAddress string
+
+	// StreamStdout == true means the stdout of executing jobs can be
+	// streamed live from the admin API.
+	StreamStdout bool
+
+	// RecentJobsSize is how many of the last jobs processed the admin API
+	// serves at /recent-jobs, at most MaxRecentJobsSize. Zero keeps none.
+	RecentJobsSize int
+
+	// RequireMetrics == true means failing to serve metrics is fatal.
+	RequireMetrics bool
 }
 
+// MaxDelay is the longest delay beanstalkd accepts, as it stores delays in
+// seconds as an unsigned 32-bit integer.
+const MaxDelay = (1<<32 - 1) * time.Second
+
+// MaxKickBound caps how many jobs are kicked by one -kick-all or admin
+// kick, so a single request cannot tie up beanstalkd for long.
+const MaxKickBound = 100000
+
+// MaxRecentJobsSize caps -recent-jobs-size, as every job kept holds the
+// tails of its output in memory.
+const MaxRecentJobsSize = 10000
+
+// UnixScheme prefixes an -address naming beanstalkd's Unix socket.
+const UnixScheme = "unix://"
+
 // TubeList is a list of beanstalkd tube names.
 type TubeList []string
 
@@ -65,30 +436,179 @@ func MustParseFlags() (o Options) {
 // ParseFlags parses and validates CLI flags into an Options struct.
 func ParseFlags() (o Options, err error) {
 	o.Tubes = TubeList{"default"}
+	o.KillSignals = SignalList{syscall.SIGTERM, syscall.SIGKILL}
 
-	flag.StringVar(&o.Address, "address", "127.0.0.1:11300", "beanstalkd TCP address.")
+	flag.StringVar(&o.Address, "address", "127.0.0.1:11300", "beanstalkd TCP address, or unix:///path/to/socket.")
+	flag.DurationVar(&o.ConnectTimeout, "connect-timeout", 10*time.Second, "Time allowed to connect to beanstalkd, 0 for no limit")
+	flag.BoolVar(&o.TLS, "tls", false, "Connect to beanstalkd over TLS")
+	flag.StringVar(&o.TLSCA, "tls-ca", "", "PEM file of CAs to verify beanstalkd against, defaults to the system roots")
+	flag.StringVar(&o.TLSCert, "tls-cert", "", "PEM file of the TLS client certificate")
+	flag.StringVar(&o.TLSKey, "tls-key", "", "PEM file of the TLS client key")
 	flag.StringVar(&o.PHPBinary, "php", "/usr/bin/php", "php binary to use")
 	flag.StringVar(&o.PHPINI, "php-ini", "/etc/php.ini", "php.ini file to use for configuration")
 	flag.StringVar(&o.InstanceRoot, "instance-root", "/var/www/html", "path to the directory where instances are located")
 	flag.StringVar(&o.ClusterRoot, "cluster-root", "/opt/cluster", "path to the directory where cluster is located")
 	flag.StringVar(&o.Controller, "controller", "/Core/Job/Console", "Controller that will handle the Job")
 	flag.DurationVar(&o.RequeueDelay, "requeue-delay", 1*time.Minute, "Delay duration for when the job is requeued")
+	flag.StringVar(&o.MetricsAddress, "metrics-address", "", "TCP address to serve Prometheus metrics on, e.g. :9090")
+	flag.Uint64Var(&o.MinFreeMemoryMB, "min-free-memory-mb", 0, "Pause reserving while less memory is available, 0 to disable")
+	flag.Uint64Var(&o.MinFreeDiskMB, "min-free-disk-mb", 0, "Pause reserving while less disk is free on -disk-path, 0 to disable")
+	flag.StringVar(&o.DiskPath, "disk-path", "/", "Path whose filesystem is checked by -min-free-disk-mb")
+	flag.BoolVar(&o.CreateWorkDir, "create-workdir", false, "Create missing job working directories under -instance-root")
+	flag.BoolVar(&o.SkipPathValidation, "skip-path-validation", false, "Don't check that the PHP binary is executable and the ini file readable at startup")
+	flag.StringVar(&o.Executor, "executor", "fork", "How jobs are run: fork PHP per job, or persistent PHP workers")
+	flag.StringVar(&o.PersistentScript, "persistent-script", "worker.php", "PHP script of the persistent workers, speaking the framed job protocol")
+	flag.Uint64Var(&o.PersistentMaxJobs, "persistent-max-jobs", 1000, "Jobs after which a persistent worker is replaced, 0 for no limit")
+	flag.Var(&o.KillSignals, "kill-signals", "Comma separated signals sent in turn to stop a timed out job, e.g. TERM,KILL")
+	flag.DurationVar(&o.KillGrace, "kill-grace", 10*time.Second, "Time to wait between the -kill-signals")
+	flag.Var(&o.MaxJobWallTime, "max-job-wall-time", "Cap on a job's run time for a tube, as tube=duration, whatever its TTR. Can be repeated.")
+	flag.Var(&o.TTRMarginOverride, "ttr-margin-override", "Margin on the TTR of a tube's jobs instead of 1s, as tube=duration,tube=duration. Can be repeated.")
+	flag.Var(&o.MaxInFlight, "max-in-flight", "Cap on the jobs of a tube executing at once across its workers, as tube=N. Can be repeated.")
+	flag.StringVar(&o.StdinFraming, "stdin-framing", "raw", "How the job body is written to the worker's stdin: raw, newline, length-prefixed or base64")
+	flag.StringVar(&o.WorkerId, "worker-id", "", "Identity of this broker in logs and job environments, defaults to the hostname")
+	flag.Var(&o.PermanentExitCodes, "permanent-exit-codes", "Comma separated list of job exit codes which are not retried.")
+	flag.Var(&o.PermanentFailureMarkers, "permanent-failure-marker", "String on job stdout meaning the job is not retried, may be repeated.")
+	flag.StringVar(&o.SuccessMarker, "success-marker", "", "String on job stdout meaning the job succeeded, whatever its exit status")
+	flag.StringVar(&o.AuditLog, "audit-log", "", "File to append a JSON line to for every job processed, reopened on SIGHUP")
+	flag.Var(&o.AuditBody, "audit-body", "Include the job packets of a tube in the audit log, as tube=key,key with the values of the keys redacted. Can be repeated.")
+	flag.StringVar(&o.PIDFile, "pid-file", "", "File to write the broker's PID to, removed on exit")
+	flag.StringVar(&o.WarmupCommand, "warmup-command", "", "Command each worker runs in -instance-root before reserving its first job, retried until it exits 0")
+	flag.StringVar(&o.PostJobHook, "post-job-hook", "", "Command run after every executed job, with JOB_ID, JOB_TUBE, JOB_EXIT_STATUS, JOB_OUTCOME, JOB_ATTEMPT and JOB_DOMAIN set")
+	flag.BoolVar(&o.RetainStdout, "retain-stdout", false, "Keep job stdout in memory even when results are not consumed")
+	flag.StringVar(&o.OnTimeout, "on-timeout", "release", "What to do with jobs exceeding their TTR: release, bury or delete")
+	flag.StringVar(&o.LogResultsOn, "log-results-on", "always", "Which jobs' results are logged: always, failure or never")
+	flag.Uint64Var(&o.TimeoutTries, "timeout-tries", 1, "Number of timeouts after which a job is buried")
+	flag.StringVar(&o.InvalidJobPolicy, "invalid-job-policy", "bury", "What to do with jobs rejected before execution: bury or delete")
+	flag.Var(&o.RequiredFields, "required-fields", "Comma separated list of packet keys every job must have, rejecting jobs missing any.")
+	flag.Uint64Var(&o.MaxBodyBytes, "max-body-bytes", 0, "Largest job body executed, 0 for no limit")
+	flag.StringVar(&o.OversizedBodyPolicy, "oversized-body-policy", "bury", "What to do with jobs over -max-body-bytes: bury or delete")
+	flag.BoolVar(&o.NoRetry, "no-retry", false, "Delete every job once executed, even if it failed or timed out. Failed jobs are lost!")
+	flag.BoolVar(&o.TrackRetriesInBody, "track-retries-in-body", false, "Re-put failed jobs with the retries key of their packet incremented, instead of releasing them")
+	flag.StringVar(&o.JobFormat, "job-format", "php", "How job bodies are serialized: php or json")
+	flag.Var(&o.AtMostOnce, "at-most-once", "Comma separated list of tubes whose jobs are deleted before execution.")
+	flag.Var(&o.SkipRetryPrecheck, "skip-retry-precheck", "Comma separated list of tubes whose jobs are handled without reading their stats, each needing a -max-job-wall-time.")
+	flag.StringVar(&o.PolicyFile, "policy-file", "", "JSON file of per-tube retry and dead-letter policies")
+	flag.StringVar(&o.RoutingFile, "routing-file", "", "YAML file of routes choosing the controller, working directory and policy of jobs")
+	flag.DurationVar(&o.ReconnectInitial, "reconnect-initial", 1*time.Second, "Initial backoff between attempts to reconnect to beanstalkd")
+	flag.DurationVar(&o.ReconnectMax, "reconnect-max", 1*time.Minute, "Maximum backoff between attempts to reconnect to beanstalkd")
+	flag.Uint64Var(&o.ReconnectMaxAttempts, "reconnect-max-attempts", 0, "Attempts to reconnect to beanstalkd before giving up, 0 for no limit")
+	flag.Uint64Var(&o.RefreshConnAfter, "refresh-conn-after", 0, "Jobs after which a worker re-dials beanstalkd, between jobs, 0 to keep the connection")
+	flag.DurationVar(&o.ReserveErrorLogInterval, "reserve-error-log-interval", 0, "Minimum time between logging repeats of the same reserve error, 0 logs every error")
+	flag.Uint64Var(&o.DeleteRetries, "delete-retries", 3, "Number of times to retry deleting a successful job on a transient error")
+	flag.DurationVar(&o.DeleteRetryBackoff, "delete-retry-backoff", 100*time.Millisecond, "Delay before retrying a delete, doubled after every try")
+	flag.DurationVar(&o.PreferNewer, "prefer-newer", 0, "Defer jobs older than this once in favour of newer ready jobs, 0 to disable")
+	flag.Var(&o.DrainOrder, "drain-order", "Comma separated list of tubes stopped one after the other on shutdown, before the rest.")
+	flag.DurationVar(&o.MaxRuntime, "max-runtime", 0, "Shut down gracefully after running this long, 0 for no limit")
+	flag.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", 1*time.Minute, "How long to wait for workers to finish on shutdown, before stopping their jobs with -kill-signals")
+	flag.DurationVar(&o.DrainJobGrace, "drain-job-grace", 0, "How long executing jobs may run on once their tube is stopped on shutdown, before being terminated and released, 0 to wait for them")
+	flag.DurationVar(&o.MaxJobAge, "max-job-age", 0, "Delete jobs older than this without executing them, 0 to disable")
+	flag.StringVar(&o.OtelEndpoint, "otel-endpoint", "", "OTLP/HTTP collector to export job spans to, e.g. http://localhost:4318")
+	flag.StringVar(&o.StatsdAddress, "statsd-addr", "", "UDP address of a statsd server to send job outcomes to, e.g. 127.0.0.1:8125")
+	flag.DurationVar(&o.HeartbeatInterval, "heartbeat-interval", 0, "How often to log a heartbeat with the jobs in flight and processed, 0 to disable")
+	flag.DurationVar(&o.ServerStatsInterval, "server-stats-interval", 0, "How often to export beanstalkd server stats as metrics, 0 to disable")
+	flag.StringVar(&o.DependencyHealthcheckURL, "dependency-healthcheck-url", "", "URL polled while jobs run, pausing reserving on every tube while it does not answer 2xx")
+	flag.DurationVar(&o.DependencyHealthcheckInterval, "dependency-healthcheck-interval", 10*time.Second, "How often -dependency-healthcheck-url is polled, also its timeout")
+	flag.StringVar(&o.AdminAddress, "admin-address", "", "TCP address to serve the admin API on, e.g. :9091")
+	flag.BoolVar(&o.StreamStdout, "stream-stdout", false, "Stream the stdout of executing jobs from the admin API at /jobs/{id}/stream")
+	flag.IntVar(&o.RecentJobsSize, "recent-jobs-size", 100, "Number of the last jobs processed served by the admin API at /recent-jobs, 0 for none")
+	flag.BoolVar(&o.RequireMetrics, "require-metrics", false, "Exit if the metrics server cannot be started")
 	flag.BoolVar(&o.All, "all", false, "Listen to all tubes, instead of -tubes=...")
+	flag.DurationVar(&o.PollJitter, "poll-jitter", 0, "Random delay of up to this much added to polling for new tubes and stats")
+	flag.IntVar(&o.MaxNewTubesPerCycle, "max-new-tubes-per-cycle", 0, "Maximum new tubes started per poll with -all, 0 for no limit")
+	flag.IntVar(&o.MaxTubes, "max-tubes", 0, "Maximum tubes watched in total with -all, 0 for no limit")
+	flag.IntVar(&o.SpawnWorkers, "spawn-workers", 4, "Goroutines starting the brokers of tubes discovered with -all")
+	flag.IntVar(&o.GoMaxProcs, "gomaxprocs", 0, "OS threads executing Go code at once, 0 for the runtime's default following the container's CPU quota")
+	flag.BoolVar(&o.Once, "once", false, "Process a single job from -tubes=... then exit")
+	flag.BoolVar(&o.SelfTest, "selftest", false, "Check connectivity to beanstalkd, PHP and the root paths, then exit")
+	flag.BoolVar(&o.PrintConfig, "print-config", false, "Print the effective configuration as JSON, with secrets redacted, then exit")
+	flag.Uint64Var(&o.ReprocessId, "reprocess-id", 0, "Reserve and process the job with this id then exit")
+	flag.Uint64Var(&o.ReplayId, "replay-id", 0, "Execute the buried job with this id again, leaving it buried, then exit")
+	flag.StringVar(&o.ReplayTube, "replay-tube", "", "Execute the next buried job of this tube again, leaving it buried, then exit")
+	flag.IntVar(&o.KickAll, "kick-all", 0, "Kick up to this many buried jobs in each watched tube then exit")
+	flag.IntVar(&o.ExitOnSuccess, "exit-on-success", 0, "Exit code in one-shot modes when the job succeeds")
+	flag.IntVar(&o.ExitOnFailure, "exit-on-failure", 1, "Exit code in one-shot modes when the job fails")
+	flag.IntVar(&o.ExitOnTimeout, "exit-on-timeout", 124, "Exit code in one-shot modes when the job times out")
+	flag.IntVar(&o.ExitOnBury, "exit-on-bury", 2, "Exit code in one-shot modes when the job is buried")
 	flag.Uint64Var(&o.PerTube, "per-tube", 1, "Number of workers per tube.")
+	flag.BoolVar(&o.SharedReserve, "shared-reserve", false, "Use one connection per tube, fanning jobs out to -per-tube workers.")
+	flag.Uint64Var(&o.ShardIndex, "shard-index", 0, "Shard of this broker, executing only jobs whose domain hashes to it")
+	flag.Uint64Var(&o.ShardCount, "shard-count", 1, "Number of shards jobs are split between by domain, 1 to disable")
+	flag.Uint64Var(&o.MaxReservedPerConn, "max-reserved-per-conn", 0, "Cap on jobs reserved at once on a shared connection, 0 for one per worker")
+	flag.Uint64Var(&o.MaxPerTube, "max-per-tube", 256, "Ceiling on -per-tube, larger values are lowered to it with a warning.")
+	flag.DurationVar(&o.AutoscaleInterval, "autoscale-interval", 0, "How often to scale the workers of each tube to its ready jobs, 0 to disable")
+	flag.Uint64Var(&o.MinPerTube, "min-per-tube", 1, "Minimum number of workers per tube when autoscaling.")
+	flag.Uint64Var(&o.TargetJobsPerWorker, "target-jobs-per-worker", 10, "Ready jobs per worker aimed for when autoscaling.")
 	flag.Var(&o.Tubes, "tubes", "Comma separated list of tubes.")
+	flag.BoolVar(&o.CrossTubePriority, "cross-tube-priority", false, "Reserve the most urgent job across a tube group first, at the cost of peeking every tube per reserve")
+	flag.StringVar(&o.TubePrefix, "tube-prefix", "", "Prefix of the beanstalkd names of all tubes, which are given without it")
+	flag.BoolVar(&o.WatchDefault, "watch-default", false, "Also reserve from the default tube, rather than ignoring it")
+	flag.Var(&o.TubeGroup, "tube-group", "Comma separated list of tubes serviced together, in round-robin order.")
 	flag.Parse()
 
+	for _, l := range []struct {
+		flag  string
+		tubes *TubeList
+	}{
+		{"tubes", &o.Tubes},
+		{"tube-group", &o.TubeGroup},
+		{"at-most-once", &o.AtMostOnce},
+		{"skip-retry-precheck", &o.SkipRetryPrecheck},
+	} {
+		var dropped []string
+		if *l.tubes, dropped = l.tubes.Dedupe(); len(dropped) > 0 {
+			log.Warnf("ignoring duplicate tubes in -%s: %s", l.flag, strings.Join(dropped, ", "))
+		}
+	}
+
+	if o.WorkerId == "" {
+		if o.WorkerId, err = os.Hostname(); err != nil {
+			return o, fmt.Errorf("failed to determine the hostname for -worker-id, error: %s", err)
+		}
+	}
+
+	if o.PolicyFile != "" {
+		if o.Policies, err = LoadPolicyFile(o.PolicyFile); err != nil {
+			return
+		}
+	}
+
+	if o.RoutingFile != "" {
+		if o.Routes, err = LoadRoutingFile(o.RoutingFile); err != nil {
+			return
+		}
+	}
+
 	err = validateOptions(o)
+	if err == nil {
+		o.RequeueDelay = clampDelay("requeue-delay", o.RequeueDelay)
+	}
 
 	return
 }
 
+// clampDelay lowers a delay beyond beanstalkd's maximum to it, with a warning.
+func clampDelay(flag string, d time.Duration) time.Duration {
+	if d > MaxDelay {
+		log.Warnf("-%s of %v exceeds beanstalkd's maximum, using %v", flag, d, MaxDelay)
+		return MaxDelay
+	}
+	return d
+}
+
 func validateOptions(o Options) error {
 	msgs := make([]string, 0)
 
 	if o.Address == "" {
 		msgs = append(msgs, "Address must not be empty (use -address flag)")
 	}
+	if path, ok := o.UnixSocket(); ok {
+		if path == "" {
+			msgs = append(msgs, "Unix socket path must not be empty (use -address flag)")
+		}
+		if o.TLS {
+			msgs = append(msgs, "TLS is not supported over a Unix socket (use -tls flag)")
+		}
+	}
 	if o.PHPBinary == "" {
 		msgs = append(msgs, "Path to PHP binary must not be empty (use -php flag)")
 	}
@@ -104,19 +624,193 @@ func validateOptions(o Options) error {
 	if o.Controller == "" {
 		msgs = append(msgs, "Controller must not be empty (use -controller flag)")
 	}
+	if !o.SkipPathValidation && o.spawnsJobs() {
+		msgs = append(msgs, validatePaths(o)...)
+	}
+	if o.ReprocessId != 0 && o.Once {
+		msgs = append(msgs, "Use only one of -once and -reprocess-id")
+	}
+	if o.ReplayId != 0 && o.ReplayTube != "" {
+		msgs = append(msgs, "Use only one of -replay-id and -replay-tube")
+	}
+	if o.KickAll < 0 || o.KickAll > MaxKickBound {
+		msgs = append(msgs, fmt.Sprintf("Kick bound must be between 0 and %d (use -kick-all flag)", MaxKickBound))
+	}
+	durations := []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"requeue-delay", o.RequeueDelay},
+		{"shutdown-timeout", o.ShutdownTimeout},
+		{"drain-job-grace", o.DrainJobGrace},
+		{"max-runtime", o.MaxRuntime},
+		{"prefer-newer", o.PreferNewer},
+		{"delete-retry-backoff", o.DeleteRetryBackoff},
+		{"max-job-age", o.MaxJobAge},
+		{"server-stats-interval", o.ServerStatsInterval},
+		{"heartbeat-interval", o.HeartbeatInterval},
+		{"reconnect-initial", o.ReconnectInitial},
+		{"reconnect-max", o.ReconnectMax},
+		{"reserve-error-log-interval", o.ReserveErrorLogInterval},
+		{"autoscale-interval", o.AutoscaleInterval},
+		{"poll-jitter", o.PollJitter},
+		{"kill-grace", o.KillGrace},
+		{"connect-timeout", o.ConnectTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			msgs = append(msgs, fmt.Sprintf("Duration must not be negative, got %v (use -%s flag)", d.value, d.flag))
+		}
+	}
+	for _, tube := range o.SkipRetryPrecheck {
+		if _, ok := o.MaxJobWallTime[tube]; !ok {
+			msgs = append(msgs, fmt.Sprintf("Tube %s skips the retry precheck, so needs a wall time cap to time its jobs (use -max-job-wall-time flag)", tube))
+		}
+	}
+	switch o.OnTimeout {
+	case "release", "bury", "delete":
+	default:
+		msgs = append(msgs, fmt.Sprintf("Timeout policy must be one of release, bury or delete, got %q (use -on-timeout flag)", o.OnTimeout))
+	}
+	switch o.LogResultsOn {
+	case "always", "failure", "never":
+	default:
+		msgs = append(msgs, fmt.Sprintf("Result logging must be one of always, failure or never, got %q (use -log-results-on flag)", o.LogResultsOn))
+	}
+	if len(o.KillSignals) == 0 {
+		msgs = append(msgs, "Kill signals must not be empty (use -kill-signals flag)")
+	}
+	switch o.Executor {
+	case "fork":
+	case "persistent":
+		if o.PersistentScript == "" {
+			msgs = append(msgs, "Persistent worker script must not be empty (use -persistent-script flag)")
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("Executor must be fork or persistent, got %q (use -executor flag)", o.Executor))
+	}
+	switch o.StdinFraming {
+	case "raw", "newline", "length-prefixed", "base64":
+	default:
+		msgs = append(msgs, fmt.Sprintf("Stdin framing must be one of raw, newline, length-prefixed or base64, got %q (use -stdin-framing flag)", o.StdinFraming))
+	}
+	switch o.ResultsOverflow {
+	case "", "block", "drop-newest", "drop-oldest":
+	default:
+		msgs = append(msgs, fmt.Sprintf("Results overflow policy must be one of block, drop-newest or drop-oldest, got %q", o.ResultsOverflow))
+	}
+	if o.ResultsBuffer < 0 {
+		msgs = append(msgs, "Results buffer must not be negative")
+	}
+	if o.InvalidJobPolicy != "bury" && o.InvalidJobPolicy != "delete" {
+		msgs = append(msgs, fmt.Sprintf("Invalid job policy must be bury or delete, got %q (use -invalid-job-policy flag)", o.InvalidJobPolicy))
+	}
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		msgs = append(msgs, "TLS client certificate and key must be given together (use -tls-cert and -tls-key flags)")
+	}
+	if !o.TLS && (o.TLSCA != "" || o.TLSCert != "") {
+		msgs = append(msgs, "TLS files are only used over TLS (use -tls flag)")
+	}
+	if o.OversizedBodyPolicy != "bury" && o.OversizedBodyPolicy != "delete" {
+		msgs = append(msgs, fmt.Sprintf("Oversized body policy must be bury or delete, got %q (use -oversized-body-policy flag)", o.OversizedBodyPolicy))
+	}
+	if o.JobFormat != "php" && o.JobFormat != "json" {
+		msgs = append(msgs, fmt.Sprintf("Job format must be php or json, got %q (use -job-format flag)", o.JobFormat))
+	}
+	if o.MinFreeDiskMB > 0 && o.DiskPath == "" {
+		msgs = append(msgs, "Disk path must not be empty when checking free disk (use -disk-path flag)")
+	}
+	if o.MaxNewTubesPerCycle < 0 {
+		msgs = append(msgs, "Maximum new tubes per cycle must not be negative (use -max-new-tubes-per-cycle flag)")
+	}
+	if o.MaxTubes < 0 {
+		msgs = append(msgs, "Maximum tubes must not be negative (use -max-tubes flag)")
+	}
+	if o.All && o.SpawnWorkers < 1 {
+		msgs = append(msgs, "Spawn workers must be at least 1 (use -spawn-workers flag)")
+	}
+	if o.GoMaxProcs < 0 {
+		msgs = append(msgs, "GOMAXPROCS must not be negative (use -gomaxprocs flag)")
+	}
+	if o.AutoscaleInterval > 0 {
+		if o.SharedReserve {
+			msgs = append(msgs, "Autoscaling cannot be used with a shared reserve (use -autoscale-interval or -shared-reserve flag)")
+		}
+		if o.TargetJobsPerWorker == 0 {
+			msgs = append(msgs, "Target jobs per worker must be positive (use -target-jobs-per-worker flag)")
+		}
+		if o.MinPerTube > o.MaxPerTube {
+			msgs = append(msgs, fmt.Sprintf("Minimum workers per tube must not exceed %d (use -min-per-tube flag, or raise -max-per-tube)", o.MaxPerTube))
+		}
+	}
+	if o.ShardCount == 0 {
+		msgs = append(msgs, "Shard count must be positive (use -shard-count flag)")
+	} else if o.ShardIndex >= o.ShardCount {
+		msgs = append(msgs, fmt.Sprintf("Shard index must be below the shard count of %d (use -shard-index flag)", o.ShardCount))
+	}
+	if o.DependencyHealthcheckURL != "" && o.DependencyHealthcheckInterval <= 0 {
+		msgs = append(msgs, "Dependency health check interval must be positive (use -dependency-healthcheck-interval flag)")
+	}
+	if o.RecentJobsSize < 0 || o.RecentJobsSize > MaxRecentJobsSize {
+		msgs = append(msgs, fmt.Sprintf("Recent jobs size must be between 0 and %d, got %d (use -recent-jobs-size flag)", MaxRecentJobsSize, o.RecentJobsSize))
+	}
+	if len(o.AuditBody) > 0 && o.AuditLog == "" {
+		msgs = append(msgs, "Logging job bodies needs the audit log (use -audit-log flag)")
+	}
+	if o.StreamStdout && o.AdminAddress == "" {
+		msgs = append(msgs, "Streaming stdout needs the admin API (use -admin-address flag)")
+	}
+	if !o.All {
+		if len(o.Tubes) == 0 {
+			msgs = append(msgs, "Tube list must not be empty (use -tubes flag, or -all)")
+		} else if hasEmpty(o.Tubes) {
+			msgs = append(msgs, fmt.Sprintf("Tube names must not be empty, got %q (use -tubes flag)", strings.Join(o.Tubes, ",")))
+		}
+	}
+	if hasEmpty(o.TubeGroup) {
+		msgs = append(msgs, fmt.Sprintf("Tube names must not be empty, got %q (use -tube-group flag)", strings.Join(o.TubeGroup, ",")))
+	}
+	for _, tube := range append(append(TubeList{}, o.Tubes...), o.TubeGroup...) {
+		if tube == "" {
+			continue
+		}
+		// The names are checked as set, but the prefix may make them invalid.
+		if err := CheckTubeName(o.Prefixed(tube)); err != nil {
+			msgs = append(msgs, fmt.Sprintf("Invalid %s (use -tubes, -tube-group or -tube-prefix flag)", err))
+		}
+	}
+	if o.Once && o.All {
+		msgs = append(msgs, "One-shot mode cannot listen to all tubes (use -tubes flag with -once)")
+	}
 
 	if len(msgs) == 0 {
 		return nil
 	} else {
-		return errors.New(strings.Join(msgs, "\n"))
+		return &ValidationError{Messages: msgs}
 	}
 }
 
+// ValidationError lists every way in which the options are invalid, one
+// message per failure.
+type ValidationError struct {
+	Messages []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Messages, "\n")
+}
+
 // Set replaces the TubeList by parsing the comma-separated value string.
 func (t *TubeList) Set(value string) error {
 	list := strings.Split(value, ",")
-	for i, value := range list {
-		list[i] = value
+	for _, name := range list {
+		// Empty names are reported by validateOptions.
+		if name == "" {
+			continue
+		}
+		if err := CheckTubeName(name); err != nil {
+			return err
+		}
 	}
 	*t = list
 	return nil
@@ -125,3 +819,305 @@ func (t *TubeList) Set(value string) error {
 func (t *TubeList) String() string {
 	return fmt.Sprint(*t)
 }
+
+// MaxTubeNameLength is the longest tube name beanstalkd accepts, in bytes.
+const MaxTubeNameLength = 200
+
+// tubeNameChars are the characters beanstalkd accepts in tube names.
+const tubeNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-+/;.$_()"
+
+// CheckTubeName returns an error if beanstalkd would refuse name as the name
+// of a tube: when it is empty or longer than MaxTubeNameLength, holds other
+// characters than letters, digits and -+/;.$_(), or starts with a hyphen.
+func CheckTubeName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("tube name must not be empty")
+	case len(name) > MaxTubeNameLength:
+		return fmt.Errorf("tube name %.20q... is %d bytes long, beanstalkd allows at most %d", name, len(name), MaxTubeNameLength)
+	case name[0] == '-':
+		return fmt.Errorf("tube name %q must not start with a hyphen", name)
+	}
+	if i := strings.IndexFunc(name, func(r rune) bool { return !strings.ContainsRune(tubeNameChars, r) }); i >= 0 {
+		return fmt.Errorf("tube name %q holds %q, beanstalkd only allows letters, digits and -+/;.$_()", name, []rune(name[i:])[0])
+	}
+	return nil
+}
+
+// hasEmpty reports whether any tube in the list has an empty name.
+func hasEmpty(tubes TubeList) bool {
+	for _, tube := range tubes {
+		if tube == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefixed returns the beanstalkd name of tube, adding the tube prefix.
+func (o Options) Prefixed(tube string) string {
+	return o.TubePrefix + tube
+}
+
+// Unprefixed strips the tube prefix from the beanstalkd name of a tube. The
+// result is false if the name lacks the prefix, making it another tenant's.
+func (o Options) Unprefixed(tube string) (string, bool) {
+	if !strings.HasPrefix(tube, o.TubePrefix) {
+		return tube, false
+	}
+	return strings.TrimPrefix(tube, o.TubePrefix), true
+}
+
+// UnixSocket returns the socket path of a unix:// address.
+func (o Options) UnixSocket() (string, bool) {
+	if !strings.HasPrefix(o.Address, UnixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(o.Address, UnixScheme), true
+}
+
+// IntList is a comma-separated list of integers.
+type IntList []int
+
+// Set replaces the IntList by parsing the comma-separated value string.
+func (l *IntList) Set(value string) error {
+	list := IntList{}
+	for _, v := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		list = append(list, i)
+	}
+	*l = list
+	return nil
+}
+
+func (l *IntList) String() string {
+	return fmt.Sprint(*l)
+}
+
+// TubeDurations maps tubes to durations, collected from a repeatable
+// tube=duration flag.
+type TubeDurations map[string]time.Duration
+
+// Set adds the tube=duration value to the TubeDurations.
+func (t *TubeDurations) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected tube=duration, got %q", value)
+	}
+	d, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("duration of tube %s must be positive, got %s", parts[0], d)
+	}
+	if *t == nil {
+		*t = make(TubeDurations)
+	}
+	(*t)[parts[0]] = d
+	return nil
+}
+
+func (t *TubeDurations) String() string {
+	return fmt.Sprint(map[string]time.Duration(*t))
+}
+
+// TubeMargins maps tubes to non-negative durations, collected from a flag
+// holding a comma-separated list of tube=duration, which may be repeated.
+type TubeMargins map[string]time.Duration
+
+// Set adds the tube=duration values of the list to the TubeMargins.
+func (t *TubeMargins) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expected tube=duration, got %q", v)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("duration of tube %s must not be negative, got %s", parts[0], d)
+		}
+		if *t == nil {
+			*t = make(TubeMargins)
+		}
+		(*t)[parts[0]] = d
+	}
+	return nil
+}
+
+func (t *TubeMargins) String() string {
+	return fmt.Sprint(map[string]time.Duration(*t))
+}
+
+// TubeInts maps tubes to positive integers, collected from a repeatable
+// tube=N flag.
+type TubeInts map[string]int
+
+// Set adds the tube=N value to the TubeInts.
+func (t *TubeInts) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected tube=N, got %q", value)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("value of tube %s must be positive, got %d", parts[0], n)
+	}
+	if *t == nil {
+		*t = make(TubeInts)
+	}
+	(*t)[parts[0]] = n
+	return nil
+}
+
+func (t *TubeInts) String() string {
+	return fmt.Sprint(map[string]int(*t))
+}
+
+// TubeFields maps tubes to lists of job packet keys, collected from a
+// repeatable tube=key,key flag. The list may be empty.
+type TubeFields map[string]FieldList
+
+// Set adds the tube=key,key value to the TubeFields.
+func (t *TubeFields) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected tube=key,key, got %q", value)
+	}
+	var fields FieldList
+	if err := fields.Set(parts[1]); err != nil {
+		return err
+	}
+	if *t == nil {
+		*t = make(TubeFields)
+	}
+	(*t)[parts[0]] = fields
+	return nil
+}
+
+func (t *TubeFields) String() string {
+	return fmt.Sprint(map[string]FieldList(*t))
+}
+
+// SignalList is a comma-separated list of signal names.
+type SignalList []os.Signal
+
+// Set replaces the SignalList by parsing the comma-separated value string.
+func (l *SignalList) Set(value string) error {
+	list := SignalList{}
+	for _, v := range strings.Split(value, ",") {
+		sig, err := cmd.ParseSignal(v)
+		if err != nil {
+			return err
+		}
+		list = append(list, sig)
+	}
+	*l = list
+	return nil
+}
+
+// MarshalJSON encodes the SignalList as a list of signal names.
+func (l SignalList) MarshalJSON() ([]byte, error) {
+	names := make([]string, len(l))
+	for i, sig := range l {
+		names[i] = cmd.SignalName(sig)
+	}
+	return json.Marshal(names)
+}
+
+func (l *SignalList) String() string {
+	names := make([]string, len(*l))
+	for i, sig := range *l {
+		names[i] = cmd.SignalName(sig)
+	}
+	return strings.Join(names, ",")
+}
+
+// FieldList is a comma-separated list of job packet keys.
+type FieldList []string
+
+// Set replaces the FieldList by parsing the comma-separated value string,
+// ignoring empty keys.
+func (l *FieldList) Set(value string) error {
+	list := FieldList{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	*l = list
+	return nil
+}
+
+func (l *FieldList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// StringList collects the values of a flag which may be repeated.
+type StringList []string
+
+// Set appends value to the StringList.
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *StringList) String() string {
+	return fmt.Sprint(*l)
+}
+
+// Dedupe returns the list without repeated tubes, keeping the first of each,
+// along with the repeats dropped.
+func (t TubeList) Dedupe() (unique TubeList, dropped []string) {
+	seen := make(map[string]bool, len(t))
+	for _, tube := range t {
+		if seen[tube] {
+			dropped = append(dropped, tube)
+			continue
+		}
+		seen[tube] = true
+		unique = append(unique, tube)
+	}
+	return
+}
+
+// spawnsJobs reports whether the options run jobs, rather than only printing
+// the configuration, testing connectivity or kicking buried jobs, following
+// the order main picks the mode in.
+func (o Options) spawnsJobs() bool {
+	if o.SelfTest || o.PrintConfig {
+		return false
+	}
+	return o.KickAll == 0 || o.Once || o.ReprocessId != 0
+}
+
+// validatePaths checks that the PHP binary is executable and the ini file is
+// readable, so that a typo fails at startup rather than every job at runtime.
+func validatePaths(o Options) (msgs []string) {
+	// The binary is looked up as it is executed, on the PATH unless it
+	// names a path.
+	if o.PHPBinary != "" {
+		if _, err := exec.LookPath(o.PHPBinary); errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			msgs = append(msgs, fmt.Sprintf("PHP binary %s is not accessible, error: %s (use -php flag)", o.PHPBinary, err))
+		} else if err != nil {
+			msgs = append(msgs, fmt.Sprintf("PHP binary %s is not executable (use -php flag)", o.PHPBinary))
+		}
+	}
+	if o.PHPINI != "" {
+		if f, err := os.Open(o.PHPINI); err != nil {
+			msgs = append(msgs, fmt.Sprintf("PHP ini file %s is not readable, error: %s (use -php-ini flag)", o.PHPINI, err))
+		} else {
+			f.Close()
+		}
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// PolicyRule is an entry of the policy file. It sets the retry and disposal
+// policy for the tubes matched by Tube, which is a name or a glob pattern.
+// Fields that are not set fall back to the global defaults.
+type PolicyRule struct {
+	Tube string `json:"tube" yaml:"tube"`
+
+	// MaxReleases is the number of releases after which a job is given up on.
+	MaxReleases *uint64 `json:"maxReleases" yaml:"maxReleases"`
+
+	// MaxTimeouts is the number of timeouts after which a job is given up on.
+	MaxTimeouts *uint64 `json:"maxTimeouts" yaml:"maxTimeouts"`
+
+	// Backoff is the base delay for releasing failed jobs, doubled on every
+	// release.
+	Backoff *Duration `json:"backoff" yaml:"backoff"`
+
+	// DeadletterTube receives the jobs that are given up on.
+	DeadletterTube string `json:"deadletterTube" yaml:"deadletterTube"`
+
+	// DeleteOnSuccess == false means successful jobs are buried for
+	// inspection instead of being deleted.
+	DeleteOnSuccess *bool `json:"deleteOnSuccess" yaml:"deleteOnSuccess"`
+}
+
+// PolicyList is the ordered list of rules read from a policy file.
+type PolicyList []PolicyRule
+
+// Duration is a time.Duration read from a string such as "30s".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// LoadPolicyFile reads a JSON policy file holding a list of PolicyRules.
+func LoadPolicyFile(filename string) (PolicyList, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var l PolicyList
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s, error: %s", filename, err)
+	}
+
+	for _, r := range l {
+		if _, err := path.Match(r.Tube, ""); err != nil {
+			return nil, fmt.Errorf("invalid tube pattern %q in policy file %s", r.Tube, filename)
+		}
+		if r.Backoff != nil && r.Backoff.Duration < 0 {
+			return nil, fmt.Errorf("negative backoff for tube %q in policy file %s", r.Tube, filename)
+		}
+	}
+	return l, nil
+}
+
+// Match returns the rule that applies to tube. A rule naming the tube exactly
+// takes precedence over glob patterns; among patterns the first in the file
+// wins.
+func (l PolicyList) Match(tube string) (PolicyRule, bool) {
+	for _, r := range l {
+		if r.Tube == tube {
+			return r, true
+		}
+	}
+	for _, r := range l {
+		if ok, _ := path.Match(r.Tube, tube); ok {
+			return r, true
+		}
+	}
+	return PolicyRule{}, false
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes data to a file in a temporary directory, returning its
+// path.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPolicyMatch(t *testing.T) {
+	l, err := LoadPolicyFile(writeFile(t, "policy.json", `[
+		{"tube": "email-*", "maxReleases": 3, "backoff": "30s"},
+		{"tube": "email-*-bulk", "maxReleases": 1},
+		{"tube": "email-eu", "deadletterTube": "email-dead"},
+		{"tube": "*", "deleteOnSuccess": false}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tube string
+		want string
+	}{
+		// An exact name wins over an earlier pattern.
+		{"email-eu", "email-eu"},
+		// Among patterns, the first in the file wins.
+		{"email-us", "email-*"},
+		{"email-us-bulk", "email-*"},
+		{"sms", "*"},
+	}
+	for _, tt := range tests {
+		r, ok := l.Match(tt.tube)
+		if !ok || r.Tube != tt.want {
+			t.Errorf("tube %s matched %q (%t), want %q", tt.tube, r.Tube, ok, tt.want)
+		}
+	}
+
+	r, _ := l.Match("email-us")
+	if *r.MaxReleases != 3 || r.Backoff.Duration != 30*time.Second {
+		t.Errorf("email-* rule has %d releases and %v backoff", *r.MaxReleases, r.Backoff.Duration)
+	}
+	if _, ok := PolicyList(l[:3]).Match("sms"); ok {
+		t.Error("a tube matching no rule was matched")
+	}
+}
+
+func TestLoadPolicyFileErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"malformed JSON":   `[{"tube": "email"`,
+		"bad pattern":      `[{"tube": "email-["}]`,
+		"negative backoff": `[{"tube": "email", "backoff": "-1s"}]`,
+		"bad duration":     `[{"tube": "email", "backoff": "soon"}]`,
+	} {
+		if _, err := LoadPolicyFile(writeFile(t, "policy.json", data)); err == nil {
+			t.Errorf("%s: policy file loaded", name)
+		}
+	}
+	if _, err := LoadPolicyFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing policy file loaded")
+	}
+}
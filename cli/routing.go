@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Route is an entry of the routing file. It matches jobs by tube, a name or
+// glob pattern, and optionally by string fields of the job packet, and sets
+// the controller, working directory and retry policy for them. Fields that
+// are not set fall back to the flags, the domain key and the policy file.
+type Route struct {
+	PolicyRule `yaml:",inline"`
+
+	// Match holds packet fields which must all equal the given values.
+	Match map[string]string `json:"match" yaml:"match"`
+
+	// Controller handles the jobs instead of -controller.
+	Controller string `json:"controller" yaml:"controller"`
+
+	// WorkDir is the directory the jobs are executed in, instead of routing
+	// on the domain key.
+	WorkDir string `json:"workDir" yaml:"workDir"`
+}
+
+// RoutingTable is the ordered list of routes read from a routing file.
+type RoutingTable []Route
+
+// LoadRoutingFile reads a YAML routing file holding a list of Routes. As YAML
+// is a superset of JSON, a JSON routing file is read too.
+func LoadRoutingFile(filename string) (RoutingTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var t RoutingTable
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse routing file %s, error: %s", filename, err)
+	}
+
+	for _, r := range t {
+		if r.Tube == "" {
+			return nil, fmt.Errorf("route without a tube in routing file %s (use \"*\" for a default route)", filename)
+		}
+		if _, err := path.Match(r.Tube, ""); err != nil {
+			return nil, fmt.Errorf("invalid tube pattern %q in routing file %s", r.Tube, filename)
+		}
+		if r.Backoff != nil && r.Backoff.Duration < 0 {
+			return nil, fmt.Errorf("negative backoff for tube %q in routing file %s", r.Tube, filename)
+		}
+	}
+	return t, nil
+}
+
+// Match returns the first route matching a job of tube, whose packet fields
+// are looked up with field. A route of "*" without predicates placed last
+// serves as the default.
+func (t RoutingTable) Match(tube string, field func(key string) (string, bool)) (Route, bool) {
+	for _, r := range t {
+		if ok, _ := path.Match(r.Tube, tube); !ok {
+			continue
+		}
+		if r.matchFields(field) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+func (r Route) matchFields(field func(key string) (string, bool)) bool {
+	for key, want := range r.Match {
+		if got, ok := field(key); !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoutingMatch(t *testing.T) {
+	table, err := LoadRoutingFile(writeFile(t, "routing.yml", `
+- tube: report-*
+  match:
+    type: export
+  controller: /Reports/Export
+  maxTimeouts: 3
+  backoff: 1m
+- tube: report-*
+  controller: /Reports/Run
+- tube: maintenance
+  workDir: /opt/cluster/worker
+- tube: "*"
+  controller: /Core/Job/Console
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tube       string
+		packet     map[string]string
+		controller string
+		workDir    string
+	}{
+		// The first route whose tube and fields match wins.
+		{"report-daily", map[string]string{"type": "export"}, "/Reports/Export", ""},
+		{"report-daily", map[string]string{"type": "print"}, "/Reports/Run", ""},
+		{"report-daily", nil, "/Reports/Run", ""},
+		{"maintenance", map[string]string{"type": "export"}, "", "/opt/cluster/worker"},
+		// The default route covers the rest.
+		{"email", nil, "/Core/Job/Console", ""},
+	}
+	for _, tt := range tests {
+		r, ok := table.Match(tt.tube, func(key string) (string, bool) {
+			v, ok := tt.packet[key]
+			return v, ok
+		})
+		if !ok || r.Controller != tt.controller || r.WorkDir != tt.workDir {
+			t.Errorf("%s %v: matched %t, controller %q, work dir %q, want %q, %q",
+				tt.tube, tt.packet, ok, r.Controller, r.WorkDir, tt.controller, tt.workDir)
+		}
+	}
+
+	r, _ := table.Match("report-daily", func(string) (string, bool) { return "export", true })
+	if r.MaxTimeouts == nil || *r.MaxTimeouts != 3 || r.Backoff == nil || r.Backoff.Duration != time.Minute {
+		t.Errorf("export route has policy %+v", r.PolicyRule)
+	}
+
+	noField := func(string) (string, bool) { return "", false }
+	if _, ok := RoutingTable(table[:3]).Match("email", noField); ok {
+		t.Error("a job matching no route was routed without a default")
+	}
+}
+
+func TestLoadRoutingFileJSON(t *testing.T) {
+	table, err := LoadRoutingFile(writeFile(t, "routing.json", `[
+		{"tube": "report-*", "match": {"type": "export"}, "controller": "/Reports/Export", "maxTimeouts": 3},
+		{"tube": "*", "workDir": "/opt/cluster/worker", "backoff": "30s"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 2 || table[0].Match["type"] != "export" || *table[0].MaxTimeouts != 3 {
+		t.Errorf("read %+v", table)
+	}
+	if table[1].WorkDir != "/opt/cluster/worker" || table[1].Backoff.Duration != 30*time.Second {
+		t.Errorf("default route read as %+v", table[1])
+	}
+}
+
+func TestLoadRoutingFileErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"syntax":       "- tube: [",
+		"no tube":      "- controller: /Core/Job/Console",
+		"pattern":      "- tube: \"[\"",
+		"backoff":      "- tube: jobs\n  backoff: soon",
+		"neg. backoff": "- tube: jobs\n  backoff: -1s",
+	} {
+		if _, err := LoadRoutingFile(writeFile(t, "routing.yml", data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type Cmd struct {
@@ -12,23 +15,64 @@ type Cmd struct {
 	stderrPipe io.ReadCloser
 	stdinPipe  io.WriteCloser
 	stdoutPipe io.ReadCloser
+
+	// stderr keeps the tail of what the process writes to stderr, which is
+	// passed on to the broker's own.
+	stderr *tailBuffer
+
+	kill KillSequence
+
+	// escalate starts the escalation through the kill sequence once,
+	// however many times the process is terminated.
+	escalate sync.Once
+
+	// exited is closed once the process has been waited on.
+	exited chan struct{}
+
+	// stdinDone is closed once writing stdin has finished, stdinErr being
+	// the error that stopped it, if any.
+	stdinDone chan struct{}
+	stdinErr  error
+}
+
+// KillSequence is how a process is terminated: the first signal is sent,
+// then each of the others in turn, Grace apart, while it keeps running.
+type KillSequence struct {
+	Signals []os.Signal
+	Grace   time.Duration
+}
+
+// SetKillSequence sets how Terminate stops the process, SIGTERM alone by
+// default.
+func (c *Cmd) SetKillSequence(k KillSequence) {
+	c.kill = k
 }
 
-func (c Cmd) SetPath(path string) {
+func (c *Cmd) SetPath(path string) {
 	c.cmd.Dir = path
 }
 
+// AddEnv adds variables, in the form "key=value", to the environment of the
+// command. It must be called before the command is started.
+func (c *Cmd) AddEnv(env ...string) {
+	c.cmd.Env = append(c.cmd.Env, env...)
+}
+
 // WaitResult is sent to the channel returned by WaitChan().
 // It indicates the exit status, or a non-exit-status error e.g. IO error.
 // In the case of a non-exit-status, Status is -1
 type WaitResult struct {
 	Status int
 	Err    error
+
+	// StdinErr is the error which stopped stdin being written in full. A
+	// process exiting without reading all of its stdin is not an error.
+	StdinErr error
 }
 
 // NewCommand returns a Cmd with IO configured, but not started.
 func NewCommand(cwd, name string, args ...string) (cmd *Cmd, out <-chan []byte, err error) {
-	cmd = &Cmd{}
+	cmd = &Cmd{exited: make(chan struct{}), stdinDone: make(chan struct{}), stderr: &tailBuffer{max: MaxStderrBytes}}
 	cmd.cmd = exec.Command(name, args...)
 	cmd.cmd.Dir = cwd
 	cmd.cmd.Env = []string{
@@ -49,31 +93,91 @@ func NewCommand(cwd, name string, args ...string) (cmd *Cmd, out <-chan []byte,
 		return
 	}
 
-	cmd.cmd.Stderr = os.Stderr
+	cmd.cmd.Stderr = io.MultiWriter(os.Stderr, cmd.stderr)
+	cmd.cmd.WaitDelay = StderrWaitDelay
 	cmd.stderrPipe = os.Stderr
 
 	out = readerToChannel(cmd.stdoutPipe)
 	return
 }
 
-// Start the process, write input to stdin, then close stdin.
+// Start the process, then write input to stdin in the background, closing
+// it once done, so that a child reading slowly holds up neither the start
+// nor the reading of its stdout.
 func (c *Cmd) StartWithStdin(input []byte) (err error) {
 	err = c.cmd.Start()
 	if err != nil {
+		close(c.stdinDone)
 		return
 	}
-	_, err = c.stdinPipe.Write(input)
-	if err != nil {
+	go c.writeStdin(input)
+	return nil
+}
+
+// writeStdin writes input to stdin in full, then closes it. Should the
+// process exit first, the pipe is broken or closed by Wait, which only means
+// the process did not need the rest of its input.
+func (c *Cmd) writeStdin(input []byte) {
+	defer close(c.stdinDone)
+	defer c.stdinPipe.Close()
+	for len(input) > 0 {
+		n, err := c.stdinPipe.Write(input)
+		input = input[n:]
+		if err != nil {
+			if !errors.Is(err, syscall.EPIPE) && !errors.Is(err, os.ErrClosed) {
+				c.stdinErr = err
+			}
+			return
+		}
+	}
+}
+
+// Terminate the process with the first signal of its kill sequence, then
+// escalate through the others in the background while it keeps running.
+// Terminating it again resends the first signal, without escalating twice.
+// Escalation needs the process to be waited on with WaitChan to notice it
+// exiting.
+func (c *Cmd) Terminate() (err error) {
+	signals := c.kill.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM}
+	}
+	if err = c.cmd.Process.Signal(signals[0]); err != nil {
 		return
 	}
-	c.stdinPipe.Close()
+
+	if len(signals) > 1 {
+		c.escalate.Do(func() {
+			go func() {
+				for _, sig := range signals[1:] {
+					select {
+					case <-c.exited:
+						return
+					case <-time.After(c.kill.Grace):
+					}
+					c.cmd.Process.Signal(sig)
+				}
+			}()
+		})
+	}
 	return nil
 }
 
-// Terminate the process with SIGTERM.
-// TODO: follow up with SIGKILL if still running.
-func (c *Cmd) Terminate() (err error) {
-	return c.cmd.Process.Signal(syscall.SIGTERM)
+// Started reports whether the process was started, in which case it must be
+// waited on to be reaped.
+func (c *Cmd) Started() bool {
+	return c.cmd.Process != nil
+}
+
+// Stderr returns the last MaxStderrBytes the process wrote to stderr. It is
+// complete once the process has been waited on.
+func (c *Cmd) Stderr() []byte {
+	return c.stderr.Bytes()
+}
+
+// Kill the process with SIGKILL.
+func (c *Cmd) Kill() (err error) {
+	return c.cmd.Process.Kill()
 }
 
 // WaitChan starts a goroutine to wait for the command to exit, and returns
@@ -83,13 +187,20 @@ func (cmd *Cmd) WaitChan() <-chan WaitResult {
 	ch := make(chan WaitResult)
 	go func() {
 		err := cmd.cmd.Wait()
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// The process exited 0, only its stderr was cut short.
+			err = nil
+		}
+		close(cmd.exited)
+		// Wait closed stdin, so writing it finishes promptly.
+		<-cmd.stdinDone
 		if err == nil {
-			ch <- WaitResult{0, nil}
+			ch <- WaitResult{Status: 0, StdinErr: cmd.stdinErr}
 		} else if e1, ok := err.(*exec.ExitError); ok {
 			status := e1.Sys().(syscall.WaitStatus).ExitStatus()
-			ch <- WaitResult{status, nil}
+			ch <- WaitResult{Status: status, StdinErr: cmd.stdinErr}
 		} else {
-			ch <- WaitResult{-1, err}
+			ch <- WaitResult{Status: -1, Err: err, StdinErr: cmd.stdinErr}
 		}
 	}()
 	return ch
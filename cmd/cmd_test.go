@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ignoringTerm starts a process which ignores SIGTERM, appending a line to
+// the file usr1 whenever it gets SIGUSR1.
+func ignoringTerm(t *testing.T, k KillSequence) (*Cmd, string) {
+	t.Helper()
+	dir := t.TempDir()
+	usr1 := filepath.Join(dir, "usr1")
+	script := "trap '' TERM; trap '/bin/echo usr1 >>" + usr1 + "' USR1; while :; do /bin/sleep 0.05; done"
+	c, _, err := NewCommand(dir, "/bin/sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetKillSequence(k)
+	if err := c.StartWithStdin(nil); err != nil {
+		t.Fatal(err)
+	}
+	// Give the shell time to set its traps.
+	time.Sleep(100 * time.Millisecond)
+	return c, usr1
+}
+
+func TestTerminateEscalates(t *testing.T) {
+	k := KillSequence{Signals: []os.Signal{syscall.SIGTERM, syscall.SIGKILL}, Grace: 100 * time.Millisecond}
+	c, _ := ignoringTerm(t, k)
+	wait := c.WaitChan()
+
+	start := time.Now()
+	if err := c.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wr := <-wait:
+		if took := time.Since(start); took < k.Grace {
+			t.Errorf("exited after %v, before the grace period", took)
+		}
+		if wr.Status != -1 {
+			t.Errorf("exit status %d, want killed", wr.Status)
+		}
+	case <-time.After(5 * time.Second):
+		c.Kill()
+		t.Fatal("not killed after ignoring SIGTERM")
+	}
+}
+
+func TestTerminateEscalatesOnce(t *testing.T) {
+	k := KillSequence{Signals: []os.Signal{syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGKILL}, Grace: 300 * time.Millisecond}
+	c, usr1 := ignoringTerm(t, k)
+	wait := c.WaitChan()
+
+	// Terminated again, say by a timeout then a shutdown, the process is
+	// still sent each signal of the sequence once.
+	for i := 0; i < 3; i++ {
+		if err := c.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-wait:
+	case <-time.After(5 * time.Second):
+		c.Kill()
+		t.Fatal("not killed after ignoring SIGTERM")
+	}
+	data, _ := os.ReadFile(usr1)
+	if n := strings.Count(string(data), "usr1"); n != 1 {
+		t.Errorf("got SIGUSR1 %d times, want once", n)
+	}
+}
+
+func TestStderrKeepsTail(t *testing.T) {
+	script := "/bin/echo start >&2; head -c " + strconv.Itoa(MaxStderrBytes) + " /dev/zero | tr '\\0' x >&2; /bin/echo end >&2"
+	c, out, err := NewCommand(t.TempDir(), "/bin/sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartWithStdin(nil); err != nil {
+		t.Fatal(err)
+	}
+	for range out {
+	}
+	<-c.WaitChan()
+
+	stderr := string(c.Stderr())
+	if len(stderr) != MaxStderrBytes || strings.Contains(stderr, "start") || !strings.HasSuffix(stderr, "xend\n") {
+		t.Errorf("kept %d bytes of stderr, want the last %d", len(stderr), MaxStderrBytes)
+	}
+}
+
+// run starts script with input on stdin, returning how long starting it
+// took, its stdout and how it exited.
+func run(t *testing.T, script string, input []byte) (time.Duration, string, WaitResult) {
+	t.Helper()
+	c, out, err := NewCommand(t.TempDir(), "/bin/sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.StartWithStdin(input); err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+
+	var stdout []byte
+	for data := range out {
+		stdout = append(stdout, data...)
+	}
+	select {
+	case wr := <-c.WaitChan():
+		return took, string(stdout), wr
+	case <-time.After(5 * time.Second):
+		c.Kill()
+		t.Fatal("process did not exit")
+	}
+	return 0, "", WaitResult{}
+}
+
+func TestStdinWrittenToSlowReader(t *testing.T) {
+	// The body is larger than a pipe buffer, so writing it blocks until the
+	// child reads it.
+	body := []byte(strings.Repeat("x", 1<<20))
+	took, stdout, wr := run(t, "/bin/sleep 0.3; /usr/bin/wc -c", body)
+	if took > 200*time.Millisecond {
+		t.Errorf("starting took %v, waiting for the child to read its stdin", took)
+	}
+	if strings.TrimSpace(stdout) != strconv.Itoa(len(body)) {
+		t.Errorf("child read %s bytes, want %d", strings.TrimSpace(stdout), len(body))
+	}
+	if wr.Status != 0 || wr.Err != nil || wr.StdinErr != nil {
+		t.Errorf("exited %+v, want cleanly", wr)
+	}
+}
+
+func TestStderrHeldOpenByGrandchild(t *testing.T) {
+	// The child exits, leaving behind a process holding its stderr.
+	start := time.Now()
+	_, _, wr := run(t, "/bin/sleep 10 >/dev/null & /bin/echo err >&2", nil)
+	if took := time.Since(start); took > StderrWaitDelay+time.Second {
+		t.Errorf("waiting took %v, want it within %v of the exit", took, StderrWaitDelay)
+	}
+	if wr.Status != 0 || wr.Err != nil {
+		t.Errorf("exited %+v, want cleanly", wr)
+	}
+}
+
+func TestStdinNotReadByEarlyExit(t *testing.T) {
+	body := []byte(strings.Repeat("x", 1<<20))
+	_, _, wr := run(t, "exit 3", body)
+	if wr.Status != 3 || wr.Err != nil {
+		t.Errorf("exited %+v, want status 3", wr)
+	}
+	if wr.StdinErr != nil {
+		t.Errorf("exiting without reading stdin reported as %s", wr.StdinErr)
+	}
+}
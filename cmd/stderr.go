@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxStderrBytes is how much of a process's stderr is kept, its tail.
+const MaxStderrBytes = 64 * 1024
+
+// StderrWaitDelay is how long stderr is read on once a process has exited,
+// before it is closed on the processes it started, which may hold it open
+// long after.
+const StderrWaitDelay = time.Second
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if over := len(b.data) - b.max; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the bytes kept.
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.data...)
+}
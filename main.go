@@ -1,36 +1,411 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/kayako/beanstalk-broker/broker"
+	"github.com/kayako/beanstalk-broker/bs"
 	"github.com/kayako/beanstalk-broker/cli"
+	"github.com/kayako/beanstalk-broker/metrics"
+	"github.com/kayako/beanstalk-broker/tracing"
+	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 	opts := cli.MustParseFlags()
+	bs.ReserveErrorLogInterval = opts.ReserveErrorLogInterval
+	if opts.PrintConfig {
+		fmt.Println(opts)
+		os.Exit(0)
+	}
+
+	log.Infof("running with GOMAXPROCS=%d", setGOMAXPROCS(opts.GoMaxProcs))
+
+	tracer := tracing.NewTracer(opts.OtelEndpoint, "beanstalk-broker")
+
+	if opts.SelfTest {
+		if !broker.SelfTest(opts, os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Once {
+		runOnce(opts, tracer)
+	}
+
+	if opts.ReprocessId != 0 {
+		reprocess(opts, tracer)
+	}
+
+	if opts.ReplayId != 0 || opts.ReplayTube != "" {
+		replay(opts, tracer)
+	}
+
+	if opts.KickAll != 0 {
+		kickAll(opts)
+	}
+
+	if opts.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		serveHTTP("metrics", opts.MetricsAddress, mux, opts.RequireMetrics)
+	}
+
+	log.WithField("event", "config").Infof("effective configuration: %s", opts)
+
+	if opts.PIDFile != "" {
+		if err := writePIDFile(opts.PIDFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	bd := broker.NewBrokerDispatcher(opts)
+	bd.Tracer = tracer
+
+	if opts.AuditLog != "" {
+		audit, err := broker.OpenAuditLog(opts.AuditLog)
+		if err != nil {
+			log.Fatalf("failed to open audit log %s, error: %s", opts.AuditLog, err)
+		}
+		bd.Audit = audit
+		handleHangup(func() { reopenAuditLog(audit) })
+	}
+
+	if opts.StatsdAddress != "" {
+		statsd, err := broker.DialStatsd(opts.StatsdAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bd.Statsd = statsd
+	}
+
+	// flush writes out what the reporting subsystems have buffered, once the
+	// brokers have stopped, and removes the PID file.
+	flush := func() {
+		flushWithTimeout(opts.ShutdownTimeout, tracer.Close, func() {
+			if err := bd.Audit.Close(); err != nil {
+				log.Errorf("failed to close audit log, error: %s", err)
+			}
+			bd.Statsd.Close()
+		})
+		removePIDFile(opts.PIDFile)
+	}
+
+	if opts.AdminAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/jobs/in-flight", bd.InFlight)
+		mux.Handle("/kick-all", broker.KickAllHandler(opts))
+		mux.Handle("/tubes/", bd.Floors)
+		if opts.RecentJobsSize > 0 {
+			bd.Recent = broker.NewRecentJobs(opts.RecentJobsSize)
+			mux.Handle("/recent-jobs", bd.Recent)
+		}
+		if bd.Streams != nil {
+			mux.Handle("/jobs/", bd.Streams)
+		}
+		serveHTTP("admin API", opts.AdminAddress, mux, false)
+	}
+
+	if opts.ServerStatsInterval > 0 {
+		if err := bd.RunServerStats(opts.ServerStatsInterval); err != nil {
+			log.Errorf("failed to start polling server stats, error: %s", err)
+		}
+	}
+
+	if opts.HeartbeatInterval > 0 {
+		bd.RunHeartbeat(opts.HeartbeatInterval)
+	}
+
+	if opts.DependencyHealthcheckURL != "" {
+		check := broker.URLChecker(opts.DependencyHealthcheckURL, opts.DependencyHealthcheckInterval)
+		bd.RunDependencyHealth(check, opts.DependencyHealthcheckInterval)
+	}
+
+	if opts.AutoscaleInterval > 0 {
+		if err := bd.RunAutoscaler(opts.AutoscaleInterval); err != nil {
+			log.Errorf("failed to start the autoscaler, error: %s", err)
+		}
+	}
 
 	if opts.All {
-		bd.RunAllTubes()
+		// The tube group is started first, so that polling finds its tubes
+		// already started rather than starting them again.
+		if len(opts.TubeGroup) > 0 {
+			bd.RunTubeGroup(opts.TubeGroup)
+		}
+		if err := bd.RunAllTubes(); err != nil {
+			log.Fatalf("failed to poll for tubes, error: %s", err)
+		}
 	} else {
 		bd.RunTubes(opts.Tubes)
+		if len(opts.TubeGroup) > 0 {
+			bd.RunTubeGroup(opts.TubeGroup)
+		}
+	}
+
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			bd.Shutdown()
+			if err := bd.WaitWithTimeout(opts.ShutdownTimeout); err != nil {
+				log.Error(err)
+				if n := bd.InFlight.Terminate(); n > 0 {
+					log.Warnf("terminated %d jobs still executing", n)
+					grace := opts.KillGrace*time.Duration(len(opts.KillSignals)-1) + time.Second
+					if err := bd.WaitWithTimeout(grace); err != nil {
+						log.Error(err)
+					}
+				}
+				flush()
+				os.Exit(1)
+			}
+		})
 	}
+	handleShutdown(shutdown)
 
-	handleShutdown(bd.Shutdown)
+	if opts.MaxRuntime > 0 {
+		time.AfterFunc(opts.MaxRuntime, func() {
+			log.Infof("reached the maximum runtime of %v, shutting down", opts.MaxRuntime)
+			shutdown()
+		})
+	}
 	bd.Wait()
+	flush()
+
+	if err := bd.Err(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// setGOMAXPROCS sets GOMAXPROCS to n, or leaves the runtime's default when n
+// is zero, returning the effective value. Since Go 1.25 the default follows
+// the CPU quota of the cgroup the broker runs in, so is not detected here.
+func setGOMAXPROCS(n int) int {
+	if n > 0 {
+		runtime.GOMAXPROCS(n)
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// runOnce processes a single job and exits with the code mapped to its outcome.
+func runOnce(opts cli.Options, tracer *tracing.Tracer) {
+	b := broker.NewGroup(opts, opts.Tubes, 0, nil)
+	b.Tracer = tracer
+	result, err := b.RunOnce()
+	if err != nil {
+		log.Error(err)
+	}
+	tracer.Close()
+	os.Exit(exitCode(opts, result, err))
+}
+
+// reprocess processes the job given by -reprocess-id and exits with the code
+// mapped to its outcome.
+func reprocess(opts cli.Options, tracer *tracing.Tracer) {
+	b := broker.NewGroup(opts, opts.Tubes, 0, nil)
+	b.Tracer = tracer
+	result, err := b.ReprocessJob(opts.ReprocessId)
+	if err != nil {
+		log.Error(err)
+	}
+	tracer.Close()
+	os.Exit(exitCode(opts, result, err))
+}
+
+// replay executes the buried job given by -replay-id or -replay-tube again,
+// leaving it buried, prints its output and exits with the code mapped to its
+// outcome.
+func replay(opts cli.Options, tracer *tracing.Tracer) {
+	b := broker.NewGroup(opts, opts.Tubes, 0, nil)
+	b.Tracer = tracer
+	result, err := b.Replay(opts.ReplayId, opts.ReplayTube)
+	if err != nil {
+		log.Error(err)
+	}
+	printOutput(os.Stdout, os.Stderr, result)
+	tracer.Close()
+	os.Exit(exitCode(opts, result, err))
+}
+
+// printOutput writes the stdout and stderr captured from a job's worker to
+// stdout and stderr, once the worker has finished.
+func printOutput(stdout, stderr io.Writer, result *broker.JobResult) {
+	if result == nil {
+		return
+	}
+	stdout.Write(result.Stdout)
+	stderr.Write(result.Stderr)
+}
+
+// kickAll kicks the buried jobs of the watched tubes as set by -kick-all,
+// prints the count per tube and exits.
+func kickAll(opts cli.Options) {
+	kicked, err := broker.KickAll(opts, opts.KickAll)
+	for tube, n := range kicked {
+		fmt.Printf("%s: %d\n", tube, n)
+	}
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// exitCode translates the outcome of a one-shot job into the configured
+// process exit code.
+func exitCode(opts cli.Options, result *broker.JobResult, err error) int {
+	switch {
+	case err != nil || result == nil:
+		return opts.ExitOnFailure
+	case result.Buried:
+		return opts.ExitOnBury
+	case result.TimedOut:
+		return opts.ExitOnTimeout
+	case result.Error != nil || !result.ExitedOK():
+		return opts.ExitOnFailure
+	default:
+		return opts.ExitOnSuccess
+	}
+}
+
+// serveHTTP starts an optional HTTP server in its own goroutine. A failure to
+// bind is logged and job processing carries on without the server, unless the
+// server is required, in which case the process exits.
+func serveHTTP(name, address string, handler http.Handler, required bool) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		if required {
+			log.Fatalf("failed to start %s server on %s, error: %s", name, address, err)
+		}
+		log.Errorf("failed to start %s server on %s, continuing without it, error: %s", name, address, err)
+		return
+	}
+
+	log.Infof("serving %s on %s", name, address)
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			log.Errorf("%s server failed, error: %s", name, err)
+		}
+	}()
+}
+
+// flushWithTimeout runs the flush funcs one after the other, giving up on
+// them after timeout so a stuck subsystem cannot hold up exiting.
+func flushWithTimeout(timeout time.Duration, flushes ...func()) {
+	done := make(chan struct{})
+	go func() {
+		for _, f := range flushes {
+			f()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Errorf("gave up flushing on shutdown after %v", timeout)
+	}
+}
+
+// writePIDFile writes the PID of the broker to path. A file left by a broker
+// which is still running is an error, so that the same broker is not started
+// twice; one left by a broker which has since died is replaced.
+func writePIDFile(path string) error {
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(pid)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write PID file %s, error: %s", path, err)
+			}
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create PID file %s, error: %s", path, err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read PID file %s, error: %s", path, err)
+		}
+		if other, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && processAlive(other) {
+			return fmt.Errorf("PID file %s names process %d, which is still running", path, other)
+		}
+		log.Warnf("replacing stale PID file %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale PID file %s, error: %s", path, err)
+		}
+	}
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// removePIDFile removes the PID file written by writePIDFile, if any.
+func removePIDFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove PID file %s, error: %s", path, err)
+	}
 }
 
 // handleShutdown registers a listener for signals and
-// executes the handler when a signal is trapped
+// executes the handler when a signal is trapped. Signals arriving while the
+// handler runs are logged and otherwise ignored, leaving the drain to finish.
 func handleShutdown(handle func()) {
-	sh := make(chan os.Signal)
+	sh := make(chan os.Signal, 1)
 	signal.Notify(sh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	go func(s chan os.Signal) {
 		<-s
-		handle()
+		go handle()
+		for sig := range s {
+			log.Warnf("received %s while shutting down, already draining", sig)
+		}
 	}(sh)
 }
+
+// handleHangup calls handle for every SIGHUP, as sent by log rotation once
+// it has moved the files aside.
+func handleHangup(handle func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			handle()
+		}
+	}()
+}
+
+// reopenAuditLog reopens the audit log, for it to be rotated.
+func reopenAuditLog(audit *broker.AuditLog) {
+	if err := audit.Reopen(); err != nil {
+		log.Errorf("failed to reopen audit log, error: %s", err)
+		return
+	}
+	log.Info("reopened audit log")
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kayako/beanstalk-broker/broker"
+	"github.com/kayako/beanstalk-broker/cli"
+)
+
+func TestExitCode(t *testing.T) {
+	opts := cli.Options{ExitOnSuccess: 10, ExitOnFailure: 11, ExitOnTimeout: 12, ExitOnBury: 13}
+
+	tests := []struct {
+		name   string
+		result *broker.JobResult
+		err    error
+		want   int
+	}{
+		{"success", &broker.JobResult{Executed: true}, nil, 10},
+		{"non-zero exit", &broker.JobResult{Executed: true, ExitStatus: 3}, nil, 11},
+		{"success marker", &broker.JobResult{Executed: true, ExitStatus: 3, SuccessMarked: true}, nil, 10},
+		{"result error", &broker.JobResult{Error: errors.New("failed to spawn worker")}, nil, 11},
+		{"broker error", nil, errors.New("connection refused"), 11},
+		{"no result", nil, nil, 11},
+		{"timed out", &broker.JobResult{Executed: true, TimedOut: true, ExitStatus: -1}, nil, 12},
+		{"buried", &broker.JobResult{Buried: true}, nil, 13},
+		{"buried after timing out", &broker.JobResult{Buried: true, TimedOut: true}, nil, 13},
+	}
+	for _, tt := range tests {
+		if got := exitCode(opts, tt.result, tt.err); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrintOutput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	printOutput(&stdout, &stderr, &broker.JobResult{Stdout: []byte("out\n"), Stderr: []byte("err\n")})
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("printed %q and %q, want the job's stdout and stderr", stdout.String(), stderr.String())
+	}
+	printOutput(&stdout, &stderr, nil)
+}
+
+func TestServeHTTPBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	// A metrics port already in use is logged, and serveHTTP returns for
+	// the broker to carry on starting up.
+	returned := make(chan struct{})
+	go func() {
+		serveHTTP("metrics", taken.Addr().String(), http.NotFoundHandler(), false)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("serveHTTP blocked on a bind failure")
+	}
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+	serveHTTP("admin API", address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), false)
+	resp, err := http.Get("http://" + address + "/")
+	if err != nil {
+		t.Fatalf("the server started after the failure is not serving, error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// TestMainProcess runs main with the arguments runMain passes, when run as
+// its child.
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv("BROKER_TEST_MAIN_ARGS")
+	if args == "" {
+		t.Skip("only run by runMain")
+	}
+	os.Args = append([]string{"beanstalk-broker"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runMain runs main with args in a child process, returning its exit code
+// and output. The child is killed if it has not exited within timeout.
+func runMain(t *testing.T, timeout time.Duration, args ...string) (int, string) {
+	t.Helper()
+	c := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	c.Env = append(os.Environ(), "BROKER_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+	var output bytes.Buffer
+	c.Stdout, c.Stderr = &output, &output
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	timer := time.AfterFunc(timeout, func() { c.Process.Kill() })
+	defer timer.Stop()
+
+	err := c.Wait()
+	if e, ok := err.(*exec.ExitError); ok {
+		if !timer.Stop() {
+			t.Fatalf("still running after %v:\n%s", timeout, output.String())
+		}
+		return e.ExitCode(), output.String()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, output.String()
+}
+
+// idleBeanstalkd is a beanstalkd without jobs: reserves never return. It
+// returns the address it listens on.
+func idleBeanstalkd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					args := strings.Fields(line)
+					if len(args) == 0 {
+						continue
+					}
+					switch args[0] {
+					case "watch", "ignore":
+						c.Write([]byte("WATCHING 1\r\n"))
+					case "use":
+						c.Write([]byte("USING " + args[1] + "\r\n"))
+					case "reserve", "reserve-with-timeout":
+						// Wait for the client to hang up.
+					default:
+						c.Write([]byte("UNKNOWN_COMMAND\r\n"))
+					}
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMaxRuntime(t *testing.T) {
+	start := time.Now()
+	code, output := runMain(t, 10*time.Second,
+		"-address="+idleBeanstalkd(t),
+		"-tubes=jobs",
+		"-skip-path-validation",
+		"-max-runtime=300ms",
+		"-shutdown-timeout=5s",
+	)
+	if code != 0 {
+		t.Errorf("exited %d after -max-runtime, want 0:\n%s", code, output)
+	}
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("exited after %v, before -max-runtime", took)
+	}
+}
+
+func TestFlushWithTimeout(t *testing.T) {
+	defer func(d time.Duration) { broker.AuditFlushInterval = d }(broker.AuditFlushInterval)
+	broker.AuditFlushInterval = time.Hour
+	path := t.TempDir() + "/audit.log"
+	audit, err := broker.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Record("jobs", "w1", &broker.JobResult{JobId: 7})
+
+	// A flush that hangs, here after the audit log is closed, is given up
+	// on after the timeout.
+	hang := make(chan struct{})
+	defer close(hang)
+	start := time.Now()
+	flushWithTimeout(100*time.Millisecond, func() { audit.Close() }, func() { <-hang })
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("flushing took %v", took)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"id":7,`) {
+		t.Errorf("pending audit line not flushed on shutdown, log holds %q", data)
+	}
+}
+
+func TestSetGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	if got := setGOMAXPROCS(3); got != 3 || runtime.GOMAXPROCS(0) != 3 {
+		t.Errorf("GOMAXPROCS is %d, reported %d, want 3", runtime.GOMAXPROCS(0), got)
+	}
+	// Zero leaves the value as it is.
+	if got := setGOMAXPROCS(0); got != 3 || runtime.GOMAXPROCS(0) != 3 {
+		t.Errorf("GOMAXPROCS is %d, reported %d, want it left at 3", runtime.GOMAXPROCS(0), got)
+	}
+}
+
+func TestPIDFile(t *testing.T) {
+	path := t.TempDir() + "/broker.pid"
+
+	// The file is written once the broker has started, and removed once it
+	// has shut down.
+	seen := make(chan string, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if data, err := os.ReadFile(path); err == nil && len(data) > 0 {
+				seen <- string(data)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(seen)
+	}()
+	code, output := runMain(t, 10*time.Second,
+		"-address="+idleBeanstalkd(t),
+		"-tubes=jobs",
+		"-skip-path-validation",
+		"-pid-file="+path,
+		"-max-runtime=500ms",
+		"-shutdown-timeout=5s",
+	)
+	if code != 0 {
+		t.Fatalf("exited %d, want 0:\n%s", code, output)
+	}
+	if pid, ok := <-seen; !ok {
+		t.Error("PID file was not written")
+	} else if _, err := strconv.Atoi(strings.TrimSpace(pid)); err != nil {
+		t.Errorf("PID file holds %q", pid)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file not removed on exit, error: %v", err)
+	}
+}
+
+func TestPIDFileOfRunningProcess(t *testing.T) {
+	path := t.TempDir() + "/broker.pid"
+	running := strconv.Itoa(os.Getpid()) + "\n"
+	if err := os.WriteFile(path, []byte(running), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err == nil {
+		t.Error("overwrote the PID file of a running process")
+	}
+	if data, _ := os.ReadFile(path); string(data) != running {
+		t.Errorf("PID file holds %q, want %q", data, running)
+	}
+
+	// A PID file left by a process which has died is replaced.
+	if err := os.WriteFile(path, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != running {
+		t.Errorf("PID file holds %q, want %q", data, running)
+	}
+	removePIDFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file not removed, error: %v", err)
+	}
+}
+
+func TestAuditLogReopenedOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/audit.log"
+	audit, err := broker.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	handleHangup(func() { reopenAuditLog(audit) })
+
+	// Rotation moves the file aside, then signals the broker.
+	audit.Record("jobs", "w1", &broker.JobResult{JobId: 1})
+	if err := os.Rename(path, dir+"/audit.log.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("audit log not reopened")
+		}
+	}
+
+	audit.Record("jobs", "w1", &broker.JobResult{JobId: 2})
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for file, id := range map[string]string{"audit.log.1": `"id":1,`, "audit.log": `"id":2,`} {
+		data, err := os.ReadFile(dir + "/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], id) {
+			t.Errorf("%s holds %q, want only the record with %s", file, lines, id)
+		}
+	}
+}
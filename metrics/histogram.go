@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Histogram counts observations in buckets, partitioned by labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds, which
+// must be sorted, and registers it with DefaultRegistry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	DefaultRegistry.register(h)
+	return h
+}
+
+// Observe adds a value for the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	k := labelKey(h.name, h.labels, labelValues)
+	i := sort.SearchFloat64s(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[k] = s
+	}
+	s.counts[i]++
+	s.sum += value
+	s.count++
+}
+
+// Count returns the number of observations for the given label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	k := labelKey(h.name, h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[k]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	names := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		s := h.series[k]
+		prefix := k
+		if len(h.labels) > 0 {
+			prefix += "\xff"
+		}
+
+		var cumulative uint64
+		for i, c := range s.counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, prefix+le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, k), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Package metrics provides a minimal registry of labelled counters, gauges
+and histograms, exposed over HTTP in the Prometheus text format.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultRegistry is the registry metrics are added to by NewCounter and
+// NewGauge, and which Handler exposes.
+var DefaultRegistry = &Registry{}
+
+// metric is implemented by every type that can be written by a Registry.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics to be exposed together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Expose writes all registered metrics in the Prometheus text format.
+func (r *Registry) Expose(w io.Writer) {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// ServeHTTP exposes the registry to Prometheus scrapers.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Expose(w)
+}
+
+// Handler returns an http.Handler exposing DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// vec holds the values of a metric, keyed by its label values.
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (v *vec) key(values []string) string {
+	return labelKey(v.name, v.labels, values)
+}
+
+// labelKey joins label values into the key of a series.
+func labelKey(name string, labels, values []string) string {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", name, len(labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) add(delta float64, values []string) {
+	k := v.key(values)
+	v.mu.Lock()
+	v.values[k] += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(value float64, values []string) {
+	k := v.key(values)
+	v.mu.Lock()
+	v.values[k] = value
+	v.mu.Unlock()
+}
+
+func (v *vec) get(values []string) float64 {
+	k := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[k]
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", v.name, formatLabels(v.labels, k), v.values[k])
+	}
+	v.mu.Unlock()
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	v *vec
+}
+
+// NewCounter creates a counter and registers it with DefaultRegistry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	DefaultRegistry.register(c.v)
+	return c
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.v.add(1, labelValues)
+}
+
+// Add increments the counter for the given label values by delta.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.v.add(delta, labelValues)
+}
+
+// Value returns the current value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.v.get(labelValues)
+}
+
+// Gauge is a value that can go up and down, partitioned by labels.
+type Gauge struct {
+	v *vec
+}
+
+// NewGauge creates a gauge and registers it with DefaultRegistry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	DefaultRegistry.register(g.v)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.set(value, labelValues)
+}
+
+// Inc increments the gauge for the given label values by one.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.v.add(1, labelValues)
+}
+
+// Dec decrements the gauge for the given label values by one.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.v.add(-1, labelValues)
+}
+
+// Value returns the current value for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.v.get(labelValues)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io"
+	"time"
+)
+
+// SinceGauge is a gauge of the seconds elapsed since an event was last
+// marked, partitioned by labels. It is computed when exposed, so it keeps
+// growing while the event does not recur.
+type SinceGauge struct {
+	v   *vec
+	now func() time.Time
+}
+
+// NewSinceGauge creates a since gauge and registers it with DefaultRegistry.
+func NewSinceGauge(name, help string, labels ...string) *SinceGauge {
+	g := &SinceGauge{v: newVec(name, help, "gauge", labels), now: time.Now}
+	DefaultRegistry.register(g)
+	return g
+}
+
+// Mark records the event as happening now for the given label values,
+// resetting the gauge to zero.
+func (g *SinceGauge) Mark(labelValues ...string) {
+	g.v.set(float64(g.now().UnixNano())/1e9, labelValues)
+}
+
+// Value returns the seconds elapsed since the event was last marked for the
+// given label values, or zero if it never was.
+func (g *SinceGauge) Value(labelValues ...string) float64 {
+	marked := g.v.get(labelValues)
+	if marked == 0 {
+		return 0
+	}
+	return g.elapsed(marked)
+}
+
+func (g *SinceGauge) elapsed(marked float64) float64 {
+	return float64(g.now().UnixNano())/1e9 - marked
+}
+
+func (g *SinceGauge) write(w io.Writer) {
+	elapsed := newVec(g.v.name, g.v.help, g.v.kind, g.v.labels)
+	g.v.mu.Lock()
+	for k, marked := range g.v.values {
+		elapsed.values[k] = g.elapsed(marked)
+	}
+	g.v.mu.Unlock()
+	elapsed.write(w)
+}
@@ -0,0 +1,344 @@
+/*
+Package tracing records job executions as spans and exports them to an
+OpenTelemetry collector using OTLP over HTTP with JSON encoding.
+
+Only the standard library is used, so tracing adds no dependencies to the
+build; a test guards this. Spans can be exported elsewhere instead, such as
+into a MemoryExporter for tests, with NewTracerWithExporter. A nil *Tracer and the nil *Span it returns are valid no-ops, which is
+how tracing is disabled.
+*/
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// batchSize is the number of finished spans sent per export request.
+	batchSize = 64
+
+	// flushInterval is the longest a finished span waits to be exported.
+	flushInterval = 5 * time.Second
+)
+
+// Span is a single timed operation within a trace.
+type Span struct {
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	failed   bool
+
+	attributes map[string]interface{}
+	events     []event
+
+	tracer *Tracer
+}
+
+type event struct {
+	name string
+	time time.Time
+}
+
+// Tracer creates spans and exports them in batches once they end.
+type Tracer struct {
+	exporter Exporter
+
+	spans chan *Span
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Exporter sends batches of finished spans on.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// NewTracer returns a Tracer exporting to the OTLP/HTTP collector at
+// endpoint, e.g. http://localhost:4318. It returns nil when endpoint is empty.
+func NewTracer(endpoint, service string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+
+	return NewTracerWithExporter(&otlpExporter{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	})
+}
+
+// NewTracerWithExporter returns a Tracer exporting with e.
+func NewTracerWithExporter(e Exporter) *Tracer {
+	t := &Tracer{
+		exporter: e,
+		spans:    make(chan *Span, batchSize*4),
+		done:     make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t
+}
+
+// Start begins a span. When traceParent is a W3C traceparent header value,
+// the span joins that trace as a child of its parent span; otherwise a new
+// trace is started.
+func (t *Tracer) Start(name, traceParent string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	if !parseTraceParent(traceParent, &s.traceID, &s.parentID) {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttribute records a string, bool or integer attribute on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// AddEvent records a named point in time on the span.
+func (s *Span) AddEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.events = append(s.events, event{name, time.Now()})
+}
+
+// SetFailed marks the span's status as an error.
+func (s *Span) SetFailed() {
+	if s == nil {
+		return
+	}
+	s.failed = true
+}
+
+// End finishes the span and queues it for export. Spans are dropped rather
+// than blocking the caller when the export queue is full.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.Warn("trace export queue full, dropping span")
+	}
+}
+
+// Close exports any queued spans and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		close(t.spans)
+		<-t.done
+	})
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(append([]*Span(nil), spans...)); err != nil {
+		log.Errorf("failed to export spans, error: %s", err)
+	}
+}
+
+// otlpExporter exports spans to an OTLP/HTTP collector, JSON encoded.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans, error: %s", err)
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// encode builds the OTLP/JSON ExportTraceServiceRequest for spans.
+func (e *otlpExporter) encode(spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              5, // SPAN_KIND_CONSUMER
+			"startTimeUnixNano": fmt.Sprint(s.start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(s.end.UnixNano()),
+			"attributes":        encodeAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			span["status"] = map[string]interface{}{"code": 2} // STATUS_CODE_ERROR
+		}
+		events := make([]map[string]interface{}, len(s.events))
+		for j, e := range s.events {
+			events[j] = map[string]interface{}{
+				"name":         e.name,
+				"timeUnixNano": fmt.Sprint(e.time.UnixNano()),
+			}
+		}
+		span["events"] = events
+		encoded[i] = span
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeAttributes(map[string]interface{}{"service.name": e.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/kayako/beanstalk-broker"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func encodeAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(attributes))
+	for k, v := range attributes {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int, int64, uint64:
+			value = map[string]interface{}{"intValue": fmt.Sprint(v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": k, "value": value})
+	}
+	return encoded
+}
+
+// Name returns the name of the span.
+func (s *Span) Name() string {
+	return s.name
+}
+
+// Attribute returns the value of an attribute of the span, false if it has
+// none by that name.
+func (s *Span) Attribute(key string) (interface{}, bool) {
+	v, ok := s.attributes[key]
+	return v, ok
+}
+
+// Failed reports whether the span's status is an error.
+func (s *Span) Failed() bool {
+	return s.failed
+}
+
+// TraceID returns the trace of the span in hex.
+func (s *Span) TraceID() string {
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// MemoryExporter keeps the spans exported to it in memory, for tests and
+// embedders inspecting them. It is safe for concurrent use.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Export adds spans to those kept.
+func (e *MemoryExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// parseTraceParent extracts the trace and parent span ids from a W3C
+// traceparent value of the form 00-<32 hex>-<16 hex>-<2 hex>.
+func parseTraceParent(value string, traceID *[16]byte, parentID *[8]byte) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return false
+	}
+	return *traceID != [16]byte{}
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryExporter(t *testing.T) {
+	e := &MemoryExporter{}
+	tracer := NewTracerWithExporter(e)
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	s := tracer.Start("jobs /Core/Job/Console", parent)
+	s.SetAttribute("beanstalk.job_id", uint64(42))
+	s.SetFailed()
+	s.End()
+	tracer.Start("jobs /Core/Job/Console", "").End()
+	tracer.Close()
+
+	spans := e.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(spans))
+	}
+	if id, _ := spans[0].Attribute("beanstalk.job_id"); id != uint64(42) {
+		t.Errorf("job id attribute %v, want 42", id)
+	}
+	if !spans[0].Failed() || spans[1].Failed() {
+		t.Errorf("failed %t and %t, want only the first span failed", spans[0].Failed(), spans[1].Failed())
+	}
+	if got := spans[0].TraceID(); got != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("trace %s, want the traceparent's", got)
+	}
+	if spans[1].TraceID() == spans[0].TraceID() {
+		t.Error("a span without a traceparent joined another trace")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	s := tracer.Start("jobs", "")
+	s.SetAttribute("key", "value")
+	s.AddEvent("timeout")
+	s.SetFailed()
+	s.End()
+	tracer.Close()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var req map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("exported to %s, want /v1/traces", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/", "beanstalk-broker")
+	s := tracer.Start("jobs /Core/Job/Console", "")
+	s.SetAttribute("process.exit_code", 3)
+	s.AddEvent("timeout")
+	s.End()
+	tracer.Close()
+
+	rs := req["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	span := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	if span["name"] != "jobs /Core/Job/Console" {
+		t.Errorf("span name %v", span["name"])
+	}
+	attr := span["attributes"].([]interface{})[0].(map[string]interface{})
+	if attr["key"] != "process.exit_code" || attr["value"].(map[string]interface{})["intValue"] != "3" {
+		t.Errorf("attribute %v, want process.exit_code=3", attr)
+	}
+	if n := len(span["events"].([]interface{})); n != 1 {
+		t.Errorf("%d events, want 1", n)
+	}
+}
+
+func TestNoDependencies(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, src, parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imp := range f.Imports {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			if strings.Contains(strings.Split(path, "/")[0], ".") && path != "github.com/sirupsen/logrus" {
+				t.Errorf("%s imports %s, tracing must only use the standard library and logrus", file, path)
+			}
+		}
+	}
+}